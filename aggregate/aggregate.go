@@ -0,0 +1,353 @@
+// Package aggregate turns the raw CumulativeEnergy and InstantaneousPower
+// streams of a meter into aligned interval records, e.g. the energy used and
+// the min/max/mean demand of every 15 minutes, hour and day.
+//
+// Readings are reordered within a lateness window before being accounted, so
+// out-of-order timestamps are tolerated; older readings are dropped. The
+// summation counters at the interval boundaries are interpolated between the
+// surrounding readings, which spreads the energy of missing readings over the
+// intervals they span. A decreasing counter is taken as a meter reset.
+// Intervals are closed by the first energy reading past their end, the
+// partial interval in which a meter is first seen is not published.
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/internal/meter"
+	"github.com/kbhuyan/emu/util"
+)
+
+type Options struct {
+	Periods  []time.Duration
+	Lateness time.Duration
+	Location *time.Location
+}
+
+type Option func(*Options)
+
+// WithPeriods sets the interval lengths, each must divide a day.
+func WithPeriods(periods ...time.Duration) Option {
+	return func(o *Options) {
+		o.Periods = periods
+	}
+}
+
+// WithLateness sets how long readings are held back to be put in order.
+func WithLateness(d time.Duration) Option {
+	return func(o *Options) {
+		o.Lateness = d
+	}
+}
+
+// WithLocation sets the time zone the intervals are aligned in.
+func WithLocation(loc *time.Location) Option {
+	return func(o *Options) {
+		o.Location = loc
+	}
+}
+
+// sample is a reading waiting in the lateness window.
+type sample struct {
+	ts     int64
+	power  *emu.InstantaneousPowerDemand
+	energy *emu.CumulativeEnergyConsumption
+}
+
+// counter tracks a summation counter across meter resets.
+type counter struct {
+	last   float64
+	offset float64
+}
+
+func (c *counter) add(raw float64, first bool) float64 {
+	if !first && raw < c.last {
+		emu.WarningLogger.Printf("summation went down from %.3f to %.3f, assuming a meter reset", c.last, raw)
+		c.offset += c.last
+	}
+	c.last = raw
+	return raw + c.offset
+}
+
+// maxHeld bounds the power readings held by a bucket waiting for an energy
+// reading.
+const maxHeld = 4096
+
+// bucket accumulates the current interval of a period.
+type bucket struct {
+	start     int64
+	end       int64
+	delivered float64 // counters at start, valid when known is set
+	received  float64
+	known     bool
+	demand    demandStats
+	energyN   int
+	held      []sample // power readings past end, until an energy reading closes the bucket
+}
+
+type demandStats struct {
+	min, max, sum float64
+	n             int
+}
+
+func (d *demandStats) add(p float64) {
+	if d.n == 0 || p < d.min {
+		d.min = p
+	}
+	if d.n == 0 || p > d.max {
+		d.max = p
+	}
+	d.sum += p
+	d.n++
+}
+
+type meterState struct {
+	pending   []sample // ordered by ts
+	maxTs     int64
+	committed int64 // ts of the last accounted reading
+
+	started   bool
+	lastTs    int64 // last energy reading
+	delivered counter
+	received  counter
+	lastD     float64 // adjusted counters of the last energy reading
+	lastR     float64
+
+	buckets []*bucket // one per period
+}
+
+// Aggregator publishes the IntervalEnergy messages of the readings added to
+// it. It is safe for concurrent use.
+type Aggregator struct {
+	opt    *Options
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	lck    sync.Mutex
+	meters map[meter.Key]*meterState
+}
+
+func NewAggregator(opts ...Option) (*Aggregator, error) {
+	options := &Options{
+		Periods:  []time.Duration{15 * time.Minute, time.Hour, 24 * time.Hour},
+		Lateness: 2 * time.Minute,
+		Location: time.Local,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	for _, p := range options.Periods {
+		if p < time.Second || (24*time.Hour)%p != 0 {
+			return nil, fmt.Errorf("invalid period %s, it must divide a day", p)
+		}
+	}
+	return &Aggregator{
+		opt:    options,
+		pubsub: util.NewPubSub[emu.MessageName, emu.Message](),
+		meters: make(map[meter.Key]*meterState),
+	}, nil
+}
+
+// Subscribe returns a channel receiving the IntervalEnergy messages.
+func (a *Aggregator) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	if mn != IntervalEnergy {
+		return nil, fmt.Errorf("invalid aggregate MessageName %s", mn)
+	}
+	return a.pubsub.Subscribe(mn), nil
+}
+
+func (a *Aggregator) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	a.pubsub.Close(mn, ch)
+}
+
+// Run aggregates the readings published by device until ctx is done.
+func (a *Aggregator) Run(ctx context.Context, device emu.Emu) error {
+	pch, err := device.Subscribe(emu.InstantaneousPower)
+	if err != nil {
+		return err
+	}
+	defer device.Unsubscribe(emu.InstantaneousPower, pch)
+	ech, err := device.Subscribe(emu.CumulativeEnergy)
+	if err != nil {
+		return err
+	}
+	defer device.Unsubscribe(emu.CumulativeEnergy, ech)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-pch:
+			a.Add(m)
+		case m := <-ech:
+			a.Add(m)
+		}
+	}
+}
+
+// Add accounts an InstantaneousPower or CumulativeEnergy reading and
+// publishes the intervals it closes. Other messages are ignored.
+func (a *Aggregator) Add(msg emu.Message) {
+	var s sample
+	var key meter.Key
+	switch m := msg.(type) {
+	case *emu.InstantaneousPowerDemand:
+		s = sample{ts: m.TimeStamp, power: m}
+		key = meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}
+	case *emu.CumulativeEnergyConsumption:
+		s = sample{ts: m.TimeStamp, energy: m}
+		key = meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}
+	default:
+		return
+	}
+	a.lck.Lock()
+	ms, ok := a.meters[key]
+	if !ok {
+		ms = &meterState{}
+		a.meters[key] = ms
+	}
+	intervals := a.add(key, ms, s)
+	a.lck.Unlock()
+	for _, iv := range intervals {
+		a.pubsub.Publish(IntervalEnergy, iv)
+	}
+}
+
+func (a *Aggregator) add(key meter.Key, ms *meterState, s sample) []*Interval {
+	if ms.committed != 0 && s.ts < ms.committed {
+		emu.WarningLogger.Printf("dropping %s reading of %d, older than the lateness window", key.MeterMacId, s.ts)
+		return nil
+	}
+	i, _ := slices.BinarySearchFunc(ms.pending, s.ts, func(p sample, ts int64) int {
+		// insert after the readings of the same time
+		if p.ts <= ts {
+			return -1
+		}
+		return 1
+	})
+	ms.pending = slices.Insert(ms.pending, i, s)
+	ms.maxTs = max(ms.maxTs, s.ts)
+
+	watermark := ms.maxTs - int64(a.opt.Lateness/time.Second)
+	var out []*Interval
+	n := 0
+	for ; n < len(ms.pending) && ms.pending[n].ts <= watermark; n++ {
+		out = append(out, a.commit(key, ms, ms.pending[n])...)
+		ms.committed = ms.pending[n].ts
+	}
+	ms.pending = slices.Delete(ms.pending, 0, n)
+	return out
+}
+
+// commit accounts a reading in time order.
+func (a *Aggregator) commit(key meter.Key, ms *meterState, s sample) []*Interval {
+	if ms.buckets == nil {
+		ms.buckets = make([]*bucket, len(a.opt.Periods))
+		for i, p := range a.opt.Periods {
+			start := a.bucketStart(s.ts, p)
+			ms.buckets[i] = &bucket{start: start, end: a.bucketEnd(start, p)}
+		}
+	}
+	var out []*Interval
+	if s.energy != nil {
+		first := !ms.started
+		d := ms.delivered.add(s.energy.Delivered, first)
+		r := ms.received.add(s.energy.Received, first)
+		for i, p := range a.opt.Periods {
+			b := ms.buckets[i]
+			if first && s.ts >= b.end {
+				// first reading of the meter, align the bucket on it
+				b.start = a.bucketStart(s.ts, p)
+				b.end = a.bucketEnd(b.start, p)
+				b.replay()
+			}
+			for !first && s.ts >= b.end {
+				// interpolate the counters at the end of the bucket
+				f := float64(b.end-ms.lastTs) / float64(s.ts-ms.lastTs)
+				endD := ms.lastD + (d-ms.lastD)*f
+				endR := ms.lastR + (r-ms.lastR)*f
+				if b.known {
+					out = append(out, b.interval(key, endD, endR))
+				}
+				next := a.bucketEnd(b.end, p)
+				*b = bucket{start: b.end, end: next, delivered: endD, received: endR, known: true, held: b.held}
+				b.replay()
+			}
+			b.energyN++
+		}
+		ms.started = true
+		ms.lastTs, ms.lastD, ms.lastR = s.ts, d, r
+	}
+	if s.power != nil {
+		for _, b := range ms.buckets {
+			b.addPower(s)
+		}
+	}
+	return out
+}
+
+// addPower accounts a power reading in the bucket, holding it when it is past
+// the end of the bucket: the bucket can only be closed by an energy reading.
+func (b *bucket) addPower(s sample) {
+	switch {
+	case s.ts >= b.end:
+		if len(b.held) == maxHeld {
+			// no energy reading for long, the oldest readings are lost
+			b.held = slices.Delete(b.held, 0, 1)
+		}
+		b.held = append(b.held, s)
+	case s.ts >= b.start:
+		b.demand.add(s.power.Power)
+	}
+}
+
+// replay accounts the held power readings once the bucket moved forward.
+func (b *bucket) replay() {
+	held := b.held
+	b.held = nil
+	for _, s := range held {
+		b.addPower(s)
+	}
+}
+
+func (b *bucket) interval(key meter.Key, endD, endR float64) *Interval {
+	iv := &Interval{
+		Start:         b.start,
+		Period:        b.end - b.start,
+		Delivered:     meter.Round(endD-b.delivered, 6),
+		Received:      meter.Round(endR-b.received, 6),
+		DemandSamples: b.demand.n,
+		EnergySamples: b.energyN,
+		DeviceMacId:   key.DeviceMacId,
+		MeterMacId:    key.MeterMacId,
+	}
+	iv.Energy = meter.Round(iv.Delivered-iv.Received, 6)
+	if b.demand.n > 0 {
+		iv.MinDemand = b.demand.min
+		iv.MaxDemand = b.demand.max
+		iv.MeanDemand = meter.Round(b.demand.sum/float64(b.demand.n), 6)
+	}
+	return iv
+}
+
+// bucketStart aligns ts on the period within its day in the configured
+// location, so that daily buckets start at local midnight.
+func (a *Aggregator) bucketStart(ts int64, period time.Duration) int64 {
+	t := time.Unix(ts, 0).In(a.opt.Location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, a.opt.Location)
+	if period == 24*time.Hour {
+		return midnight.Unix()
+	}
+	since := t.Sub(midnight)
+	return midnight.Add(since - since%period).Unix()
+}
+
+func (a *Aggregator) bucketEnd(start int64, period time.Duration) int64 {
+	if period == 24*time.Hour {
+		// days are 23 or 25 hours long when daylight saving time changes
+		return time.Unix(start, 0).In(a.opt.Location).AddDate(0, 0, 1).Unix()
+	}
+	return start + int64(period/time.Second)
+}
@@ -0,0 +1,124 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// collect adds the readings to a and returns the intervals published.
+func collect(t *testing.T, a *Aggregator, readings []emu.Message) []*Interval {
+	t.Helper()
+	ch, err := a.Subscribe(IntervalEnergy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Unsubscribe(IntervalEnergy, ch)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, m := range readings {
+			a.Add(m)
+		}
+	}()
+	var out []*Interval
+	for {
+		select {
+		case m := <-ch:
+			out = append(out, m.(*Interval))
+		case <-done:
+			return out
+		}
+	}
+}
+
+func TestPowerBetweenEnergyReadings(t *testing.T) {
+	a, err := NewAggregator(WithPeriods(15*time.Minute), WithLocation(time.UTC), WithLateness(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	var readings []emu.Message
+	for ts := base; ts < base+4*3600; ts += 10 {
+		readings = append(readings, &emu.InstantaneousPowerDemand{TimeStamp: ts, Power: 1})
+		if (ts-base)%240 == 0 {
+			readings = append(readings, &emu.CumulativeEnergyConsumption{TimeStamp: ts, Delivered: float64(ts-base) / 3600})
+		}
+	}
+	got := collect(t, a, readings)
+	if len(got) < 10 {
+		t.Fatalf("got %d intervals, want at least 10", len(got))
+	}
+	for _, iv := range got {
+		if iv.DemandSamples != 90 {
+			t.Errorf("interval %s has %d demand samples, want 90", time.Unix(iv.Start, 0).UTC(), iv.DemandSamples)
+		}
+		if iv.Energy != 0.25 {
+			t.Errorf("interval %s has %.6f kWh, want 0.25", time.Unix(iv.Start, 0).UTC(), iv.Energy)
+		}
+	}
+}
+
+func TestWindowAlignment(t *testing.T) {
+	a, err := NewAggregator(WithPeriods(15*time.Minute, time.Hour), WithLocation(time.UTC), WithLateness(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 22, 7, 0, 0, time.UTC).Unix()
+	var readings []emu.Message
+	for i := int64(0); i < 180; i++ {
+		ts := base + i*60
+		// the power readings come 10s late, out of order
+		readings = append(readings, &emu.InstantaneousPowerDemand{TimeStamp: ts + 10, Power: 2})
+		readings = append(readings, &emu.CumulativeEnergyConsumption{TimeStamp: ts, Delivered: float64(i) * 0.1})
+	}
+	got := collect(t, a, readings)
+	for _, iv := range got {
+		start := time.Unix(iv.Start, 0).UTC()
+		if start.Before(time.Unix(base, 0)) {
+			t.Errorf("partial interval %s published", start)
+		}
+		if time.Duration(iv.Period)*time.Second == time.Hour && start.Minute() != 0 {
+			t.Errorf("hourly interval starts at %s", start)
+		}
+		if start.Minute()%15 != 0 {
+			t.Errorf("interval starts at %s", start)
+		}
+		want := 0.1 * float64(iv.Period) / 60
+		if d := iv.Energy - want; d > 1e-6 || d < -1e-6 {
+			t.Errorf("interval %s has %.6f kWh, want %.6f", start, iv.Energy, want)
+		}
+	}
+	if len(got) == 0 {
+		t.Fatal("no interval published")
+	}
+}
+
+func TestMeterReset(t *testing.T) {
+	a, err := NewAggregator(WithPeriods(15*time.Minute), WithLocation(time.UTC), WithLateness(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	var readings []emu.Message
+	d := 500.0
+	for i := int64(0); i <= 60; i++ {
+		if i == 20 {
+			d = 0
+		}
+		d += 0.1
+		readings = append(readings, &emu.CumulativeEnergyConsumption{TimeStamp: base + i*60, Delivered: d})
+	}
+	for _, iv := range collect(t, a, readings) {
+		if iv.Energy < 0 {
+			t.Errorf("interval %s has %.6f kWh after the reset", time.Unix(iv.Start, 0).UTC(), iv.Energy)
+		}
+	}
+}
+
+func TestInvalidPeriod(t *testing.T) {
+	if _, err := NewAggregator(WithPeriods(7 * time.Minute)); err == nil {
+		t.Error("7m period accepted")
+	}
+}
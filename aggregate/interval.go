@@ -0,0 +1,62 @@
+package aggregate
+
+import "github.com/kbhuyan/emu"
+
+// IntervalEnergy is the name of the messages published by an Aggregator.
+const IntervalEnergy emu.MessageName = "IntervalEnergy"
+
+func init() {
+	emu.RegisterMessage(IntervalEnergy, func() emu.Message { return &Interval{} })
+}
+
+// Interval is the energy used and the demand seen by a meter over an aligned
+// interval [Start, Start+Period).
+type Interval struct {
+	Start         int64   `json:"Start"`      //Unix time
+	Period        int64   `json:"Period"`     //Unit is second
+	Energy        float64 `json:"Energy"`     //Unit is kWh, delivered minus received
+	Delivered     float64 `json:"Delivered"`  //Unit is kWh
+	Received      float64 `json:"Received"`   //Unit is kWh
+	MinDemand     float64 `json:"MinDemand"`  //Unit is kW
+	MaxDemand     float64 `json:"MaxDemand"`  //Unit is kW
+	MeanDemand    float64 `json:"MeanDemand"` //Unit is kW, mean of the readings
+	DemandSamples int     `json:"DemandSamples"`
+	EnergySamples int     `json:"EnergySamples"`
+	DeviceMacId   string  `json:"DeviceMacId"`
+	MeterMacId    string  `json:"MeterMacId"`
+}
+
+func (m *Interval) GetName() string {
+	return string(IntervalEnergy)
+}
+
+func (m *Interval) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp", "Start":
+		return m.Start, true
+	case "Period":
+		return m.Period, true
+	case "Energy":
+		return m.Energy, true
+	case "Delivered":
+		return m.Delivered, true
+	case "Received":
+		return m.Received, true
+	case "MinDemand":
+		return m.MinDemand, true
+	case "MaxDemand":
+		return m.MaxDemand, true
+	case "MeanDemand":
+		return m.MeanDemand, true
+	case "DemandSamples":
+		return m.DemandSamples, true
+	case "EnergySamples":
+		return m.EnergySamples, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
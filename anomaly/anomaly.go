@@ -0,0 +1,489 @@
+// Package anomaly learns the typical demand of a household and flags the
+// readings that depart from it.
+//
+// The profile is made of one statistic per hour of the week, the exponentially
+// weighted mean and variance of the hourly mean demand, plus the same for the
+// daily baseload (the lowest hourly mean of a day), so its memory does not
+// grow with time. It is learnt live and, when the device keeps a history, from
+// the last weeks of it on start. Three kinds of anomalies are published:
+//
+//   - Overnight: an hour of the night used much more than usual for it,
+//   - Baseload: the baseload has been well above usual for several days,
+//   - Step: the demand jumped, or fell, by more than the step threshold and
+//     much more than it varies in that hour, and stayed there.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/history"
+	"github.com/kbhuyan/emu/util"
+)
+
+// Kinds of anomalies.
+const (
+	Overnight = "Overnight"
+	Baseload  = "Baseload"
+	Step      = "Step"
+)
+
+type Options struct {
+	Threshold    float64 // score above which a value is anomalous
+	LearningRate float64
+	MinWeeks     int // observations of an hour before it is judged
+	NightFrom    int // hour of the day
+	NightTo      int // hour of the day, excluded
+	StepKW       float64
+	StepWindow   time.Duration
+	BaseloadDays int
+	LearnHistory time.Duration
+	Location     *time.Location
+	MeterMacId   string // of the household, the first meter read when empty
+}
+
+const (
+	minDayHours   = 20   // hours seen for the baseload of a day to count
+	stepPersist   = 2    // readings past a step for it to be reported
+	sigmaFloorKW  = 0.05 // least standard deviation
+	sigmaFloorRel = 0.1  // least standard deviation relative to the mean
+)
+
+type Option func(*Options)
+
+// WithThreshold sets the score, in standard deviations, above which a value
+// is anomalous.
+func WithThreshold(score float64) Option {
+	return func(o *Options) {
+		o.Threshold = score
+	}
+}
+
+// WithLearningRate sets the weight of a new observation in the profile, the
+// higher the faster it adapts.
+func WithLearningRate(rate float64) Option {
+	return func(o *Options) {
+		o.LearningRate = rate
+	}
+}
+
+// WithMinWeeks sets the number of weeks an hour must have been observed
+// before its usage is judged.
+func WithMinWeeks(n int) Option {
+	return func(o *Options) {
+		o.MinWeeks = n
+	}
+}
+
+// WithNight sets the hours of the day, from included to excluded, checked
+// for unusual usage. They wrap past midnight when from is after to, e.g.
+// WithNight(22, 6).
+func WithNight(from, to int) Option {
+	return func(o *Options) {
+		o.NightFrom = from
+		o.NightTo = to
+	}
+}
+
+// WithStep sets the smallest demand change, in kW, reported as a step and
+// the window the new demand is compared to.
+func WithStep(kw float64, window time.Duration) Option {
+	return func(o *Options) {
+		o.StepKW = kw
+		o.StepWindow = window
+	}
+}
+
+// WithBaseloadDays sets the number of consecutive days the baseload must be
+// high before it is reported.
+func WithBaseloadDays(n int) Option {
+	return func(o *Options) {
+		o.BaseloadDays = n
+	}
+}
+
+// WithLearnHistory sets how far back the device history is learnt from on
+// start, zero disables it.
+func WithLearnHistory(d time.Duration) Option {
+	return func(o *Options) {
+		o.LearnHistory = d
+	}
+}
+
+// WithLocation sets the time zone of the hours of the week.
+func WithLocation(loc *time.Location) Option {
+	return func(o *Options) {
+		o.Location = loc
+	}
+}
+
+// WithMeter sets the meter of the household, the readings of the other
+// meters are ignored. By default it is the first meter read.
+func WithMeter(mac string) Option {
+	return func(o *Options) {
+		o.MeterMacId = mac
+	}
+}
+
+// stat is an exponentially weighted mean and variance.
+type stat struct {
+	Mean     float64
+	Variance float64
+	N        int
+}
+
+func (s *stat) update(x float64, rate float64) {
+	if s.N == 0 {
+		s.Mean, s.Variance, s.N = x, 0, 1
+		return
+	}
+	// average the first observations evenly
+	a := max(rate, 1/float64(s.N+1))
+	diff := x - s.Mean
+	incr := a * diff
+	s.Mean += incr
+	s.Variance = (1 - a) * (s.Variance + diff*incr)
+	s.N++
+}
+
+// score is the deviation of x from the mean in standard deviations, with a
+// floor on the deviation so that very regular hours do not flag noise.
+func (s *stat) score(x float64) float64 {
+	return (x - s.Mean) / s.sigma()
+}
+
+func (s *stat) sigma() float64 {
+	return max(math.Sqrt(s.Variance), sigmaFloorKW, sigmaFloorRel*math.Abs(s.Mean))
+}
+
+type reading struct {
+	ts    int64
+	power float64
+}
+
+// Detector publishes the Anomaly messages of the demand readings added to
+// it. It models a single household, that of one meter. It is safe for
+// concurrent use.
+type Detector struct {
+	opt    *Options
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	lck    sync.Mutex
+
+	hours    [7 * 24]stat
+	baseload stat
+
+	hourStart time.Time // of the hour being accumulated
+	hourSum   float64
+	hourN     int
+
+	day      time.Time // midnight of the day being accumulated
+	dayMin   float64
+	dayHours int
+	highDays int
+
+	nightReported time.Time // day of the last Overnight anomaly
+
+	window []reading // readings of the last StepWindow
+	steps  int       // consecutive readings past the step
+	stepTo float64   // direction of the pending step
+
+	deviceMacId string
+	meterMacId  string
+}
+
+func NewDetector(opts ...Option) (*Detector, error) {
+	options := &Options{
+		Threshold:    3,
+		LearningRate: 0.2,
+		MinWeeks:     3,
+		NightFrom:    0,
+		NightTo:      5,
+		StepKW:       3,
+		StepWindow:   5 * time.Minute,
+		BaseloadDays: 3,
+		LearnHistory: 8 * 7 * 24 * time.Hour,
+		Location:     time.Local,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Threshold <= 0 {
+		return nil, fmt.Errorf("invalid threshold %g", options.Threshold)
+	}
+	if options.LearningRate <= 0 || options.LearningRate > 1 {
+		return nil, fmt.Errorf("invalid learning rate %g", options.LearningRate)
+	}
+	if options.NightFrom < 0 || options.NightFrom > 23 || options.NightTo < 0 || options.NightTo > 24 ||
+		options.NightFrom == options.NightTo {
+		return nil, fmt.Errorf("invalid night hours %d-%d", options.NightFrom, options.NightTo)
+	}
+	if options.StepKW <= 0 || options.StepWindow <= 0 {
+		return nil, fmt.Errorf("invalid step %gkW over %s", options.StepKW, options.StepWindow)
+	}
+	return &Detector{
+		opt:        options,
+		pubsub:     util.NewPubSub[emu.MessageName, emu.Message](),
+		meterMacId: options.MeterMacId,
+	}, nil
+}
+
+// Subscribe returns a channel receiving the Anomaly messages.
+func (d *Detector) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	if mn != AnomalyMessage {
+		return nil, fmt.Errorf("invalid anomaly MessageName %s", mn)
+	}
+	return d.pubsub.Subscribe(mn), nil
+}
+
+func (d *Detector) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	d.pubsub.Close(mn, ch)
+}
+
+// Run learns from the history of device, if it keeps one, then detects the
+// anomalies of its demand until ctx is done. Without WithMeter, the history
+// learnt is that of the first meter read. It fails when the history cannot
+// be read.
+func (d *Detector) Run(ctx context.Context, device emu.Emu) error {
+	var (
+		ch  chan emu.Message
+		err error
+	)
+	// the readings of the other meters are ignored when the device does not
+	// filter them
+	if ms, ok := device.(emu.MeterSubscriber); ok && d.opt.MeterMacId != "" {
+		ch, err = ms.SubscribeMeter(emu.InstantaneousPower, emu.WithMeter(d.opt.MeterMacId))
+	} else {
+		ch, err = device.Subscribe(emu.InstantaneousPower)
+	}
+	if err != nil {
+		return err
+	}
+	defer device.Unsubscribe(emu.InstantaneousPower, ch)
+	var h *emu.History
+	if hk, ok := device.(emu.HistoryKeeper); ok {
+		h = hk.History()
+	}
+	learn := h != nil && d.opt.LearnHistory > 0
+	learnMeter := func(meter string) error {
+		learn = false
+		// the current hour is left to the live readings
+		now := time.Now().Truncate(time.Hour)
+		points, err := h.Range(emu.InstantaneousPower, meter, now.Add(-d.opt.LearnHistory), now, time.Hour)
+		if err != nil {
+			return fmt.Errorf("unable to learn the demand history: %w", err)
+		}
+		d.Learn(points)
+		return nil
+	}
+	if learn && d.opt.MeterMacId != "" {
+		if err := learnMeter(d.opt.MeterMacId); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-ch:
+			if p, ok := m.(*emu.InstantaneousPowerDemand); ok && learn {
+				if err := learnMeter(p.MeterMacId); err != nil {
+					return err
+				}
+			}
+			d.Add(m)
+		}
+	}
+}
+
+// Learn updates the profile with hourly points, without reporting anomalies.
+// Points must be in time order and precede the readings added.
+func (d *Detector) Learn(points []history.Point) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	for _, p := range points {
+		if p.Count > 0 {
+			d.closeHour(p.Time.In(d.opt.Location), p.Mean, false)
+		}
+	}
+}
+
+// Add accounts an InstantaneousPower reading and publishes the anomalies it
+// reveals. Other messages, and the readings of other meters, are ignored.
+func (d *Detector) Add(msg emu.Message) {
+	m, ok := msg.(*emu.InstantaneousPowerDemand)
+	if !ok {
+		return
+	}
+	d.lck.Lock()
+	anomalies := d.add(m)
+	d.lck.Unlock()
+	for _, a := range anomalies {
+		d.pubsub.Publish(AnomalyMessage, a)
+	}
+}
+
+func (d *Detector) add(m *emu.InstantaneousPowerDemand) []*Anomaly {
+	if d.meterMacId == "" {
+		d.meterMacId = m.MeterMacId
+	} else if !strings.EqualFold(m.MeterMacId, d.meterMacId) {
+		emu.DebugLogger.Printf("ignoring the demand of meter %s", m.MeterMacId)
+		return nil
+	}
+	d.deviceMacId = m.DeviceMacId
+	t := time.Unix(m.TimeStamp, 0).In(d.opt.Location)
+	hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, d.opt.Location)
+	if !d.hourStart.IsZero() && hour.Before(d.hourStart) {
+		emu.WarningLogger.Printf("dropping demand of %d, older than the current hour", m.TimeStamp)
+		return nil
+	}
+	var out []*Anomaly
+	if !hour.Equal(d.hourStart) {
+		if d.hourN > 0 {
+			out = append(out, d.closeHour(d.hourStart, d.hourSum/float64(d.hourN), true)...)
+		}
+		d.hourStart, d.hourSum, d.hourN = hour, 0, 0
+	}
+	d.hourSum += m.Power
+	d.hourN++
+	if a := d.step(m.TimeStamp, m.Power, hour); a != nil {
+		out = append(out, a)
+	}
+	return out
+}
+
+// closeHour accounts the mean demand of the hour starting at start.
+func (d *Detector) closeHour(start time.Time, mean float64, report bool) []*Anomaly {
+	var out []*Anomaly
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, d.opt.Location)
+	if !day.Equal(d.day) {
+		if a := d.closeDay(report); a != nil {
+			out = append(out, a)
+		}
+		d.day, d.dayMin, d.dayHours = day, mean, 0
+	}
+	d.dayMin = min(d.dayMin, mean)
+	d.dayHours++
+
+	// hours are learnt above the baseload, so that a change of baseload is
+	// reported once as such rather than by every hour of the night
+	above := mean - d.baseload.Mean
+	s := &d.hours[hourOfWeek(start)]
+	h := start.Hour()
+	night := d.opt.NightFrom <= h && h < d.opt.NightTo
+	if d.opt.NightFrom > d.opt.NightTo {
+		night = d.opt.NightFrom <= h || h < d.opt.NightTo
+	}
+	if report && night && s.N >= d.opt.MinWeeks && !d.nightReported.Equal(day) {
+		if score := s.score(above); score > d.opt.Threshold {
+			d.nightReported = day
+			usual := s.Mean + d.baseload.Mean
+			out = append(out, d.anomaly(start.Add(time.Hour).Unix(), Overnight, score, mean, usual,
+				fmt.Sprintf("%.2f kW between %02d:00 and %02d:00, usually %.2f kW", mean, h, h+1, usual)))
+		}
+	}
+	s.update(above, d.opt.LearningRate)
+	return out
+}
+
+// closeDay accounts the baseload of the day being accumulated.
+func (d *Detector) closeDay(report bool) *Anomaly {
+	if d.day.IsZero() || d.dayHours < minDayHours {
+		return nil
+	}
+	b := &d.baseload
+	if b.N < d.opt.MinWeeks || b.score(d.dayMin) <= d.opt.Threshold {
+		d.highDays = 0
+		b.update(d.dayMin, d.opt.LearningRate)
+		return nil
+	}
+	// keep the usual baseload while it may only be a few unusual days
+	d.highDays++
+	if d.highDays < d.opt.BaseloadDays {
+		return nil
+	}
+	score := b.score(d.dayMin)
+	usual := b.Mean
+	if d.highDays > d.opt.BaseloadDays {
+		b.update(d.dayMin, d.opt.LearningRate)
+		return nil
+	}
+	// the high baseload is the new normal
+	b.Mean = d.dayMin
+	if !report {
+		return nil
+	}
+	end := d.day.AddDate(0, 0, 1)
+	return d.anomaly(end.Unix()-1, Baseload, score, d.dayMin, usual,
+		fmt.Sprintf("baseload of %.2f kW for %d days, usually %.2f kW", d.dayMin, d.highDays, usual))
+}
+
+// step reports a change of demand larger than StepKW and than the variation
+// of the hour, once it lasted stepPersist readings.
+func (d *Detector) step(ts int64, power float64, hour time.Time) *Anomaly {
+	from := ts - int64(d.opt.StepWindow/time.Second)
+	i := 0
+	for i < len(d.window) && d.window[i].ts < from {
+		i++
+	}
+	d.window = d.window[i:]
+	n := len(d.window) - d.steps
+	if n <= 0 {
+		d.window = append(d.window, reading{ts, power})
+		return nil
+	}
+	// level before the pending step
+	level := 0.0
+	for _, r := range d.window[:n] {
+		level += r.power
+	}
+	level /= float64(n)
+	diff := power - level
+	s := &d.hours[hourOfWeek(hour)]
+	sigma := s.sigma()
+	d.window = append(d.window, reading{ts, power})
+	if math.Abs(diff) < d.opt.StepKW || (s.N >= d.opt.MinWeeks && math.Abs(diff) < d.opt.Threshold*sigma) ||
+		(d.steps > 0 && math.Signbit(diff) != math.Signbit(d.stepTo)) {
+		d.steps = 0
+		return nil
+	}
+	d.steps++
+	d.stepTo = diff
+	if d.steps < stepPersist {
+		return nil
+	}
+	// the new demand is the level from now on
+	d.window = d.window[len(d.window)-d.steps:]
+	d.steps = 0
+	score := math.Abs(diff) / d.opt.StepKW
+	if s.N >= d.opt.MinWeeks {
+		score = math.Abs(diff) / sigma
+	}
+	verb := "rose"
+	if diff < 0 {
+		verb = "fell"
+	}
+	return d.anomaly(ts, Step, score, power, level,
+		fmt.Sprintf("demand %s by %.2f kW to %.2f kW", verb, math.Abs(diff), power))
+}
+
+func (d *Detector) anomaly(ts int64, kind string, score, value, expected float64, explanation string) *Anomaly {
+	return &Anomaly{
+		TimeStamp:   ts,
+		Kind:        kind,
+		Score:       math.Round(score*100) / 100,
+		Value:       math.Round(value*1000) / 1000,
+		Expected:    math.Round(expected*1000) / 1000,
+		Explanation: explanation,
+		DeviceMacId: d.deviceMacId,
+		MeterMacId:  d.meterMacId,
+	}
+}
+
+func hourOfWeek(t time.Time) int {
+	return int(t.Weekday())*24 + t.Hour()
+}
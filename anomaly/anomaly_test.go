@@ -0,0 +1,205 @@
+package anomaly
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+const meter = "0x00135003000aaaa"
+
+// collect returns the anomalies published while feed runs.
+func collect(t *testing.T, d *Detector, feed func()) []*Anomaly {
+	t.Helper()
+	ch, err := d.Subscribe(AnomalyMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Unsubscribe(AnomalyMessage, ch)
+	var (
+		out  []*Anomaly
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case m := <-ch:
+				out = append(out, m.(*Anomaly))
+			case <-stop:
+				// the last anomaly may still be buffered
+				select {
+				case m := <-ch:
+					out = append(out, m.(*Anomaly))
+				default:
+				}
+				return
+			}
+		}
+	}()
+	feed()
+	close(stop)
+	wg.Wait()
+	return out
+}
+
+// household feeds six weeks of readings every 30s: a baseload of 0.35 kW,
+// 1.25 kW more during the day, 1.5 kW more between 2:00 and 3:00 on day 30,
+// 4 kW more for 40 min on day 32 and a baseload 0.4 kW higher from day 35.
+func household(d *Detector, start time.Time) {
+	rng := rand.New(rand.NewSource(1))
+	for ts := start; ts.Before(start.AddDate(0, 0, 42)); ts = ts.Add(30 * time.Second) {
+		p := 0.3 + rng.Float64()*0.1
+		if h := ts.Hour(); h >= 7 && h < 23 {
+			p += 1 + rng.Float64()*0.5
+		}
+		day := int(ts.Sub(start).Hours() / 24)
+		if day >= 35 {
+			p += 0.4
+		}
+		if day == 30 && ts.Hour() == 2 {
+			p += 1.5
+		}
+		if day == 32 && ts.Hour() == 12 && ts.Minute() >= 10 && ts.Minute() < 50 {
+			p += 4
+		}
+		d.Add(&emu.InstantaneousPowerDemand{TimeStamp: ts.Unix(), Power: p, MeterMacId: meter})
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+	d, err := NewDetector(WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	anomalies := collect(t, d, func() { household(d, start) })
+	at := func(a *Anomaly) time.Time { return time.Unix(a.TimeStamp, 0).UTC() }
+	var overnight, steps, baseload []*Anomaly
+	for _, a := range anomalies {
+		if a.MeterMacId != meter {
+			t.Errorf("%s anomaly of meter %q", a.Kind, a.MeterMacId)
+		}
+		switch a.Kind {
+		case Overnight:
+			overnight = append(overnight, a)
+		case Step:
+			steps = append(steps, a)
+		case Baseload:
+			baseload = append(baseload, a)
+		}
+	}
+	if len(overnight) == 0 || !at(overnight[0]).Equal(start.AddDate(0, 0, 30).Add(3*time.Hour)) {
+		t.Errorf("overnight anomalies %v, want one ending at 3:00 on day 30", overnight)
+	}
+	for _, a := range overnight[1:] {
+		// until the higher baseload is learnt
+		if at(a).Before(start.AddDate(0, 0, 35)) {
+			t.Errorf("overnight anomaly at %s", at(a))
+		}
+	}
+	if len(steps) != 2 || steps[0].Value < steps[0].Expected || steps[1].Value > steps[1].Expected {
+		t.Errorf("steps %v, want a rise then a fall", steps)
+	} else if from := start.AddDate(0, 0, 32).Add(12*time.Hour + 10*time.Minute); at(steps[0]).Before(from) ||
+		at(steps[1]).Before(from.Add(40*time.Minute)) {
+		t.Errorf("steps at %s and %s", at(steps[0]), at(steps[1]))
+	}
+	if len(baseload) != 1 || baseload[0].Value-baseload[0].Expected < 0.3 {
+		t.Errorf("baseload anomalies %v, want one", baseload)
+	} else if want := start.AddDate(0, 0, 38).Add(-time.Second); !at(baseload[0]).Equal(want) {
+		t.Errorf("baseload anomaly at %s, want the end of the third day, %s", at(baseload[0]), want)
+	}
+}
+
+// A night wrapping past midnight includes the hours after midnight.
+func TestNightPastMidnight(t *testing.T) {
+	d, err := NewDetector(WithLocation(time.UTC), WithNight(23, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var overnight []*Anomaly
+	for _, a := range collect(t, d, func() { household(d, start) }) {
+		if a.Kind == Overnight {
+			overnight = append(overnight, a)
+		}
+	}
+	if len(overnight) == 0 || !time.Unix(overnight[0].TimeStamp, 0).UTC().Equal(start.AddDate(0, 0, 30).Add(3*time.Hour)) {
+		t.Errorf("overnight anomalies %v, want one ending at 3:00 on day 30", overnight)
+	}
+}
+
+// The readings of the other meters do not affect the model of the first.
+func TestOtherMeter(t *testing.T) {
+	d, err := NewDetector(WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	anomalies := collect(t, d, func() {
+		for ts := start; ts.Before(start.Add(time.Hour)); ts = ts.Add(30 * time.Second) {
+			d.Add(&emu.InstantaneousPowerDemand{TimeStamp: ts.Unix(), Power: 0.3, MeterMacId: meter})
+			// a solar meter jumping at the same time
+			p := 0.0
+			if ts.Sub(start) > 30*time.Minute {
+				p = 5
+			}
+			d.Add(&emu.InstantaneousPowerDemand{TimeStamp: ts.Unix(), Power: p, MeterMacId: "0x00135003000bbbb"})
+		}
+	})
+	if len(anomalies) != 0 {
+		t.Errorf("anomalies %+v of the other meter", anomalies[0])
+	}
+
+	d, err = NewDetector(WithLocation(time.UTC), WithMeter("0x00135003000BBBB"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anomalies = collect(t, d, func() {
+		for ts := start; ts.Before(start.Add(time.Hour)); ts = ts.Add(30 * time.Second) {
+			d.Add(&emu.InstantaneousPowerDemand{TimeStamp: ts.Unix(), Power: 0.3, MeterMacId: meter})
+			p := 0.0
+			if ts.Sub(start) > 30*time.Minute {
+				p = 5
+			}
+			d.Add(&emu.InstantaneousPowerDemand{TimeStamp: ts.Unix(), Power: p, MeterMacId: "0x00135003000bbbb"})
+		}
+	})
+	if len(anomalies) != 1 || anomalies[0].Kind != Step || anomalies[0].MeterMacId != "0x00135003000BBBB" {
+		t.Errorf("anomalies %v, want the step of the meter given", anomalies)
+	}
+}
+
+func TestStatScore(t *testing.T) {
+	var s stat
+	for _, x := range []float64{1, 1.2, 0.8, 1.1, 0.9} {
+		s.update(x, 0.2)
+	}
+	if s.N != 5 || s.Mean < 0.9 || s.Mean > 1.1 {
+		t.Fatalf("stat %+v", s)
+	}
+	// the deviation of very regular values is floored
+	var flat stat
+	for range 10 {
+		flat.update(0.2, 0.2)
+	}
+	if got := flat.score(0.3); math.Abs(got-2) > 1e-9 {
+		t.Errorf("score of 0.3 over a flat 0.2 = %g, want 2 with the %g kW floor", got, sigmaFloorKW)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{
+		WithThreshold(0), WithLearningRate(0), WithLearningRate(1.5), WithNight(-1, 5), WithNight(0, 25), WithNight(3, 3), WithStep(0, time.Minute),
+	} {
+		if _, err := NewDetector(opt); err == nil {
+			t.Errorf("NewDetector(%+v) succeeded", opt)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package anomaly
+
+import "github.com/kbhuyan/emu"
+
+// AnomalyMessage is the name of the messages published by a Detector.
+const AnomalyMessage emu.MessageName = "Anomaly"
+
+func init() {
+	emu.RegisterMessage(AnomalyMessage, func() emu.Message { return &Anomaly{} })
+}
+
+// Anomaly is a departure of the demand from the learnt profile.
+type Anomaly struct {
+	TimeStamp   int64   `json:"TimeStamp"` //Unix time
+	Kind        string  `json:"Kind"`
+	Score       float64 `json:"Score"`    //standard deviations from the usual value
+	Value       float64 `json:"Value"`    //Unit is kW
+	Expected    float64 `json:"Expected"` //Unit is kW
+	Explanation string  `json:"Explanation"`
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Anomaly) GetName() string {
+	return string(AnomalyMessage)
+}
+
+func (m *Anomaly) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Kind":
+		return m.Kind, true
+	case "Score":
+		return m.Score, true
+	case "Value":
+		return m.Value, true
+	case "Expected":
+		return m.Expected, true
+	case "Explanation":
+		return m.Explanation, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
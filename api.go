@@ -1,10 +1,15 @@
 package emu
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"slices"
 	"time"
+
+	"github.com/kbhuyan/emu/history"
 )
 
 var (
@@ -34,7 +39,7 @@ func StringToLogLevel(l string) (LogLevel, error) {
 		return LOG_INFO, nil
 	case "LOG_WARNING":
 		return LOG_WARNING, nil
-	case "	LOG_ERROR":
+	case "LOG_ERROR":
 		return LOG_ERROR, nil
 	case "LOG_OFF":
 		return LOG_OFF, nil
@@ -48,6 +53,11 @@ type EmuOptions struct {
 	TimeOut   time.Duration
 	LogWriter io.Writer
 	LogLevel  LogLevel
+	Metrics   Metrics
+	KeepAlive time.Duration // tcp:// and rfc2217:// devices
+
+	HistoryDir     string
+	HistoryOptions []history.Option
 }
 
 type EmuOption func(*EmuOptions)
@@ -64,6 +74,15 @@ func WithTimeOut(timeout time.Duration) EmuOption {
 	}
 }
 
+// WithKeepAlive sets the idle time after which the connection to a network
+// device is probed, 15s by default, a negative value disables the probes. A
+// device that stops answering the probes is reconnected.
+func WithKeepAlive(idle time.Duration) EmuOption {
+	return func(o *EmuOptions) {
+		o.KeepAlive = idle
+	}
+}
+
 func WithLogWriter(w io.Writer) EmuOption {
 	return func(o *EmuOptions) {
 		o.LogWriter = w
@@ -75,6 +94,46 @@ func WithLoggingLevel(l LogLevel) EmuOption {
 	}
 }
 
+// WithMetrics registers a collector that is notified of the session's
+// internal events, e.g. by the exporter/prometheus package.
+func WithMetrics(m Metrics) EmuOption {
+	return func(o *EmuOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithHistory persists the InstantaneousPower and CumulativeEnergy readings
+// in an embedded time-series store in dir, queried through Emu.History.
+func WithHistory(dir string, opts ...history.Option) EmuOption {
+	return func(o *EmuOptions) {
+		o.HistoryDir = dir
+		o.HistoryOptions = opts
+	}
+}
+
+// Metrics receives internal events of an emu session. The methods are called
+// from the reader goroutine and must not block.
+type Metrics interface {
+	// MessageReceived is called for every complete message read from the device.
+	MessageReceived(name string)
+	// ParseError is called when a message could not be parsed or converted.
+	ParseError(name string)
+	// CommandCompleted is called with the time between sending a command and its response.
+	CommandCompleted(id CommandId, latency time.Duration)
+	// Reconnected is called after the connection to the device is re-established.
+	Reconnected()
+	// ClockDrift is called on every TimeCluster with the device clock minus the host clock.
+	ClockDrift(drift time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) MessageReceived(string)                    {}
+func (noopMetrics) ParseError(string)                         {}
+func (noopMetrics) CommandCompleted(CommandId, time.Duration) {}
+func (noopMetrics) Reconnected()                              {}
+func (noopMetrics) ClockDrift(time.Duration)                  {}
+
 type Emu interface {
 	SendCommand(Command) error
 	GetResponse() (Message, error)
@@ -88,25 +147,79 @@ type Emu interface {
 	// GetInstantaneousPowerConsumption() (*InstantaneousPowerDemand, error)
 }
 
+// The interfaces below are the capabilities added to the sessions after Emu,
+// kept apart so that the implementations of Emu outside of this module are
+// not broken. The sessions of NewEmu and Dial implement all of them, callers
+// type-assert an Emu for the ones they need.
+
+// MeterSubscriber subscribes to the messages of one meter.
+type MeterSubscriber interface {
+	// SubscribeMeter returns a channel receiving the messages of the given
+	// name, of the meter given by WithMeter or of all the meters.
+	SubscribeMeter(MessageName, ...MeterOption) (chan Message, error)
+}
+
+// RawSender exchanges the XML fragments not modelled by the library.
+type RawSender interface {
+	// WriteRaw writes an XML fragment to the device as is, e.g. a command not
+	// modelled by CommandId. Its response is only published when known.
+	WriteRaw(fragment string) error
+	// SendRaw sends the command name with the parameters, e.g. a firmware
+	// command not modelled by CommandId, and returns the fragments of the
+	// expected elements once all of them are read. Without expected elements,
+	// the first fragment read that the device does not write periodically,
+	// e.g. not an InstantaneousDemand, is returned. The wait is bounded by the
+	// time out of the session, and a command awaiting its response is answered
+	// first.
+	SendRaw(ctx context.Context, name string, params map[string]string, expect ...string) ([]*Fragment, error)
+}
+
+// HistoryKeeper keeps the readings of the session.
+type HistoryKeeper interface {
+	// History returns the persisted readings, nil unless WithHistory is set.
+	History() *History
+}
+
+// NetworkReporter reports the join of the device to the meter.
+type NetworkReporter interface {
+	// NetworkStatus returns the state of the join to the meter and its
+	// latest transitions.
+	NetworkStatus() NetworkStatus
+}
+
+// MeterLister lists the meters the device is joined to.
+type MeterLister interface {
+	// Meters returns the meters seen so far, from the MeterList response and
+	// the MeterMacId of the messages, completed by the MeterInfo responses.
+	Meters() []Meter
+}
+
 func NewEmu(dev string, opts ...EmuOption) (Emu, error) {
 	options := &EmuOptions{
 		BaudRate:  115200,
 		TimeOut:   15 * time.Second,
 		LogWriter: os.Stdout,
 		LogLevel:  LOG_ERROR,
+		Metrics:   noopMetrics{},
+		KeepAlive: 15 * time.Second,
 	}
 	for _, opt := range opts {
 		opt(options)
 	}
 
+	if _, ok := socketPath(dev); ok {
+		return dialSocket(dev, options)
+	}
 	return newEmuImpl(dev, options)
 }
 
 type CumulativeEnergyConsumption struct {
-	TimeStamp   int64
-	Energy      float64 //Unit is kWh
-	DeviceMacId string
-	MeterMacId  string
+	TimeStamp   int64   `json:"TimeStamp"`
+	Energy      float64 `json:"Energy"`    //Unit is kWh, delivered minus received
+	Delivered   float64 `json:"Delivered"` //Unit is kWh
+	Received    float64 `json:"Received"`  //Unit is kWh
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
 }
 
 func (m *CumulativeEnergyConsumption) GetName() string {
@@ -118,6 +231,10 @@ func (m *CumulativeEnergyConsumption) GetAttrib(at string) (any, bool) {
 		return m.TimeStamp, true
 	case "Energy":
 		return m.Energy, true
+	case "Delivered":
+		return m.Delivered, true
+	case "Received":
+		return m.Received, true
 	case "DeviceMacId":
 		return m.DeviceMacId, true
 	case "MeterMacId":
@@ -128,10 +245,10 @@ func (m *CumulativeEnergyConsumption) GetAttrib(at string) (any, bool) {
 }
 
 type InstantaneousPowerDemand struct {
-	TimeStamp   int64
-	Power       float64 //Unit is KW
-	DeviceMacId string
-	MeterMacId  string
+	TimeStamp   int64   `json:"TimeStamp"`
+	Power       float64 `json:"Power"` //Unit is KW
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
 }
 
 func (m *InstantaneousPowerDemand) GetName() string {
@@ -152,6 +269,155 @@ func (m *InstantaneousPowerDemand) GetAttrib(at string) (any, bool) {
 	}
 }
 
+type CurrentPrice struct {
+	TimeStamp   int64   `json:"TimeStamp"`
+	Price       float64 `json:"Price"`    //Unit is Currency per kWh
+	Currency    int     `json:"Currency"` //ISO 4217 numeric code
+	Tier        int     `json:"Tier"`
+	RateLabel   string  `json:"RateLabel"`
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *CurrentPrice) GetName() string {
+	return string(Price)
+}
+func (m *CurrentPrice) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Price":
+		return m.Price, true
+	case "Currency":
+		return m.Currency, true
+	case "Tier":
+		return m.Tier, true
+	case "RateLabel":
+		return m.RateLabel, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// Notice is the UtilityMessage, a text message sent by the utility to the
+// customer through the meter.
+type Notice struct {
+	TimeStamp            int64  `json:"TimeStamp"`
+	Id                   string `json:"Id"`
+	Text                 string `json:"Text"`
+	Priority             string `json:"Priority"` //Low, Medium, High or Critical
+	ConfirmationRequired bool   `json:"ConfirmationRequired"`
+	Confirmed            bool   `json:"Confirmed"`
+	Queue                string `json:"Queue"`     //Active or Cancel Pending
+	StartTime            int64  `json:"StartTime"` //Unix time
+	Duration             int64  `json:"Duration"`  //Unit is minutes
+	DeviceMacId          string `json:"DeviceMacId"`
+	MeterMacId           string `json:"MeterMacId"`
+}
+
+func (m *Notice) GetName() string {
+	return string(UtilityMessage)
+}
+func (m *Notice) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Id":
+		return m.Id, true
+	case "Text":
+		return m.Text, true
+	case "Priority":
+		return m.Priority, true
+	case "ConfirmationRequired":
+		return m.ConfirmationRequired, true
+	case "Confirmed":
+		return m.Confirmed, true
+	case "Queue":
+		return m.Queue, true
+	case "StartTime":
+		return m.StartTime, true
+	case "Duration":
+		return m.Duration, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// Meter types of a Meter.
+const (
+	MeterElectric = 0
+	MeterGas      = 1
+	MeterWater    = 2
+	MeterOther    = 3
+)
+
+// Meter is the MeterInfo response, describing a meter the device is joined to.
+type Meter struct {
+	DeviceMacId string `json:"DeviceMacId"`
+	MeterMacId  string `json:"MeterMacId"`
+	MeterType   int    `json:"MeterType"` //MeterElectric, MeterGas, MeterWater or MeterOther
+	NickName    string `json:"NickName"`
+	Account     string `json:"Account"`
+	Auth        string `json:"Auth"`
+	Host        string `json:"Host"`
+	Enabled     bool   `json:"Enabled"`
+}
+
+func (m *Meter) GetName() string {
+	return string(MeterInfo)
+}
+func (m *Meter) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	case "MeterType":
+		return m.MeterType, true
+	case "NickName":
+		return m.NickName, true
+	case "Account":
+		return m.Account, true
+	case "Auth":
+		return m.Auth, true
+	case "Host":
+		return m.Host, true
+	case "Enabled":
+		return m.Enabled, true
+	default:
+		return nil, false
+	}
+}
+
+// JoinedMeters is the MeterList response, listing the meters the device is
+// joined to.
+type JoinedMeters struct {
+	DeviceMacId string   `json:"DeviceMacId"`
+	MeterMacIds []string `json:"MeterMacIds"`
+}
+
+func (m *JoinedMeters) GetName() string {
+	return string(MeterList)
+}
+func (m *JoinedMeters) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacIds":
+		return m.MeterMacIds, true
+	default:
+		return nil, false
+	}
+}
+
 type MessageName string
 
 const (
@@ -160,9 +426,39 @@ const (
 	TimeCluster        MessageName = "TimeCluster"
 	InstantaneousPower MessageName = "InstantaneousPower"
 	CumulativeEnergy   MessageName = "CumulativeEnergy"
+	Price              MessageName = "Price"
+	ConnectionStatus   MessageName = "ConnectionStatus"
+	MeterList          MessageName = "MeterList"
+	MeterInfo          MessageName = "MeterInfo"
+	NetworkTransition  MessageName = "NetworkTransition"
+	UtilityMessage     MessageName = "UtilityMessage"
 	Ack                MessageName = "Ack"
+	// RawFragments receives every fragment read from the device as a Fragment.
+	// It is not listed by MessageNames, being a copy of the other messages.
+	RawFragments MessageName = "RawFragments"
 )
 
+// MessageNames returns the names of the messages that can be subscribed to.
+func MessageNames() []MessageName {
+	return slices.Clone(apiMessageNames)
+}
+
+// CommandIds returns the ids of the commands, in order.
+func CommandIds() []CommandId {
+	return slices.Sorted(maps.Keys(commandIdString))
+}
+
+// AttributeNames returns the names of the attributes known to the device
+// messages and commands, sorted.
+func AttributeNames() []string {
+	names := make([]string, 0, len(attribTypeMap))
+	for at := range attribTypeMap {
+		names = append(names, string(at))
+	}
+	slices.Sort(names)
+	return names
+}
+
 type Message interface {
 	GetName() string
 	//	SetAttrib(string, any)
@@ -176,13 +472,31 @@ const (
 	GET_DEVICE_INFO                      // gets the basic emu-2 device info HW/SW version, make/model etc.
 	GET_TIME                             // gets the time (local and UTC) on the emu-2 as sync with the smart energy meter
 	GET_CONN_STATUS                      // gets the current connection status with the smart energy meter
+	GET_DEMAND                           // gets the instantaneous demand from the smart energy meter
+	GET_SUMMATION                        // gets the cumulative energy delivered and received from the smart energy meter
+	GET_METER_LIST                       // gets the MeterMacId of the meters the emu-2 is joined to
+	GET_METER_INFO                       // gets the type, nickname, account etc. of a meter
+	SET_METER_INFO                       // sets the nickname, account etc. of a meter
+	SET_TIME                             // sets the UTC and local time of the emu-2, see NewSetTimeCommand
+	GET_NETWORK                          // gets the Zigbee network joined by the emu-2: channel, PAN, coordinator, link strength
+	JOIN_NETWORK                         // makes the emu-2 (re)join the network of the smart energy meter
+	GET_MESSAGE                          // gets the latest text message of the utility
 )
 
 var CommandResponseMap = map[CommandId]MessageName{
 	RESTART:         Ack,
 	GET_DEVICE_INFO: DeviceInfo,
 	GET_TIME:        TimeCluster,
-	GET_CONN_STATUS: NetworkInfo,
+	GET_CONN_STATUS: ConnectionStatus,
+	GET_DEMAND:      InstantaneousPower,
+	GET_SUMMATION:   CumulativeEnergy,
+	GET_METER_LIST:  MeterList,
+	GET_METER_INFO:  MeterInfo,
+	SET_METER_INFO:  Ack,
+	SET_TIME:        Ack,
+	GET_NETWORK:     NetworkInfo,
+	JOIN_NETWORK:    Ack,
+	GET_MESSAGE:     UtilityMessage,
 }
 
 func (c CommandId) String() string {
@@ -204,12 +518,56 @@ type Command interface {
 	SetAttrib(string, any)
 }
 
-func NewCommand(id CommandId) (Command, error) {
+type MeterOptions struct {
+	MeterMacId string
+}
+
+type MeterOption func(*MeterOptions)
+
+// NewSetTimeCommand returns the SET_TIME command setting the clock of the
+// device to t, its local time being that of the location of t.
+func NewSetTimeCommand(t time.Time) (Command, error) {
+	cmd, err := NewCommand(SET_TIME)
+	if err != nil {
+		return nil, err
+	}
+	_, offset := t.Zone()
+	cmd.SetAttrib(string(emuUTCTime), fmt.Sprintf("0x%08x", ZigbeeSeconds(t)))
+	cmd.SetAttrib(string(emuLocalTime), fmt.Sprintf("0x%08x", ZigbeeSeconds(t)+int64(offset)))
+	return cmd, nil
+}
+
+// WithMeter targets the meter of the given MeterMacId: a subscription only
+// receives its messages and a command is sent for it. When the device is
+// joined to a single meter it may be left out.
+func WithMeter(mac string) MeterOption {
+	return func(o *MeterOptions) {
+		o.MeterMacId = mac
+	}
+}
+
+func newMeterOptions(opts []MeterOption) *MeterOptions {
+	options := &MeterOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+func NewCommand(id CommandId, opts ...MeterOption) (Command, error) {
 	if name, ok := cmdIdcmdMap[id]; ok {
-		return &commandImpl{
-			Id:   id,
-			Name: name,
-		}, nil
+		cmd := &commandImpl{
+			Id:      id,
+			Name:    name,
+			Attribs: make(map[string]any),
+		}
+		if meter := newMeterOptions(opts).MeterMacId; meter != "" {
+			if !slices.Contains(meterCommands, id) {
+				return nil, fmt.Errorf("command %s does not accept a MeterMacId", id)
+			}
+			cmd.SetAttrib(string(emuMeterMacId), meter)
+		}
+		return cmd, nil
 	}
 	return nil, fmt.Errorf("invalid command id %+v", id)
 }
@@ -0,0 +1,265 @@
+// Package clock monitors the clock of an EMU-2 against the host clock.
+//
+// A Monitor asks the device its time periodically and publishes the drift on
+// every TimeCluster, which the session also reports to its emu.Metrics. It may
+// set the device clock to the host clock when the drift grows too large, and
+// flag the readings whose device timestamps are too far from the host clock to
+// be trusted, e.g. after the device lost its time.
+package clock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// the device clock is set at most once per minSyncInterval, should it ignore
+// SET_TIME
+const minSyncInterval = time.Hour
+
+var readingNames = []emu.MessageName{
+	emu.InstantaneousPower, emu.CumulativeEnergy, emu.Price,
+}
+
+type Options struct {
+	Interval time.Duration // between GET_TIME commands, 0 only listens
+	MaxSkew  time.Duration // readings further from the host clock are flagged, 0 disables
+	Sync     time.Duration // the device clock is set above this drift, 0 disables
+}
+
+type Option func(*Options)
+
+// WithInterval sets how often the device is asked its time. With 0 the
+// Monitor only listens to the TimeCluster messages.
+func WithInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.Interval = d
+	}
+}
+
+// WithMaxSkew flags the readings whose timestamp is further than d from the
+// host clock with an ImplausibleTimestamp message.
+func WithMaxSkew(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxSkew = d
+	}
+}
+
+// WithSync sets the device clock to the host clock when the drift exceeds d.
+func WithSync(d time.Duration) Option {
+	return func(o *Options) {
+		o.Sync = d
+	}
+}
+
+// Monitor publishes the ClockDrift and ImplausibleTimestamp messages of a
+// device. It is safe for concurrent use.
+type Monitor struct {
+	opt    *Options
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	lck    sync.Mutex
+
+	lastSync time.Time
+}
+
+func NewMonitor(opts ...Option) (*Monitor, error) {
+	options := &Options{
+		Interval: time.Hour,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Interval < 0 || options.MaxSkew < 0 || options.Sync < 0 {
+		return nil, fmt.Errorf("interval, max skew and sync must not be negative")
+	}
+	return &Monitor{
+		opt:    options,
+		pubsub: util.NewPubSub[emu.MessageName, emu.Message](),
+	}, nil
+}
+
+// Subscribe returns a channel receiving the ClockDrift or ImplausibleTimestamp
+// messages.
+func (c *Monitor) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	if mn != ClockDrift && mn != ImplausibleTimestamp {
+		return nil, fmt.Errorf("invalid clock MessageName %s", mn)
+	}
+	return c.pubsub.Subscribe(mn), nil
+}
+
+func (c *Monitor) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	c.pubsub.Close(mn, ch)
+}
+
+// Run monitors the clock of device until ctx is done. It sends commands to
+// the device, which must not be sent other commands meanwhile unless they are
+// serialized, e.g. by an emu.Manager.
+func (c *Monitor) Run(ctx context.Context, device emu.Emu) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	names := []emu.MessageName{emu.TimeCluster}
+	if c.opt.MaxSkew > 0 {
+		names = append(names, readingNames...)
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	msgs := make(chan emu.Message)
+	for _, mn := range names {
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		defer device.Unsubscribe(mn, ch)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-ch:
+					select {
+					case msgs <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	// the commands are sent from their own goroutine, as their responses are
+	// also published to the subscriptions read here
+	syncs := make(chan struct{}, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.poll(ctx, device, syncs)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-msgs:
+			if c.Add(m) {
+				select {
+				case syncs <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *Monitor) poll(ctx context.Context, device emu.Emu, syncs <-chan struct{}) {
+	var tick <-chan time.Time
+	if c.opt.Interval > 0 {
+		ticker := time.NewTicker(c.opt.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		getTime(device)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			getTime(device)
+		case <-syncs:
+			emu.InfoLogger.Println("setting the device clock to the host clock.")
+			if setTime(device) {
+				getTime(device)
+			}
+		}
+	}
+}
+
+// getTime asks the device its time, which is received as a TimeCluster.
+func getTime(device emu.Emu) bool {
+	cmd, err := emu.NewCommand(emu.GET_TIME)
+	return execute(device, cmd, err)
+}
+
+// setTime sets the device clock to the host clock.
+func setTime(device emu.Emu) bool {
+	cmd, err := emu.NewSetTimeCommand(time.Now())
+	return execute(device, cmd, err)
+}
+
+func execute(device emu.Emu, cmd emu.Command, err error) bool {
+	if err == nil {
+		if err = device.SendCommand(cmd); err == nil {
+			_, err = device.GetResponse()
+		}
+	}
+	if err != nil {
+		emu.WarningLogger.Printf("clock command failed: %v", err)
+		return false
+	}
+	return true
+}
+
+// Add publishes the drift of a TimeCluster, or flags a reading with an
+// implausible timestamp, received now. It reports whether the device clock
+// should be set. Other messages are ignored.
+func (c *Monitor) Add(msg emu.Message) bool {
+	c.lck.Lock()
+	out, sync := c.add(msg, time.Now())
+	c.lck.Unlock()
+	if out != nil {
+		c.pubsub.Publish(emu.MessageName(out.GetName()), out)
+	}
+	return sync
+}
+
+func (c *Monitor) add(msg emu.Message, now time.Time) (emu.Message, bool) {
+	device, _ := msg.GetAttrib("DeviceMacId")
+	meter, _ := msg.GetAttrib("MeterMacId")
+	deviceMacId, _ := device.(string)
+	meterMacId, _ := meter.(string)
+	if emu.MessageName(msg.GetName()) == emu.TimeCluster {
+		v, _ := msg.GetAttrib("UTCTime")
+		utc, ok := v.(int64)
+		if !ok {
+			return nil, false
+		}
+		v, _ = msg.GetAttrib("LocalTime")
+		local, _ := v.(int64)
+		drift := time.Unix(utc, 0).Sub(now).Round(time.Second)
+		sync := c.opt.Sync > 0 && drift.Abs() > c.opt.Sync && now.Sub(c.lastSync) >= minSyncInterval
+		if sync {
+			c.lastSync = now
+		}
+		return &Drift{
+			TimeStamp:   now.Unix(),
+			DeviceTime:  utc,
+			LocalTime:   local,
+			Drift:       drift.Seconds(),
+			Synced:      sync,
+			DeviceMacId: deviceMacId,
+			MeterMacId:  meterMacId,
+		}, sync
+	}
+	if c.opt.MaxSkew <= 0 {
+		return nil, false
+	}
+	v, _ := msg.GetAttrib("TimeStamp")
+	ts, ok := v.(int64)
+	if !ok {
+		return nil, false
+	}
+	skew := float64(ts - now.Unix())
+	if math.Abs(skew) <= c.opt.MaxSkew.Seconds() {
+		return nil, false
+	}
+	return &Implausible{
+		TimeStamp:   ts,
+		HostTime:    now.Unix(),
+		Skew:        skew,
+		Message:     msg.GetName(),
+		DeviceMacId: deviceMacId,
+		MeterMacId:  meterMacId,
+	}, false
+}
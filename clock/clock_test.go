@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// timeCluster is a TimeCluster as converted by the session, its times in Unix
+// time.
+type timeCluster map[string]any
+
+func (m timeCluster) GetName() string { return string(emu.TimeCluster) }
+
+func (m timeCluster) GetAttrib(at string) (any, bool) {
+	v, ok := m[at]
+	return v, ok
+}
+
+var now = time.Unix(1_700_000_000, 0)
+
+func TestDrift(t *testing.T) {
+	c, _ := NewMonitor(WithSync(30 * time.Second))
+	out, sync := c.add(timeCluster{"UTCTime": now.Unix() - 12, "LocalTime": now.Unix() - 12 - 7*3600, "DeviceMacId": "0xd8d5b90000001111"}, now)
+	d, ok := out.(*Drift)
+	if !ok || sync {
+		t.Fatalf("add = %+v, %v", out, sync)
+	}
+	if d.Drift != -12 || d.DeviceTime != now.Unix()-12 || d.LocalTime != now.Unix()-12-7*3600 || d.TimeStamp != now.Unix() ||
+		d.Synced || d.DeviceMacId != "0xd8d5b90000001111" {
+		t.Errorf("drift %+v", d)
+	}
+	// the clock is set once per minSyncInterval
+	for i, want := range []bool{true, false, true, false} {
+		at := now.Add(time.Duration(i) * 30 * time.Minute)
+		out, sync := c.add(timeCluster{"UTCTime": at.Unix() + 45}, at)
+		if sync != want || out.(*Drift).Synced != want || out.(*Drift).Drift != 45 {
+			t.Errorf("after %d min: %+v, %v, want sync %v", i*30, out, sync, want)
+		}
+	}
+	if out, _ := c.add(timeCluster{"LocalTime": now.Unix()}, now); out != nil {
+		t.Errorf("drift %+v of a TimeCluster without UTCTime", out)
+	}
+
+	c, _ = NewMonitor()
+	if _, sync := c.add(timeCluster{"UTCTime": now.Unix() + 3600}, now); sync {
+		t.Error("clock set without WithSync")
+	}
+}
+
+func TestImplausible(t *testing.T) {
+	c, _ := NewMonitor(WithMaxSkew(time.Hour))
+	out, _ := c.add(&emu.InstantaneousPowerDemand{TimeStamp: now.Unix() - 86400, MeterMacId: "0x00135003000aaaa"}, now)
+	i, ok := out.(*Implausible)
+	if !ok || i.Skew != -86400 || i.HostTime != now.Unix() || i.Message != string(emu.InstantaneousPower) || i.MeterMacId != "0x00135003000aaaa" {
+		t.Errorf("add = %+v", out)
+	}
+	if out, _ := c.add(&emu.InstantaneousPowerDemand{TimeStamp: now.Unix() + 3600}, now); out != nil {
+		t.Errorf("add = %+v within the skew", out)
+	}
+
+	c, _ = NewMonitor()
+	if out, _ := c.add(&emu.InstantaneousPowerDemand{TimeStamp: now.Unix() - 86400}, now); out != nil {
+		t.Errorf("add = %+v without WithMaxSkew", out)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{WithInterval(-time.Second), WithMaxSkew(-time.Second), WithSync(-time.Second)} {
+		if _, err := NewMonitor(opt); err == nil {
+			t.Errorf("NewMonitor(%+v) succeeded", opt)
+		}
+	}
+	c, _ := NewMonitor()
+	if _, err := c.Subscribe(emu.TimeCluster); err == nil {
+		t.Error("subscribed to TimeCluster")
+	}
+}
@@ -0,0 +1,84 @@
+package clock
+
+import "github.com/kbhuyan/emu"
+
+// Names of the messages published by a Monitor.
+const (
+	ClockDrift           emu.MessageName = "ClockDrift"
+	ImplausibleTimestamp emu.MessageName = "ImplausibleTimestamp"
+)
+
+func init() {
+	emu.RegisterMessage(ClockDrift, func() emu.Message { return &Drift{} })
+	emu.RegisterMessage(ImplausibleTimestamp, func() emu.Message { return &Implausible{} })
+}
+
+// Drift is published on every TimeCluster of the device.
+type Drift struct {
+	TimeStamp   int64   `json:"TimeStamp"`  //Unix time of the host
+	DeviceTime  int64   `json:"DeviceTime"` //Unix time of the device, its UTCTime
+	LocalTime   int64   `json:"LocalTime"`  //LocalTime of the device
+	Drift       float64 `json:"Drift"`      //Unit is second, device clock minus host clock
+	Synced      bool    `json:"Synced"`     //the device clock is being set to the host clock
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Drift) GetName() string {
+	return string(ClockDrift)
+}
+
+func (m *Drift) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "DeviceTime":
+		return m.DeviceTime, true
+	case "LocalTime":
+		return m.LocalTime, true
+	case "Drift":
+		return m.Drift, true
+	case "Synced":
+		return m.Synced, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// Implausible is published for a reading whose device timestamp is further
+// from the host clock than the maximum skew.
+type Implausible struct {
+	TimeStamp   int64   `json:"TimeStamp"` //Unix time of the reading
+	HostTime    int64   `json:"HostTime"`  //Unix time the reading was received
+	Skew        float64 `json:"Skew"`      //Unit is second, TimeStamp minus HostTime
+	Message     string  `json:"Message"`   //name of the reading
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Implausible) GetName() string {
+	return string(ImplausibleTimestamp)
+}
+
+func (m *Implausible) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "HostTime":
+		return m.HostTime, true
+	case "Skew":
+		return m.Skew, true
+	case "Message":
+		return m.Message, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// runBridge exposes the serial port of the device over TCP, for
+// emu.NewEmu("tcp://host:port") or "rfc2217://host:port" on another host.
+// One client is served at a time, a new client replaces the current one.
+func runBridge(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	listen := fs.String("listen", ":2217", "Address to serve the serial port on")
+	rfc2217 := fs.Bool("rfc2217", false, "Speak RFC 2217 so that the clients set the baud rate, raw TCP otherwise")
+	keepAlive := fs.Duration("keepalive", 15*time.Second, "Idle time before the clients are probed, negative to disable")
+	fs.Parse(args)
+
+	options := &emu.EmuOptions{LogWriter: os.Stdout, LogLevel: emu.LOG_ERROR}
+	for _, opt := range opts {
+		opt(options)
+	}
+	emu.SetLogging(options.LogWriter, options.LogLevel)
+	b := &bridge{dev: port, rfc2217: *rfc2217, mode: serial.Mode{
+		BaudRate: options.BaudRate,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	lc := net.ListenConfig{KeepAliveConfig: net.KeepAliveConfig{
+		Enable:   *keepAlive >= 0,
+		Idle:     *keepAlive,
+		Interval: *keepAlive / 3,
+		Count:    3,
+	}, KeepAlive: *keepAlive}
+	l, err := lc.Listen(ctx, "tcp", *listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		// unblock the read of the port
+		b.lck.Lock()
+		if b.port != nil {
+			b.port.Close()
+		}
+		b.lck.Unlock()
+	}()
+
+	go b.readPort(ctx)
+	info("bridging %s on %s", port, l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.setClient(nil, nil)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go b.serve(conn)
+	}
+}
+
+// bridgeWriteWait bounds a write to the client, which is dropped when it does
+// not read the data of the port in time.
+const bridgeWriteWait = 5 * time.Second
+
+// bridge copies the data between the serial port and the current client.
+type bridge struct {
+	dev     string
+	rfc2217 bool
+
+	lck    sync.Mutex
+	mode   serial.Mode
+	port   serial.Port        // nil while the port is being opened
+	client io.ReadWriteCloser // nil without client
+	conn   net.Conn           // of the client
+}
+
+// readPort copies the data of the port to the client, or drops it without
+// client, reopening the port when it fails.
+func (b *bridge) readPort(ctx context.Context) {
+	buf := make([]byte, 4096)
+	for {
+		port, err := b.openPort(ctx)
+		if err != nil {
+			return
+		}
+		for {
+			n, err := port.Read(buf)
+			if err != nil || n == 0 {
+				// without read timeout, an empty read means the device is gone
+				emu.WarningLogger.Printf("reading %s failed, reopening it: %v", b.dev, err)
+				break
+			}
+			b.forward(buf[:n])
+		}
+		b.lck.Lock()
+		b.port = nil
+		b.lck.Unlock()
+		port.Close()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// forward writes data to the client, if any, dropping the client when the
+// write fails or times out so that the port is read on.
+func (b *bridge) forward(data []byte) {
+	b.lck.Lock()
+	client, conn := b.client, b.conn
+	b.lck.Unlock()
+	if client == nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(bridgeWriteWait))
+	if _, err := client.Write(data); err != nil {
+		emu.WarningLogger.Printf("writing to client %s failed, dropping it: %v", conn.RemoteAddr(), err)
+		b.lck.Lock()
+		if b.client == client {
+			b.client, b.conn = nil, nil
+		}
+		b.lck.Unlock()
+		client.Close()
+	}
+}
+
+// openPort opens the port, retrying until it is available or ctx is done.
+func (b *bridge) openPort(ctx context.Context) (serial.Port, error) {
+	backoff := time.Second
+	for {
+		b.lck.Lock()
+		mode := b.mode
+		b.lck.Unlock()
+		port, err := serial.Open(b.dev, &mode)
+		if err == nil {
+			b.lck.Lock()
+			b.port = port
+			b.lck.Unlock()
+			return port, nil
+		}
+		emu.WarningLogger.Printf("opening %s failed, retrying in %s: %v", b.dev, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, openMaxBackoff)
+	}
+}
+
+// serve copies the data of the client to the port until it disconnects or
+// is replaced.
+func (b *bridge) serve(conn net.Conn) {
+	var client io.ReadWriteCloser = conn
+	if b.rfc2217 {
+		client = util.NewRfc2217Server(conn, b.setBaudRate)
+	}
+	info("client %s connected", conn.RemoteAddr())
+	b.setClient(client, conn)
+	defer func() {
+		b.lck.Lock()
+		if b.client == client {
+			b.client, b.conn = nil, nil
+		}
+		b.lck.Unlock()
+		client.Close()
+		info("client %s disconnected", conn.RemoteAddr())
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, err := client.Read(buf)
+		if n > 0 {
+			b.lck.Lock()
+			port := b.port
+			b.lck.Unlock()
+			if port == nil {
+				emu.WarningLogger.Printf("%s is not open, dropping %d bytes of %s", b.dev, n, conn.RemoteAddr())
+			} else if _, err := port.Write(buf[:n]); err != nil {
+				emu.WarningLogger.Printf("writing %s failed: %v", b.dev, err)
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				emu.WarningLogger.Printf("client %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// setClient makes client, served on conn, the current client, disconnecting
+// the previous one.
+func (b *bridge) setClient(client io.ReadWriteCloser, conn net.Conn) {
+	b.lck.Lock()
+	old := b.client
+	b.client, b.conn = client, conn
+	b.lck.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// setBaudRate sets the baud rate asked by a RFC 2217 client and returns the
+// rate in effect.
+func (b *bridge) setBaudRate(baud int) int {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	if baud == 0 || baud == b.mode.BaudRate {
+		return b.mode.BaudRate
+	}
+	mode := b.mode
+	mode.BaudRate = baud
+	if b.port != nil {
+		if err := b.port.SetMode(&mode); err != nil {
+			emu.WarningLogger.Printf("setting %s to %d bauds failed: %v", b.dev, baud, err)
+			return b.mode.BaudRate
+		}
+	}
+	b.mode = mode
+	info("%s set to %d bauds", b.dev, baud)
+	return baud
+}
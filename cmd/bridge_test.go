@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBridgeForward(t *testing.T) {
+	b := &bridge{}
+	b.forward([]byte("dropped without client"))
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	b.setClient(conn, conn)
+	go b.forward([]byte("<TimeCluster>\n"))
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil || string(buf[:n]) != "<TimeCluster>\n" {
+		t.Fatalf("client read %q, %v", buf[:n], err)
+	}
+}
+
+// A client not reading is dropped rather than holding up the port.
+func TestBridgeStalledClient(t *testing.T) {
+	b := &bridge{}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	b.setClient(conn, conn)
+	start := time.Now()
+	b.forward([]byte("<TimeCluster>\n"))
+	if d := time.Since(start); d > bridgeWriteWait+time.Second {
+		t.Errorf("write to a stalled client took %s", d)
+	}
+	b.lck.Lock()
+	client := b.client
+	b.lck.Unlock()
+	if client != nil {
+		t.Fatal("stalled client kept")
+	}
+	// the client is disconnected
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read of the dropped client = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/clock"
+)
+
+func runClock(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("clock", flag.ExitOnError)
+	set := fs.Bool("set", false, "Set the device clock to the host clock")
+	watch := fs.Duration("watch", 0, "Keep asking the device its time at this interval, 0 to check once")
+	maxSkew := fs.Duration("max-skew", 0, "While watching, flag the readings further than this from the host clock")
+	syncAbove := fs.Duration("sync", 0, "While watching, set the device clock when the drift exceeds this")
+	fs.Parse(args)
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	if *set {
+		cmd, err := emu.NewSetTimeCommand(time.Now())
+		if err != nil {
+			return err
+		}
+		if _, err := executeCommand(device, cmd); err != nil {
+			return err
+		}
+	}
+	if *watch <= 0 {
+		cmd, err := emu.NewCommand(emu.GET_TIME)
+		if err != nil {
+			return err
+		}
+		rsp, err := executeCommand(device, cmd)
+		if err != nil {
+			return err
+		}
+		v, _ := rsp.GetAttrib("UTCTime")
+		utc, ok := v.(int64)
+		if !ok {
+			return fmt.Errorf("UTCTime not found in %+v", rsp)
+		}
+		local, _ := rsp.GetAttrib("LocalTime")
+		now := time.Now()
+		if !output.text() {
+			d := &clock.Drift{TimeStamp: now.Unix(), DeviceTime: utc, Drift: time.Unix(utc, 0).Sub(now).Round(time.Second).Seconds()}
+			d.LocalTime, _ = local.(int64)
+			d.DeviceMacId, d.MeterMacId = attribString(rsp, "DeviceMacId"), attribString(rsp, "MeterMacId")
+			return output.print(d)
+		}
+		fmt.Printf("device UTC %s, local %s\n", formatUTC(utc), formatUTC(local))
+		fmt.Printf("host   UTC %s, drift %s\n", now.UTC().Format(time.DateTime), time.Unix(utc, 0).Sub(now).Round(time.Second))
+		return nil
+	}
+
+	monitor, err := clock.NewMonitor(clock.WithInterval(*watch), clock.WithMaxSkew(*maxSkew), clock.WithSync(*syncAbove))
+	if err != nil {
+		return err
+	}
+	drifts, _ := monitor.Subscribe(clock.ClockDrift)
+	defer monitor.Unsubscribe(clock.ClockDrift, drifts)
+	flagged, _ := monitor.Subscribe(clock.ImplausibleTimestamp)
+	defer monitor.Unsubscribe(clock.ImplausibleTimestamp, flagged)
+
+	ctx, stop := signalContext()
+	defer stop()
+	go monitor.Run(ctx, device)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-drifts:
+			if !output.text() {
+				output.print(m)
+				continue
+			}
+			d := m.(*clock.Drift)
+			msg := fmt.Sprintf("%s drift %s", formatTime(d.TimeStamp), time.Duration(d.Drift)*time.Second)
+			if d.Synced {
+				msg += ", setting the device clock"
+			}
+			fmt.Println(msg)
+		case m := <-flagged:
+			if !output.text() {
+				output.print(m)
+				continue
+			}
+			i := m.(*clock.Implausible)
+			fmt.Printf("%s implausible %s timestamp %s, %s off\n",
+				formatTime(i.HostTime), i.Message, formatTime(i.TimeStamp), time.Duration(i.Skew)*time.Second)
+		}
+	}
+}
+
+func attribString(m emu.Message, at string) string {
+	v, _ := m.GetAttrib(at)
+	s, _ := v.(string)
+	return s
+}
+
+// formatUTC formats a device time attribute, which is a Unix time.
+func formatUTC(v any) string {
+	ts, ok := v.(int64)
+	if !ok {
+		return "unknown"
+	}
+	return time.Unix(ts, 0).UTC().Format(time.DateTime)
+}
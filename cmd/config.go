@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kbhuyan/emu"
+)
+
+// configPaths returns the paths searched in order for the configuration
+// file when -config is not given.
+func configPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "emuctl", "config.yaml"))
+	}
+	return append(paths, "/etc/emuctl.yaml")
+}
+
+// findConfig returns path, or else the first of the configPaths found, empty
+// when none is.
+func findConfig(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	for _, p := range configPaths() {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// loadProfile returns the profile name of the configuration file at path, or
+// of the first configuration file found, with the environment overrides.
+// Without a configuration file, the profile holds the environment overrides.
+func loadProfile(path string, name string) (emu.Profile, error) {
+	path, err := findConfig(path)
+	if err != nil {
+		return emu.Profile{}, err
+	}
+	if path == "" {
+		if name != "" {
+			return emu.Profile{}, usageErrorf("profile %s: no configuration file in %v", name, configPaths())
+		}
+		return emu.ProfileFromEnv(emu.Profile{})
+	}
+	p, err := emu.LoadProfile(path, name)
+	if err != nil {
+		return emu.Profile{}, usageError{err}
+	}
+	return p, nil
+}
+
+// settings returns the port of the device and its options, from the flags
+// over the environment over the configuration file. The configuration file is
+// read again on every call.
+func settings() (string, []emu.EmuOption, error) {
+	p, err := loadProfile(*configFlag, *profileFlag)
+	if err != nil {
+		return "", nil, err
+	}
+	applyProfile(p)
+	ll, err := emu.StringToLogLevel(*logFlag)
+	if err != nil {
+		return "", nil, usageErrorf("bad log level: %v", err)
+	}
+	if *quiet {
+		ll = emu.LOG_ERROR
+	}
+	opts := []emu.EmuOption{emu.WithBaudRate(*baudFlag), emu.WithTimeOut(*timeoutFlag), emu.WithLoggingLevel(ll)}
+	if *historyFlag != "" {
+		opts = append(opts, emu.WithHistory(*historyFlag))
+	}
+	port, err := resolvePort(*portFlag, *deviceFlag, opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad device: %w", err)
+	}
+	return port, opts, nil
+}
+
+// flags given on the command line, which the profile does not override
+var givenFlags map[string]bool
+
+// applyProfile sets the flags not given on the command line to the settings
+// of the profile, or back to their default when the profile has none.
+func applyProfile(p emu.Profile) {
+	if givenFlags == nil {
+		givenFlags = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			givenFlags[f.Name] = true
+		})
+	}
+	values := map[string]string{
+		"port":    p.Port,
+		"meter":   p.Meter,
+		"log":     p.Log,
+		"history": p.History,
+		"baud":    "",
+		"timeout": "",
+	}
+	if p.Baud != 0 {
+		values["baud"] = strconv.Itoa(p.Baud)
+	}
+	if p.Timeout != 0 {
+		values["timeout"] = p.Timeout.String()
+	}
+	for name, value := range values {
+		if givenFlags[name] {
+			continue
+		}
+		if value == "" {
+			value = flag.Lookup(name).DefValue
+		}
+		flag.Set(name, value)
+	}
+}
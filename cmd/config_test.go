@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+func TestApplyProfile(t *testing.T) {
+	defer func(given map[string]bool) {
+		givenFlags = given
+		for _, name := range []string{"port", "baud", "timeout", "log", "meter", "history"} {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}(givenFlags)
+	// -baud is given on the command line
+	givenFlags = map[string]bool{"baud": true}
+	*baudFlag = 57600
+
+	applyProfile(emu.Profile{Port: "/dev/ttyACM0", Baud: 9600, Timeout: time.Minute, Meter: "0x00135003000bbbb"})
+	if *portFlag != "/dev/ttyACM0" || *baudFlag != 57600 || *timeoutFlag != time.Minute || *meterFlag != "0x00135003000bbbb" {
+		t.Errorf("flags port %s, baud %d, timeout %s, meter %s", *portFlag, *baudFlag, *timeoutFlag, *meterFlag)
+	}
+	// the settings a profile read again no longer has are reset
+	applyProfile(emu.Profile{Log: "LOG_INFO"})
+	if *portFlag != "/dev/ttyACM1" || *timeoutFlag != 15*time.Second || *meterFlag != "" || *logFlag != "LOG_INFO" || *baudFlag != 57600 {
+		t.Errorf("flags port %s, timeout %s, meter %q, log %s, baud %d", *portFlag, *timeoutFlag, *meterFlag, *logFlag, *baudFlag)
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	for _, v := range []string{emu.EnvProfile, emu.EnvPort, emu.EnvBaud, emu.EnvTimeout, emu.EnvLog, emu.EnvMeter, emu.EnvHistory} {
+		t.Setenv(v, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("port: /dev/ttyACM0\nprofiles:\n  solar:\n    port: /dev/ttyACM1\n"), 0o644)
+	t.Setenv(emu.EnvBaud, "9600")
+	p, err := loadProfile(path, "solar")
+	if err != nil || p.Port != "/dev/ttyACM1" || p.Baud != 9600 {
+		t.Errorf("loadProfile = %+v, %v", p, err)
+	}
+	if _, err := loadProfile(path, "attic"); exitCode(err) != exitUsage {
+		t.Errorf("unknown profile: %v, want a usage error", err)
+	}
+
+	// without configuration file, only the environment
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if path, _ := findConfig(""); path != "" {
+		t.Skipf("configuration file %s on the host", path)
+	}
+	if p, err := loadProfile("", ""); err != nil || p != (emu.Profile{Baud: 9600}) {
+		t.Errorf("loadProfile without file = %+v, %v", p, err)
+	}
+	if _, err := loadProfile("", "solar"); exitCode(err) != exitUsage {
+		t.Errorf("profile without file: %v, want a usage error", err)
+	}
+}
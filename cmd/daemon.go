@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/datalog"
+	"github.com/kbhuyan/emu/exporter/prometheus"
+	"github.com/kbhuyan/emu/mqtt"
+	"github.com/kbhuyan/emu/util"
+)
+
+const defaultSocket = "/run/emu.sock"
+
+// daemonConfig is the daemon section of the configuration file, e.g.
+//
+//	daemon:
+//	  socket: /run/emu.sock
+//	  metrics:
+//	    listen: ":9100"
+//	  mqtt:
+//	    broker: tcp://localhost:1883
+//	  log:
+//	    file: /var/log/emu/readings.csv
+//	    daily: true
+type daemonConfig struct {
+	Socket  string         `yaml:"socket"`
+	Metrics *metricsConfig `yaml:"metrics"`
+	Mqtt    *mqttConfig    `yaml:"mqtt"`
+	Log     *logConfig     `yaml:"log"`
+}
+
+type metricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type mqttConfig struct {
+	Broker          string `yaml:"broker"`
+	ClientId        string `yaml:"client-id"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	TopicPrefix     string `yaml:"topic-prefix"`
+	DiscoveryPrefix string `yaml:"discovery-prefix"`
+	QoS             *byte  `yaml:"qos"`
+	Retain          *bool  `yaml:"retain"`
+}
+
+type logConfig struct {
+	File       string            `yaml:"file"`
+	Topics     []emu.MessageName `yaml:"topics"`
+	Format     string            `yaml:"format"`
+	Columns    []string          `yaml:"columns"`
+	TimeFormat string            `yaml:"time-format"`
+	MaxSize    int64             `yaml:"max-size"` // MB
+	Daily      bool              `yaml:"daily"`
+	Gzip       *bool             `yaml:"gzip"`
+}
+
+// loadDaemonConfig reads the daemon section of the configuration file, empty
+// without a configuration file.
+func loadDaemonConfig() (daemonConfig, error) {
+	var f struct {
+		Daemon daemonConfig `yaml:"daemon"`
+	}
+	path, err := findConfig(*configFlag)
+	if err != nil || path == "" {
+		return f.Daemon, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f.Daemon, err
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return f.Daemon, fmt.Errorf("%s: %w", path, err)
+	}
+	return f.Daemon, nil
+}
+
+// daemon owns the device and runs the exporters of the configuration, which
+// are restarted on a reload.
+type daemon struct {
+	started time.Time
+	reload  chan struct{}
+
+	lck       sync.Mutex
+	port      string
+	device    emu.Emu           // nil while the device is being opened
+	server    *emu.SocketServer // of the device, serving the control socket
+	exporters []string
+	reloaded  time.Time
+	active    time.Time // of the last message read from the device, or of its opening
+	opening   bool      // while openDevice retries
+}
+
+// daemonStatus answers the status request of the control socket.
+type daemonStatus struct {
+	Pid       int              `json:"Pid"`
+	Port      string           `json:"Port"`
+	Connected bool             `json:"Connected"`
+	Network   emu.NetworkState `json:"Network"`
+	Exporters []string         `json:"Exporters"`
+	Started   int64            `json:"Started"`  //Unix time
+	Reloaded  int64            `json:"Reloaded"` //Unix time of the last reload, 0 if none
+}
+
+func runDaemon(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := fs.String("socket", "", "Path of the control socket, by default the one of the configuration file or "+defaultSocket)
+	fs.Parse(args)
+
+	cfg, err := loadDaemonConfig()
+	if err != nil {
+		return err
+	}
+	if *socket != "" {
+		cfg.Socket = *socket
+	}
+	if cfg.Socket == "" {
+		cfg.Socket = defaultSocket
+	}
+	l, err := listenControl(cfg.Socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	d := &daemon{started: time.Now(), reload: make(chan struct{}, 1)}
+	d.setDevice(port, nil, nil)
+	go d.serveControl(l)
+	info("control socket on %s", cfg.Socket)
+
+	ctx, stop := signalContext()
+	defer stop()
+	hangups, release := util.Hangups()
+	defer release()
+	var watchdog <-chan time.Time
+	interval := util.SdWatchdogInterval()
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- d.run(runCtx, port, opts, cfg)
+		}()
+	supervise:
+		for {
+			select {
+			case <-watchdog:
+				// systemd restarts the daemon when the device stalls, not
+				// while it is opened or the session reconnects
+				if idle, stalled := d.stalled(max(interval, stallTimeout)); !stalled {
+					util.SdNotify(util.SdWatchdog)
+				} else {
+					emu.WarningLogger.Printf("nothing read from %s for %s, not pinging the watchdog", port, idle.Round(time.Second))
+				}
+			case <-ctx.Done():
+				util.SdNotify(util.SdStopping)
+				info("stopping")
+				cancel()
+				<-done
+				return nil
+			case <-hangups:
+				d.requestReload()
+			case <-d.reload:
+				util.SdNotify(util.SdReloadingNow())
+				newPort, newOpts, err := settings()
+				var newCfg daemonConfig
+				if err == nil {
+					newCfg, err = loadDaemonConfig()
+				}
+				if err != nil {
+					emu.ErrorLogger.Printf("reload failed, keeping the running configuration: %v", err)
+					util.SdNotify(util.SdReady)
+					continue
+				}
+				info("reloading the configuration")
+				cancel()
+				<-done
+				newCfg.Socket = cfg.Socket // the socket is kept until a restart
+				port, opts, cfg = newPort, newOpts, newCfg
+				d.lck.Lock()
+				d.reloaded = time.Now()
+				d.lck.Unlock()
+				break supervise
+			case err := <-done:
+				cancel()
+				emu.ErrorLogger.Printf("restarting in %s: %v", daemonRestartDelay, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(daemonRestartDelay):
+				}
+				break supervise
+			}
+		}
+	}
+}
+
+const (
+	daemonRestartDelay = 10 * time.Second
+	openMaxBackoff     = time.Minute
+	// stallTimeout is how long the device may be silent before the watchdog
+	// is no longer pinged, past the backoff of the reconnects of a session.
+	stallTimeout = 5 * time.Minute
+)
+
+// run opens the device and runs the exporters of cfg until ctx is done or
+// one of them fails.
+func (d *daemon) run(ctx context.Context, port string, opts []emu.EmuOption, cfg daemonConfig) error {
+	var (
+		exporter *prometheus.Exporter
+		metrics  = &activity{daemon: d}
+	)
+	if cfg.Metrics != nil {
+		exporter = prometheus.NewExporter()
+		metrics.Metrics = exporter
+	}
+	opts = append(opts, emu.WithMetrics(metrics))
+	d.setOpening(true)
+	util.SdNotify("STATUS=opening " + port)
+	device, err := openDevice(ctx, port, opts)
+	d.setOpening(false)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	device.Start()
+
+	var (
+		wg        sync.WaitGroup
+		errs      = make(chan error, 4)
+		exporters []string
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		wg.Wait()
+		d.setDevice(port, nil, nil)
+	}()
+	start := func(name string, run func() error) {
+		exporters = append(exporters, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(); err != nil {
+				errs <- fmt.Errorf("%s: %w", name, err)
+			}
+		}()
+	}
+	if exporter != nil {
+		listen := cfg.Metrics.Listen
+		if listen == "" {
+			listen = ":9100"
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exporter.Handler())
+		srv := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		start("metrics "+listen, func() error {
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				srv.Shutdown(shutdownCtx)
+			}()
+			go exporter.Run(ctx, device)
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	if m := cfg.Mqtt; m != nil {
+		bridge, err := mqtt.NewBridge(device, m.Broker, m.options()...)
+		if err != nil {
+			return err
+		}
+		start("mqtt "+m.Broker, func() error {
+			return bridge.Run(ctx)
+		})
+	}
+	if c := cfg.Log; c != nil {
+		logger, names, err := c.logger()
+		if err != nil {
+			return err
+		}
+		start("log "+c.File, func() error {
+			defer logger.Close()
+			return logger.Run(ctx, device, names)
+		})
+	}
+	d.setDevice(port, device, exporters)
+	util.SdNotify(util.SdReady)
+	util.SdNotify("STATUS=serving " + port)
+	info("serving %s with %s", port, strings.Join(exporters, ", "))
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// touch records an activity of the device.
+func (d *daemon) touch() {
+	d.lck.Lock()
+	d.active = time.Now()
+	d.lck.Unlock()
+}
+
+// idle returns the time since the last activity of the device.
+func (d *daemon) idle() time.Duration {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	return time.Since(d.active)
+}
+
+// setOpening records whether the device is being opened, which counts as an
+// activity until it is open.
+func (d *daemon) setOpening(opening bool) {
+	d.lck.Lock()
+	d.opening = opening
+	d.active = time.Now()
+	d.lck.Unlock()
+}
+
+// stalled returns the time since the last activity of the device and whether
+// it is longer than limit while the device is not being opened.
+func (d *daemon) stalled(limit time.Duration) (time.Duration, bool) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	idle := time.Since(d.active)
+	return idle, !d.opening && idle >= limit
+}
+
+// activity is the emu.Metrics of the device of the daemon, recording the
+// messages read for the watchdog before passing the events to Metrics, if
+// any.
+type activity struct {
+	emu.Metrics
+	daemon *daemon
+}
+
+func (a *activity) MessageReceived(name string) {
+	a.daemon.touch()
+	if a.Metrics != nil {
+		a.Metrics.MessageReceived(name)
+	}
+}
+
+func (a *activity) ParseError(name string) {
+	if a.Metrics != nil {
+		a.Metrics.ParseError(name)
+	}
+}
+
+func (a *activity) CommandCompleted(id emu.CommandId, latency time.Duration) {
+	if a.Metrics != nil {
+		a.Metrics.CommandCompleted(id, latency)
+	}
+}
+
+func (a *activity) Reconnected() {
+	if a.Metrics != nil {
+		a.Metrics.Reconnected()
+	}
+}
+
+func (a *activity) ClockDrift(drift time.Duration) {
+	if a.Metrics != nil {
+		a.Metrics.ClockDrift(drift)
+	}
+}
+
+func (d *daemon) requestReload() {
+	select {
+	case d.reload <- struct{}{}:
+	default: // a reload is pending
+	}
+}
+
+// setDevice serves the device, or no device when nil, on the control socket.
+// The clients of the previous device are disconnected so that they reconnect
+// to the new one.
+func (d *daemon) setDevice(port string, device emu.Emu, exporters []string) {
+	server := emu.NewSocketServer(device,
+		emu.WithSocketHandler("status", func(map[string]string) (any, error) {
+			return d.status(), nil
+		}),
+		emu.WithSocketHandler("reload", func(map[string]string) (any, error) {
+			d.requestReload()
+			return nil, nil
+		}))
+	d.lck.Lock()
+	old := d.server
+	d.port, d.device, d.server, d.exporters = port, device, server, exporters
+	d.lck.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// openDevice opens the device at port, retrying until it is available or ctx
+// is done.
+func openDevice(ctx context.Context, port string, opts []emu.EmuOption) (emu.Emu, error) {
+	backoff := time.Second
+	for {
+		device, err := emu.NewEmu(port, opts...)
+		if err == nil {
+			return device, nil
+		}
+		emu.WarningLogger.Printf("opening %s failed, retrying in %s: %v", port, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, openMaxBackoff)
+	}
+}
+
+func (m *mqttConfig) options() []mqtt.BridgeOption {
+	var opts []mqtt.BridgeOption
+	if m.ClientId != "" {
+		opts = append(opts, mqtt.WithClientId(m.ClientId))
+	}
+	if m.Username != "" {
+		opts = append(opts, mqtt.WithCredentials(m.Username, m.Password))
+	}
+	if m.TopicPrefix != "" {
+		opts = append(opts, mqtt.WithTopicPrefix(m.TopicPrefix))
+	}
+	if m.DiscoveryPrefix != "" {
+		opts = append(opts, mqtt.WithDiscoveryPrefix(m.DiscoveryPrefix))
+	}
+	if m.QoS != nil {
+		opts = append(opts, mqtt.WithQoS(*m.QoS))
+	}
+	if m.Retain != nil {
+		opts = append(opts, mqtt.WithRetain(*m.Retain))
+	}
+	return opts
+}
+
+func (c *logConfig) logger() (*datalog.Logger, []emu.MessageName, error) {
+	names := c.Topics
+	if len(names) == 0 {
+		names = []emu.MessageName{emu.InstantaneousPower, emu.CumulativeEnergy}
+	}
+	format := datalog.CSV
+	if c.Format != "" {
+		var err error
+		if format, err = datalog.StringToFormat(c.Format); err != nil {
+			return nil, nil, err
+		}
+	}
+	columns := c.Columns
+	if len(columns) == 0 {
+		columns = datalog.DefaultColumns(format, names)
+	}
+	opts := []datalog.Option{datalog.WithFormat(format), datalog.WithColumns(columns...),
+		datalog.WithRotation(c.MaxSize<<20, c.Daily, c.Gzip == nil || *c.Gzip)}
+	if c.TimeFormat != "" {
+		opts = append(opts, datalog.WithTimeFormat(c.TimeFormat))
+	}
+	logger, err := datalog.NewLogger(c.File, opts...)
+	return logger, names, err
+}
+
+// listenControl listens on the control socket at path, replacing a stale
+// socket left by a daemon that did not stop cleanly.
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the group of the socket may control the daemon
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (d *daemon) serveControl(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		d.lck.Lock()
+		server := d.server
+		d.lck.Unlock()
+		go server.ServeConn(conn)
+	}
+}
+
+func (d *daemon) status() *daemonStatus {
+	d.lck.Lock()
+	device := d.device
+	status := &daemonStatus{
+		Pid:       os.Getpid(),
+		Port:      d.port,
+		Connected: device != nil,
+		Network:   emu.StateUnknown,
+		Exporters: d.exporters,
+		Started:   d.started.Unix(),
+	}
+	if !d.reloaded.IsZero() {
+		status.Reloaded = d.reloaded.Unix()
+	}
+	d.lck.Unlock()
+	if device != nil {
+		status.Network = networkStatus(device).State
+	}
+	return status
+}
+
+// runControl sends a request to the control socket of a daemon, for the
+// emuctl invocations sharing its device.
+func runControl(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("control", flag.ExitOnError)
+	socket := fs.String("socket", defaultSocket, "Path of the control socket of the daemon")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: emuctl control [-socket path] status|reload|<COMMAND> [Attribute=value ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return usageErrorf("no request")
+	}
+
+	addr := "unix://" + *socket
+	op := fs.Arg(0)
+	if op == "status" || op == "reload" {
+		return controlRequest(*socket, op)
+	}
+
+	id, err := emu.StrToCommandId(strings.ToUpper(op))
+	if err != nil {
+		return usageErrorf("bad command: %v", err)
+	}
+	var meterOpts []emu.MeterOption
+	if *meterFlag != "" {
+		meterOpts = append(meterOpts, emu.WithMeter(*meterFlag))
+	}
+	cmd, err := emu.NewCommand(id, meterOpts...)
+	if id == emu.SET_TIME {
+		cmd, err = emu.NewSetTimeCommand(time.Now())
+	}
+	if err != nil {
+		return usageError{err}
+	}
+	for _, p := range fs.Args()[1:] {
+		key, value, ok := strings.Cut(p, "=")
+		if !ok || key == "" {
+			return usageErrorf("invalid parameter %q, expecting Attribute=value", p)
+		}
+		cmd.SetAttrib(key, value)
+	}
+	device, err := emu.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	m, err := executeCommand(device, cmd)
+	if err != nil {
+		return err
+	}
+	return output.print(m)
+}
+
+// controlRequest sends an op of the daemon, rather than of its device, to
+// the control socket and prints its answer.
+func controlRequest(socket string, op string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(map[string]any{"id": 1, "op": op}); err != nil {
+		return err
+	}
+	var rsp struct {
+		Error string        `json:"error"`
+		Data  *daemonStatus `json:"data"`
+	}
+	if err := json.NewDecoder(conn).Decode(&rsp); err != nil {
+		return err
+	}
+	switch {
+	case rsp.Error != "":
+		return errors.New(rsp.Error)
+	case rsp.Data != nil:
+		return output.printRecord("DaemonStatus", rsp.Data, "")
+	}
+	return nil
+}
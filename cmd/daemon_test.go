@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+type countMetrics struct {
+	emu.Metrics
+	received int
+}
+
+func (m *countMetrics) MessageReceived(string) { m.received++ }
+
+func TestActivity(t *testing.T) {
+	d := &daemon{active: time.Now().Add(-time.Hour)}
+	if d.idle() < time.Hour {
+		t.Fatalf("idle %s", d.idle())
+	}
+	// without metrics exporter
+	a := &activity{daemon: d}
+	a.MessageReceived("TimeCluster")
+	a.ParseError("TimeCluster")
+	a.Reconnected()
+	if idle := d.idle(); idle > time.Second {
+		t.Errorf("idle %s after a message", idle)
+	}
+
+	m := &countMetrics{}
+	a = &activity{Metrics: m, daemon: d}
+	a.MessageReceived("InstantaneousDemand")
+	if m.received != 1 {
+		t.Errorf("%d messages passed on, want 1", m.received)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	d := &daemon{}
+	d.setOpening(true)
+	d.active = time.Now().Add(-time.Hour)
+	if _, stalled := d.stalled(time.Minute); stalled {
+		t.Error("stalled while opening")
+	}
+	d.setOpening(false)
+	// the session may be reconnecting
+	d.active = time.Now().Add(-30 * time.Second)
+	if _, stalled := d.stalled(time.Minute); stalled {
+		t.Error("stalled within the limit")
+	}
+	d.active = time.Now().Add(-time.Hour)
+	if idle, stalled := d.stalled(time.Minute); !stalled || idle < time.Hour {
+		t.Errorf("idle %s, stalled %v after an hour", idle, stalled)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// resolvePort returns the port of the targeted device among the comma
+// separated ports: the only one when device is empty, otherwise the one whose
+// name (base of its path) or DeviceMacId is device.
+func resolvePort(ports string, device string, opts []emu.EmuOption) (string, error) {
+	var paths []string
+	for _, p := range strings.Split(ports, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no port")
+	}
+	if device == "" {
+		if len(paths) > 1 {
+			return "", fmt.Errorf("%d ports given, use -device to target one", len(paths))
+		}
+		return paths[0], nil
+	}
+	for _, p := range paths {
+		if filepath.Base(p) == device || p == device {
+			return p, nil
+		}
+	}
+
+	// identify the devices by DeviceMacId
+	manager := emu.NewManager(opts...)
+	defer manager.Close()
+	for _, p := range paths {
+		if err := manager.Add(filepath.Base(p), p); err != nil {
+			return "", err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, md, err := manager.WaitDevice(ctx, device)
+	if err != nil {
+		return "", err
+	}
+	info("device %s is on %s", md.DeviceMacId, md.Path)
+	return md.Path, nil
+}
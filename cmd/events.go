@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/events"
+)
+
+func runEvents(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	duration := fs.Duration("duration", 0, "How long to watch the demand, 0 until interrupted")
+	threshold := fs.Float64("threshold", 0.3, "Smallest change of demand, in kW, seen as an appliance switching")
+	tolerance := fs.Float64("tolerance", 0.2, "Relative power difference allowed between the edges of a cycle")
+	edges := fs.Bool("edges", false, "Print the edges as well as the cycles")
+	fs.Parse(args)
+
+	detector, err := events.NewDetector(events.WithThreshold(*threshold), events.WithTolerance(*tolerance))
+	if err != nil {
+		return err
+	}
+	cycles, _ := detector.Subscribe(events.ApplianceCycle)
+	defer detector.Unsubscribe(events.ApplianceCycle, cycles)
+	edgeCh, _ := detector.Subscribe(events.ApplianceEdge)
+	defer detector.Unsubscribe(events.ApplianceEdge, edgeCh)
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	ctx, stop := signalContext()
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	go detector.Run(ctx, device)
+
+	info("Watching the demand, press Ctrl+C for the report.")
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case m := <-edgeCh:
+			if !*edges {
+				continue
+			}
+			if !output.text() {
+				output.print(m)
+				continue
+			}
+			e := m.(*events.Edge)
+			fmt.Printf("%s edge %+.3f kW, demand %.3f kW\n", formatTime(e.TimeStamp), e.Delta, e.Power)
+		case m := <-cycles:
+			if !output.text() {
+				output.print(m)
+				continue
+			}
+			c := m.(*events.Cycle)
+			fmt.Printf("%s cycle %.3f kW for %s, %.3f kWh, signature #%d (%s)\n",
+				formatTime(c.Start), c.Power, time.Duration(c.Duration)*time.Second, c.Energy, c.Signature, c.Label)
+		}
+	}
+
+	sigs := detector.Signatures()
+	if !output.text() {
+		for _, s := range sigs {
+			record := map[string]any{"Id": s.Id, "Power": s.Power, "Duration": s.Duration.Seconds(), "Count": s.Count, "LastSeen": s.LastSeen.Unix()}
+			if err := output.printRecord("Signature", record, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(sigs) == 0 {
+		fmt.Println("No appliance cycle detected.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SIGNATURE\tPOWER\tDURATION\tCOUNT\tLAST SEEN")
+	for _, s := range sigs {
+		fmt.Fprintf(w, "#%d\t%.2f kW\t%s\t%d\t%s\n", s.Id, s.Power, s.Duration, s.Count, s.LastSeen.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func formatTime(ts int64) string {
+	return time.Unix(ts, 0).Format(time.DateTime)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/datalog"
+)
+
+func runLog(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	file := fs.String("file", "emu.csv", "Path of the log file")
+	topics := fs.String("topics", "InstantaneousPower,CumulativeEnergy", "Comma separated messages to log")
+	format := fs.String("format", "csv", "Output format (csv, jsonl)")
+	columns := fs.String("columns", "", "Comma separated columns: time, type, data or attribute names (default depends on the topics)")
+	timeFormat := fs.String("time-format", datalog.TimeRFC3339, "Format of the time column (utc, local, rfc3339, epoch)")
+	maxSize := fs.Int64("max-size", 0, "Rotate the file when it exceeds this many MB, 0 to disable")
+	daily := fs.Bool("daily", false, "Rotate the file every day")
+	compress := fs.Bool("gzip", true, "Gzip the rotated files")
+	fs.Parse(args)
+
+	f, err := datalog.StringToFormat(*format)
+	if err != nil {
+		return err
+	}
+	var names []emu.MessageName
+	for _, t := range strings.Split(*topics, ",") {
+		names = append(names, emu.MessageName(strings.TrimSpace(t)))
+	}
+	cols := datalog.DefaultColumns(f, names)
+	if *columns != "" {
+		cols = strings.Split(*columns, ",")
+	}
+	if *maxSize < 0 {
+		return fmt.Errorf("invalid max size %d", *maxSize)
+	}
+
+	logger, err := datalog.NewLogger(*file,
+		datalog.WithFormat(f),
+		datalog.WithColumns(cols...),
+		datalog.WithTimeFormat(*timeFormat),
+		datalog.WithRotation(*maxSize<<20, *daily, *compress))
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	ctx, stop := signalContext()
+	defer stop()
+	info("logging %s to %s", *topics, *file)
+	return logger.Run(ctx, device, names)
+}
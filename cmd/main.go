@@ -3,148 +3,94 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/kbhuyan/emu"
 )
 
-func waitingToBeTerminate(device emu.Emu) {
-	// Create a channel to receive signals.
-	sigChan := make(chan os.Signal, 1)
-
-	// Notify the channel of specific signals.
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	fmt.Println("Program is running. Press Ctrl+C to interrupt.")
-
-	// Block until a signal is received.
-	sig := <-sigChan
-
-	// Handle the signal.
-	switch sig {
-	case syscall.SIGINT:
-		fmt.Println("SIGINT received. Exiting...")
-		device.Close()
-		os.Exit(0)
-	case syscall.SIGTERM:
-		fmt.Println("SIGTERM received. Exiting...")
-		device.Close()
-		os.Exit(0)
-	default:
-		fmt.Println("Unexpected signal received.")
-	}
-}
+// flags of emuctl, those of the device can be set by the configuration file
+var (
+	portFlag    = flag.String("port", "/dev/ttyACM1", "Serial port device path, or comma separated paths of several devices")
+	deviceFlag  = flag.String("device", "", "Name (base of the port path) or DeviceMacId of the device to use among the ports")
+	meterFlag   = flag.String("meter", "", "MeterMacId of the meter a command is sent for, when joined to several meters")
+	baudFlag    = flag.Int("baud", 115200, "Baud rate (115200, 9600, etc)")
+	timeoutFlag = flag.Duration("timeout", 15*time.Second, "Read timeout duration")
+	logFlag     = flag.String("log", "LOG_WARNING", "Emu logging level (LOG_ALL, LOG_INFO, LOG_WARNING, LOG_ERROR, LOG_OFF)")
+	historyFlag = flag.String("history", "", "Directory where the session records the messages, none when empty")
+	configFlag  = flag.String("config", "", "Configuration file, by default the first of ~/.config/emuctl/config.yaml and /etc/emuctl.yaml")
+	profileFlag = flag.String("profile", "", "Profile of the configuration file to use, by default $EMU_PROFILE or the default profile of the file")
+	listFlag    = flag.Bool("list", false, "List available commands and exit")
+	outputFlag  = flag.String("output", formatText, "Output format of the results (text, json, yaml, csv, table)")
+)
 
 func main() {
-	// Configure command-line flags
-	port := flag.String("port", "/dev/ttyACM1", "Serial port device path")
-	baud := flag.Int("baud", 115200, "Baud rate (115200, 9600, etc)")
-	timeout := flag.Duration("timeout", 15*time.Second, "Read timeout duration")
-	logLevel := flag.String("log", "LOG_WARNING", "Emu logging level (LOG_ALL, LOG_INFO, LOG_WARNING, LOG_ERROR, LOG_OFF)")
-	list := flag.Bool("list", false, "List available commands and exit")
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "emuctl: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
 
+func run() error {
 	flag.Parse()
 
 	// Handle --list flag
-	if *list {
+	if *listFlag {
 		printAvailableCommands()
-		return
+		return nil
 	}
 
 	// Get command from positional arguments
 	args := flag.Args()
 	if len(args) < 1 {
-		log.Fatalf("Usage: emuctl [flags] <command>\n%s", cmdList)
+		return usageErrorf("no command\nUsage: emuctl [flags] <command>\n%s\n%s", cmdList, subcommandList)
 	}
 
-	ll, err := emu.StringToLogLevel(*logLevel)
+	var err error
+	if output, err = newPrinter(*outputFlag, os.Stdout); err != nil {
+		return err
+	}
+	dev, opts, err := settings()
 	if err != nil {
-		log.Fatalf("Bad log level: %s\n", err)
+		return err
 	}
+
 	cmdStr := args[0]
+	if sub, ok := subcommands[cmdStr]; ok {
+		if err := sub(dev, opts, args[1:]); err != nil {
+			return fmt.Errorf("%s: %w", cmdStr, err)
+		}
+		return nil
+	}
 	command, err := emu.StrToCommandId(cmdStr)
 	if err != nil {
-		log.Fatalf("Bad command: %v\n %s\n", err, cmdList)
+		return usageErrorf("bad command: %v\n%s", err, cmdList)
 	}
 
-	device, err := emu.NewEmu(*port, emu.WithBaudRate(*baud), emu.WithTimeOut(*timeout), emu.WithLoggingLevel(ll))
-	if err != nil {
-		log.Fatalf("Connection failed: %v", err)
+	var meterOpts []emu.MeterOption
+	if *meterFlag != "" {
+		meterOpts = append(meterOpts, emu.WithMeter(*meterFlag))
+	}
+	cmd, err := emu.NewCommand(command, meterOpts...)
+	if command == emu.SET_TIME {
+		cmd, err = emu.NewSetTimeCommand(time.Now())
 	}
-	defer device.Close()
-	device.Start()
-
-	//fmt.Println("commanf: ", command)
-	// Execute command
-	cmd, err := emu.NewCommand(command)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return usageError{err}
 	}
 
-	if msg, err := executeCommand(device, cmd); err != nil {
-		log.Fatalf("%v", err)
-	} else {
-		processMessage(msg)
+	device, err := emu.NewEmu(dev, opts...)
+	if err != nil {
+		return fmt.Errorf("connection failed: %w", err)
 	}
+	defer device.Close()
+	device.Start()
 
-	// go func() {
-
-	// 	if energy, err := device.GetCumulativeEnergyConsumption(); err != nil {
-	// 		log.Fatalf("%v", err)
-	// 	} else {
-	// 		log.Printf("TimeStamp: %s Current Cumulative Energy Delivered: %.3fkWh\n", time.Unix(energy.TimeStamp, 0), energy.Energy)
-	// 	}
-
-	// 	if power, err := device.GetInstantaneousPowerConsumption(); err != nil {
-	// 		log.Fatalf("%v", err)
-	// 	} else {
-	// 		log.Printf("TimeStamp: %s Instantaneous Demand: %.3fkW\n", time.Unix(power.TimeStamp, 0), power.Power)
-	// 	}
-
-	// }()
-
-	//waitingToBeTerminate(device)
-}
-
-func processMessage(msg emu.Message) {
-	name := emu.MessageName(msg.GetName())
-	switch name {
-	case emu.TimeCluster:
-		var local, utc int64
-		if value, ok := msg.GetAttrib("LocalTime"); !ok {
-			log.Printf("LocalTime not found %+v\n", msg)
-			return
-		} else {
-			local = value.(int64)
-		}
-		if value, ok := msg.GetAttrib("UTCTime"); !ok {
-			log.Printf("UTCTime not found %+v\n", msg)
-			return
-		} else {
-			utc = value.(int64)
-		}
-		log.Printf("TimeCluster: LocalTime: %s UTCTime %s\n",
-			time.Unix(local, 0).In(time.UTC).Format("2006-01-02 15:04:05"),
-			time.Unix(utc, 0).In(time.UTC).Format("2006-01-02 15:04:05"))
-	case emu.InstantaneousPower:
-		if power, ok := msg.(*emu.InstantaneousPowerDemand); ok {
-			log.Printf("TimeStamp: %s Instantaneous Demand: %.3fkW\n", time.Unix(power.TimeStamp, 0), power.Power)
-		} else {
-			log.Printf("invalid message: expecting emu.InstantaneousPowerDemand insted got %T. %+v", msg, msg)
-		}
-	case emu.CumulativeEnergy:
-		if energy, ok := msg.(*emu.CumulativeEnergyConsumption); ok {
-			log.Printf("TimeStamp: %s Current Cumulative Energy Delivered: %.3fkWh\n", time.Unix(energy.TimeStamp, 0), energy.Energy)
-		} else {
-			log.Printf("invalid message: expecting emu.CumulativeEnergyConsumption insted got %T. %+v", msg, msg)
-		}
-	default:
-		log.Printf("Message: %+v\n", msg)
+	msg, err := executeCommand(device, cmd)
+	if err != nil {
+		return err
 	}
+	return output.print(msg)
 }
 
 func executeCommand(device emu.Emu, cmd emu.Command) (emu.Message, error) {
@@ -166,8 +112,18 @@ var cmdList = `Available EMU commands:
 	RESTART				- restarts the emu-2 device
 	GET_DEVICE_INFO		- gets the basic emu-2 device info HW/SW version, make/model etc.
 	GET_TIME			- gets the time (local and UTC) on the emu-2 as sync with the smart energy meter
-	GET_CONN_STATUS		- gets the current connection status with the smart energy meter`
+	GET_CONN_STATUS		- gets the current connection status with the smart energy meter
+	GET_DEMAND			- gets the instantaneous demand from the smart energy meter
+	GET_SUMMATION		- gets the cumulative energy delivered and received from the smart energy meter
+	GET_METER_LIST		- gets the MeterMacId of the meters the emu-2 is joined to
+	GET_METER_INFO		- gets the type, nickname, account etc. of a meter
+	SET_METER_INFO		- sets the nickname, account etc. of a meter
+	SET_TIME			- sets the time of the emu-2 to the host time
+	GET_NETWORK			- gets the Zigbee network joined by the emu-2: channel, PAN, coordinator, link strength
+	JOIN_NETWORK		- makes the emu-2 (re)join the network of the smart energy meter
+	GET_MESSAGE			- gets the latest text message of the utility`
 
 func printAvailableCommands() {
 	fmt.Println(cmdList)
+	fmt.Println(subcommandList)
 }
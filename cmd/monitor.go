@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"golang.org/x/term"
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// ISO 4217 codes of the usual currencies of the Price messages
+var currencies = map[int]string{36: "AUD", 124: "CAD", 554: "NZD", 826: "GBP", 840: "USD", 978: "EUR"}
+
+// reading is a demand in kW at a time.
+type reading struct {
+	at time.Time
+	kw float64
+}
+
+// dashboard is the state rendered by emuctl monitor.
+type dashboard struct {
+	window  time.Duration
+	power   []reading // the oldest first, within window
+	day     time.Time // midnight of the day counted by energy and cost
+	since   time.Time // first summation of the day
+	energy  float64   // kWh delivered since
+	cost    float64   // cost of energy, at the price current when it was used
+	last    *emu.CumulativeEnergyConsumption
+	price   *emu.CurrentPrice
+	notice  *emu.Notice
+	network emu.NetworkStatus
+	updated time.Time
+}
+
+func runMonitor(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	window := fs.Duration("window", 15*time.Minute, "Span of the demand sparkline")
+	plain := fs.Bool("plain", false, "Print a line per reading instead of the full-screen dashboard, the default when stdout is not a terminal")
+	fs.Parse(args)
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	topics := []emu.MessageName{emu.InstantaneousPower, emu.CumulativeEnergy, emu.Price, emu.UtilityMessage, emu.NetworkTransition}
+	chs := make(map[emu.MessageName]<-chan emu.Message)
+	for _, mn := range topics {
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		defer device.Unsubscribe(mn, ch)
+		chs[mn] = ch
+	}
+	// fill the dashboard without waiting for the periodic messages; the
+	// responses are published, so they are sent apart from the loop reading them
+	go func() {
+		for _, id := range []emu.CommandId{emu.GET_CONN_STATUS, emu.GET_NETWORK, emu.GET_DEMAND, emu.GET_SUMMATION, emu.GET_MESSAGE} {
+			if err := runCommand(device, id); err != nil {
+				emu.WarningLogger.Printf("%s failed: %v", id, err)
+			}
+		}
+	}()
+
+	fd := int(os.Stdout.Fd())
+	fullScreen := !*plain && output.text() && term.IsTerminal(fd)
+	if fullScreen {
+		// alternate screen without cursor, restored on exit
+		fmt.Print("\x1b[?1049h\x1b[?25l")
+		defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	}
+
+	d := &dashboard{window: *window}
+	ctx, stop := signalContext()
+	defer stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var m emu.Message
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case m = <-chs[emu.InstantaneousPower]:
+		case m = <-chs[emu.CumulativeEnergy]:
+		case m = <-chs[emu.Price]:
+		case m = <-chs[emu.UtilityMessage]:
+		case m = <-chs[emu.NetworkTransition]:
+		}
+		now := time.Now()
+		if m != nil {
+			d.update(m, now)
+		}
+		d.network = networkStatus(device)
+		if !fullScreen {
+			if m != nil && output.text() {
+				printReading(os.Stdout, m)
+			} else if m != nil {
+				output.print(m)
+			}
+			continue
+		}
+		width, _, err := term.GetSize(fd)
+		if err != nil {
+			width = 80
+		}
+		var sb strings.Builder
+		sb.WriteString("\x1b[H\x1b[2J")
+		d.render(&sb, port, now, width)
+		fmt.Print(sb.String())
+	}
+}
+
+func (d *dashboard) update(m emu.Message, now time.Time) {
+	d.updated = now
+	switch m := m.(type) {
+	case *emu.InstantaneousPowerDemand:
+		d.power = append(d.power, reading{at: now, kw: m.Power})
+		i := 0
+		for i < len(d.power) && now.Sub(d.power[i].at) > d.window {
+			i++
+		}
+		d.power = d.power[i:]
+	case *emu.CumulativeEnergyConsumption:
+		if day := midnight(now); !day.Equal(d.day) {
+			d.day, d.since, d.energy, d.cost = day, now, 0, 0
+		} else if d.last != nil && m.Energy >= d.last.Energy {
+			delta := m.Energy - d.last.Energy
+			d.energy += delta
+			if d.price != nil {
+				d.cost += delta * d.price.Price
+			}
+		}
+		d.last = m
+	case *emu.CurrentPrice:
+		d.price = m
+	case *emu.Notice:
+		d.notice = m
+	}
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, day := t.Date()
+	return time.Date(y, m, day, 0, 0, 0, 0, t.Location())
+}
+
+func (d *dashboard) render(w io.Writer, port string, now time.Time, width int) {
+	line := func(label, format string, a ...any) {
+		fmt.Fprintf(w, "  %-14s %s\n", label, fmt.Sprintf(format, a...))
+	}
+	fmt.Fprintf(w, "emuctl monitor  %s  %s\n\n", port, now.Format(time.DateTime))
+	if n := len(d.power); n > 0 {
+		line("Demand", "%.3f kW", d.power[n-1].kw)
+	} else {
+		line("Demand", "waiting for a reading")
+	}
+	line("", "%s", sparkline(d.power, now, d.window, max(10, width-20)))
+	line("", "last %s, min %.3f kW, max %.3f kW", d.window, minPower(d.power), maxPower(d.power))
+	fmt.Fprint(w, "\n")
+	if d.day.IsZero() {
+		line("Today", "waiting for a summation")
+	} else {
+		line("Today", "%.3f kWh since %s", d.energy, d.since.Format("15:04"))
+	}
+	if d.price != nil {
+		currency := currencies[d.price.Currency]
+		line("Cost today", "%.2f %s", d.cost, currency)
+		tier := fmt.Sprintf("tier %d", d.price.Tier)
+		if d.price.RateLabel != "" {
+			tier += ", " + d.price.RateLabel
+		}
+		line("Price", "%g %s/kWh (%s)", d.price.Price, currency, tier)
+	} else {
+		line("Price", "not published by the meter")
+	}
+	fmt.Fprint(w, "\n")
+	status := d.network
+	line("Network", "%s", status.State)
+	if !status.Since.IsZero() {
+		line("", "since %s", status.Since.Format(time.DateTime))
+	}
+	if n := status.Network; n != nil {
+		line("Link strength", "%d%%", n.LinkStrength)
+		line("Meter", "%s", n.MeterMacId)
+	}
+	fmt.Fprint(w, "\n")
+	if d.notice != nil && d.notice.Text != "" {
+		line("Message", "%s", d.notice.Text)
+		line("", "%s priority, %s", d.notice.Priority, formatTime(d.notice.TimeStamp))
+	} else {
+		line("Message", "none")
+	}
+	if !d.updated.IsZero() {
+		fmt.Fprintf(w, "\n  updated %s ago, Ctrl+C to quit\n", now.Sub(d.updated).Round(time.Second))
+	}
+}
+
+// sparkline draws the mean demand of the width slots of window ending at now,
+// scaled between the smallest and largest of them.
+func sparkline(power []reading, now time.Time, window time.Duration, width int) string {
+	sums := make([]float64, width)
+	counts := make([]int, width)
+	start := now.Add(-window)
+	for _, r := range power {
+		i := int(float64(r.at.Sub(start)) / float64(window) * float64(width))
+		if i < 0 || i >= width {
+			continue
+		}
+		sums[i] += r.kw
+		counts[i]++
+	}
+	lo, hi := minPower(power), maxPower(power)
+	var sb strings.Builder
+	for i := range sums {
+		if counts[i] == 0 {
+			sb.WriteRune(' ')
+			continue
+		}
+		level := 0
+		if hi > lo {
+			level = int((sums[i]/float64(counts[i]) - lo) / (hi - lo) * float64(len(sparks)-1))
+		}
+		sb.WriteRune(sparks[level])
+	}
+	return sb.String()
+}
+
+func minPower(power []reading) float64 {
+	if len(power) == 0 {
+		return 0
+	}
+	lo := power[0].kw
+	for _, r := range power[1:] {
+		lo = min(lo, r.kw)
+	}
+	return lo
+}
+
+func maxPower(power []reading) float64 {
+	if len(power) == 0 {
+		return 0
+	}
+	hi := power[0].kw
+	for _, r := range power[1:] {
+		hi = max(hi, r.kw)
+	}
+	return hi
+}
+
+// printReading prints m as a line of the plain mode.
+func printReading(w io.Writer, m emu.Message) {
+	switch m := m.(type) {
+	case *emu.InstantaneousPowerDemand:
+		fmt.Fprintf(w, "%s demand %.3f kW\n", formatTime(m.TimeStamp), m.Power)
+	case *emu.CumulativeEnergyConsumption:
+		fmt.Fprintf(w, "%s summation %.3f kWh delivered %.3f kWh received %.3f kWh\n", formatTime(m.TimeStamp), m.Energy, m.Delivered, m.Received)
+	case *emu.CurrentPrice:
+		fmt.Fprintf(w, "%s price %g %s/kWh tier %d %s\n", formatTime(m.TimeStamp), m.Price, currencies[m.Currency], m.Tier, m.RateLabel)
+	case *emu.Notice:
+		fmt.Fprintf(w, "%s message %s (%s priority)\n", formatTime(m.TimeStamp), m.Text, m.Priority)
+	case *emu.StateTransition:
+		fmt.Fprintf(w, "%s network %s -> %s %s\n", formatTime(m.TimeStamp), m.From, m.To, m.Description)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSparkline(t *testing.T) {
+	now := time.Unix(1655127645, 0)
+	for _, tc := range []struct {
+		kw   []float64
+		want string
+	}{
+		{[]float64{1, 2, 3}, string([]rune{sparks[0], sparks[3], sparks[len(sparks)-1]})},
+		// exporting to the grid all along
+		{[]float64{-3, -2, -1}, string([]rune{sparks[0], sparks[3], sparks[len(sparks)-1]})},
+		{[]float64{1, 1, 1}, string([]rune{sparks[0], sparks[0], sparks[0]})},
+	} {
+		var power []reading
+		for i, kw := range tc.kw {
+			power = append(power, reading{at: now.Add(time.Duration(i-len(tc.kw)) * time.Minute), kw: kw})
+		}
+		if got := sparkline(power, now, time.Duration(len(tc.kw))*time.Minute, len(tc.kw)); got != tc.want {
+			t.Errorf("sparkline of %v = %q, want %q", tc.kw, got, tc.want)
+		}
+		if lo, hi := minPower(power), maxPower(power); lo != min(tc.kw[0], tc.kw[2]) || hi != max(tc.kw[0], tc.kw[2]) {
+			t.Errorf("range of %v = %g, %g", tc.kw, lo, hi)
+		}
+	}
+	if got := sparkline(nil, now, time.Minute, 3); got != "   " {
+		t.Errorf("sparkline without reading = %q", got)
+	}
+}
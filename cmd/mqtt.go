@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/mqtt"
+)
+
+func runMqtt(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("mqtt", flag.ExitOnError)
+	broker := fs.String("broker", "tcp://localhost:1883", "MQTT broker URL")
+	clientId := fs.String("client-id", "emu-bridge", "MQTT client id")
+	username := fs.String("username", "", "MQTT username")
+	password := fs.String("password", "", "MQTT password")
+	prefix := fs.String("topic-prefix", "emu", "Prefix of the state and availability topics")
+	discovery := fs.String("discovery-prefix", "homeassistant", "Home Assistant discovery prefix, empty to disable discovery")
+	qos := fs.Uint("qos", 1, "QoS of the published messages (0, 1, 2)")
+	retain := fs.Bool("retain", true, "Publish state messages as retained")
+	fs.Parse(args)
+	if *qos > 2 {
+		return usageErrorf("invalid -qos %d, expecting 0, 1 or 2", *qos)
+	}
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	bridge, err := mqtt.NewBridge(device, *broker,
+		mqtt.WithClientId(*clientId),
+		mqtt.WithCredentials(*username, *password),
+		mqtt.WithTopicPrefix(*prefix),
+		mqtt.WithDiscoveryPrefix(*discovery),
+		mqtt.WithQoS(byte(*qos)),
+		mqtt.WithRetain(*retain))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	info("bridging to %s", *broker)
+	return bridge.Run(ctx)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// hints to diagnose a pairing stuck in a state
+var networkHints = map[emu.NetworkState]string{
+	emu.StateUnknown:        "no status received yet; check the device is powered and the port is right",
+	emu.StateDiscovery:      "no meter network found; move the device closer to the meter or check it was registered with the utility",
+	emu.StateJoinFailed:     "the meter did not accept the join; check the utility registered the install code and MAC of the device",
+	emu.StateRejected:       "the meter refused the keys; the install code registered with the utility is likely wrong, re-register it and JOIN_NETWORK",
+	emu.StateDisconnected:   "the network was lost; check the link strength and the distance to the meter, or JOIN_NETWORK",
+	emu.StateRejoining:      "rejoining after losing the network; the link to the meter is probably weak",
+	emu.StateAuthenticating: "authenticating with the meter; this should complete within a minute",
+}
+
+func runNetwork(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("network", flag.ExitOnError)
+	join := fs.Bool("join", false, "Make the device (re)join the network of the meter first")
+	watch := fs.Duration("watch", 0, "Keep printing the state transitions for this long, e.g. while pairing")
+	fs.Parse(args)
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	if *watch > 0 {
+		transitions, err := device.Subscribe(emu.NetworkTransition)
+		if err != nil {
+			return err
+		}
+		defer device.Unsubscribe(emu.NetworkTransition, transitions)
+		go func() {
+			for t := range transitions {
+				t := t.(*emu.StateTransition)
+				if !output.text() {
+					output.print(t)
+					continue
+				}
+				fmt.Printf("%s %s -> %s (%s) %s\n", formatTime(t.TimeStamp), t.From, t.To, t.Status, t.Description)
+			}
+		}()
+	}
+
+	if *join {
+		if err := runCommand(device, emu.JOIN_NETWORK); err != nil {
+			return err
+		}
+	}
+	for _, id := range []emu.CommandId{emu.GET_CONN_STATUS, emu.GET_NETWORK} {
+		if err := runCommand(device, id); err != nil {
+			emu.WarningLogger.Printf("%s failed: %v", id, err)
+		}
+	}
+	if *watch > 0 {
+		ctx, stop := signalContext()
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, *watch)
+		defer cancel()
+		<-ctx.Done()
+	}
+
+	status := networkStatus(device)
+	if !output.text() {
+		return output.printRecord("NetworkStatus", status, "")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "State\t%s\n", status.State)
+	if !status.Since.IsZero() {
+		fmt.Fprintf(w, "Since\t%s\n", status.Since.Format(time.DateTime))
+	}
+	if n := status.Network; n != nil {
+		fmt.Fprintf(w, "Status\t%s %s\n", n.Status, n.Description)
+		fmt.Fprintf(w, "Meter\t%s\n", n.MeterMacId)
+		fmt.Fprintf(w, "Coordinator\t%s\n", n.CoordMacId)
+		fmt.Fprintf(w, "Channel\t%d\n", n.Channel)
+		fmt.Fprintf(w, "Extended PAN\t%s\n", n.ExtPanId)
+		fmt.Fprintf(w, "Short address\t%s\n", n.ShortAddr)
+		fmt.Fprintf(w, "Link strength\t%d%%\n", n.LinkStrength)
+	}
+	if hint, ok := networkHints[status.State]; ok {
+		fmt.Fprintf(w, "Hint\t%s\n", hint)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(status.History) > 0 {
+		fmt.Println("History:")
+		for _, t := range status.History {
+			fmt.Printf("  %s %s -> %s\n", formatTime(t.TimeStamp), t.From, t.To)
+		}
+	}
+	return nil
+}
+
+func runCommand(device emu.Emu, id emu.CommandId) error {
+	cmd, err := emu.NewCommand(id)
+	if err != nil {
+		return err
+	}
+	_, err = executeCommand(device, cmd)
+	return err
+}
+
+// networkStatus returns the network status of device, unknown when it does
+// not report it.
+func networkStatus(device emu.Emu) emu.NetworkStatus {
+	if r, ok := device.(emu.NetworkReporter); ok {
+		return r.NetworkStatus()
+	}
+	return emu.NetworkStatus{State: emu.StateUnknown}
+}
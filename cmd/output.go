@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of -output.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+	formatCSV   = "csv"
+	formatTable = "table"
+)
+
+var formats = []string{formatText, formatJSON, formatYAML, formatCSV, formatTable}
+
+// Exit codes of emuctl.
+const (
+	exitDeviceError = 1 // the device failed or answered an error, or any other failure
+	exitUsage       = 2 // bad flags, command or parameters
+	exitTimeout     = 3 // the device did not answer in time
+)
+
+// usageError is an error of the command line.
+type usageError struct {
+	error
+}
+
+func usageErrorf(format string, a ...any) error {
+	return usageError{fmt.Errorf(format, a...)}
+}
+
+func (e usageError) Unwrap() error {
+	return e.error
+}
+
+// exitCode returns the exit code reporting err.
+func exitCode(err error) int {
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, emu.ErrTimeOut), errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return exitTimeout
+	default:
+		return exitDeviceError
+	}
+}
+
+// units of the attributes printed in the text format
+var units = map[string]string{
+	"Power":        "kW",
+	"Delta":        "kW",
+	"Energy":       "kWh",
+	"Delivered":    "kWh",
+	"Received":     "kWh",
+	"LinkStrength": "%",
+	"Drift":        "s",
+	"Skew":         "s",
+	"Price":        "per kWh",
+}
+
+// printer writes the messages and records of a command in the format of
+// -output. Records are flattened into attributes, named as in the JSON
+// envelope of the messages.
+type printer struct {
+	format  string
+	w       io.Writer
+	lck     sync.Mutex
+	yaml    *yaml.Encoder
+	columns []string // csv and table: columns of the last header
+	widths  []int    // table: widths of the columns
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	if !slices.Contains(formats, format) {
+		return nil, usageErrorf("unknown output format %s, expecting one of %s", format, strings.Join(formats, ", "))
+	}
+	return &printer{format: format, w: w}, nil
+}
+
+// output prints the results of emuctl, quiet suppresses its informational messages.
+var (
+	output = &printer{format: formatText, w: os.Stdout}
+	quiet  = flag.Bool("quiet", false, "Print the results only, without informational messages and warnings")
+)
+
+// info prints an informational message to stderr, unless quiet.
+func info(format string, a ...any) {
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+func (p *printer) text() bool {
+	return p.format == formatText
+}
+
+func (p *printer) printf(format string, a ...any) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	fmt.Fprintf(p.w, format, a...)
+}
+
+// print prints m.
+func (p *printer) print(m emu.Message) error {
+	return p.printRecord(m.GetName(), m, "")
+}
+
+// printRecord prints v, a message or any value encoding to a JSON object, as
+// the record name. The note follows the name in the text format.
+func (p *printer) printRecord(name string, v any, note string) error {
+	attribs, err := flatten(v)
+	if err != nil {
+		return err
+	}
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	switch p.format {
+	case formatJSON:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		env := emu.Envelope{Type: emu.MessageName(name), Data: data}
+		if ts, ok := attribs["TimeStamp"].(int64); ok {
+			env.TimeStamp = ts
+		}
+		return json.NewEncoder(p.w).Encode(env)
+	case formatYAML:
+		if p.yaml == nil {
+			p.yaml = yaml.NewEncoder(p.w)
+		}
+		doc := map[string]any{"type": name, "data": attribs}
+		if ts, ok := attribs["TimeStamp"].(int64); ok {
+			doc["ts"] = ts
+		}
+		return p.yaml.Encode(doc)
+	case formatCSV:
+		columns := append([]string{"type"}, slices.Sorted(maps.Keys(attribs))...)
+		w := csv.NewWriter(p.w)
+		if !slices.Equal(columns, p.columns) {
+			p.columns = columns
+			w.Write(columns)
+		}
+		row := []string{name}
+		for _, c := range columns[1:] {
+			row = append(row, formatValue(attribs[c]))
+		}
+		w.Write(row)
+		w.Flush()
+		return w.Error()
+	case formatTable:
+		columns := append([]string{"TYPE"}, slices.Sorted(maps.Keys(attribs))...)
+		row := []string{name}
+		for _, c := range columns[1:] {
+			row = append(row, formatValue(attribs[c]))
+		}
+		if !slices.Equal(columns, p.columns) {
+			p.columns = columns
+			p.widths = make([]int, len(columns))
+			for i, c := range columns {
+				p.widths[i] = max(len(c), len(row[i]))
+			}
+			p.writeRow(columns)
+		}
+		p.writeRow(row)
+		return nil
+	default:
+		fmt.Fprintf(p.w, "%s%s\n", name, note)
+		width := 0
+		for key := range attribs {
+			width = max(width, len(key))
+		}
+		for _, key := range slices.Sorted(maps.Keys(attribs)) {
+			value := formatValue(attribs[key])
+			if ts, ok := attribs[key].(int64); ok && isTimeAttribute(key) && ts > 0 {
+				value = fmt.Sprintf("%d (%s)", ts, time.Unix(ts, 0).Format(time.DateTime))
+			} else if unit, ok := units[key]; ok {
+				value += " " + unit
+			}
+			fmt.Fprintf(p.w, "  %-*s  %s\n", width, key, value)
+		}
+		return nil
+	}
+}
+
+// writeRow writes the cells of a table row, widening the columns to fit.
+func (p *printer) writeRow(cells []string) {
+	var sb strings.Builder
+	for i, cell := range cells {
+		p.widths[i] = max(p.widths[i], len(cell))
+		if i == len(cells)-1 {
+			sb.WriteString(cell)
+		} else {
+			fmt.Fprintf(&sb, "%-*s  ", p.widths[i], cell)
+		}
+	}
+	fmt.Fprintln(p.w, sb.String())
+}
+
+// flatten returns the attributes of v as encoded in JSON, with the numbers as
+// int64 when integral, float64 otherwise.
+func flatten(v any) (map[string]any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var attribs map[string]any
+	if err := dec.Decode(&attribs); err != nil {
+		return nil, fmt.Errorf("%T is not a record: %w", v, err)
+	}
+	for key, value := range attribs {
+		if n, ok := value.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				attribs[key] = i
+			} else {
+				attribs[key], _ = n.Float64()
+			}
+		}
+	}
+	return attribs, nil
+}
+
+// formatValue formats an attribute for the text, csv and table formats,
+// nested values as JSON.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]any, []any:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isTimeAttribute(key string) bool {
+	return key == "TimeStamp" || strings.HasSuffix(key, "Time")
+}
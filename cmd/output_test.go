@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kbhuyan/emu"
+	"gopkg.in/yaml.v3"
+)
+
+func printAll(t *testing.T, format string, msgs ...emu.Message) string {
+	t.Helper()
+	var sb strings.Builder
+	p, err := newPrinter(format, &sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if err := p.print(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sb.String()
+}
+
+var (
+	demand1 = &emu.InstantaneousPowerDemand{TimeStamp: 1655127645, Power: 1.25, MeterMacId: "0x00135003000aaaa"}
+	demand2 = &emu.InstantaneousPowerDemand{TimeStamp: 1655127655, Power: 0.5, MeterMacId: "0x00135003000aaaa"}
+	network = &emu.Network{Name: emu.NetworkInfo, Status: "Connected", LinkStrength: 100}
+)
+
+func TestPrintJSON(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(printAll(t, formatJSON, demand1, network)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines %q", lines)
+	}
+	m, err := emu.UnmarshalMessage([]byte(lines[0]))
+	if d, ok := m.(*emu.InstantaneousPowerDemand); err != nil || !ok || *d != *demand1 {
+		t.Errorf("decoded %+v, %v from %s", m, err, lines[0])
+	}
+	if !strings.Contains(lines[0], `"ts":1655127645`) || strings.Contains(lines[1], `"ts"`) {
+		t.Errorf("timestamps of %q", lines)
+	}
+}
+
+func TestPrintYAML(t *testing.T) {
+	dec := yaml.NewDecoder(strings.NewReader(printAll(t, formatYAML, demand1, network)))
+	var docs []map[string]any
+	for {
+		var doc map[string]any
+		if err := dec.Decode(&doc); err != nil {
+			break
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) != 2 || docs[0]["type"] != "InstantaneousPower" || docs[0]["ts"] != 1655127645 || docs[1]["type"] != "NetworkInfo" {
+		t.Fatalf("documents %v", docs)
+	}
+	if data := docs[0]["data"].(map[string]any); data["Power"] != 1.25 || data["MeterMacId"] != "0x00135003000aaaa" {
+		t.Errorf("data %v", data)
+	}
+}
+
+func TestPrintCSV(t *testing.T) {
+	got := printAll(t, formatCSV, demand1, demand2, network)
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	// a header for each change of columns
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "type,") || !strings.HasPrefix(lines[3], "type,") {
+		t.Fatalf("csv %q", lines)
+	}
+	header := strings.Split(lines[0], ",")
+	row := strings.Split(lines[2], ",")
+	for i, c := range header {
+		want := map[string]string{"type": "InstantaneousPower", "Power": "0.5", "TimeStamp": "1655127655"}[c]
+		if want != "" && row[i] != want {
+			t.Errorf("%s = %q, want %q", c, row[i], want)
+		}
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(printAll(t, formatTable, demand1, demand2)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "TYPE ") || !strings.HasPrefix(lines[1], "InstantaneousPower  ") {
+		t.Fatalf("table %q", lines)
+	}
+	// the columns are aligned
+	col := strings.Index(lines[0], "Power")
+	if col < 0 || !strings.HasPrefix(lines[1][col:], "1.25 ") || !strings.HasPrefix(lines[2][col:], "0.5 ") {
+		t.Errorf("table %q", lines)
+	}
+}
+
+func TestPrintText(t *testing.T) {
+	got := printAll(t, formatText, demand1)
+	if !strings.HasPrefix(got, "InstantaneousPower\n") || !strings.Contains(got, "  Power        1.25 kW\n") ||
+		!strings.Contains(got, "  TimeStamp    1655127645 (") {
+		t.Errorf("text %q", got)
+	}
+}
+
+func TestNewPrinter(t *testing.T) {
+	if _, err := newPrinter("xml", os.Stdout); exitCode(err) != exitUsage {
+		t.Errorf("newPrinter(xml) = %v, want a usage error", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{usageErrorf("unknown command"), exitUsage},
+		{fmt.Errorf("response error: %w", emu.ErrTimeOut), exitTimeout},
+		{context.DeadlineExceeded, exitTimeout},
+		{os.ErrDeadlineExceeded, exitTimeout},
+		{errors.New("device answered an error"), exitDeviceError},
+	} {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/server"
+)
+
+func serve(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to serve the HTTP API on")
+	origins := fs.String("allowed-origins", "", "Comma separated cross origins allowed to open a WebSocket, * for any")
+	fs.Parse(args)
+
+	var serverOpts []server.ServerOption
+	if *origins != "" {
+		serverOpts = append(serverOpts, server.WithAllowedOrigins(strings.Split(*origins, ",")...))
+	}
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	srv := &http.Server{Addr: *listen, Handler: server.NewServer(device, serverOpts...), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	info("serving the HTTP API on %s", *listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/exporter/prometheus"
+)
+
+func serveMetrics(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("serve-metrics", flag.ExitOnError)
+	listen := fs.String("listen", ":9100", "Address to serve the /metrics endpoint on")
+	fs.Parse(args)
+
+	exporter := prometheus.NewExporter()
+	device, err := emu.NewEmu(port, append(opts, emu.WithMetrics(exporter))...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter.Handler())
+	srv := &http.Server{Addr: *listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go exporter.Run(ctx, device)
+
+	info("serving metrics on %s/metrics", *listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"golang.org/x/term"
+)
+
+const shellHelp = `Shell commands:
+	<COMMAND> [Attribute=value ...]	- sends an EMU command, e.g. GET_DEMAND MeterMacId=0x00135003xxxxxxxx
+	watch [topic ...]			- streams the messages of the topics inline, lists the watched topics without one
+	unwatch [topic ...]			- stops streaming the topics, all of them without one
+	raw <xml>				- writes an XML fragment to the device as is
+	raw <name> [Attribute=value ...] [Element ...]
+						- sends the command name, e.g. one not listed below, and prints the
+						  fragments of the elements, the ones read for a few seconds without one
+	history				- lists the lines entered in this session
+	help					- prints this help
+	exit					- closes the session`
+
+var shellBuiltins = []string{"watch", "unwatch", "raw", "history", "help", "exit"}
+
+// rawDevice is a device taking the raw commands of the shell.
+type rawDevice interface {
+	emu.Emu
+	emu.RawSender
+}
+
+// shell runs the lines entered by the user against one open device.
+type shell struct {
+	device  rawDevice
+	out     *printer
+	history []string
+	watches map[emu.MessageName]*watcher
+}
+
+// watcher streams the messages of a topic until stop is closed, and closes
+// stopped once unsubscribed.
+type watcher struct {
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func runShell(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	fs.Parse(args)
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	raw, ok := device.(rawDevice)
+	if !ok {
+		return fmt.Errorf("%s does not take raw commands", port)
+	}
+	device.Start()
+
+	sh := &shell{device: raw, out: output, watches: make(map[emu.MessageName]*watcher)}
+	defer sh.unwatch(nil)
+	var readLine func() (string, error)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "emu> ")
+		t.AutoCompleteCallback = sh.completer()
+		sh.out = &printer{format: output.format, w: t}
+		readLine = t.ReadLine
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		readLine = func() (string, error) {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		}
+	}
+	sh.printf("Connected to %s, type help for the commands.\n", port)
+	for {
+		line, err := readLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sh.history = append(sh.history, line)
+		if !sh.exec(line) {
+			return nil
+		}
+	}
+}
+
+func (sh *shell) printf(format string, a ...any) {
+	sh.out.printf(format, a...)
+}
+
+// exec runs a line and reports whether the session goes on.
+func (sh *shell) exec(line string) bool {
+	word, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch word {
+	case "exit", "quit":
+		return false
+	case "help":
+		sh.printf("%s\n%s\n", shellHelp, cmdList)
+	case "history":
+		for i, h := range sh.history {
+			sh.printf("%4d  %s\n", i+1, h)
+		}
+	case "watch":
+		if rest == "" {
+			sh.printf("watching: %v\n", slices.Sorted(maps.Keys(sh.watches)))
+			break
+		}
+		for _, topic := range strings.Fields(rest) {
+			if err := sh.watch(emu.MessageName(topic)); err != nil {
+				sh.printf("error: %v\n", err)
+			}
+		}
+	case "unwatch":
+		var topics []emu.MessageName
+		for _, topic := range strings.Fields(rest) {
+			topics = append(topics, emu.MessageName(topic))
+		}
+		sh.unwatch(topics)
+	case "raw":
+		if strings.HasPrefix(rest, "<") {
+			if err := sh.device.WriteRaw(rest); err != nil {
+				sh.printf("error: %v\n", err)
+			}
+			break
+		}
+		sh.raw(strings.Fields(rest))
+	default:
+		sh.command(word, strings.Fields(rest))
+	}
+	return true
+}
+
+func (sh *shell) command(word string, params []string) {
+	id, err := emu.StrToCommandId(strings.ToUpper(word))
+	if err != nil {
+		sh.printf("unknown command %s, type help for the commands\n", word)
+		return
+	}
+	var cmd emu.Command
+	if id == emu.SET_TIME {
+		cmd, err = emu.NewSetTimeCommand(time.Now())
+	} else {
+		cmd, err = emu.NewCommand(id)
+	}
+	if err != nil {
+		sh.printf("error: %v\n", err)
+		return
+	}
+	for _, p := range params {
+		key, value, ok := strings.Cut(p, "=")
+		if !ok || key == "" {
+			sh.printf("invalid parameter %q, expecting Attribute=value\n", p)
+			return
+		}
+		cmd.SetAttrib(key, value)
+	}
+	start := time.Now()
+	rsp, err := executeCommand(sh.device, cmd)
+	if err != nil {
+		sh.printf("error: %v\n", err)
+		return
+	}
+	sh.out.printRecord(rsp.GetName(), rsp, fmt.Sprintf(" (%s)", time.Since(start).Round(time.Millisecond)))
+}
+
+func (sh *shell) raw(words []string) {
+	if len(words) == 0 {
+		sh.printf("usage: raw <xml> | raw <name> [Attribute=value ...] [Element ...]\n")
+		return
+	}
+	params := make(map[string]string)
+	var expect []string
+	for _, w := range words[1:] {
+		if key, value, ok := strings.Cut(w, "="); ok {
+			params[key] = value
+		} else {
+			expect = append(expect, w)
+		}
+	}
+	start := time.Now()
+	fragments, err := sh.device.SendRaw(context.Background(), words[0], params, expect...)
+	note := fmt.Sprintf(" (%s)", time.Since(start).Round(time.Millisecond))
+	for _, f := range fragments {
+		sh.out.printRecord(f.Element, f, note)
+	}
+	if err != nil {
+		sh.printf("error: %v\n", err)
+	}
+}
+
+func (sh *shell) watch(topic emu.MessageName) error {
+	if _, ok := sh.watches[topic]; ok {
+		return nil
+	}
+	ch, err := sh.device.Subscribe(topic)
+	if err != nil {
+		return err
+	}
+	w := &watcher{stop: make(chan struct{}), stopped: make(chan struct{})}
+	sh.watches[topic] = w
+	go func() {
+		defer close(w.stopped)
+		defer sh.device.Unsubscribe(topic, ch)
+		for {
+			select {
+			case <-w.stop:
+				return
+			case m := <-ch:
+				sh.out.printRecord(m.GetName(), m, " ["+time.Now().Format(time.TimeOnly)+"]")
+			}
+		}
+	}()
+	return nil
+}
+
+// unwatch stops streaming the topics, all of them when empty.
+func (sh *shell) unwatch(topics []emu.MessageName) {
+	if len(topics) == 0 {
+		topics = slices.Collect(maps.Keys(sh.watches))
+	}
+	for _, topic := range topics {
+		if w, ok := sh.watches[topic]; ok {
+			close(w.stop)
+			<-w.stopped
+			delete(sh.watches, topic)
+		}
+	}
+}
+
+// completer returns the tab-completion of the commands, topics and attribute
+// names of a line.
+func (sh *shell) completer() func(string, int, rune) (string, int, bool) {
+	commands := slices.Clone(shellBuiltins)
+	for _, id := range emu.CommandIds() {
+		commands = append(commands, id.String())
+	}
+	var topics []string
+	for _, mn := range emu.MessageNames() {
+		topics = append(topics, string(mn))
+	}
+	topics = append(topics, string(emu.RawFragments))
+	attributes := emu.AttributeNames()
+	return func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		head := line[:pos]
+		start := strings.LastIndex(head, " ") + 1
+		prefix := head[start:]
+		candidates := commands
+		if start > 0 {
+			switch strings.Fields(head)[0] {
+			case "watch", "unwatch":
+				candidates = topics
+			case "raw", "history", "help", "exit":
+				return "", 0, false
+			default:
+				candidates = attributes
+			}
+		}
+		var matches []string
+		for _, c := range candidates {
+			if strings.HasPrefix(strings.ToLower(c), strings.ToLower(prefix)) {
+				matches = append(matches, c)
+			}
+		}
+		if len(matches) == 0 {
+			return "", 0, false
+		}
+		completion := commonPrefix(matches)
+		if len(matches) == 1 && start > 0 && !slices.Contains(topics, completion) {
+			completion += "="
+		} else if len(matches) == 1 {
+			completion += " "
+		}
+		if len(matches) > 1 && len(completion) <= len(prefix) {
+			// nothing more to complete, list the candidates once the line is released
+			go sh.printf("%s\n", strings.Join(matches, "  "))
+			return "", 0, false
+		}
+		return head[:start] + completion + line[pos:], start + len(completion), true
+	}
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(strings.ToLower(w), strings.ToLower(prefix)) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
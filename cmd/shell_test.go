@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// shellDevice answers the commands of a shell with rsp and records what it
+// is sent, the other methods of the interface are not used.
+type shellDevice struct {
+	emu.Emu
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	rsp    emu.Message
+	sent   []string
+}
+
+func (d *shellDevice) SendCommand(cmd emu.Command) error {
+	data, _ := json.Marshal(cmd)
+	d.sent = append(d.sent, string(data))
+	return nil
+}
+
+func (d *shellDevice) GetResponse() (emu.Message, error) {
+	return d.rsp, nil
+}
+
+func (d *shellDevice) WriteRaw(fragment string) error {
+	d.sent = append(d.sent, fragment)
+	return nil
+}
+
+func (d *shellDevice) SendRaw(ctx context.Context, name string, params map[string]string, expect ...string) ([]*emu.Fragment, error) {
+	data, _ := json.Marshal(params)
+	d.sent = append(d.sent, name+" "+string(data)+" "+strings.Join(expect, ","))
+	return []*emu.Fragment{{Element: "ScheduleInfo", Attribs: map[string]string{"Event": "demand"}}}, nil
+}
+
+func (d *shellDevice) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	return d.pubsub.Subscribe(mn), nil
+}
+
+func (d *shellDevice) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	d.pubsub.Close(mn, ch)
+}
+
+// syncBuffer is written by the printer of the shell while the test reads it.
+type syncBuffer struct {
+	lck sync.Mutex
+	sb  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	return b.sb.Write(p)
+}
+
+// take returns what was written and forgets it.
+func (b *syncBuffer) take() string {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	s := b.sb.String()
+	b.sb.Reset()
+	return s
+}
+
+func newTestShell() (*shell, *shellDevice, *syncBuffer) {
+	device := &shellDevice{pubsub: util.NewPubSub[emu.MessageName, emu.Message]()}
+	out := &syncBuffer{}
+	sh := &shell{device: device, out: &printer{format: formatText, w: out}, watches: make(map[emu.MessageName]*watcher)}
+	return sh, device, out
+}
+
+func TestShellCommand(t *testing.T) {
+	sh, device, out := newTestShell()
+	device.rsp = &emu.InstantaneousPowerDemand{Power: 1.25, MeterMacId: "0x00135003000aaaa"}
+	sh.exec("get_demand MeterMacId=0x00135003000aaaa")
+	if len(device.sent) != 1 || !strings.Contains(device.sent[0], `"Name":"get_instantaneous_demand"`) ||
+		!strings.Contains(device.sent[0], `"MeterMacId":"0x00135003000aaaa"`) {
+		t.Errorf("sent %v", device.sent)
+	}
+	if got := out.take(); !strings.HasPrefix(got, "InstantaneousPower (") || !strings.Contains(got, "Power        1.25 kW") {
+		t.Errorf("printed %q", got)
+	}
+
+	device.sent = nil
+	sh.exec("get_demand MeterMacId")
+	sh.exec("get_weather")
+	if len(device.sent) != 0 {
+		t.Errorf("sent %v", device.sent)
+	}
+	if got := out.take(); !strings.Contains(got, `invalid parameter "MeterMacId"`) || !strings.Contains(got, "unknown command get_weather") {
+		t.Errorf("printed %q", got)
+	}
+}
+
+func TestShellRaw(t *testing.T) {
+	sh, device, out := newTestShell()
+	sh.exec("raw <Command><Name>get_schedule</Name></Command>")
+	sh.exec("raw get_schedule Event=demand ScheduleInfo")
+	if len(device.sent) != 2 || device.sent[0] != "<Command><Name>get_schedule</Name></Command>" ||
+		device.sent[1] != `get_schedule {"Event":"demand"} ScheduleInfo` {
+		t.Errorf("sent %q", device.sent)
+	}
+	if got := out.take(); !strings.HasPrefix(got, "ScheduleInfo (") {
+		t.Errorf("printed %q", got)
+	}
+	sh.exec("raw")
+	if got := out.take(); !strings.HasPrefix(got, "usage: raw") {
+		t.Errorf("printed %q", got)
+	}
+}
+
+func TestShellWatch(t *testing.T) {
+	sh, device, out := newTestShell()
+	sh.exec("watch InstantaneousPower Price")
+	sh.exec("watch")
+	if got := out.take(); got != "watching: [InstantaneousPower Price]\n" {
+		t.Errorf("printed %q", got)
+	}
+	device.pubsub.Publish(emu.InstantaneousPower, &emu.InstantaneousPowerDemand{Power: 2})
+	deadline := time.Now().Add(5 * time.Second)
+	var got string
+	for !strings.Contains(got, "Power        2 kW") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got += out.take()
+	}
+	if !strings.HasPrefix(got, "InstantaneousPower [") {
+		t.Errorf("printed %q", got)
+	}
+	sh.exec("unwatch Price")
+	sh.exec("watch")
+	if got := out.take(); got != "watching: [InstantaneousPower]\n" {
+		t.Errorf("printed %q", got)
+	}
+	sh.exec("unwatch")
+	if len(sh.watches) != 0 || device.pubsub.Subscribed(func(emu.MessageName) bool { return true }) {
+		t.Error("subscriptions left after unwatch")
+	}
+}
+
+func TestShellHistory(t *testing.T) {
+	sh, _, out := newTestShell()
+	sh.history = []string{"watch Price", "history"}
+	if !sh.exec("history") {
+		t.Error("history ended the session")
+	}
+	if got := out.take(); got != "   1  watch Price\n   2  history\n" {
+		t.Errorf("printed %q", got)
+	}
+	if sh.exec("exit") || sh.exec("quit") {
+		t.Error("exit did not end the session")
+	}
+}
+
+func TestShellCompleter(t *testing.T) {
+	sh, _, _ := newTestShell()
+	complete := sh.completer()
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"get_dem", "GET_DEMAND "},
+		{"wat", "watch "},
+		{"watch InstantaneousP", "watch InstantaneousPower "},
+		{"GET_DEMAND MeterMac", "GET_DEMAND MeterMacId="},
+	} {
+		got, pos, ok := complete(tc.line, len(tc.line), '\t')
+		if !ok || got != tc.want || pos != len(tc.want) {
+			t.Errorf("completion of %q = %q, %d, %v, want %q", tc.line, got, pos, ok, tc.want)
+		}
+	}
+	if _, _, ok := complete("raw get_sch", 11, '\t'); ok {
+		t.Error("completed the name of a raw command")
+	}
+	if got := commonPrefix([]string{"GET_DEMAND", "get_device_info"}); got != "GET_DE" {
+		t.Errorf("commonPrefix = %q", got)
+	}
+}
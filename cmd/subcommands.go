@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// subcommand runs a long-lived emuctl mode against the device at port.
+// args are the command line arguments following the subcommand name.
+type subcommand func(port string, opts []emu.EmuOption, args []string) error
+
+var subcommands = map[string]subcommand{
+	"serve-metrics": serveMetrics,
+	"mqtt":          runMqtt,
+	"serve":         serve,
+	"log":           runLog,
+	"watch":         watch,
+	"events":        runEvents,
+	"clock":         runClock,
+	"network":       runNetwork,
+	"shell":         runShell,
+	"monitor":       runMonitor,
+	"daemon":        runDaemon,
+	"control":       runControl,
+	"bridge":        runBridge,
+}
+
+var subcommandList = `Available emuctl subcommands (use "emuctl <subcommand> -h" for their flags):
+	serve-metrics		- exports meter readings and client health as Prometheus metrics
+	mqtt			- publishes meter readings to an MQTT broker with Home Assistant discovery
+	serve			- serves the device over an HTTP/JSON API with a Server-Sent Events stream
+	log			- writes messages to CSV or JSON Lines files with rotation
+	watch			- raises alerts from the conditions of a rules file
+	events			- detects appliances switching on and off and reports their signatures
+	clock			- checks, sets or watches the device clock against the host clock
+	network			- shows the join state of the meter network with diagnostics, or (re)joins it
+	shell			- runs commands interactively over one open connection
+	monitor			- shows a live dashboard of the demand, today's energy and cost, price, network and utility message
+	daemon			- owns the device and runs the exporters of the configuration file, for systemd
+	control			- queries, reloads or sends a command through the daemon owning the device
+	bridge			- exposes the serial port of the device over TCP, optionally RFC 2217, for tcp:// devices`
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return util.TerminationContext(context.Background())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/rules"
+)
+
+func watch(port string, opts []emu.EmuOption, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	file := fs.String("rules", "rules.yaml", "Path of the YAML rules file")
+	fs.Parse(args)
+
+	cfg, err := rules.LoadFile(*file)
+	if err != nil {
+		return err
+	}
+	engine, err := rules.NewEngine(cfg)
+	if err != nil {
+		return err
+	}
+
+	device, err := emu.NewEmu(port, opts...)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	device.Start()
+
+	ctx, stop := signalContext()
+	defer stop()
+	info("watching %d rules from %s", len(cfg.Rules), *file)
+	return engine.Run(ctx, device)
+}
@@ -3,7 +3,12 @@ package emu
 import "time"
 
 const (
-	closingGracePeriord time.Duration = time.Second * 5
+	reconnectMinBackoff time.Duration = time.Second
+	reconnectMaxBackoff time.Duration = time.Minute
+	// the meter reports 0xFFFFFFFF when no price has been configured
+	priceNotAvailable int64 = 0xFFFFFFFF
+	// transitions kept by Emu.NetworkStatus
+	networkHistorySize = 32
 )
 
 type atrribType uint8
@@ -62,6 +67,8 @@ const (
 	emuFastPollStatus            emuMessageName = "FastPollStatus"
 	emuCurrentSummationDelivered emuMessageName = "CurrentSummationDelivered"
 	emuScheduleInfo              emuMessageName = "ScheduleInfo"
+	emuMeterList                 emuMessageName = "MeterList"
+	emuMeterInfo                 emuMessageName = "MeterInfo"
 	emuWarning                   emuMessageName = "Warning"
 	emuAck                       emuMessageName = "Ack"
 )
@@ -82,6 +89,11 @@ const (
 	emuGetPriceBlocks               emuCommandName = "get_price_blocks"
 	emuGetSchedule                  emuCommandName = "get_schedule"
 	emuGetProfileData               emuCommandName = "get_profile_data"
+	emuSetTime                      emuCommandName = "set_time"
+	emuJoinNetwork                  emuCommandName = "join_network"
+	emuGetMeterList                 emuCommandName = "get_meter_list"
+	emuGetMeterInfo                 emuCommandName = "get_meter_info"
+	emuSetMeterInfo                 emuCommandName = "set_meter_info"
 )
 
 type emuMessageAttribute string
@@ -131,6 +143,17 @@ const (
 	emuEnabled              emuMessageAttribute = "Enabled"
 	emuEvent                emuMessageAttribute = "Event"
 	emuMode                 emuMessageAttribute = "Mode"
+	emuPrice                emuMessageAttribute = "Price"
+	emuCurrency             emuMessageAttribute = "Currency"
+	emuTrailingDigits       emuMessageAttribute = "TrailingDigits"
+	emuTier                 emuMessageAttribute = "Tier"
+	emuRateLabel            emuMessageAttribute = "RateLabel"
+	emuMeterType            emuMessageAttribute = "MeterType"
+	emuNickName             emuMessageAttribute = "NickName"
+	emuAccount              emuMessageAttribute = "Account"
+	emuAuth                 emuMessageAttribute = "Auth"
+	emuHost                 emuMessageAttribute = "Host"
+	emuStatusCode           emuMessageAttribute = "StatusCode"
 )
 
 type emMessage2ApiMessage func(*messageImpl) (Message, error)
@@ -139,10 +162,17 @@ var (
 	messageProcessorMap = map[emuMessageName]emMessage2ApiMessage{
 		emuCurrentSummationDelivered: emuCurrentSummationDelivered2CumulativeEnergy,
 		emuInstantaneousDemand:       emuInstantaneousDemand2InstantaneousPower,
+		emuPriceCluster:              emuPriceCluster2Price,
+		emuMeterList:                 emuMeterList2MeterList,
+		emuMeterInfo:                 emuMeterInfo2MeterInfo,
+		emuConnectionStatus:          emuConnectionStatus2ConnectionStatus,
+		emuNetworkInfo:               emuNetworkInfo2NetworkInfo,
+		emuMessageCluster:            emuMessageCluster2UtilityMessage,
 	}
 
 	apiMessageNames = []MessageName{
-		DeviceInfo, NetworkInfo, TimeCluster, InstantaneousPower, CumulativeEnergy,
+		DeviceInfo, NetworkInfo, TimeCluster, InstantaneousPower, CumulativeEnergy, Price, ConnectionStatus,
+		MeterList, MeterInfo, NetworkTransition, UtilityMessage,
 	}
 	emuResponses = []emuMessageName{
 		emuNetworkInfo,
@@ -162,6 +192,8 @@ var (
 		emuFastPollStatus,
 		emuCurrentSummationDelivered,
 		emuScheduleInfo,
+		emuMeterList,
+		emuMeterInfo,
 		emuWarning,
 		emuAck,
 	}
@@ -171,8 +203,20 @@ var (
 		GET_DEVICE_INFO: emuGetDeviceInfo,
 		GET_TIME:        emuGetTime,
 		GET_CONN_STATUS: emuGetConnStatus,
+		GET_DEMAND:      emuGetInstantaneousDemand,
+		GET_SUMMATION:   emuGetCurrentSummationDelivered,
+		SET_TIME:        emuSetTime,
+		GET_NETWORK:     emuGetNetworkInfo,
+		JOIN_NETWORK:    emuJoinNetwork,
+		GET_METER_LIST:  emuGetMeterList,
+		GET_METER_INFO:  emuGetMeterInfo,
+		SET_METER_INFO:  emuSetMeterInfo,
+		GET_MESSAGE:     emuGetMessage,
 	}
 
+	// commands accepting a MeterMacId, see WithMeter
+	meterCommands = []CommandId{GET_TIME, GET_DEMAND, GET_SUMMATION, GET_METER_INFO, SET_METER_INFO, GET_MESSAGE}
+
 	cmdRspMap = map[emuCommandName]emuMessageName{
 		emuRestart:                      emuAck,
 		emuGetDeviceInfo:                emuDeviceInfo,
@@ -187,6 +231,11 @@ var (
 		emuGetPriceBlocks:               emuAck,
 		emuGetSchedule:                  emuAck,
 		emuGetProfileData:               emuAck,
+		emuSetTime:                      emuAck,
+		emuJoinNetwork:                  emuAck,
+		emuGetMeterList:                 emuMeterList,
+		emuGetMeterInfo:                 emuMeterInfo,
+		emuSetMeterInfo:                 emuAck,
 	}
 
 	attribTypeMap = map[emuMessageAttribute]atrribType{
@@ -204,7 +253,7 @@ var (
 		emuSuppressTrailingZero: BOOLEAN,
 		emuSummationDelivered:   UINT64,
 		emuSummationReceived:    UINT64,
-		emuChannel:              STRING,
+		emuChannel:              UINT8,
 		emuExtPanId:             STRING,
 		emuLinkStrength:         UINT8,
 		emuDescription:          STRING,
@@ -234,5 +283,16 @@ var (
 		emuEnabled:              BOOLEAN,
 		emuEvent:                STRING,
 		emuMode:                 STRING,
+		emuPrice:                UINT32,
+		emuCurrency:             UINT16,
+		emuTrailingDigits:       UINT8,
+		emuTier:                 UINT8,
+		emuRateLabel:            STRING,
+		emuMeterType:            UINT16,
+		emuNickName:             STRING,
+		emuAccount:              STRING,
+		emuAuth:                 STRING,
+		emuHost:                 STRING,
+		emuStatusCode:           UINT8,
 	}
 )
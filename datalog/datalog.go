@@ -0,0 +1,306 @@
+// Package datalog continuously writes emu messages to CSV or JSON Lines
+// files, rotating them by size or by day.
+//
+// Every row is made of columns: "time" is the time of the message in the
+// configured format, "type" its name, "data" all of its attributes as a JSON
+// object, and any other column the attribute of that name.
+package datalog
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+type Format int
+
+const (
+	CSV Format = iota + 1
+	JSONL
+)
+
+func StringToFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "csv":
+		return CSV, nil
+	case "jsonl":
+		return JSONL, nil
+	default:
+		return 0, fmt.Errorf("invalid format: %s", s)
+	}
+}
+
+// Time formats of the "time" column.
+const (
+	TimeUTC     = "utc"     // 2006-01-02 15:04:05 in UTC
+	TimeLocal   = "local"   // 2006-01-02 15:04:05 in the local time zone
+	TimeRFC3339 = "rfc3339" // RFC 3339 with the local offset
+	TimeEpoch   = "epoch"   // seconds since the unix epoch
+)
+
+type Options struct {
+	Format     Format
+	Columns    []string
+	TimeFormat string
+	MaxSize    int64 // bytes, zero disables rotation by size
+	Daily      bool
+	Compress   bool
+}
+
+type Option func(*Options)
+
+func WithFormat(f Format) Option {
+	return func(o *Options) {
+		o.Format = f
+	}
+}
+
+func WithColumns(columns ...string) Option {
+	return func(o *Options) {
+		o.Columns = columns
+	}
+}
+
+func WithTimeFormat(format string) Option {
+	return func(o *Options) {
+		o.TimeFormat = format
+	}
+}
+
+// WithRotation rotates the file when it would exceed maxSize bytes and, if
+// daily is set, when the day changes. Rotated files are gzipped when
+// compress is set.
+func WithRotation(maxSize int64, daily bool, compress bool) Option {
+	return func(o *Options) {
+		o.MaxSize = maxSize
+		o.Daily = daily
+		o.Compress = compress
+	}
+}
+
+// DefaultColumns returns the columns logged for the given messages when
+// none are configured.
+func DefaultColumns(format Format, names []emu.MessageName) []string {
+	if format == JSONL {
+		return []string{"time", "type", "data"}
+	}
+	columns := []string{"time", "type", "DeviceMacId", "MeterMacId"}
+	for _, name := range names {
+		for _, c := range valueColumns[name] {
+			if !slices.Contains(columns, c) {
+				columns = append(columns, c)
+			}
+		}
+	}
+	return columns
+}
+
+var valueColumns = map[emu.MessageName][]string{
+	emu.InstantaneousPower: {"Power"},
+	emu.CumulativeEnergy:   {"Energy", "Delivered", "Received"},
+	emu.Price:              {"Price", "Currency", "Tier", "RateLabel"},
+	emu.NetworkInfo:        {"Status", "LinkStrength"},
+	emu.ConnectionStatus:   {"Status", "LinkStrength"},
+	emu.TimeCluster:        {"UTCTime", "LocalTime"},
+	emu.DeviceInfo:         {"FWVersion", "HWVersion", "ModelId"},
+	emu.UtilityMessage:     {"Id", "Text", "Priority"},
+}
+
+// Logger writes messages as rows of a rotating file.
+type Logger struct {
+	opt  *Options
+	file *rotatingFile
+}
+
+// NewLogger opens, or appends to, the log file at path.
+func NewLogger(path string, opts ...Option) (*Logger, error) {
+	options := &Options{
+		Format:     CSV,
+		TimeFormat: TimeRFC3339,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	switch options.TimeFormat {
+	case TimeUTC, TimeLocal, TimeRFC3339, TimeEpoch:
+	default:
+		return nil, fmt.Errorf("invalid time format: %s", options.TimeFormat)
+	}
+	if len(options.Columns) == 0 {
+		options.Columns = DefaultColumns(options.Format, nil)
+	}
+	l := &Logger{opt: options}
+	var header func(io.Writer) error
+	if options.Format == CSV {
+		header = func(w io.Writer) error {
+			cw := csv.NewWriter(w)
+			cw.Write(options.Columns)
+			cw.Flush()
+			return cw.Error()
+		}
+	}
+	file, err := openRotatingFile(path, options.MaxSize, options.Daily, options.Compress, header)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Write appends msg as a row.
+func (l *Logger) Write(msg emu.Message) error {
+	row, err := l.row(msg)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	switch l.opt.Format {
+	case CSV:
+		cw := csv.NewWriter(&b)
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = csvValue(v)
+		}
+		cw.Write(record)
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	case JSONL:
+		// keys are written in column order, unlike when marshalling a map
+		b.WriteByte('{')
+		for i, c := range l.opt.Columns {
+			key, _ := json.Marshal(c)
+			value, err := json.Marshal(row[i])
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.Write(key)
+			b.WriteByte(':')
+			b.Write(value)
+		}
+		b.WriteString("}\n")
+	default:
+		return fmt.Errorf("invalid format %d", l.opt.Format)
+	}
+	// a row is written at once so that rotation never splits it
+	_, err = l.file.Write([]byte(b.String()))
+	return err
+}
+
+// Close closes the file, waiting for the compression of rotated files.
+func (l *Logger) Close() error {
+	return l.file.Close()
+}
+
+// Run writes the messages of the given names published by device until ctx
+// is done.
+func (l *Logger) Run(ctx context.Context, device emu.Emu, names []emu.MessageName) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs := make(chan emu.Message)
+	for _, name := range names {
+		ch, err := device.Subscribe(name)
+		if err != nil {
+			return err
+		}
+		defer device.Unsubscribe(name, ch)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-ch:
+					select {
+					case msgs <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-msgs:
+			if err := l.Write(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (l *Logger) row(msg emu.Message) ([]any, error) {
+	row := make([]any, len(l.opt.Columns))
+	for i, c := range l.opt.Columns {
+		switch c {
+		case "time":
+			row[i] = l.formatTime(messageTime(msg))
+		case "type":
+			row[i] = msg.GetName()
+		case "data":
+			env, err := emu.NewEnvelope(msg)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = env.Data
+		default:
+			if v, ok := msg.GetAttrib(c); ok {
+				row[i] = v
+			}
+		}
+	}
+	return row, nil
+}
+
+// messageTime returns the TimeStamp of msg or, for messages without one, the
+// time it is logged.
+func messageTime(msg emu.Message) time.Time {
+	if v, ok := msg.GetAttrib("TimeStamp"); ok {
+		if ts, ok := v.(int64); ok {
+			return time.Unix(ts, 0)
+		}
+	}
+	return time.Now()
+}
+
+func (l *Logger) formatTime(t time.Time) any {
+	switch l.opt.TimeFormat {
+	case TimeUTC:
+		return t.UTC().Format(time.DateTime)
+	case TimeLocal:
+		return t.Local().Format(time.DateTime)
+	case TimeEpoch:
+		return t.Unix()
+	default:
+		return t.Local().Format(time.RFC3339)
+	}
+}
+
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.RawMessage:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,130 @@
+package datalog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+func power(ts int64) emu.Message {
+	return &emu.InstantaneousPowerDemand{TimeStamp: ts, Power: 1.5, DeviceMacId: "0x1", MeterMacId: "0x2"}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "power.csv")
+	l, err := NewLogger(path, WithColumns("time", "type", "Power"), WithTimeFormat(TimeEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700000000))
+	l.Write(power(1700000001))
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "time,type,Power\n1700000000,InstantaneousPower,1.5\n1700000001,InstantaneousPower,1.5\n"
+	if got := readFile(t, path); got != want {
+		t.Errorf("log is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRotationBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "power.csv")
+	l, err := NewLogger(path, WithColumns("time", "Power"), WithTimeFormat(TimeEpoch), WithRotation(64, false, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := int64(0); ts < 20; ts++ {
+		l.Write(power(1700000000 + ts))
+	}
+	l.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "power.*.csv"))
+	if len(files) == 0 {
+		t.Fatal("no rotated file")
+	}
+	for _, f := range append(files, path) {
+		if got := readFile(t, f); !strings.HasPrefix(got, "time,Power\n") || len(got) > 64 {
+			t.Errorf("%s is %q", filepath.Base(f), got)
+		}
+	}
+}
+
+func TestDailyRotationName(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "power.csv")
+	l, err := NewLogger(path, WithColumns("time", "Power"), WithTimeFormat(TimeEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700000000))
+	l.Close()
+	yesterday := time.Now().AddDate(0, 0, -1)
+	if err := os.Chtimes(path, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLogger(path, WithColumns("time", "Power"), WithTimeFormat(TimeEpoch), WithRotation(0, true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700086400))
+	l.Close()
+	rotated := filepath.Join(dir, "power."+yesterday.Format("20060102")+".csv")
+	if got := readFile(t, rotated); got != "time,Power\n1700000000,1.5\n" {
+		t.Errorf("%s is %q", filepath.Base(rotated), got)
+	}
+	if got := readFile(t, path); got != "time,Power\n1700086400,1.5\n" {
+		t.Errorf("%s is %q", filepath.Base(path), got)
+	}
+}
+
+func TestColumnsChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "power.csv")
+	l, err := NewLogger(path, WithColumns("time", "Power"), WithTimeFormat(TimeEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700000000))
+	l.Close()
+
+	l, err = NewLogger(path, WithColumns("time", "Power", "MeterMacId"), WithTimeFormat(TimeEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700000001))
+	l.Close()
+	if got := readFile(t, path); got != "time,Power,MeterMacId\n1700000001,1.5,0x2\n" {
+		t.Errorf("%s is %q", filepath.Base(path), got)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "power.*.csv"))
+	if len(files) != 1 || readFile(t, files[0]) != "time,Power\n1700000000,1.5\n" {
+		t.Errorf("previous log rotated to %v", files)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "power.jsonl")
+	l, err := NewLogger(path, WithFormat(JSONL), WithColumns("time", "Power"), WithTimeFormat(TimeEpoch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(power(1700000000))
+	l.Close()
+	if got := readFile(t, path); got != `{"time":1700000000,"Power":1.5}`+"\n" {
+		t.Errorf("log is %q", got)
+	}
+}
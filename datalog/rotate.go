@@ -0,0 +1,174 @@
+package datalog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// rotatingFile is a file that is renamed aside, and optionally gzipped, once
+// it reaches maxSize bytes or the day changes. An existing file starting with
+// another header, e.g. written with other columns, is renamed aside as well.
+type rotatingFile struct {
+	path     string
+	maxSize  int64 // zero disables rotation by size
+	daily    bool
+	compress bool
+	header   func(io.Writer) error
+
+	f       *os.File
+	size    int64
+	day     string // of the rows, as time.DateOnly
+	pending sync.WaitGroup
+}
+
+func openRotatingFile(path string, maxSize int64, daily bool, compress bool, header func(io.Writer) error) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, daily: daily, compress: compress, header: header}
+	if err := r.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open(now time.Time) error {
+	if dir := filepath.Dir(r.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.day = f, info.Size(), now.Format(time.DateOnly)
+	if r.size == 0 {
+		if r.header != nil {
+			return r.header(r)
+		}
+		return nil
+	}
+	// appending to the file of a previous run
+	r.day = info.ModTime().Format(time.DateOnly)
+	if r.header != nil {
+		var header bytes.Buffer
+		if err := r.header(&header); err != nil {
+			return err
+		}
+		if !startsWith(r.path, header.Bytes()) {
+			emu.WarningLogger.Printf("%s has another header, rotating it", r.path)
+			return r.rotate(now)
+		}
+	}
+	return nil
+}
+
+// startsWith reports whether the file at path starts with prefix.
+func startsWith(path string, prefix []byte) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, len(prefix))
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false
+	}
+	return bytes.Equal(b, prefix)
+}
+
+// Write writes a complete row, rotating the file beforehand when needed.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	now := time.Now()
+	if (r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize) ||
+		(r.daily && now.Format(time.DateOnly) != r.day) {
+		if err := r.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to <name>.<time><ext>, or <name>.<day><ext>
+// when its rows are of a previous day, and opens a new one.
+func (r *rotatingFile) rotate(now time.Time) error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	stamp := now.Format("20060102-150405")
+	if r.day != now.Format(time.DateOnly) {
+		stamp = strings.ReplaceAll(r.day, "-", "")
+	}
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "." + stamp
+	rotated := base + ext
+	// never overwrite a file rotated within the same second
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = base + "-" + strconv.Itoa(i) + ext
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if r.compress {
+		r.pending.Add(1)
+		go func() {
+			defer r.pending.Done()
+			if err := gzipFile(rotated); err != nil {
+				emu.WarningLogger.Printf("unable to compress %s: %v", rotated, err)
+			}
+		}()
+	}
+	return r.open(now)
+}
+
+func (r *rotatingFile) Close() error {
+	err := r.f.Close()
+	r.pending.Wait()
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// gzipFile replaces path by path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
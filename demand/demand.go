@@ -0,0 +1,288 @@
+// Package demand tracks the peak demand of a meter the way demand tariffs
+// bill it: the highest average kW over a rolling window (15 or 30 minutes)
+// within a billing period.
+//
+// Every InstantaneousPower reading is held until the next one. On each reading
+// a Tracker publishes the rolling average, the period peak and a projection:
+// the highest average the window would reach if the current demand persisted
+// while the older readings slide out of it. An alert is published when the
+// projection crosses the threshold, so load can be shed before a new peak is
+// registered.
+package demand
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/internal/meter"
+	"github.com/kbhuyan/emu/util"
+)
+
+type Options struct {
+	Window     time.Duration
+	BillingDay int // day of the month the billing period starts
+	Limit      float64
+	Margin     float64
+	Rate       float64
+	Location   *time.Location
+}
+
+type Option func(*Options)
+
+// WithWindow sets the length of the averaging window.
+func WithWindow(d time.Duration) Option {
+	return func(o *Options) {
+		o.Window = d
+	}
+}
+
+// WithBillingDay sets the day of the month, 1 to 28, the billing periods
+// start at midnight.
+func WithBillingDay(day int) Option {
+	return func(o *Options) {
+		o.BillingDay = day
+	}
+}
+
+// WithLimit sets a demand, in kW, to stay under even when the period peak is
+// lower.
+func WithLimit(kw float64) Option {
+	return func(o *Options) {
+		o.Limit = kw
+	}
+}
+
+// WithMargin lowers the alert threshold by a fraction of it, e.g. 0.05 warns
+// when the projection is within 5% of the peak.
+func WithMargin(fraction float64) Option {
+	return func(o *Options) {
+		o.Margin = fraction
+	}
+}
+
+// WithRate sets the demand charge per kW of peak.
+func WithRate(rate float64) Option {
+	return func(o *Options) {
+		o.Rate = rate
+	}
+}
+
+// WithLocation sets the time zone of the billing periods.
+func WithLocation(loc *time.Location) Option {
+	return func(o *Options) {
+		o.Location = loc
+	}
+}
+
+// reading is a demand held from ts until the next reading.
+type reading struct {
+	ts    int64
+	power float64
+}
+
+type meterState struct {
+	readings    []reading // within the window, ordered by ts
+	periodStart int64
+	periodEnd   int64
+	peak        float64
+	peakTime    int64
+	alerting    bool
+	peaking     bool // the average is setting the peak
+}
+
+// Tracker publishes the Demand and DemandAlert messages of the readings added
+// to it. It is safe for concurrent use.
+type Tracker struct {
+	opt    *Options
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	lck    sync.Mutex
+	meters map[meter.Key]*meterState
+}
+
+func NewTracker(opts ...Option) (*Tracker, error) {
+	options := &Options{
+		Window:     15 * time.Minute,
+		BillingDay: 1,
+		Location:   time.Local,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Window < time.Minute {
+		return nil, fmt.Errorf("invalid window %s", options.Window)
+	}
+	if options.BillingDay < 1 || options.BillingDay > 28 {
+		return nil, fmt.Errorf("invalid billing day %d, it must be between 1 and 28", options.BillingDay)
+	}
+	if options.Margin < 0 || options.Margin >= 1 {
+		return nil, fmt.Errorf("invalid margin %g", options.Margin)
+	}
+	return &Tracker{
+		opt:    options,
+		pubsub: util.NewPubSub[emu.MessageName, emu.Message](),
+		meters: make(map[meter.Key]*meterState),
+	}, nil
+}
+
+// Subscribe returns a channel receiving the Demand or DemandAlert messages.
+func (t *Tracker) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	if mn != Demand && mn != DemandAlert {
+		return nil, fmt.Errorf("invalid demand MessageName %s", mn)
+	}
+	return t.pubsub.Subscribe(mn), nil
+}
+
+func (t *Tracker) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	t.pubsub.Close(mn, ch)
+}
+
+// Run tracks the demand published by device until ctx is done.
+func (t *Tracker) Run(ctx context.Context, device emu.Emu) error {
+	ch, err := device.Subscribe(emu.InstantaneousPower)
+	if err != nil {
+		return err
+	}
+	defer device.Unsubscribe(emu.InstantaneousPower, ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-ch:
+			t.Add(m)
+		}
+	}
+}
+
+// Add accounts an InstantaneousPower reading and publishes the resulting
+// Demand and alerts. Other messages are ignored.
+func (t *Tracker) Add(msg emu.Message) {
+	m, ok := msg.(*emu.InstantaneousPowerDemand)
+	if !ok {
+		return
+	}
+	key := meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}
+	t.lck.Lock()
+	ms, ok := t.meters[key]
+	if !ok {
+		ms = &meterState{}
+		t.meters[key] = ms
+	}
+	status, alerts := t.add(key, ms, reading{m.TimeStamp, m.Power})
+	t.lck.Unlock()
+	if status == nil {
+		return
+	}
+	t.pubsub.Publish(Demand, status)
+	for _, a := range alerts {
+		t.pubsub.Publish(DemandAlert, a)
+	}
+}
+
+func (t *Tracker) add(key meter.Key, ms *meterState, r reading) (*Status, []*Alert) {
+	if n := len(ms.readings); n > 0 && r.ts <= ms.readings[n-1].ts {
+		emu.WarningLogger.Printf("dropping %s demand of %d, not newer than the previous one", key.MeterMacId, r.ts)
+		return nil, nil
+	}
+	window := int64(t.opt.Window / time.Second)
+	if n := len(ms.readings); n > 0 && r.ts-ms.readings[n-1].ts > window {
+		// the demand during the gap is unknown, start over
+		ms.readings = ms.readings[:0]
+	}
+	if r.ts >= ms.periodEnd {
+		ms.periodStart, ms.periodEnd = t.period(r.ts)
+		ms.peak, ms.peakTime, ms.alerting, ms.peaking = 0, 0, false, false
+	}
+	ms.readings = append(ms.readings, r)
+	from := r.ts - window
+	// keep the last reading held at the start of the window
+	i := 0
+	for i+1 < len(ms.readings) && ms.readings[i+1].ts <= from {
+		i++
+	}
+	ms.readings = ms.readings[i:]
+	full := ms.readings[0].ts <= from
+
+	// energy of every reading within the window, in kW.s
+	segments := make([]float64, len(ms.readings)-1)
+	total := 0.0
+	for i := range segments {
+		start := max(ms.readings[i].ts, from)
+		segments[i] = ms.readings[i].power * float64(ms.readings[i+1].ts-start)
+		total += segments[i]
+	}
+	average := total / float64(window)
+	// the window average is piecewise linear as the readings slide out of
+	// it, so its highest value is reached at the end of a reading
+	projected := average
+	left := total
+	for i, e := range segments {
+		left -= e
+		slide := ms.readings[i+1].ts - from
+		projected = max(projected, (left+r.power*float64(slide))/float64(window))
+	}
+
+	var alerts []*Alert
+	alert := func(kind string, threshold float64) {
+		alerts = append(alerts, &Alert{
+			TimeStamp:   r.ts,
+			Kind:        kind,
+			Average:     meter.Round(average, 6),
+			Projected:   meter.Round(projected, 6),
+			Threshold:   meter.Round(threshold, 6),
+			Peak:        meter.Round(ms.peak, 6),
+			DeviceMacId: key.DeviceMacId,
+			MeterMacId:  key.MeterMacId,
+		})
+	}
+	threshold := max(ms.peak, t.opt.Limit) * (1 - t.opt.Margin)
+	switch {
+	case full && average > ms.peak:
+		// alert once while the average keeps raising the peak, the first
+		// peak of a period is not news
+		first := ms.peak == 0
+		ms.peak, ms.peakTime = average, r.ts
+		if !ms.peaking && !first {
+			alert(NewPeak, threshold)
+		}
+		ms.peaking = true
+	default:
+		ms.peaking = false
+	}
+	if threshold > 0 {
+		switch {
+		case !ms.alerting && projected > threshold:
+			ms.alerting = true
+			alert(PeakPredicted, threshold)
+		case ms.alerting && projected <= threshold:
+			ms.alerting = false
+			alert(PeakAverted, threshold)
+		}
+	}
+
+	return &Status{
+		TimeStamp:   r.ts,
+		Window:      window,
+		Average:     meter.Round(average, 6),
+		Full:        full,
+		Projected:   meter.Round(projected, 6),
+		Peak:        meter.Round(ms.peak, 6),
+		PeakTime:    ms.peakTime,
+		PeriodStart: ms.periodStart,
+		Charge:      meter.Round(ms.peak*t.opt.Rate, 6),
+		DeviceMacId: key.DeviceMacId,
+		MeterMacId:  key.MeterMacId,
+	}, alerts
+}
+
+// period returns the billing period of ts.
+func (t *Tracker) period(ts int64) (int64, int64) {
+	now := time.Unix(ts, 0).In(t.opt.Location)
+	start := time.Date(now.Year(), now.Month(), t.opt.BillingDay, 0, 0, 0, 0, t.opt.Location)
+	if start.After(now) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start.Unix(), start.AddDate(0, 1, 0).Unix()
+}
@@ -0,0 +1,192 @@
+package demand
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/internal/meter"
+)
+
+var key = meter.Key{DeviceMacId: "0xd8d5b9000000abcd", MeterMacId: "0x00135003007c3d11"}
+
+// feed adds a reading of kw every minute from ts for n minutes and returns
+// the last status and every alert.
+func feed(t *testing.T, tr *Tracker, ms *meterState, ts int64, n int, kw float64) (*Status, []*Alert) {
+	t.Helper()
+	var (
+		last   *Status
+		alerts []*Alert
+	)
+	for i := range n {
+		status, a := tr.add(key, ms, reading{ts + int64(i)*60, kw})
+		if status == nil {
+			t.Fatalf("reading at %d dropped", ts+int64(i)*60)
+		}
+		last = status
+		alerts = append(alerts, a...)
+	}
+	return last, alerts
+}
+
+func kinds(alerts []*Alert) []string {
+	var out []string
+	for _, a := range alerts {
+		out = append(out, a.Kind)
+	}
+	return out
+}
+
+func TestWindow(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC), WithRate(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &meterState{}
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	status, _ := feed(t, tr, ms, base, 15, 2)
+	if status.Full || status.Average != 1.866667 {
+		t.Errorf("after 14 min: full %v, average %g, want a partial 28/15 kW", status.Full, status.Average)
+	}
+	// the reading at 15 min completes the window of the readings held
+	status, _ = feed(t, tr, ms, base+15*60, 1, 4)
+	if !status.Full || status.Average != 2 || status.Peak != 2 || status.Charge != 20 {
+		t.Errorf("full window: %+v", status)
+	}
+	// 4 kW persisting would replace the whole window
+	if status.Projected != 4 {
+		t.Errorf("projected %g, want 4", status.Projected)
+	}
+	status, _ = feed(t, tr, ms, base+16*60, 1, 4)
+	if status.Average != 2.133333 || status.Peak != 2.133333 || status.PeakTime != base+16*60 {
+		t.Errorf("one minute of 4 kW: %+v", status)
+	}
+	if want := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix(); status.PeriodStart != want {
+		t.Errorf("period start %d, want %d", status.PeriodStart, want)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &meterState{}
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	// the first peak of the period is not news
+	status, alerts := feed(t, tr, ms, base, 20, 2)
+	if status.Peak != 2 || len(alerts) != 0 {
+		t.Fatalf("steady demand: peak %g, alerts %v", status.Peak, kinds(alerts))
+	}
+	// above the peak once the window is replaced
+	_, alerts = feed(t, tr, ms, base+20*60, 1, 2.5)
+	if got := kinds(alerts); len(got) != 1 || got[0] != PeakPredicted || alerts[0].Threshold != 2 || alerts[0].Projected != 2.5 {
+		t.Fatalf("alerts %+v, want PeakPredicted", alerts)
+	}
+	// a single NewPeak while the average keeps rising
+	status, alerts = feed(t, tr, ms, base+21*60, 10, 2.5)
+	if got := kinds(alerts); len(got) != 1 || got[0] != NewPeak {
+		t.Errorf("alerts %v, want one NewPeak", got)
+	}
+	if status.Peak <= 2 {
+		t.Errorf("peak %g not raised", status.Peak)
+	}
+	// the last minute of 2.5 kW still raises the peak
+	_, alerts = feed(t, tr, ms, base+31*60, 2, 0.5)
+	if got := kinds(alerts); len(got) != 1 || got[0] != PeakAverted {
+		t.Errorf("alerts %v, want PeakAverted once the demand drops", got)
+	}
+}
+
+func TestMargin(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC), WithMargin(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &meterState{}
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	feed(t, tr, ms, base, 16, 2)
+	// within 10% of the peak
+	_, alerts := feed(t, tr, ms, base+16*60, 1, 1.9)
+	if got := kinds(alerts); len(got) != 1 || got[0] != PeakPredicted || alerts[0].Threshold != 1.8 {
+		t.Errorf("alerts %+v, want PeakPredicted above 1.8 kW", alerts)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC), WithLimit(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &meterState{}
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+	// no peak yet, the limit alone sets the threshold
+	_, alerts := feed(t, tr, ms, base, 2, 3.5)
+	if got := kinds(alerts); len(got) != 1 || got[0] != PeakPredicted || alerts[0].Threshold != 3 {
+		t.Errorf("alerts %+v, want PeakPredicted above the limit", alerts)
+	}
+}
+
+func TestGapAndPeriod(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC), WithBillingDay(15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &meterState{}
+	base := time.Date(2024, 3, 14, 23, 0, 0, 0, time.UTC).Unix()
+	status, _ := feed(t, tr, ms, base, 20, 2)
+	if status.Peak != 2 || status.PeriodStart != time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Fatalf("before the billing day: %+v", status)
+	}
+	if s, _ := tr.add(key, ms, reading{base + 19*60, 3}); s != nil {
+		t.Error("reading not newer than the previous one accepted")
+	}
+	// the demand during a gap longer than the window is unknown
+	status, _ = feed(t, tr, ms, base+80*60, 1, 2)
+	if status.Full || status.Average != 0 {
+		t.Errorf("after a gap: %+v", status)
+	}
+	// a new period starts over on the billing day
+	if status.Peak != 0 || status.PeriodStart != time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("new period: %+v", status)
+	}
+}
+
+// The Demand messages are published by meter.
+func TestAdd(t *testing.T) {
+	tr, err := NewTracker(WithLocation(time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := tr.Subscribe(Demand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Unsubscribe(Demand, ch)
+	if _, err := tr.Subscribe(emu.InstantaneousPower); err == nil {
+		t.Error("subscribed to a reading")
+	}
+	done := make(chan []*Status)
+	go func() {
+		var out []*Status
+		for range 2 {
+			out = append(out, (<-ch).(*Status))
+		}
+		done <- out
+	}()
+	tr.Add(&emu.InstantaneousPowerDemand{TimeStamp: 1700000000, Power: 1, MeterMacId: "0xa"})
+	tr.Add(&emu.CurrentPrice{TimeStamp: 1700000000})
+	tr.Add(&emu.InstantaneousPowerDemand{TimeStamp: 1700000000, Power: 1, MeterMacId: "0xb"})
+	out := <-done
+	if out[0].MeterMacId != "0xa" || out[1].MeterMacId != "0xb" {
+		t.Errorf("statuses of %s and %s, want one per meter", out[0].MeterMacId, out[1].MeterMacId)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{WithWindow(time.Second), WithBillingDay(0), WithBillingDay(29), WithMargin(1), WithMargin(-0.1)} {
+		if _, err := NewTracker(opt); err == nil {
+			t.Errorf("NewTracker(%+v) succeeded", opt)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package demand
+
+import "github.com/kbhuyan/emu"
+
+// Names of the messages published by a Tracker.
+const (
+	Demand      emu.MessageName = "Demand"
+	DemandAlert emu.MessageName = "DemandAlert"
+)
+
+// Kinds of alerts.
+const (
+	PeakPredicted = "PeakPredicted" // the projected average exceeds the threshold
+	PeakAverted   = "PeakAverted"   // the projected average is back under the threshold
+	NewPeak       = "NewPeak"       // the rolling average set a new peak for the period
+)
+
+func init() {
+	emu.RegisterMessage(Demand, func() emu.Message { return &Status{} })
+	emu.RegisterMessage(DemandAlert, func() emu.Message { return &Alert{} })
+}
+
+// Status is the demand of a meter, published on every InstantaneousPower
+// reading.
+type Status struct {
+	TimeStamp   int64   `json:"TimeStamp"` //Unix time
+	Window      int64   `json:"Window"`    //Unit is second
+	Average     float64 `json:"Average"`   //Unit is kW, over the last Window
+	Full        bool    `json:"Full"`      //Average covers a whole Window
+	Projected   float64 `json:"Projected"` //Unit is kW, highest average if the current demand persists
+	Peak        float64 `json:"Peak"`      //Unit is kW, highest full Average of the billing period
+	PeakTime    int64   `json:"PeakTime"`
+	PeriodStart int64   `json:"PeriodStart"`
+	Charge      float64 `json:"Charge"` //Peak times the demand rate
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Status) GetName() string {
+	return string(Demand)
+}
+
+func (m *Status) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Window":
+		return m.Window, true
+	case "Average":
+		return m.Average, true
+	case "Full":
+		return m.Full, true
+	case "Projected":
+		return m.Projected, true
+	case "Peak":
+		return m.Peak, true
+	case "PeakTime":
+		return m.PeakTime, true
+	case "PeriodStart":
+		return m.PeriodStart, true
+	case "Charge":
+		return m.Charge, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// Alert is published when the demand of a meter crosses its threshold, the
+// highest of the period peak and the configured limit.
+type Alert struct {
+	TimeStamp   int64   `json:"TimeStamp"` //Unix time
+	Kind        string  `json:"Kind"`
+	Average     float64 `json:"Average"`   //Unit is kW
+	Projected   float64 `json:"Projected"` //Unit is kW
+	Threshold   float64 `json:"Threshold"` //Unit is kW
+	Peak        float64 `json:"Peak"`      //Unit is kW
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Alert) GetName() string {
+	return string(DemandAlert)
+}
+
+func (m *Alert) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Kind":
+		return m.Kind, true
+	case "Average":
+		return m.Average, true
+	case "Projected":
+		return m.Projected, true
+	case "Threshold":
+		return m.Threshold, true
+	case "Peak":
+		return m.Peak, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
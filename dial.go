@@ -0,0 +1,343 @@
+package emu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu/util"
+)
+
+// socketEmu is the Emu of a device shared through the socket of a
+// SocketServer. It reconnects when the server goes away, e.g. while the
+// process owning the device reloads, and subscribes again.
+type socketEmu struct {
+	path   string
+	opt    *EmuOptions
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	connLck   sync.Mutex // serializes the writes
+	conn      net.Conn
+	closeOnce sync.Once
+
+	lck        sync.Mutex
+	lastId     uint64
+	pending    map[uint64]chan *socketResponse
+	response   chan *socketResponse // of the last SendCommand
+	responseId uint64
+	subs       map[uint64]socketSubscription
+	subIds     map[<-chan Message]uint64
+	pubsub     *util.PubSub[uint64, Message]
+}
+
+type socketSubscription struct {
+	topic MessageName
+	meter string
+}
+
+// Dial connects to the SocketServer listening on addr, e.g.
+// "unix:///run/emu.sock", and returns its device. NewEmu dials the unix://
+// addresses as well. History is not shared and is always nil, Start is not
+// needed but harmless.
+func Dial(addr string, opts ...EmuOption) (Emu, error) {
+	if _, ok := socketPath(addr); !ok {
+		return nil, fmt.Errorf("invalid socket address %q, expecting %s<path>", addr, socketScheme)
+	}
+	return NewEmu(addr, opts...)
+}
+
+func dialSocket(addr string, opt *EmuOptions) (Emu, error) {
+	initSessionLog(opt)
+	path, _ := socketPath(addr)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, ErrDeviceIO.Errorf("socket dial failed: %+v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &socketEmu{
+		path:    path,
+		opt:     opt,
+		ctx:     ctx,
+		cancel:  cancel,
+		conn:    conn,
+		pending: make(map[uint64]chan *socketResponse),
+		subs:    make(map[uint64]socketSubscription),
+		subIds:  make(map[<-chan Message]uint64),
+		pubsub:  util.NewPubSub[uint64, Message](),
+	}
+	sessionOpened()
+	go e.reader(conn)
+	return e, nil
+}
+
+func (e *socketEmu) Start() {}
+
+// send writes the request and returns the channel of its response.
+func (e *socketEmu) send(req *socketRequest) (chan *socketResponse, error) {
+	ch := make(chan *socketResponse, 1)
+	e.lck.Lock()
+	e.lastId++
+	req.Id = e.lastId
+	e.pending[req.Id] = ch
+	e.lck.Unlock()
+	line, err := json.Marshal(req)
+	if err == nil {
+		e.connLck.Lock()
+		e.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		_, err = e.conn.Write(append(line, '\n'))
+		e.connLck.Unlock()
+	}
+	if err != nil {
+		e.lck.Lock()
+		delete(e.pending, req.Id)
+		e.lck.Unlock()
+		return nil, ErrDeviceWrite.Errorf("error while writing to socket %+v", err)
+	}
+	return ch, nil
+}
+
+// wait returns the response of a request sent by send.
+func (e *socketEmu) wait(id uint64, ch chan *socketResponse) (*socketResponse, error) {
+	defer func() {
+		e.lck.Lock()
+		delete(e.pending, id)
+		e.lck.Unlock()
+	}()
+	select {
+	case rsp := <-ch:
+		return rsp, rsp.err()
+	case <-time.After(e.opt.TimeOut):
+		return nil, ErrTimeOut
+	case <-e.ctx.Done():
+		return nil, ErrChannelClosed.Errorf("channel closed %+v", e.ctx.Err())
+	}
+}
+
+// call sends the request and waits for its response.
+func (e *socketEmu) call(req *socketRequest) (*socketResponse, error) {
+	ch, err := e.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return e.wait(req.Id, ch)
+}
+
+func (e *socketEmu) SendCommand(c Command) error {
+	cmd, ok := c.(*commandImpl)
+	if !ok {
+		return fmt.Errorf("invalid command type %T or %+v", c, c)
+	}
+	req := &socketRequest{Op: "command", Command: cmd.Id.String(), Params: make(map[string]string)}
+	for key, value := range cmd.Attribs {
+		req.Params[key] = attribText(value)
+	}
+	ch, err := e.send(req)
+	if err != nil {
+		return err
+	}
+	e.lck.Lock()
+	// the response of an earlier command is not waited for anymore
+	delete(e.pending, e.responseId)
+	e.response, e.responseId = ch, req.Id
+	e.lck.Unlock()
+	return nil
+}
+
+func (e *socketEmu) GetResponse() (Message, error) {
+	e.lck.Lock()
+	ch, id := e.response, e.responseId
+	e.response, e.responseId = nil, 0
+	e.lck.Unlock()
+	// without a command, times out as the device does
+	rsp, err := e.wait(id, ch)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Message == nil {
+		return nil, ErrMsgProc.Errorf("response without message")
+	}
+	return rsp.Message.Message()
+}
+
+func (e *socketEmu) WriteRaw(fragment string) error {
+	_, err := e.call(&socketRequest{Op: "raw", Fragment: fragment})
+	return err
+}
+
+func (e *socketEmu) SendRaw(ctx context.Context, name string, params map[string]string, expect ...string) ([]*Fragment, error) {
+	return sendRaw(ctx, e, e.opt.TimeOut, name, params, expect)
+}
+
+func (e *socketEmu) Subscribe(mn MessageName) (chan Message, error) {
+	return e.SubscribeMeter(mn)
+}
+
+func (e *socketEmu) SubscribeMeter(mn MessageName, opts ...MeterOption) (chan Message, error) {
+	s := socketSubscription{topic: mn, meter: newMeterOptions(opts).MeterMacId}
+	e.lck.Lock()
+	e.lastId++
+	sub := e.lastId
+	e.lck.Unlock()
+	if _, err := e.call(&socketRequest{Op: "subscribe", Sub: sub, Topic: s.topic, Meter: s.meter}); err != nil {
+		return nil, err
+	}
+	ch := e.pubsub.Subscribe(sub)
+	e.lck.Lock()
+	e.subs[sub] = s
+	e.subIds[ch] = sub
+	e.lck.Unlock()
+	return ch, nil
+}
+
+func (e *socketEmu) Unsubscribe(mn MessageName, ch <-chan Message) {
+	e.lck.Lock()
+	sub, ok := e.subIds[ch]
+	delete(e.subIds, ch)
+	delete(e.subs, sub)
+	e.lck.Unlock()
+	if !ok {
+		return
+	}
+	e.pubsub.Close(sub, ch)
+	if _, err := e.call(&socketRequest{Op: "unsubscribe", Sub: sub}); err != nil {
+		WarningLogger.Printf("unsubscribe %s failed: %v", mn, err)
+	}
+}
+
+func (e *socketEmu) History() *History {
+	return nil
+}
+
+func (e *socketEmu) NetworkStatus() NetworkStatus {
+	rsp, err := e.call(&socketRequest{Op: "network"})
+	if err != nil || rsp.Network == nil {
+		WarningLogger.Printf("network status unavailable: %v", err)
+		return NetworkStatus{State: StateUnknown}
+	}
+	return rsp.Network.status()
+}
+
+func (e *socketEmu) Meters() []Meter {
+	rsp, err := e.call(&socketRequest{Op: "meters"})
+	if err != nil {
+		WarningLogger.Printf("meters unavailable: %v", err)
+		return nil
+	}
+	return rsp.Meters
+}
+
+func (e *socketEmu) Close() {
+	InfoLogger.Println("closing the emu session.")
+	e.cancel()
+	e.connLck.Lock()
+	defer e.connLck.Unlock()
+	e.conn.Close()
+	e.closeOnce.Do(sessionClosed)
+}
+
+// reader dispatches the responses and the messages of the subscriptions
+// until the session is closed, reconnecting when the connection is lost.
+func (e *socketEmu) reader(conn net.Conn) {
+	for {
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(nil, socketMaxRequest)
+		for scanner.Scan() {
+			var rsp socketResponse
+			if err := json.Unmarshal(scanner.Bytes(), &rsp); err != nil {
+				WarningLogger.Printf("invalid socket response: %v", err)
+				continue
+			}
+			e.dispatch(&rsp)
+		}
+		if e.ctx.Err() != nil {
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			WarningLogger.Printf("socket %s lost: %v", e.path, err)
+		} else {
+			WarningLogger.Printf("socket %s closed by the server", e.path)
+		}
+		e.failPending()
+		if conn = e.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+func (e *socketEmu) dispatch(rsp *socketResponse) {
+	if rsp.Id == 0 {
+		if rsp.Message == nil {
+			return
+		}
+		m, err := rsp.Message.Message()
+		if err != nil {
+			WarningLogger.Printf("unable to decode %s: %v", rsp.Message.Type, err)
+			return
+		}
+		e.opt.Metrics.MessageReceived(m.GetName())
+		e.pubsub.Publish(rsp.Sub, m)
+		return
+	}
+	e.lck.Lock()
+	ch, ok := e.pending[rsp.Id]
+	delete(e.pending, rsp.Id)
+	e.lck.Unlock()
+	if ok {
+		ch <- rsp
+	}
+}
+
+// failPending answers the requests waiting for a response of the lost
+// connection.
+func (e *socketEmu) failPending() {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	for id, ch := range e.pending {
+		ch <- &socketResponse{Id: id, Error: ErrChannelClosed.Error()}
+		delete(e.pending, id)
+	}
+}
+
+// reconnect keeps dialing the socket, backing off between attempts, until it
+// succeeds or the session is closed, then subscribes again.
+func (e *socketEmu) reconnect() net.Conn {
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		conn, err := net.Dial("unix", e.path)
+		if err == nil {
+			e.connLck.Lock()
+			e.conn = conn
+			e.connLck.Unlock()
+			InfoLogger.Println("socket reconnected.")
+			e.opt.Metrics.Reconnected()
+			go e.resubscribe()
+			return conn
+		}
+		WarningLogger.Printf("reconnect failed, retrying in %s: %v", backoff, err)
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+func (e *socketEmu) resubscribe() {
+	e.lck.Lock()
+	subs := make(map[uint64]socketSubscription, len(e.subs))
+	for sub, s := range e.subs {
+		subs[sub] = s
+	}
+	e.lck.Unlock()
+	for sub, s := range subs {
+		if _, err := e.call(&socketRequest{Op: "subscribe", Sub: sub, Topic: s.topic, Meter: s.meter}); err != nil {
+			WarningLogger.Printf("subscribe %s again failed: %v", s.topic, err)
+		}
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bufio"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kbhuyan/emu/util"
@@ -61,23 +65,64 @@ func (m *commandImpl) GetAttrib(key string) (any, bool) {
 	return value, ok
 }
 
+// xml renders the command with its attributes, in name order, as the
+// <Command> fragment understood by the device.
+func (m *commandImpl) xml() string {
+	var sb strings.Builder
+	sb.WriteString("<Command><Name>" + string(m.Name) + "</Name>")
+	for _, key := range slices.Sorted(maps.Keys(m.Attribs)) {
+		sb.WriteString("<" + key + ">")
+		xml.EscapeText(&sb, []byte(attribText(m.Attribs[key])))
+		sb.WriteString("</" + key + ">")
+	}
+	sb.WriteString("</Command>")
+	return sb.String()
+}
+
+// attribText renders the value of a command attribute as sent to the device.
+func attribText(v any) string {
+	if b, ok := v.(bool); ok {
+		// the device spells booleans Y and N
+		return map[bool]string{true: "Y", false: "N"}[b]
+	}
+	return fmt.Sprint(v)
+}
+
 type emuImpl struct {
 	conn      io.ReadWriteCloser
+	connLck   sync.Mutex
+	open      func() (io.ReadWriteCloser, error)
 	responses chan Message
 	ctx       context.Context
 	cancel    context.CancelFunc
-	cmdState  *commandState
+	cmdState  *commandState // guarded by stateLck, as the reader sends and completes it
+	stateLck  sync.Mutex
+	cmdLck    sync.Mutex     // no command is sent while SendRaw waits for its fragments
+	wg        sync.WaitGroup // the reader
+	closeOnce sync.Once
 	opt       *EmuOptions
 	//	subscriptions map[MessageName]map[*func(Message)]bool
 	//	lck           sync.RWMutex
-	pubsub *util.PubSub[MessageName, Message]
+	pubsub  *util.PubSub[subscription, Message]
+	history *History
+
+	lck      sync.Mutex
+	meterSub map[<-chan Message]string // MeterMacId filtering the subscriptions
+	meters   []Meter
+	network  NetworkStatus
 }
 
-func newEmuImpl(dev string, opt *EmuOptions) (Emu, error) {
-	initLog(opt.LogWriter, opt.LogLevel)
+// subscription is a topic of the pubsub: the messages of a name, of any
+// meter when meter is empty.
+type subscription struct {
+	name  MessageName
+	meter string
+}
+
+func openSerial(dev string, baudRate int) (io.ReadWriteCloser, error) {
 	// Configure serial port
 	mode := &serial.Mode{
-		BaudRate: opt.BaudRate,
+		BaudRate: baudRate,
 		DataBits: 8,
 		Parity:   serial.NoParity,
 		StopBits: serial.OneStopBit,
@@ -86,38 +131,181 @@ func newEmuImpl(dev string, opt *EmuOptions) (Emu, error) {
 	if err != nil {
 		return nil, ErrDeviceIO.Errorf("serial open failed: %+v", err)
 	}
+	return port, nil
+}
+
+// schemes of the devices exposed over TCP, e.g. by emuctl bridge
+const (
+	tcpScheme     = "tcp://"
+	rfc2217Scheme = "rfc2217://"
+)
+
+// openNetwork connects to a device exposed over TCP at a tcp:// address, or
+// at a rfc2217:// address negotiating the baud rate with the server.
+func openNetwork(dev string, opt *EmuOptions) (io.ReadWriteCloser, bool, error) {
+	addr, ok := strings.CutPrefix(dev, tcpScheme)
+	rfc2217 := false
+	if !ok {
+		if addr, ok = strings.CutPrefix(dev, rfc2217Scheme); !ok {
+			return nil, false, nil
+		}
+		rfc2217 = true
+	}
+	dialer := &net.Dialer{
+		Timeout:   opt.TimeOut,
+		KeepAlive: opt.KeepAlive, // negative disables the probes
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   opt.KeepAlive >= 0,
+			Idle:     opt.KeepAlive,
+			Interval: opt.KeepAlive / 3,
+			Count:    3,
+		},
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, true, ErrDeviceIO.Errorf("tcp dial failed: %+v", err)
+	}
+	if !rfc2217 {
+		return conn, true, nil
+	}
+	rc, err := util.NewRfc2217Client(conn, opt.BaudRate)
+	if err != nil {
+		conn.Close()
+		return nil, true, ErrDeviceIO.Errorf("rfc2217 negotiation failed: %+v", err)
+	}
+	return rc, true, nil
+}
+
+func newEmuImpl(dev string, opt *EmuOptions) (Emu, error) {
+	initSessionLog(opt)
+	open := func() (io.ReadWriteCloser, error) {
+		if conn, ok, err := openNetwork(dev, opt); ok {
+			return conn, err
+		}
+		return openSerial(dev, opt.BaudRate)
+	}
+	port, err := open()
+	if err != nil {
+		return nil, err
+	}
+	var hist *History
+	if opt.HistoryDir != "" {
+		if hist, err = openHistory(opt.HistoryDir, opt.HistoryOptions); err != nil {
+			port.Close()
+			return nil, err
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	pubsub := util.NewPubSub[MessageName, Message]()
+	pubsub := util.NewPubSub[subscription, Message]()
 
+	sessionOpened()
 	return &emuImpl{
 		conn:      port,
+		open:      open,
 		responses: make(chan Message, 1),
 		ctx:       ctx,
 		cancel:    cancel,
 		cmdState:  nil,
 		opt:       opt,
 		//		subscriptions: make(map[MessageName]map[*func(Message)]bool),
-		pubsub: pubsub,
+		pubsub:   pubsub,
+		history:  hist,
+		meterSub: make(map[<-chan Message]string),
+		network:  NetworkStatus{State: StateUnknown},
 	}, nil
 }
 
 func (e *emuImpl) Start() {
-	go e.reader()
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.reader()
+	}()
 }
 
 func (e *emuImpl) SendCommand(c Command) error {
+	e.cmdLck.Lock()
+	defer e.cmdLck.Unlock()
 	if rspName, ok := CommandResponseMap[c.CommandId()]; ok {
 		if _, ok := c.(*commandImpl); ok {
+			// drop a response that arrived after an earlier GetResponse timed out
+			select {
+			case <-e.responses:
+			default:
+			}
 			time.Sleep(100 * time.Millisecond)
-			e.cmdState = &commandState{command: c, status: CmdPending, rspName: rspName}
+			meter, _ := c.(*commandImpl).GetAttrib(string(emuMeterMacId))
+			cs := &commandState{command: c, status: CmdPending, rspName: rspName}
+			if meter != nil {
+				cs.meter = fmt.Sprint(meter)
+			}
+			e.stateLck.Lock()
+			e.cmdState = cs
+			e.stateLck.Unlock()
 			return nil
 		}
 	}
 	return fmt.Errorf("invalid command type %T or %+v", c, c)
 }
 
+func (e *emuImpl) WriteRaw(fragment string) error {
+	if err := xml.Unmarshal([]byte(fragment), new(struct{})); err != nil {
+		return fmt.Errorf("invalid xml fragment: %w", err)
+	}
+	DebugLogger.Printf("writing raw fragment: %s", fragment)
+	e.connLck.Lock()
+	defer e.connLck.Unlock()
+	if _, err := e.conn.Write([]byte(fragment)); err != nil {
+		return ErrDeviceWrite.Errorf("error while writing to devive %+v", err)
+	}
+	return nil
+}
+
+func (e *emuImpl) SendRaw(ctx context.Context, name string, params map[string]string, expect ...string) ([]*Fragment, error) {
+	e.cmdLck.Lock()
+	defer e.cmdLck.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, e.opt.TimeOut)
+	defer cancel()
+	// the response of the pending command could be taken for a fragment of the
+	// raw command, and the other way around
+	if err := e.awaitCommand(ctx); err != nil {
+		return nil, err
+	}
+	return sendRaw(ctx, e, e.opt.TimeOut, name, params, expect)
+}
+
+// awaitCommand waits until the last command is answered or timed out.
+func (e *emuImpl) awaitCommand(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		e.stateLck.Lock()
+		cs := e.cmdState
+		done := cs == nil || cs.status == CmdError ||
+			cs.status == CmdSent && time.Since(cs.sentAt) >= e.opt.TimeOut
+		e.stateLck.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrTimeOut
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// rawSubscribed reports whether the fragments read are subscribed to, from any
+// meter.
+func (e *emuImpl) rawSubscribed() bool {
+	return e.pubsub.Subscribed(func(s subscription) bool { return s.name == RawFragments })
+}
+
 func (e *emuImpl) GetResponse() (Message, error) {
 	select {
 	case resp := <-e.responses:
@@ -137,6 +325,30 @@ func emuInstantaneousDemand2InstantaneousPower(m *messageImpl) (Message, error)
 	return GetInstantaneousPowerConsumption(m)
 }
 
+func emuPriceCluster2Price(m *messageImpl) (Message, error) {
+	return GetCurrentPrice(m)
+}
+
+func emuConnectionStatus2ConnectionStatus(m *messageImpl) (Message, error) {
+	return GetNetwork(m)
+}
+
+func emuNetworkInfo2NetworkInfo(m *messageImpl) (Message, error) {
+	return GetNetwork(m)
+}
+
+func emuMeterList2MeterList(m *messageImpl) (Message, error) {
+	return GetJoinedMeters(m)
+}
+
+func emuMeterInfo2MeterInfo(m *messageImpl) (Message, error) {
+	return GetMeter(m)
+}
+
+func emuMessageCluster2UtilityMessage(m *messageImpl) (Message, error) {
+	return GetNotice(m)
+}
+
 func convertApiMessage(m *messageImpl) (Message, error) {
 	if processor, ok := messageProcessorMap[m.Name]; ok {
 		return processor(m)
@@ -149,15 +361,89 @@ func convertApiMessage(m *messageImpl) (Message, error) {
 }
 
 func (e *emuImpl) Subscribe(mn MessageName) (chan Message, error) {
-	if slices.Contains(apiMessageNames, mn) {
-		return e.pubsub.Subscribe(mn), nil
+	return e.SubscribeMeter(mn)
+}
+
+func (e *emuImpl) SubscribeMeter(mn MessageName, opts ...MeterOption) (chan Message, error) {
+	if slices.Contains(apiMessageNames, mn) || mn == RawFragments {
+		meter := strings.ToLower(newMeterOptions(opts).MeterMacId)
+		ch := e.pubsub.Subscribe(subscription{name: mn, meter: meter})
+		if meter != "" {
+			e.lck.Lock()
+			e.meterSub[ch] = meter
+			e.lck.Unlock()
+		}
+		return ch, nil
 	} else {
 		return nil, fmt.Errorf("invalid API MessageName %s", mn)
 	}
 }
 
 func (e *emuImpl) Unsubscribe(mn MessageName, ch <-chan Message) {
-	e.pubsub.Close(mn, ch)
+	e.lck.Lock()
+	meter := e.meterSub[ch]
+	delete(e.meterSub, ch)
+	e.lck.Unlock()
+	e.pubsub.Close(subscription{name: mn, meter: meter}, ch)
+}
+
+// publish sends m to the subscriptions of its name, and of its name and
+// meter when it carries a MeterMacId, giving up on the subscribers not
+// reading once the session is closed.
+func (e *emuImpl) publish(m Message) {
+	mn := MessageName(m.GetName())
+	e.pubsub.PublishContext(e.ctx, subscription{name: mn}, m)
+	if mac, ok := m.GetAttrib(string(emuMeterMacId)); ok {
+		if s, ok := mac.(string); ok && s != "" {
+			e.pubsub.PublishContext(e.ctx, subscription{name: mn, meter: strings.ToLower(s)}, m)
+		}
+	}
+}
+
+func (e *emuImpl) Meters() []Meter {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	return slices.Clone(e.meters)
+}
+
+// learnMeters updates the meters from m: MeterList is authoritative, MeterInfo
+// completes a meter and any other MeterMacId adds a meter not seen yet.
+func (e *emuImpl) learnMeters(m Message) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	find := func(mac string) int {
+		return slices.IndexFunc(e.meters, func(mt Meter) bool {
+			return strings.EqualFold(mt.MeterMacId, mac)
+		})
+	}
+	switch m := m.(type) {
+	case *JoinedMeters:
+		meters := make([]Meter, 0, len(m.MeterMacIds))
+		for _, mac := range m.MeterMacIds {
+			mt := Meter{DeviceMacId: m.DeviceMacId, MeterMacId: mac}
+			if i := find(mac); i >= 0 {
+				mt = e.meters[i]
+			}
+			meters = append(meters, mt)
+		}
+		e.meters = meters
+	case *Meter:
+		if i := find(m.MeterMacId); i >= 0 {
+			e.meters[i] = *m
+		} else {
+			e.meters = append(e.meters, *m)
+		}
+	default:
+		mac, _ := m.GetAttrib(string(emuMeterMacId))
+		s, ok := mac.(string)
+		if !ok || s == "" || find(s) >= 0 {
+			return
+		}
+		dev, _ := m.GetAttrib(string(emuDeviceMacId))
+		mt := Meter{MeterMacId: s}
+		mt.DeviceMacId, _ = dev.(string)
+		e.meters = append(e.meters, mt)
+	}
 }
 
 // func (e *emuImpl) Subscribe(names []MessageName, handler *func(Message)) error {
@@ -195,8 +481,48 @@ func (e *emuImpl) Unsubscribe(mn MessageName, ch <-chan Message) {
 func (e *emuImpl) Close() {
 	InfoLogger.Println("closing the emu session.")
 	e.cancel()
-	time.Sleep(closingGracePeriord)
+	e.connLck.Lock()
 	e.conn.Close()
+	e.connLck.Unlock()
+	// the reader may still be recording a message
+	e.wg.Wait()
+	e.closeOnce.Do(sessionClosed)
+	if e.history != nil {
+		if err := e.history.close(); err != nil {
+			WarningLogger.Printf("closing history failed: %v", err)
+		}
+	}
+}
+
+func (e *emuImpl) History() *History {
+	return e.history
+}
+
+// reconnect closes the current connection and keeps reopening the device,
+// backing off between attempts, until it succeeds or the session is closed.
+func (e *emuImpl) reconnect() bool {
+	backoff := reconnectMinBackoff
+	e.connLck.Lock()
+	e.conn.Close()
+	e.connLck.Unlock()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		conn, err := e.open()
+		if err == nil {
+			e.connLck.Lock()
+			e.conn = conn
+			e.connLck.Unlock()
+			InfoLogger.Println("device reconnected.")
+			e.opt.Metrics.Reconnected()
+			return true
+		}
+		WarningLogger.Printf("reconnect failed, retrying in %s: %v", backoff, err)
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
 }
 
 // func (e *emuImpl) GetCumulativeEnergyConsumption() (*CumulativeEnergyConsumption, error) {
@@ -224,6 +550,7 @@ func (e *emuImpl) Close() {
 
 func (e *emuImpl) reader() {
 	rp := newResponseProcessor()
+	fc := &fragmentCollector{}
 	reader := bufio.NewReader(e.conn)
 	for {
 		select {
@@ -232,47 +559,74 @@ func (e *emuImpl) reader() {
 			return
 		default:
 			if reader.Buffered() == 0 {
-				if rp.state != RspReceiving && e.cmdState != nil {
+				if rp.state != RspReceiving {
 					e.sendCommand()
 				}
 			}
 			line, err := reader.ReadString('\n')
 			if err != nil {
+				if e.ctx.Err() != nil {
+					break
+				}
 				if err == io.EOF {
 					WarningLogger.Printf("EOF: nothing to read")
-					break
 				} else {
 					ErrorLogger.Printf("Read error: %v", err)
 				}
+				if e.reconnect() {
+					reader = bufio.NewReader(e.conn)
+					rp = newResponseProcessor()
+					fc = &fragmentCollector{}
+				}
 				break
 			}
+			if element, fragment, ok := fc.add(line); ok && e.rawSubscribed() {
+				e.publish(newFragment(element, fragment, time.Now()))
+			}
 			rp.process(line)
 			if rp.state == RspReceived {
-				//For internal commands e.g. Demand and Contineous etc
-				if e.cmdState != nil && e.cmdState.status == CmdSent {
-					//check if response is for the command
-					if e.cmdState.rspName == MessageName(rp.resp.GetName()) {
-						e.responses <- rp.resp
-						e.cmdState = nil
+				e.opt.Metrics.MessageReceived(rp.resp.GetName())
+				if rp.resp.Name == emuTimeCluster {
+					if utc, ok := rp.resp.Attribs[emuUTCTime].(int64); ok {
+						e.opt.Metrics.ClockDrift(time.Unix(utc, 0).Sub(time.Now()).Round(time.Second))
 					}
 				}
+				//For internal commands e.g. Demand and Contineous etc
+				//check if response is for the command, unless converted below
+				if _, converted := messageProcessorMap[rp.resp.Name]; !converted {
+					e.completeCommand(rp.resp, func(cs *commandState) bool { return cs.answeredBy(rp.resp) })
+				}
 				if m, err := convertApiMessage(rp.resp); err == nil {
-					e.pubsub.Publish(MessageName(m.GetName()), m)
+					e.learnMeters(m)
+					e.publish(m)
+					if n, ok := m.(*Network); ok {
+						e.lck.Lock()
+						t := e.trackNetwork(n, time.Now())
+						e.lck.Unlock()
+						if t != nil {
+							InfoLogger.Printf("network %s -> %s: %s %s", t.From, t.To, t.Status, t.Description)
+							e.publish(t)
+						}
+					}
+					if e.history != nil {
+						if err := e.history.record(m); err != nil {
+							WarningLogger.Printf("unable to persist %s: %v", m.GetName(), err)
+						}
+					}
 
 					//			go e.sendToSubscribers(m)
 					//send messages to subscriber
-					if e.cmdState != nil && e.cmdState.status == CmdSent {
-						//check if response is for the command
-						if e.cmdState.rspName == MessageName(m.GetName()) {
-							e.responses <- m
-							e.cmdState = nil
-						}
-					}
+					//check if response is for the command
+					e.completeCommand(m, func(cs *commandState) bool { return cs.answeredBy(m) })
 				} else {
+					if _, ok := messageProcessorMap[rp.resp.Name]; ok {
+						e.opt.Metrics.ParseError(rp.resp.GetName())
+					}
 					WarningLogger.Printf("Ignoring, %s cannot be processed for API message", rp.resp.GetName())
 				}
 				rp = newResponseProcessor()
 			} else if rp.state == RspError {
+				e.opt.Metrics.ParseError(rp.resp.GetName())
 				WarningLogger.Printf("Abandoning processing response: [%s, %+v]\n", rp.state, rp.resp)
 				rp = newResponseProcessor()
 			}
@@ -280,6 +634,26 @@ func (e *emuImpl) reader() {
 	}
 }
 
+// completeCommand hands m to GetResponse when it answers the command sent,
+// and records how long the device took to answer it.
+func (e *emuImpl) completeCommand(m Message, answers func(cs *commandState) bool) {
+	e.stateLck.Lock()
+	defer e.stateLck.Unlock()
+	cs := e.cmdState
+	if cs == nil || cs.status != CmdSent || !answers(cs) {
+		return
+	}
+	e.opt.Metrics.CommandCompleted(cs.command.CommandId(), time.Since(cs.sentAt))
+	// never blocks, the responses are only sent with the lock held
+	select {
+	case <-e.responses:
+		WarningLogger.Printf("dropping a response not read")
+	default:
+	}
+	e.responses <- m
+	e.cmdState = nil
+}
+
 // func (e *emuImpl) sendToSubscribers(m Message) {
 // 	if sub, ok := e.subscriptions[MessageName(m.GetName())]; ok {
 // 		for hndlr := range sub {
@@ -288,17 +662,27 @@ func (e *emuImpl) reader() {
 // 	}
 // }
 
+// sendCommand writes the pending command, if any.
 func (e *emuImpl) sendCommand() error {
-
-	if e.cmdState.status == CmdPending {
+	e.stateLck.Lock()
+	defer e.stateLck.Unlock()
+	cs := e.cmdState
+	if cs == nil {
+		return nil
+	}
+	if cs.status == CmdPending {
 		//		if cid, ok := cmdIdcmdMap[e.cmdState.command.CommandId()]; ok {
-		xmlCmd := "<Command><Name>" + string(e.cmdState.command.(*commandImpl).Name) + "</Name></Command>"
+		xmlCmd := cs.command.(*commandImpl).xml()
 		DebugLogger.Printf("sending command: %s", string(xmlCmd))
-		if _, err := e.conn.Write([]byte(xmlCmd)); err != nil {
-			e.cmdState.status = CmdError
+		e.connLck.Lock()
+		_, err := e.conn.Write([]byte(xmlCmd))
+		e.connLck.Unlock()
+		if err != nil {
+			cs.status = CmdError
 			return ErrDeviceWrite.Errorf("error while writing to devive %+v", err)
 		}
-		e.cmdState.status = CmdSent
+		cs.status = CmdSent
+		cs.sentAt = time.Now()
 		//		}
 	}
 	//if response is just an Ack just send the Ack
@@ -306,14 +690,10 @@ func (e *emuImpl) sendCommand() error {
 	return nil
 }
 func (e *emuImpl) responseAck() {
-	if e.cmdState != nil && e.cmdState.status == CmdSent {
-		if mn, ok := CommandResponseMap[e.cmdState.command.CommandId()]; ok {
-			if mn == Ack {
-				e.responses <- &messageImpl{Name: emuAck, Attribs: map[emuMessageAttribute]any{emuStatus: "Success"}}
-				e.cmdState = nil
-			}
-		}
-	}
+	e.completeCommand(&messageImpl{Name: emuAck, Attribs: map[emuMessageAttribute]any{emuStatus: "Success"}}, func(cs *commandState) bool {
+		mn, ok := CommandResponseMap[cs.command.CommandId()]
+		return ok && mn == Ack
+	})
 }
 
 type rspState int
@@ -385,6 +765,24 @@ type commandState struct {
 	status  cmdStatus
 	rspName MessageName
 	command Command
+	meter   string // MeterMacId the command is sent for, if any
+	sentAt  time.Time
+}
+
+// answeredBy reports whether m is the response of the command, from its meter
+// when it is sent for one.
+func (c *commandState) answeredBy(m Message) bool {
+	if c.rspName != MessageName(m.GetName()) {
+		return false
+	}
+	if c.meter == "" {
+		return true
+	}
+	mac, ok := m.GetAttrib(string(emuMeterMacId))
+	if s, isStr := mac.(string); ok && isStr {
+		return strings.EqualFold(s, c.meter)
+	}
+	return true
 }
 
 func newCommandState() *commandState {
@@ -431,11 +829,11 @@ func (rp *responseProcessor) getAttrib(line string) (key emuMessageAttribute, va
 		case UINT64:
 			value, err = strconv.ParseInt(strValue, 0, 64)
 		case UINT32:
-			value, err = strconv.ParseInt(strValue, 0, 32)
+			value, err = parseUint(strValue, 32)
 		case UINT16:
-			value, err = strconv.ParseInt(strValue, 0, 16)
+			value, err = parseUint(strValue, 16)
 		case UINT8:
-			value, err = strconv.ParseInt(strValue, 0, 16)
+			value, err = parseUint(strValue, 8)
 		case BOOLEAN:
 			if strValue == "Y" {
 				value = true
@@ -458,6 +856,21 @@ func (rp *responseProcessor) getAttrib(line string) (key emuMessageAttribute, va
 	return key, value, nil
 }
 
+// addAttrib sets the attribute, collecting the values of a repeated one, e.g.
+// the MeterMacId of a MeterList, into a []any.
+func (rp *responseProcessor) addAttrib(key emuMessageAttribute, value any) {
+	prev, ok := rp.resp.Attribs[key]
+	if !ok {
+		rp.resp.Attribs[key] = value
+		return
+	}
+	if values, ok := prev.([]any); ok {
+		rp.resp.Attribs[key] = append(values, value)
+	} else {
+		rp.resp.Attribs[key] = []any{prev, value}
+	}
+}
+
 func (rp *responseProcessor) process(line string) {
 	line = strings.TrimLeft(line, " \t")
 	DebugLogger.Println("Processing:", line)
@@ -492,7 +905,7 @@ func (rp *responseProcessor) process(line string) {
 			WarningLogger.Printf("abandoning message %s as xml parse error:%v while processing. line: %s", rp.resp.GetName(), err, line)
 			rp.state = RspError
 		} else {
-			rp.resp.Attribs[key] = value
+			rp.addAttrib(key, value)
 		}
 	} else {
 		WarningLogger.Printf("ignoring as invalid response state %s to receive line: %s", rp.state, line)
@@ -0,0 +1,431 @@
+package emu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Envelope is the canonical JSON form of a Message, e.g.
+//
+//	{"type":"InstantaneousPower","ts":1655127645,"data":{"TimeStamp":1655127645,"Power":1.189,...}}
+//
+// Type names the message as returned by GetName, TimeStamp is the TimeStamp
+// attribute of the message when it has one and Data holds the attributes.
+type Envelope struct {
+	Type      MessageName     `json:"type"`
+	TimeStamp int64           `json:"ts,omitempty"`
+	Data      json.RawMessage `json:"data"`
+}
+
+var (
+	registryLck sync.RWMutex
+	registry    = map[MessageName]func() Message{
+		InstantaneousPower: func() Message { return &InstantaneousPowerDemand{} },
+		CumulativeEnergy:   func() Message { return &CumulativeEnergyConsumption{} },
+		Price:              func() Message { return &CurrentPrice{} },
+		MeterList:          func() Message { return &JoinedMeters{} },
+		MeterInfo:          func() Message { return &Meter{} },
+		ConnectionStatus:   func() Message { return &Network{Name: ConnectionStatus} },
+		NetworkInfo:        func() Message { return &Network{Name: NetworkInfo} },
+		NetworkTransition:  func() Message { return &StateTransition{} },
+		UtilityMessage:     func() Message { return &Notice{} },
+		RawFragments:       func() Message { return &Fragment{} },
+	}
+)
+
+func init() {
+	for _, name := range emuResponses {
+		if _, ok := registry[MessageName(name)]; ok {
+			// converted to a typed message of the same name
+			continue
+		}
+		RegisterMessage(MessageName(name), func() Message {
+			return &messageImpl{Name: name, Attribs: make(map[emuMessageAttribute]any)}
+		})
+	}
+}
+
+// RegisterMessage registers the factory creating an empty message of type
+// name, into which the data of an envelope of that type is unmarshalled.
+func RegisterMessage(name MessageName, factory func() Message) {
+	registryLck.Lock()
+	defer registryLck.Unlock()
+	registry[name] = factory
+}
+
+func newRegisteredMessage(name MessageName) (Message, error) {
+	registryLck.RLock()
+	defer registryLck.RUnlock()
+	if factory, ok := registry[name]; ok {
+		return factory(), nil
+	}
+	return nil, ErrMsgProc.Errorf("message type %s is not registered", name)
+}
+
+// NewEnvelope wraps m into its envelope.
+func NewEnvelope(m Message) (*Envelope, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{Type: MessageName(m.GetName()), Data: data}
+	if ts, ok := m.GetAttrib("TimeStamp"); ok {
+		env.TimeStamp, _ = ts.(int64)
+	}
+	return env, nil
+}
+
+// Message decodes the data of the envelope into the registered type.
+func (env *Envelope) Message() (Message, error) {
+	m, err := newRegisteredMessage(env.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(env.Data, m); err != nil {
+		return nil, ErrMsgProc.Errorf("unable to decode %s: %+v", env.Type, err)
+	}
+	return m, nil
+}
+
+// MarshalMessage encodes m as its JSON envelope.
+func MarshalMessage(m Message) ([]byte, error) {
+	env, err := NewEnvelope(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// UnmarshalMessage decodes a JSON envelope back into its concrete message.
+func UnmarshalMessage(b []byte) (Message, error) {
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, ErrMsgProc.Errorf("invalid envelope: %+v", err)
+	}
+	return env.Message()
+}
+
+// MarshalJSON encodes the attributes of the message as a JSON object.
+func (m *messageImpl) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Attribs)
+}
+
+// UnmarshalJSON decodes the attributes of the message, restoring the type
+// each known attribute has when it is read from the device.
+func (m *messageImpl) UnmarshalJSON(b []byte) error {
+	var raw map[emuMessageAttribute]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	m.Attribs = make(map[emuMessageAttribute]any, len(raw))
+	for key, value := range raw {
+		var v any
+		var err error
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			// values of a repeated attribute
+			var values []json.RawMessage
+			if err = json.Unmarshal(value, &values); err == nil {
+				list := make([]any, len(values))
+				for i, value := range values {
+					if list[i], err = decodeAttrib(key, value); err != nil {
+						break
+					}
+				}
+				v = list
+			}
+		} else {
+			v, err = decodeAttrib(key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", key, err)
+		}
+		m.Attribs[key] = v
+	}
+	return nil
+}
+
+// decodeAttrib decodes the value of an attribute to the type it has when it
+// is read from the device.
+func decodeAttrib(key emuMessageAttribute, value json.RawMessage) (any, error) {
+	// attributes unknown to the parser are kept without a value
+	if string(value) == "null" {
+		return nil, nil
+	}
+	switch attribTypeMap[key] {
+	case EPOCH, INT64, UINT64, UINT32, UINT16, UINT8:
+		var i int64
+		err := json.Unmarshal(value, &i)
+		return i, err
+	case BOOLEAN:
+		var b bool
+		err := json.Unmarshal(value, &b)
+		return b, err
+	case STRING:
+		var s string
+		err := json.Unmarshal(value, &s)
+		return s, err
+	default:
+		var v any
+		err := json.Unmarshal(value, &v)
+		return v, err
+	}
+}
+
+// binary encoding, all integers are varints and strings are length prefixed
+//
+//	version | type | ts | attribute count | (name | kind | value)...
+//
+// A list value is its count followed by the kind and value of each element,
+// a map value its count followed by the name, kind and value of each entry.
+const binaryVersion byte = 1
+
+const (
+	kindNull byte = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindString
+	kindList
+	kindMap
+)
+
+// binaryMaxDepth bounds the nesting of the lists and maps.
+const binaryMaxDepth = 16
+
+// MarshalMessageBinary encodes m into a compact binary envelope carrying the
+// same information as its JSON envelope.
+func MarshalMessageBinary(m Message) ([]byte, error) {
+	env, err := NewEnvelope(m)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(env.Data))
+	dec.UseNumber()
+	var attribs map[string]any
+	if err := dec.Decode(&attribs); err != nil {
+		return nil, err
+	}
+	b := []byte{binaryVersion}
+	b = appendString(b, string(env.Type))
+	b = binary.AppendVarint(b, env.TimeStamp)
+	b, err = appendEntries(b, attribs, 0)
+	if err != nil {
+		return nil, ErrMsgProc.Errorf("unable to encode %s: %+v", env.Type, err)
+	}
+	return b, nil
+}
+
+// appendEntries appends the count of the entries of m followed by the name,
+// kind and value of each entry, sorted by name.
+func appendEntries(b []byte, m map[string]any, depth int) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		b = appendString(b, key)
+		var err error
+		if b, err = appendValue(b, m[key], depth); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return b, nil
+}
+
+// appendValue appends the kind and value of a JSON value decoded with
+// UseNumber.
+func appendValue(b []byte, value any, depth int) ([]byte, error) {
+	if depth > binaryMaxDepth {
+		return nil, fmt.Errorf("nested more than %d levels", binaryMaxDepth)
+	}
+	switch v := value.(type) {
+	case nil:
+		b = append(b, kindNull)
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			b = append(b, kindInt)
+			b = binary.AppendVarint(b, i)
+		} else if f, err := v.Float64(); err == nil {
+			b = append(b, kindFloat)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+		} else {
+			return nil, err
+		}
+	case bool:
+		b = append(b, kindBool)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case string:
+		b = append(b, kindString)
+		b = appendString(b, v)
+	case []any:
+		b = append(b, kindList)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for i, e := range v {
+			var err error
+			if b, err = appendValue(b, e, depth+1); err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	case map[string]any:
+		b = append(b, kindMap)
+		return appendEntries(b, v, depth+1)
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+	return b, nil
+}
+
+// UnmarshalMessageBinary decodes a binary envelope back into its concrete
+// message.
+func UnmarshalMessageBinary(b []byte) (Message, error) {
+	r := &binaryReader{b: b}
+	if v := r.byte(); v != binaryVersion {
+		return nil, ErrMsgProc.Errorf("unsupported binary envelope version %d", v)
+	}
+	env := &Envelope{Type: MessageName(r.string()), TimeStamp: r.varint()}
+	attribs := r.entries(0)
+	if r.err != nil {
+		return nil, ErrMsgProc.Errorf("invalid binary envelope: %+v", r.err)
+	}
+	data, err := json.Marshal(attribs)
+	if err != nil {
+		return nil, err
+	}
+	env.Data = data
+	return env.Message()
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// binaryReader reads a binary envelope, remembering the first error.
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+func (r *binaryReader) fail() {
+	r.failf("unexpected end of data")
+}
+
+func (r *binaryReader) failf(format string, a ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, a...)
+	}
+	r.b = nil
+}
+
+// entries reads the entries appended by appendEntries.
+func (r *binaryReader) entries(depth int) map[string]any {
+	n := r.count()
+	m := make(map[string]any, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		key := r.string()
+		m[key] = r.value(depth)
+	}
+	return m
+}
+
+// value reads a value appended by appendValue.
+func (r *binaryReader) value(depth int) any {
+	if depth > binaryMaxDepth {
+		r.failf("nested more than %d levels", binaryMaxDepth)
+		return nil
+	}
+	switch kind := r.byte(); kind {
+	case kindNull:
+		return nil
+	case kindInt:
+		return r.varint()
+	case kindFloat:
+		return math.Float64frombits(r.uint64())
+	case kindBool:
+		return r.byte() == 1
+	case kindString:
+		return r.string()
+	case kindList:
+		n := r.count()
+		list := make([]any, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			list = append(list, r.value(depth+1))
+		}
+		return list
+	case kindMap:
+		return r.entries(depth + 1)
+	default:
+		r.failf("invalid kind %d", kind)
+		return nil
+	}
+}
+
+// count reads the count of a list or map, which cannot exceed the bytes left
+// as every element takes one at least.
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) byte() byte {
+	if len(r.b) < 1 {
+		r.fail()
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *binaryReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if uint64(len(r.b)) < n {
+		r.fail()
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
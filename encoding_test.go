@@ -0,0 +1,87 @@
+package emu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func roundTripMessages() []Message {
+	return []Message{
+		&InstantaneousPowerDemand{TimeStamp: 1655127645, Power: 1.189, DeviceMacId: "0xd8d5b9000000abcd", MeterMacId: "0x00135003007c3d11"},
+		&InstantaneousPowerDemand{TimeStamp: 1655127645, Power: -2},
+		&CumulativeEnergyConsumption{TimeStamp: 1655127645, Delivered: 1002.424, Received: 0.5},
+		&CurrentPrice{TimeStamp: 1655127645, Price: 0.125, Currency: 840, Tier: 2, RateLabel: "Peak"},
+		&JoinedMeters{DeviceMacId: "0xd8d5b9000000abcd", MeterMacIds: []string{"0x00135003007c3d11", "0x00135003007c3d22"}},
+		&Meter{MeterMacId: "0x00135003007c3d11", MeterType: MeterElectric, NickName: "garage", Enabled: true},
+		&Notice{TimeStamp: 1655127645, Id: "0x1", Text: "Peak hours", Priority: "High", ConfirmationRequired: true},
+		&Network{Name: NetworkInfo, DeviceMacId: "0xd8d5b9000000abcd", CoordMacId: "0x00135003007c3d11", Status: "Connected",
+			State: StateConnected, ExtPanId: "0x1", Channel: 20, ShortAddr: "0xe1c3", LinkStrength: 100},
+		&Network{Name: ConnectionStatus, DeviceMacId: "0xd8d5b9000000abcd", Status: "Rejoining", State: StateRejoining},
+		&StateTransition{TimeStamp: 1655127645, From: StateJoining, To: StateConnected, Status: "Connected"},
+		&Fragment{TimeStamp: 1655127645, Element: "ScheduleInfo", Xml: "<ScheduleInfo>\n<Event>demand</Event>\n</ScheduleInfo>",
+			Attribs: map[string]string{"Event": "demand", "Frequency": "0x1e"}},
+		&Fragment{TimeStamp: 1655127645, Element: "Unparsed", Xml: "<Unparsed>"},
+		&messageImpl{Name: emuTimeCluster, Attribs: map[emuMessageAttribute]any{
+			"UTCTime": int64(5), "DeviceMacId": "0x1", "FastPoll": true, "Foo": nil,
+		}},
+		&messageImpl{Name: emuBillingPeriodList, Attribs: map[emuMessageAttribute]any{
+			"DeviceMacId": "0x1", "StartTime": []any{int64(1655127645), int64(1657719645)}, "Duration": []any{"0x1", "0x2"},
+		}},
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, m := range roundTripMessages() {
+		b, err := MarshalMessage(m)
+		if err != nil {
+			t.Errorf("MarshalMessage(%+v): %v", m, err)
+			continue
+		}
+		got, err := UnmarshalMessage(b)
+		if err != nil || !reflect.DeepEqual(got, m) {
+			t.Errorf("JSON round trip of %s = %+v, %v, want %+v", b, got, err, m)
+		}
+	}
+}
+
+func TestMessageBinaryRoundTrip(t *testing.T) {
+	for _, m := range roundTripMessages() {
+		b, err := MarshalMessageBinary(m)
+		if err != nil {
+			t.Errorf("MarshalMessageBinary(%+v): %v", m, err)
+			continue
+		}
+		got, err := UnmarshalMessageBinary(b)
+		if err != nil || !reflect.DeepEqual(got, m) {
+			t.Errorf("binary round trip of %s = %+v, %v, want %+v", m.GetName(), got, err, m)
+		}
+		for n := 0; n < len(b); n++ {
+			if _, err := UnmarshalMessageBinary(b[:n]); err == nil {
+				t.Errorf("%s truncated to %d of %d bytes decoded", m.GetName(), n, len(b))
+				break
+			}
+		}
+	}
+}
+
+// A Network built by hand is a ConnectionStatus.
+func TestZeroNetwork(t *testing.T) {
+	m := &Network{DeviceMacId: "0xd8d5b9000000abcd", LinkStrength: 80}
+	b, err := MarshalMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := got.(*Network); !ok || n.GetName() != string(ConnectionStatus) || n.LinkStrength != 80 {
+		t.Errorf("round trip of %s = %+v", b, got)
+	}
+}
+
+func TestUnregisteredMessage(t *testing.T) {
+	if _, err := UnmarshalMessage([]byte(`{"type":"NoSuchMessage","data":{}}`)); err == nil {
+		t.Error("unregistered type decoded")
+	}
+}
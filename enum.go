@@ -5,6 +5,15 @@ var commandIdString = map[CommandId]string{
 	GET_DEVICE_INFO: "GET_DEVICE_INFO",
 	GET_TIME:        "GET_TIME",
 	GET_CONN_STATUS: "GET_CONN_STATUS",
+	GET_DEMAND:      "GET_DEMAND",
+	GET_SUMMATION:   "GET_SUMMATION",
+	SET_TIME:        "SET_TIME",
+	GET_NETWORK:     "GET_NETWORK",
+	JOIN_NETWORK:    "JOIN_NETWORK",
+	GET_METER_LIST:  "GET_METER_LIST",
+	GET_METER_INFO:  "GET_METER_INFO",
+	SET_METER_INFO:  "SET_METER_INFO",
+	GET_MESSAGE:     "GET_MESSAGE",
 }
 
 var stringCommandId = map[string]CommandId{
@@ -12,4 +21,13 @@ var stringCommandId = map[string]CommandId{
 	"GET_DEVICE_INFO": GET_DEVICE_INFO,
 	"GET_TIME":        GET_TIME,
 	"GET_CONN_STATUS": GET_CONN_STATUS,
+	"GET_DEMAND":      GET_DEMAND,
+	"GET_SUMMATION":   GET_SUMMATION,
+	"SET_TIME":        SET_TIME,
+	"GET_NETWORK":     GET_NETWORK,
+	"JOIN_NETWORK":    JOIN_NETWORK,
+	"GET_METER_LIST":  GET_METER_LIST,
+	"GET_METER_INFO":  GET_METER_INFO,
+	"SET_METER_INFO":  SET_METER_INFO,
+	"GET_MESSAGE":     GET_MESSAGE,
 }
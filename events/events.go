@@ -0,0 +1,308 @@
+// Package events detects appliances switching on and off from the step
+// changes of fast-poll InstantaneousPower readings.
+//
+// A change of demand between two readings larger than the threshold is an
+// edge; changes of the same sign following each other closely are merged, as
+// appliances often take a couple of readings to settle. A falling edge is
+// paired with the open rising edge of the closest power, within the
+// tolerance, into a cycle, and cycles of similar power and duration are
+// clustered into recurring signatures, e.g. "~2.1 kW, 40 min" for a dryer.
+package events
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/internal/meter"
+	"github.com/kbhuyan/emu/util"
+)
+
+type Options struct {
+	Threshold   float64       // smallest edge, in kW
+	Merge       time.Duration // edges of the same sign closer than this are merged
+	Tolerance   float64       // relative power difference of paired edges and of a signature
+	MaxDuration time.Duration // rising edges left open longer are dropped
+	DurationTol float64       // duration ratio of the cycles of a signature
+}
+
+type Option func(*Options)
+
+// WithThreshold sets the smallest change of demand, in kW, seen as an edge.
+func WithThreshold(kw float64) Option {
+	return func(o *Options) {
+		o.Threshold = kw
+	}
+}
+
+// WithMerge sets the time within which edges of the same sign are merged.
+func WithMerge(d time.Duration) Option {
+	return func(o *Options) {
+		o.Merge = d
+	}
+}
+
+// WithTolerance sets the relative difference of power allowed between the
+// edges of a cycle and the cycles of a signature.
+func WithTolerance(fraction float64) Option {
+	return func(o *Options) {
+		o.Tolerance = fraction
+	}
+}
+
+// WithMaxDuration sets how long an appliance may stay on before its rising
+// edge is dropped.
+func WithMaxDuration(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxDuration = d
+	}
+}
+
+// WithDurationTolerance sets the ratio between the longest and the shortest
+// duration of the cycles of a signature.
+func WithDurationTolerance(ratio float64) Option {
+	return func(o *Options) {
+		o.DurationTol = ratio
+	}
+}
+
+// Signature is a cluster of similar cycles.
+type Signature struct {
+	Id       int
+	Power    float64       // mean, in kW
+	Duration time.Duration // mean
+	Count    int
+	LastSeen time.Time
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("~%.1f kW, %s", s.Power, formatDuration(s.Duration))
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%d s", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d min", int(d.Round(time.Minute).Minutes()))
+	default:
+		return fmt.Sprintf("%.1f h", d.Hours())
+	}
+}
+
+type edge struct {
+	ts    int64
+	delta float64
+	power float64 // demand after the edge
+}
+
+// Detector publishes the ApplianceEdge and ApplianceCycle messages of the
+// demand readings added to it. It models a single meter. It is safe for
+// concurrent use.
+type Detector struct {
+	opt    *Options
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+	lck    sync.Mutex
+
+	last    *emu.InstantaneousPowerDemand
+	pending *edge  // edge that may still be merged
+	open    []edge // rising edges waiting for their falling edge
+	sigs    []*Signature
+}
+
+func NewDetector(opts ...Option) (*Detector, error) {
+	options := &Options{
+		Threshold:   0.3,
+		Merge:       15 * time.Second,
+		Tolerance:   0.2,
+		MaxDuration: 12 * time.Hour,
+		DurationTol: 1.5,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Threshold <= 0 {
+		return nil, fmt.Errorf("invalid threshold %g", options.Threshold)
+	}
+	if options.Tolerance <= 0 || options.Tolerance >= 1 {
+		return nil, fmt.Errorf("invalid tolerance %g", options.Tolerance)
+	}
+	if options.DurationTol < 1 {
+		return nil, fmt.Errorf("invalid duration tolerance %g", options.DurationTol)
+	}
+	return &Detector{
+		opt:    options,
+		pubsub: util.NewPubSub[emu.MessageName, emu.Message](),
+	}, nil
+}
+
+// Subscribe returns a channel receiving the ApplianceEdge or ApplianceCycle
+// messages.
+func (d *Detector) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	if mn != ApplianceEdge && mn != ApplianceCycle {
+		return nil, fmt.Errorf("invalid events MessageName %s", mn)
+	}
+	return d.pubsub.Subscribe(mn), nil
+}
+
+func (d *Detector) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	d.pubsub.Close(mn, ch)
+}
+
+// Run detects the events of the demand published by device until ctx is
+// done.
+func (d *Detector) Run(ctx context.Context, device emu.Emu) error {
+	ch, err := device.Subscribe(emu.InstantaneousPower)
+	if err != nil {
+		return err
+	}
+	defer device.Unsubscribe(emu.InstantaneousPower, ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-ch:
+			d.Add(m)
+		}
+	}
+}
+
+// Signatures returns the signatures seen so far, the most frequent first.
+func (d *Detector) Signatures() []Signature {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	sigs := make([]Signature, len(d.sigs))
+	for i, s := range d.sigs {
+		sigs[i] = *s
+	}
+	slices.SortStableFunc(sigs, func(a, b Signature) int {
+		return b.Count - a.Count
+	})
+	return sigs
+}
+
+// Add accounts an InstantaneousPower reading and publishes the edges and
+// cycles it completes. Other messages are ignored.
+func (d *Detector) Add(msg emu.Message) {
+	m, ok := msg.(*emu.InstantaneousPowerDemand)
+	if !ok {
+		return
+	}
+	d.lck.Lock()
+	out := d.add(m)
+	d.lck.Unlock()
+	for _, e := range out {
+		d.pubsub.Publish(emu.MessageName(e.GetName()), e)
+	}
+}
+
+func (d *Detector) add(m *emu.InstantaneousPowerDemand) []emu.Message {
+	last := d.last
+	if last != nil && m.TimeStamp <= last.TimeStamp {
+		emu.WarningLogger.Printf("dropping demand of %d, not newer than the previous one", m.TimeStamp)
+		return nil
+	}
+	d.last = m
+	if last == nil {
+		return nil
+	}
+	var out []emu.Message
+	delta := m.Power - last.Power
+	merge := int64(d.opt.Merge / time.Second)
+	if p := d.pending; p != nil {
+		if m.TimeStamp-p.ts <= merge && delta != 0 && math.Signbit(delta) == math.Signbit(p.delta) {
+			p.delta += delta
+			p.power = m.Power
+			return nil
+		}
+		out = append(out, d.commit(*p, m)...)
+		d.pending = nil
+	}
+	if math.Abs(delta) >= d.opt.Threshold/2 {
+		// half of the threshold may make an edge once merged
+		d.pending = &edge{ts: m.TimeStamp, delta: delta, power: m.Power}
+	}
+	return out
+}
+
+// commit accounts a settled edge.
+func (d *Detector) commit(e edge, m *emu.InstantaneousPowerDemand) []emu.Message {
+	if math.Abs(e.delta) < d.opt.Threshold {
+		return nil
+	}
+	out := []emu.Message{&Edge{
+		TimeStamp:   e.ts,
+		Delta:       meter.Round(e.delta, 3),
+		Power:       e.power,
+		DeviceMacId: m.DeviceMacId,
+		MeterMacId:  m.MeterMacId,
+	}}
+	maxAge := int64(d.opt.MaxDuration / time.Second)
+	d.open = slices.DeleteFunc(d.open, func(o edge) bool {
+		return e.ts-o.ts > maxAge
+	})
+	if e.delta > 0 {
+		d.open = append(d.open, e)
+		return out
+	}
+	// pair with the open rising edge of the closest power
+	off := -e.delta
+	best := -1
+	for i, o := range d.open {
+		if math.Abs(o.delta-off) > d.opt.Tolerance*max(o.delta, off) {
+			continue
+		}
+		if best < 0 || math.Abs(o.delta-off) < math.Abs(d.open[best].delta-off) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return out
+	}
+	on := d.open[best]
+	d.open = slices.Delete(d.open, best, best+1)
+	power := (on.delta + off) / 2
+	duration := time.Duration(e.ts-on.ts) * time.Second
+	sig := d.classify(power, duration, time.Unix(e.ts, 0))
+	return append(out, &Cycle{
+		Start:       on.ts,
+		End:         e.ts,
+		Duration:    e.ts - on.ts,
+		Power:       meter.Round(power, 3),
+		Energy:      meter.Round(power*duration.Hours(), 3),
+		Signature:   sig.Id,
+		Label:       sig.String(),
+		DeviceMacId: m.DeviceMacId,
+		MeterMacId:  m.MeterMacId,
+	})
+}
+
+// classify adds a cycle to the signature it matches, or to a new one.
+func (d *Detector) classify(power float64, duration time.Duration, t time.Time) *Signature {
+	var best *Signature
+	bestDist := math.Inf(1)
+	for _, s := range d.sigs {
+		dp := math.Abs(s.Power-power) / max(s.Power, power)
+		ratio := max(s.Duration, duration).Seconds() / max(min(s.Duration, duration).Seconds(), 1)
+		if dp > d.opt.Tolerance || ratio > d.opt.DurationTol {
+			continue
+		}
+		if dist := dp + math.Log(ratio); dist < bestDist {
+			best, bestDist = s, dist
+		}
+	}
+	if best == nil {
+		best = &Signature{Id: len(d.sigs) + 1}
+		d.sigs = append(d.sigs, best)
+	}
+	n := float64(best.Count)
+	best.Power = (best.Power*n + power) / (n + 1)
+	best.Duration = time.Duration((best.Duration.Seconds()*n + duration.Seconds()) / (n + 1) * float64(time.Second)).Round(time.Second)
+	best.Count++
+	best.LastSeen = t
+	return best
+}
@@ -0,0 +1,152 @@
+package events
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// feed adds a reading of power every 10s from from to to, returning the
+// messages published.
+func feed(d *Detector, from, to int64, power func(ts int64) float64) []emu.Message {
+	var out []emu.Message
+	for ts := from; ts < to; ts += 10 {
+		out = append(out, d.add(&emu.InstantaneousPowerDemand{TimeStamp: ts, Power: power(ts), MeterMacId: "0x00135003000aaaa"})...)
+	}
+	return out
+}
+
+func split(msgs []emu.Message) (edges []*Edge, cycles []*Cycle) {
+	for _, m := range msgs {
+		switch m := m.(type) {
+		case *Edge:
+			edges = append(edges, m)
+		case *Cycle:
+			cycles = append(cycles, m)
+		}
+	}
+	return
+}
+
+// A heater of 1.2 kW runs from 100 to 400 while a dryer ramping to 2.1 kW
+// over two readings runs from 200 to 900.
+func overlapping(ts int64) float64 {
+	p := 0.4
+	if ts >= 100 && ts < 400 {
+		p += 1.2
+	}
+	switch {
+	case ts == 200:
+		p += 1.1
+	case ts > 200 && ts < 900:
+		p += 2.1
+	}
+	return p
+}
+
+func TestPairing(t *testing.T) {
+	d, _ := NewDetector()
+	edges, cycles := split(feed(d, 0, 1200, overlapping))
+	var deltas []float64
+	for _, e := range edges {
+		deltas = append(deltas, e.Delta)
+	}
+	if len(deltas) != 4 || deltas[0] != 1.2 || deltas[1] != 2.1 || deltas[2] != -1.2 || deltas[3] != -2.1 {
+		t.Errorf("edges of %v, want the ramp of the dryer merged", deltas)
+	}
+	if edges[1].TimeStamp != 200 || edges[1].Power != 2.5+1.2 {
+		t.Errorf("dryer edge %+v", edges[1])
+	}
+	if len(cycles) != 2 {
+		t.Fatalf("cycles %+v", cycles)
+	}
+	// each falling edge is paired with the rising edge of its power
+	if c := cycles[0]; c.Start != 100 || c.End != 400 || c.Duration != 300 || c.Power != 1.2 || c.Energy != 0.1 {
+		t.Errorf("heater cycle %+v", c)
+	}
+	if c := cycles[1]; c.Start != 200 || c.End != 900 || c.Power != 2.1 || c.MeterMacId != "0x00135003000aaaa" {
+		t.Errorf("dryer cycle %+v", c)
+	}
+	if cycles[0].Signature == cycles[1].Signature {
+		t.Error("heater and dryer of the same signature")
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	d, _ := NewDetector()
+	// a dryer of 40 min and a heater of 15 min every 6 h, the heater also
+	// running for 2 h once
+	var cycles []*Cycle
+	for day := int64(0); day < 4; day++ {
+		from := day * 21600
+		long := day == 2
+		_, c := split(feed(d, from, from+21600, func(ts int64) float64 {
+			m, p := ts-from, 0.4
+			if m >= 3600 && m < 3600+2400 {
+				p += 2.1
+			}
+			if m >= 9000 && (m < 9900 || long && m < 9000+7200) {
+				p += 1.2
+			}
+			return p
+		}))
+		cycles = append(cycles, c...)
+	}
+	if len(cycles) != 8 {
+		t.Fatalf("%d cycles, want 8", len(cycles))
+	}
+	sigs := d.Signatures()
+	var got []string
+	for _, s := range sigs {
+		got = append(got, s.String())
+	}
+	if len(sigs) != 3 || sigs[0].Count != 4 || sigs[1].Count != 3 || sigs[2].Count != 1 {
+		t.Errorf("signatures %+v", sigs)
+	}
+	if strings.Join(got, "; ") != "~2.1 kW, 40 min; ~1.2 kW, 15 min; ~1.2 kW, 2.0 h" {
+		t.Errorf("signatures %q", got)
+	}
+	if cycles[len(cycles)-2].Label != "~2.1 kW, 40 min" {
+		t.Errorf("label %q", cycles[len(cycles)-2].Label)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	d, _ := NewDetector(WithMaxDuration(time.Hour))
+	_, cycles := split(feed(d, 0, 7200, func(ts int64) float64 {
+		if ts >= 100 && ts < 100+3700 {
+			return 1.6
+		}
+		return 0.4
+	}))
+	if len(cycles) != 0 {
+		t.Errorf("cycles %+v of a rising edge older than MaxDuration", cycles)
+	}
+}
+
+func TestSmallAndOld(t *testing.T) {
+	d, _ := NewDetector()
+	if edges, _ := split(feed(d, 0, 600, func(ts int64) float64 {
+		// below the threshold, even merged
+		return 0.4 + float64(ts/300)*0.2
+	})); len(edges) != 0 {
+		t.Errorf("edges %+v below the threshold", edges)
+	}
+	if out := d.add(&emu.InstantaneousPowerDemand{TimeStamp: 590, Power: 3}); out != nil || d.last.Power == 3 {
+		t.Errorf("reading older than the last one accounted")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, opt := range []Option{WithThreshold(0), WithTolerance(0), WithTolerance(1), WithDurationTolerance(0.5)} {
+		if _, err := NewDetector(opt); err == nil {
+			t.Errorf("NewDetector(%+v) succeeded", opt)
+		}
+	}
+	d, _ := NewDetector()
+	if _, err := d.Subscribe(emu.InstantaneousPower); err == nil {
+		t.Error("subscribed to InstantaneousPower")
+	}
+}
@@ -0,0 +1,87 @@
+package events
+
+import "github.com/kbhuyan/emu"
+
+// Names of the messages published by a Detector.
+const (
+	ApplianceEdge  emu.MessageName = "ApplianceEdge"
+	ApplianceCycle emu.MessageName = "ApplianceCycle"
+)
+
+func init() {
+	emu.RegisterMessage(ApplianceEdge, func() emu.Message { return &Edge{} })
+	emu.RegisterMessage(ApplianceCycle, func() emu.Message { return &Cycle{} })
+}
+
+// Edge is a step change of demand, an appliance switching on when Delta is
+// positive and off when it is negative.
+type Edge struct {
+	TimeStamp   int64   `json:"TimeStamp"` //Unix time
+	Delta       float64 `json:"Delta"`     //Unit is kW
+	Power       float64 `json:"Power"`     //Unit is kW, demand after the edge
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Edge) GetName() string {
+	return string(ApplianceEdge)
+}
+
+func (m *Edge) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Delta":
+		return m.Delta, true
+	case "Power":
+		return m.Power, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// Cycle is an appliance run, from its rising edge to its falling edge.
+type Cycle struct {
+	Start       int64   `json:"Start"`    //Unix time
+	End         int64   `json:"End"`      //Unix time
+	Duration    int64   `json:"Duration"` //Unit is second
+	Power       float64 `json:"Power"`    //Unit is kW
+	Energy      float64 `json:"Energy"`   //Unit is kWh
+	Signature   int     `json:"Signature"`
+	Label       string  `json:"Label"` //e.g. "~2.1 kW, 40 min"
+	DeviceMacId string  `json:"DeviceMacId"`
+	MeterMacId  string  `json:"MeterMacId"`
+}
+
+func (m *Cycle) GetName() string {
+	return string(ApplianceCycle)
+}
+
+func (m *Cycle) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp", "End":
+		return m.End, true
+	case "Start":
+		return m.Start, true
+	case "Duration":
+		return m.Duration, true
+	case "Power":
+		return m.Power, true
+	case "Energy":
+		return m.Energy, true
+	case "Signature":
+		return m.Signature, true
+	case "Label":
+		return m.Label, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
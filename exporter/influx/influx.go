@@ -0,0 +1,586 @@
+// Package influx writes emu readings as InfluxDB line protocol, either to
+// the HTTP write endpoint of InfluxDB or to a file.
+//
+// Points are batched and written by a background flusher so that a slow
+// endpoint never holds up the device; a batch that cannot be written to the
+// endpoint is spooled to disk and retried, oldest first, before the next
+// batch.
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+const (
+	spoolFile  = "spool.lp"
+	pendingLen = 16 // batches waiting for the flusher
+)
+
+var errClosed = errors.New("influx writer closed")
+
+var exportedNames = []emu.MessageName{
+	emu.InstantaneousPower, emu.CumulativeEnergy, emu.Price, emu.NetworkInfo, emu.ConnectionStatus,
+}
+
+type WriterOptions struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	SpoolDir      string // empty disables spooling of failed batches
+	MaxSpoolSize  int64  // bytes, the batches that do not fit are dropped
+	Token         string
+	Timeout       time.Duration
+}
+
+type WriterOption func(*WriterOptions)
+
+// WithBatchSize sets the number of points written at once.
+func WithBatchSize(n int) WriterOption {
+	return func(o *WriterOptions) {
+		o.BatchSize = n
+	}
+}
+
+// WithFlushInterval sets how long points are buffered before the batch is
+// written even if it is not full.
+func WithFlushInterval(d time.Duration) WriterOption {
+	return func(o *WriterOptions) {
+		o.FlushInterval = d
+	}
+}
+
+// WithSpoolDir keeps the batches that could not be written in dir until the
+// endpoint accepts them again.
+func WithSpoolDir(dir string) WriterOption {
+	return func(o *WriterOptions) {
+		o.SpoolDir = dir
+	}
+}
+
+// WithMaxSpoolSize bounds the size of the spool, 64 MiB by default.
+func WithMaxSpoolSize(size int64) WriterOption {
+	return func(o *WriterOptions) {
+		o.MaxSpoolSize = size
+	}
+}
+
+// WithToken authenticates to InfluxDB with an API token.
+func WithToken(token string) WriterOption {
+	return func(o *WriterOptions) {
+		o.Token = token
+	}
+}
+
+func WithTimeout(d time.Duration) WriterOption {
+	return func(o *WriterOptions) {
+		o.Timeout = d
+	}
+}
+
+// sink is where the batches of lines end up.
+type sink interface {
+	write(lines []byte) error
+	close() error
+}
+
+// Writer batches the line protocol of the messages written to it. It is safe
+// for concurrent use.
+type Writer struct {
+	opt     *WriterOptions
+	sink    sink
+	pending chan flushRequest
+	flushed chan struct{} // closed once the flusher is done
+
+	lck    sync.Mutex
+	batch  bytes.Buffer
+	count  int
+	closed bool
+}
+
+// flushRequest hands a batch over to the flusher, an empty batch retrying the
+// spool only. The result of the write is sent to done when not nil.
+type flushRequest struct {
+	lines []byte
+	done  chan error
+}
+
+func newWriter(options *WriterOptions, sink sink) *Writer {
+	w := &Writer{
+		opt:     options,
+		sink:    sink,
+		pending: make(chan flushRequest, pendingLen),
+		flushed: make(chan struct{}),
+	}
+	go w.flusher()
+	return w
+}
+
+// NewHTTPWriter writes to the InfluxDB write endpoint url, e.g.
+// http://localhost:8086/api/v2/write?org=home&bucket=emu&precision=s or, for
+// InfluxDB 1.x, http://localhost:8086/write?db=emu&precision=s.
+func NewHTTPWriter(url string, opts ...WriterOption) (*Writer, error) {
+	options := defaultOptions(opts)
+	if options.SpoolDir != "" {
+		if err := os.MkdirAll(options.SpoolDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return newWriter(options, &httpSink{
+		url:    url,
+		token:  options.Token,
+		client: &http.Client{Timeout: options.Timeout},
+	}), nil
+}
+
+// NewFileWriter appends to the file at path.
+func NewFileWriter(path string, opts ...WriterOption) (*Writer, error) {
+	options := defaultOptions(opts)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	options.SpoolDir = ""
+	return newWriter(options, &fileSink{f: f}), nil
+}
+
+func defaultOptions(opts []WriterOption) *WriterOptions {
+	options := &WriterOptions{
+		BatchSize:     100,
+		FlushInterval: 10 * time.Second,
+		MaxSpoolSize:  64 << 20,
+		Timeout:       10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// Write adds the points of msg to the batch, handing it over to the flusher
+// once it is full. Messages without points are ignored.
+func (w *Writer) Write(msg emu.Message) error {
+	lines := Lines(msg)
+	if len(lines) == 0 {
+		return nil
+	}
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	for _, line := range lines {
+		w.batch.WriteString(line)
+		w.batch.WriteByte('\n')
+		w.count++
+	}
+	if w.count >= w.opt.BatchSize {
+		w.handOver(nil)
+	}
+	return nil
+}
+
+// Flush writes the buffered points and waits for the result.
+func (w *Writer) Flush() error {
+	done := make(chan error, 1)
+	w.lck.Lock()
+	if w.closed {
+		w.lck.Unlock()
+		return errClosed
+	}
+	w.handOver(done)
+	w.lck.Unlock()
+	return <-done
+}
+
+// handOver queues the batch for the flusher. A batch waiting for its result is
+// queued whatever it takes, otherwise the oldest queued batch is dropped when
+// the endpoint does not keep up.
+func (w *Writer) handOver(done chan error) {
+	req := flushRequest{lines: bytes.Clone(w.batch.Bytes()), done: done}
+	w.batch.Reset()
+	w.count = 0
+	if done != nil {
+		w.pending <- req
+		return
+	}
+	for {
+		select {
+		case w.pending <- req:
+			return
+		default:
+		}
+		if len(req.lines) == 0 {
+			// the flusher is busy already
+			return
+		}
+		select {
+		case old := <-w.pending:
+			err := fmt.Errorf("influx endpoint is too slow, dropping %d points", bytes.Count(old.lines, []byte{'\n'}))
+			if old.done != nil {
+				old.done <- err
+			} else if len(old.lines) > 0 {
+				emu.WarningLogger.Print(err)
+			}
+		default:
+		}
+	}
+}
+
+// flusher writes the batches handed over until the writer is closed.
+func (w *Writer) flusher() {
+	defer close(w.flushed)
+	for req := range w.pending {
+		err := w.write(req.lines)
+		if req.done != nil {
+			req.done <- err
+		} else if err != nil {
+			emu.WarningLogger.Printf("influx flush failed: %v", err)
+		}
+	}
+}
+
+// write writes a batch after the spooled points, spooling it when the
+// endpoint is down.
+func (w *Writer) write(lines []byte) error {
+	if err := w.drainSpool(); err != nil {
+		// the endpoint is still down, keep the order by spooling behind
+		return w.spool(lines)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := w.sink.write(lines); err != nil {
+		if w.opt.SpoolDir == "" || !retryable(err) {
+			return err
+		}
+		emu.WarningLogger.Printf("influx write failed, spooling %d points: %v", bytes.Count(lines, []byte{'\n'}), err)
+		return w.spool(lines)
+	}
+	return nil
+}
+
+// spool appends the lines to the spool file, dropping them when the spool is
+// full.
+func (w *Writer) spool(lines []byte) error {
+	if len(lines) == 0 || w.opt.SpoolDir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(w.opt.SpoolDir, spoolFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Size()+int64(len(lines)) > w.opt.MaxSpoolSize {
+		return fmt.Errorf("spool full, dropping %d points", bytes.Count(lines, []byte{'\n'}))
+	}
+	_, err = f.Write(lines)
+	return err
+}
+
+// drainSpool writes the spooled points in batches, removing the spool file
+// once all of them were accepted. The spool is read a batch at a time.
+func (w *Writer) drainSpool() error {
+	if w.opt.SpoolDir == "" {
+		return nil
+	}
+	path := filepath.Join(w.opt.SpoolDir, spoolFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var batch bytes.Buffer
+	for sent := false; ; sent = true {
+		batch.Reset()
+		eof := false
+		for n := 0; n < w.opt.BatchSize && !eof; n++ {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			batch.Write(line)
+		}
+		if batch.Len() == 0 {
+			break
+		}
+		if err := w.sink.write(batch.Bytes()); err != nil && retryable(err) {
+			if sent {
+				// keep what is left for the next attempt
+				if werr := keepSpool(path, batch.Bytes(), r); werr != nil {
+					return werr
+				}
+			}
+			return err
+		} else if err != nil {
+			emu.WarningLogger.Printf("influx rejected spooled points, dropping them: %v", err)
+		}
+		if eof {
+			break
+		}
+	}
+	f.Close()
+	return os.Remove(path)
+}
+
+// keepSpool replaces the spool file with the batch followed by the rest of r.
+func keepSpool(path string, batch []byte, r io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(batch)
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close writes the buffered points, stops the flusher and closes the sink.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if errors.Is(err, errClosed) {
+		return nil
+	}
+	w.lck.Lock()
+	w.closed = true
+	close(w.pending)
+	w.lck.Unlock()
+	<-w.flushed
+	if cerr := w.sink.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Run writes the readings published by device until ctx is done.
+func (w *Writer) Run(ctx context.Context, device emu.Emu) error {
+	chs := make(map[emu.MessageName]chan emu.Message, len(exportedNames))
+	defer func() {
+		for mn, ch := range chs {
+			device.Unsubscribe(mn, ch)
+		}
+	}()
+	for _, mn := range exportedNames {
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		chs[mn] = ch
+	}
+	ticker := time.NewTicker(w.opt.FlushInterval)
+	defer ticker.Stop()
+	for {
+		var msg emu.Message
+		select {
+		case <-ctx.Done():
+			return w.Flush()
+		case <-ticker.C:
+			// the flusher also retries the spool when there is no point
+			w.lck.Lock()
+			if !w.closed {
+				w.handOver(nil)
+			}
+			w.lck.Unlock()
+			continue
+		case msg = <-chs[emu.InstantaneousPower]:
+		case msg = <-chs[emu.CumulativeEnergy]:
+		case msg = <-chs[emu.Price]:
+		case msg = <-chs[emu.NetworkInfo]:
+		case msg = <-chs[emu.ConnectionStatus]:
+		}
+		if err := w.Write(msg); err != nil {
+			emu.WarningLogger.Printf("influx write failed: %v", err)
+		}
+	}
+}
+
+// Lines returns the line protocol of the points of msg.
+func Lines(msg emu.Message) []string {
+	switch m := msg.(type) {
+	case *emu.InstantaneousPowerDemand:
+		return []string{line("emu_power", meterTags(m.DeviceMacId, m.MeterMacId),
+			[]field{{"power_kw", m.Power}}, m.TimeStamp)}
+	case *emu.CumulativeEnergyConsumption:
+		return []string{line("emu_energy", meterTags(m.DeviceMacId, m.MeterMacId),
+			[]field{{"net_kwh", m.Energy}, {"delivered_kwh", m.Delivered}, {"received_kwh", m.Received}}, m.TimeStamp)}
+	case *emu.CurrentPrice:
+		tags := append(meterTags(m.DeviceMacId, m.MeterMacId), tag{"currency", strconv.Itoa(m.Currency)})
+		return []string{line("emu_price", tags,
+			[]field{{"price", m.Price}, {"tier", int64(m.Tier)}}, m.TimeStamp)}
+	}
+	switch emu.MessageName(msg.GetName()) {
+	case emu.NetworkInfo, emu.ConnectionStatus:
+		var fields []field
+		if v, ok := msg.GetAttrib("LinkStrength"); ok && v != nil {
+			fields = append(fields, field{"link_strength", v})
+		}
+		if v, ok := msg.GetAttrib("Status"); ok && v != nil {
+			fields = append(fields, field{"status", v})
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		device, _ := msg.GetAttrib("DeviceMacId")
+		meter, _ := msg.GetAttrib("MeterMacId")
+		d, _ := device.(string)
+		m, _ := meter.(string)
+		ts := time.Now().Unix()
+		if v, ok := msg.GetAttrib("TimeStamp"); ok {
+			if t, ok := v.(int64); ok {
+				ts = t
+			}
+		}
+		return []string{line("emu_network", meterTags(d, m), fields, ts)}
+	}
+	return nil
+}
+
+type tag struct {
+	key   string
+	value string
+}
+
+type field struct {
+	key   string
+	value any
+}
+
+func meterTags(device, meter string) []tag {
+	var tags []tag
+	if device != "" {
+		tags = append(tags, tag{"device_mac_id", device})
+	}
+	if meter != "" {
+		tags = append(tags, tag{"meter_mac_id", meter})
+	}
+	return tags
+}
+
+// line renders a point with a timestamp in seconds.
+func line(measurement string, tags []tag, fields []field, ts int64) string {
+	var sb strings.Builder
+	sb.WriteString(measurementEscaper.Replace(measurement))
+	for _, t := range tags {
+		sb.WriteString("," + tagEscaper.Replace(t.key) + "=" + tagEscaper.Replace(t.value))
+	}
+	for i, f := range fields {
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(tagEscaper.Replace(f.key) + "=")
+		switch v := f.value.(type) {
+		case float64:
+			sb.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int64:
+			sb.WriteString(strconv.FormatInt(v, 10) + "i")
+		case bool:
+			sb.WriteString(strconv.FormatBool(v))
+		default:
+			sb.WriteString(`"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`)
+		}
+	}
+	sb.WriteString(" " + strconv.FormatInt(ts, 10))
+	return sb.String()
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// httpError is a response of the endpoint other than 204 No Content.
+type httpError struct {
+	status int
+	body   string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("influx responded %d: %s", e.status, e.body)
+}
+
+// retryable reports whether a failed write may succeed later, which is the
+// case for transport errors, throttling and server errors.
+func retryable(err error) bool {
+	if he, ok := err.(*httpError); ok {
+		return he.status == http.StatusTooManyRequests || he.status >= 500
+	}
+	return true
+}
+
+type httpSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpSink) write(lines []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(lines))
+	if err != nil {
+		return &httpError{status: http.StatusBadRequest, body: err.Error()}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return &httpError{status: rsp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	io.Copy(io.Discard, rsp.Body)
+	return nil
+}
+
+func (s *httpSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) write(lines []byte) error {
+	_, err := s.f.Write(lines)
+	return err
+}
+
+func (s *fileSink) close() error {
+	return s.f.Close()
+}
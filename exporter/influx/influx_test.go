@@ -0,0 +1,176 @@
+package influx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// stub is a local InfluxDB write endpoint.
+type stub struct {
+	*httptest.Server
+	lck      sync.Mutex
+	up       bool
+	accepted int // requests accepted before going down, negative for any
+	delay    time.Duration
+	lines    []string
+}
+
+func newStub() *stub {
+	s := &stub{up: true, accepted: -1}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		s.lck.Lock()
+		delay := s.delay
+		up := s.up && s.accepted != 0
+		if up {
+			s.lines = append(s.lines, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+			if s.accepted > 0 {
+				s.accepted--
+			}
+		}
+		s.lck.Unlock()
+		time.Sleep(delay)
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func (s *stub) set(up bool, accepted int) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.up, s.accepted = up, accepted
+}
+
+func (s *stub) received() []string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.lines
+}
+
+func power(ts int64) emu.Message {
+	return &emu.InstantaneousPowerDemand{TimeStamp: ts, Power: 1.5, DeviceMacId: "0x1", MeterMacId: "0x2"}
+}
+
+func spoolLines(t *testing.T, dir string) int {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, spoolFile))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "\n")
+}
+
+func TestSpool(t *testing.T) {
+	endpoint := newStub()
+	defer endpoint.Close()
+	dir := t.TempDir()
+	w, err := NewHTTPWriter(endpoint.URL+"/api/v2/write", WithBatchSize(2), WithSpoolDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	endpoint.set(false, -1)
+	for ts := int64(0); ts < 10; ts++ {
+		w.Write(power(ts))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolLines(t, dir); n != 10 {
+		t.Fatalf("%d points spooled, want 10", n)
+	}
+
+	// accepting one batch of the spool only
+	endpoint.set(true, 1)
+	w.Flush()
+	if n := spoolLines(t, dir); n != 8 {
+		t.Fatalf("%d points left in the spool, want 8", n)
+	}
+
+	endpoint.set(true, -1)
+	w.Write(power(10))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spoolLines(t, dir); n != 0 {
+		t.Errorf("%d points left in the spool, want none", n)
+	}
+	got := endpoint.received()
+	if len(got) != 11 {
+		t.Fatalf("%d points received, want 11", len(got))
+	}
+	for i, line := range got {
+		if !strings.HasSuffix(line, " "+strconv.Itoa(i)) {
+			t.Errorf("point %d is %q, out of order", i, line)
+		}
+	}
+}
+
+func TestMaxSpoolSize(t *testing.T) {
+	endpoint := newStub()
+	defer endpoint.Close()
+	endpoint.set(false, -1)
+	dir := t.TempDir()
+	w, err := NewHTTPWriter(endpoint.URL, WithBatchSize(1), WithSpoolDir(dir), WithMaxSpoolSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for ts := int64(0); ts < 100; ts++ {
+		w.Write(power(ts))
+	}
+	w.Flush()
+	info, err := os.Stat(filepath.Join(dir, spoolFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1024 {
+		t.Errorf("spool of %d bytes, want at most 1024", info.Size())
+	}
+}
+
+func TestSlowEndpoint(t *testing.T) {
+	endpoint := newStub()
+	defer endpoint.Close()
+	endpoint.lck.Lock()
+	endpoint.delay = 100 * time.Millisecond
+	endpoint.lck.Unlock()
+	w, err := NewHTTPWriter(endpoint.URL, WithBatchSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	start := time.Now()
+	for ts := int64(0); ts < 10000; ts++ {
+		w.Write(power(ts))
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("writing took %s, held up by the endpoint", d)
+	}
+}
+
+func TestLines(t *testing.T) {
+	got := Lines(&emu.InstantaneousPowerDemand{TimeStamp: 1655127645, Power: 1.189, DeviceMacId: "0x1", MeterMacId: "a b,c"})
+	want := `emu_power,device_mac_id=0x1,meter_mac_id=a\ b\,c power_kw=1.189 1655127645`
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("Lines = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+// Package prometheus exports EMU-2 meter readings and the health of the emu
+// client as Prometheus metrics.
+//
+// An Exporter is both an emu.Metrics collector, to be passed to emu.NewEmu via
+// emu.WithMetrics, and a subscriber of the meter readings published by the
+// device. Handler serves everything it gathered on a /metrics endpoint.
+//
+// The readings are exposed without timestamp, at the time of the scrape: the
+// device clock may drift or be unset, and Prometheus drops the samples
+// timestamped out of its bounds. The device time of the latest reading is a
+// metric of its own.
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/internal/meter"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "emu"
+
+var readingNames = []emu.MessageName{
+	emu.InstantaneousPower, emu.CumulativeEnergy, emu.NetworkInfo, emu.Price,
+}
+
+// Exporter keeps the latest reading per meter and counts the client internal
+// events. It is safe for concurrent use.
+type Exporter struct {
+	registry *prom.Registry
+
+	messages    *prom.CounterVec
+	parseErrors *prom.CounterVec
+	cmdLatency  *prom.HistogramVec
+	reconnects  prom.Counter
+	clockDrift  prom.Gauge
+
+	lck          sync.Mutex
+	power        map[meter.Key]*emu.InstantaneousPowerDemand
+	energy       map[meter.Key]*emu.CumulativeEnergyConsumption
+	price        map[meter.Key]*emu.CurrentPrice
+	linkStrength map[string]int64
+
+	demandDesc    *prom.Desc
+	deliveredDesc *prom.Desc
+	receivedDesc  *prom.Desc
+	priceDesc     *prom.Desc
+	tierDesc      *prom.Desc
+	linkDesc      *prom.Desc
+	readingDesc   *prom.Desc
+}
+
+// NewExporter creates an Exporter with its own registry, which also carries
+// the standard Go runtime and process collectors.
+func NewExporter() *Exporter {
+	meterLabels := []string{"device_mac", "meter_mac"}
+	x := &Exporter{
+		registry: prom.NewRegistry(),
+		messages: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_received_total",
+			Help:      "Number of messages read from the device, by message type.",
+		}, []string{"type"}),
+		parseErrors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "parse_errors_total",
+			Help:      "Number of messages that could not be parsed, by message type.",
+		}, []string{"type"}),
+		cmdLatency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_latency_seconds",
+			Help:      "Time between sending a command and receiving its response.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15},
+		}, []string{"command"}),
+		reconnects: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Number of times the connection to the device was re-established.",
+		}),
+		clockDrift: prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "clock_drift_seconds",
+			Help:      "Device clock minus host clock at the last TimeCluster.",
+		}),
+		power:        make(map[meter.Key]*emu.InstantaneousPowerDemand),
+		energy:       make(map[meter.Key]*emu.CumulativeEnergyConsumption),
+		price:        make(map[meter.Key]*emu.CurrentPrice),
+		linkStrength: make(map[string]int64),
+		demandDesc: prom.NewDesc(namespace+"_instantaneous_demand_kilowatts",
+			"Instantaneous demand reported by the meter.", meterLabels, nil),
+		deliveredDesc: prom.NewDesc(namespace+"_energy_delivered_kilowatt_hours_total",
+			"Energy delivered from the grid as reported by the meter.", meterLabels, nil),
+		receivedDesc: prom.NewDesc(namespace+"_energy_received_kilowatt_hours_total",
+			"Energy received by the grid as reported by the meter.", meterLabels, nil),
+		priceDesc: prom.NewDesc(namespace+"_price_per_kilowatt_hour",
+			"Current price per kWh published by the meter.", append(meterLabels, "currency"), nil),
+		tierDesc: prom.NewDesc(namespace+"_price_tier",
+			"Current price tier published by the meter.", meterLabels, nil),
+		linkDesc: prom.NewDesc(namespace+"_link_strength_percent",
+			"Strength of the Zigbee link between the device and the meter.", []string{"device_mac"}, nil),
+		readingDesc: prom.NewDesc(namespace+"_reading_timestamp_seconds",
+			"Device time of the latest reading, by reading.", append(meterLabels, "reading"), nil),
+	}
+	x.registry.MustRegister(
+		prom.NewGoCollector(),
+		prom.NewProcessCollector(prom.ProcessCollectorOpts{}),
+		x.messages, x.parseErrors, x.cmdLatency, x.reconnects, x.clockDrift,
+		x,
+	)
+	return x
+}
+
+// Handler returns the http.Handler serving the metrics in the Prometheus
+// exposition format.
+func (x *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(x.registry, promhttp.HandlerOpts{Registry: x.registry})
+}
+
+// Run subscribes to the meter readings of device and records them until ctx
+// is done.
+func (x *Exporter) Run(ctx context.Context, device emu.Emu) error {
+	chs := make(map[emu.MessageName]chan emu.Message, len(readingNames))
+	defer func() {
+		for mn, ch := range chs {
+			device.Unsubscribe(mn, ch)
+		}
+	}()
+	for _, mn := range readingNames {
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		chs[mn] = ch
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-chs[emu.InstantaneousPower]:
+			x.Record(msg)
+		case msg := <-chs[emu.CumulativeEnergy]:
+			x.Record(msg)
+		case msg := <-chs[emu.NetworkInfo]:
+			x.Record(msg)
+		case msg := <-chs[emu.Price]:
+			x.Record(msg)
+		}
+	}
+}
+
+// Record stores msg as the latest reading of its kind. Messages without a
+// metric are ignored.
+func (x *Exporter) Record(msg emu.Message) {
+	x.lck.Lock()
+	defer x.lck.Unlock()
+	switch m := msg.(type) {
+	case *emu.InstantaneousPowerDemand:
+		x.power[meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}] = m
+	case *emu.CumulativeEnergyConsumption:
+		x.energy[meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}] = m
+	case *emu.CurrentPrice:
+		x.price[meter.Key{DeviceMacId: m.DeviceMacId, MeterMacId: m.MeterMacId}] = m
+	default:
+		if emu.MessageName(msg.GetName()) != emu.NetworkInfo {
+			return
+		}
+		mac, _ := msg.GetAttrib("DeviceMacId")
+		link, ok := msg.GetAttrib("LinkStrength")
+		if !ok {
+			return
+		}
+		if mac, ok := mac.(string); ok {
+			if link, ok := link.(int64); ok {
+				x.linkStrength[mac] = link
+			}
+		}
+	}
+}
+
+// Describe implements prometheus.Collector for the meter readings.
+func (x *Exporter) Describe(ch chan<- *prom.Desc) {
+	ch <- x.demandDesc
+	ch <- x.deliveredDesc
+	ch <- x.receivedDesc
+	ch <- x.priceDesc
+	ch <- x.tierDesc
+	ch <- x.linkDesc
+	ch <- x.readingDesc
+}
+
+// Collect implements prometheus.Collector for the meter readings.
+func (x *Exporter) Collect(ch chan<- prom.Metric) {
+	x.lck.Lock()
+	defer x.lck.Unlock()
+	for k, m := range x.power {
+		ch <- prom.MustNewConstMetric(x.demandDesc, prom.GaugeValue, m.Power, k.DeviceMacId, k.MeterMacId)
+		ch <- prom.MustNewConstMetric(x.readingDesc, prom.GaugeValue, float64(m.TimeStamp), k.DeviceMacId, k.MeterMacId, "demand")
+	}
+	for k, m := range x.energy {
+		ch <- prom.MustNewConstMetric(x.deliveredDesc, prom.CounterValue, m.Delivered, k.DeviceMacId, k.MeterMacId)
+		ch <- prom.MustNewConstMetric(x.receivedDesc, prom.CounterValue, m.Received, k.DeviceMacId, k.MeterMacId)
+		ch <- prom.MustNewConstMetric(x.readingDesc, prom.GaugeValue, float64(m.TimeStamp), k.DeviceMacId, k.MeterMacId, "energy")
+	}
+	for k, m := range x.price {
+		ch <- prom.MustNewConstMetric(x.priceDesc, prom.GaugeValue, m.Price, k.DeviceMacId, k.MeterMacId, strconv.Itoa(m.Currency))
+		ch <- prom.MustNewConstMetric(x.tierDesc, prom.GaugeValue, float64(m.Tier), k.DeviceMacId, k.MeterMacId)
+		ch <- prom.MustNewConstMetric(x.readingDesc, prom.GaugeValue, float64(m.TimeStamp), k.DeviceMacId, k.MeterMacId, "price")
+	}
+	for mac, link := range x.linkStrength {
+		ch <- prom.MustNewConstMetric(x.linkDesc, prom.GaugeValue, float64(link), mac)
+	}
+}
+
+// MessageReceived implements emu.Metrics.
+func (x *Exporter) MessageReceived(name string) {
+	x.messages.WithLabelValues(name).Inc()
+}
+
+// ParseError implements emu.Metrics.
+func (x *Exporter) ParseError(name string) {
+	x.parseErrors.WithLabelValues(name).Inc()
+}
+
+// CommandCompleted implements emu.Metrics.
+func (x *Exporter) CommandCompleted(id emu.CommandId, latency time.Duration) {
+	x.cmdLatency.WithLabelValues(id.String()).Observe(latency.Seconds())
+}
+
+// Reconnected implements emu.Metrics.
+func (x *Exporter) Reconnected() {
+	x.reconnects.Inc()
+}
+
+// ClockDrift implements emu.Metrics.
+func (x *Exporter) ClockDrift(drift time.Duration) {
+	x.clockDrift.Set(drift.Seconds())
+}
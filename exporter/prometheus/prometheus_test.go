@@ -0,0 +1,40 @@
+package prometheus
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kbhuyan/emu"
+)
+
+func scrape(t *testing.T, x *Exporter) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	x.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReadings(t *testing.T) {
+	x := NewExporter()
+	// a device clock a year behind
+	x.Record(&emu.InstantaneousPowerDemand{TimeStamp: 1600000000, Power: 1.25, DeviceMacId: "0x1", MeterMacId: "0x2"})
+	x.Record(&emu.CumulativeEnergyConsumption{TimeStamp: 1600000060, Delivered: 100.5, Received: 2, DeviceMacId: "0x1", MeterMacId: "0x2"})
+	out := scrape(t, x)
+	for _, want := range []string{
+		`emu_instantaneous_demand_kilowatts{device_mac="0x1",meter_mac="0x2"} 1.25` + "\n",
+		`emu_energy_delivered_kilowatt_hours_total{device_mac="0x1",meter_mac="0x2"} 100.5` + "\n",
+		`emu_energy_received_kilowatt_hours_total{device_mac="0x1",meter_mac="0x2"} 2` + "\n",
+		`emu_reading_timestamp_seconds{device_mac="0x1",meter_mac="0x2",reading="demand"} 1.6e+09` + "\n",
+		`emu_reading_timestamp_seconds{device_mac="0x1",meter_mac="0x2",reading="energy"} 1.60000006e+09` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
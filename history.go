@@ -0,0 +1,52 @@
+package emu
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kbhuyan/emu/history"
+)
+
+// History answers queries over the readings persisted with WithHistory.
+type History struct {
+	store *history.Store
+}
+
+func openHistory(dir string, opts []history.Option) (*History, error) {
+	store, err := history.Open(dir, opts...)
+	if err != nil {
+		return nil, ErrDeviceIO.Errorf("unable to open history %s: %+v", dir, err)
+	}
+	return &History{store: store}, nil
+}
+
+// record persists the value of the messages kept in the history, Power for
+// InstantaneousPower and Energy for CumulativeEnergy, in a series per meter.
+func (h *History) record(m Message) error {
+	switch msg := m.(type) {
+	case *InstantaneousPowerDemand:
+		return h.store.Append(seriesName(InstantaneousPower, msg.MeterMacId), time.Unix(msg.TimeStamp, 0), msg.Power)
+	case *CumulativeEnergyConsumption:
+		return h.store.Append(seriesName(CumulativeEnergy, msg.MeterMacId), time.Unix(msg.TimeStamp, 0), msg.Energy)
+	}
+	return nil
+}
+
+// Range returns the readings of name of the meter within [from, to)
+// downsampled to step, or every reading when step is zero. The readings
+// without a MeterMacId are those of the empty meter.
+func (h *History) Range(name MessageName, meter string, from, to time.Time, step time.Duration) ([]history.Point, error) {
+	return h.store.Range(seriesName(name, meter), from, to, step)
+}
+
+// seriesName returns the series of the readings of name of the meter.
+func seriesName(name MessageName, meter string) string {
+	if meter == "" {
+		return string(name)
+	}
+	return string(name) + "-" + strings.ToLower(meter)
+}
+
+func (h *History) close() error {
+	return h.store.Close()
+}
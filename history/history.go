@@ -0,0 +1,370 @@
+// Package history is an embedded, append-only time-series store for meter
+// readings.
+//
+// Every series lives in its own directory holding segment files of fixed
+// size records and an index.json describing them. The active segment is
+// sealed once it spans SegmentDuration, sealed segments older than
+// CompactAfter are downsampled to CompactStep, and segments older than
+// Retention are removed.
+package history
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const indexFile = "index.json"
+
+type Options struct {
+	SegmentDuration time.Duration
+	CompactAfter    time.Duration // zero disables compaction
+	CompactStep     time.Duration
+	Retention       time.Duration // zero keeps the history forever
+}
+
+type Option func(*Options)
+
+func WithSegmentDuration(d time.Duration) Option {
+	return func(o *Options) {
+		o.SegmentDuration = d
+	}
+}
+
+// WithCompaction downsamples the segments older than after to the mean of
+// every step.
+func WithCompaction(after time.Duration, step time.Duration) Option {
+	return func(o *Options) {
+		o.CompactAfter = after
+		o.CompactStep = step
+	}
+}
+
+func WithRetention(d time.Duration) Option {
+	return func(o *Options) {
+		o.Retention = d
+	}
+}
+
+// Point is a downsampled value of a series over [Time, Time+step).
+type Point struct {
+	Time  time.Time
+	Min   float64
+	Max   float64
+	Mean  float64
+	Last  float64
+	Count int
+}
+
+// Store is a set of series persisted in a directory. It is safe for
+// concurrent use.
+type Store struct {
+	dir    string
+	opt    *Options
+	lck    sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	dir      string
+	segments []segment // sealed segments followed by the active one
+	active   *os.File
+}
+
+// Open opens, or creates, the store in dir.
+func Open(dir string, opts ...Option) (*Store, error) {
+	options := &Options{
+		SegmentDuration: 24 * time.Hour,
+		CompactAfter:    7 * 24 * time.Hour,
+		CompactStep:     time.Minute,
+		Retention:       365 * 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.SegmentDuration <= 0 {
+		return nil, fmt.Errorf("invalid segment duration %s", options.SegmentDuration)
+	}
+	if options.CompactAfter > 0 && options.CompactStep < time.Second {
+		return nil, fmt.Errorf("invalid compaction step %s", options.CompactStep)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, opt: options, series: make(map[string]*series)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if _, err := s.open(entry.Name()); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := s.Maintain(time.Now()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the active segments.
+func (s *Store) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	var errs []error
+	for _, ser := range s.series {
+		if ser.active != nil {
+			errs = append(errs, ser.active.Close())
+			ser.active = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Append adds the value of the named series at ts.
+func (s *Store) Append(name string, ts time.Time, value float64) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	ser, err := s.open(name)
+	if err != nil {
+		return err
+	}
+	r := record{ts: ts.Unix(), value: value}
+	cur := &ser.segments[len(ser.segments)-1]
+	if cur.Count > 0 && r.ts-cur.Min >= int64(s.opt.SegmentDuration/time.Second) {
+		if err := ser.rotate(r.ts); err != nil {
+			return err
+		}
+		cur = &ser.segments[len(ser.segments)-1]
+		// a failed maintenance is retried on the next rotation, the sample is kept regardless
+		defer s.maintain(time.Now())
+	}
+	b := make([]byte, recordSize)
+	encodeRecord(b, r)
+	if _, err := ser.active.Write(b); err != nil {
+		return err
+	}
+	cur.add(r)
+	return nil
+}
+
+// Range returns the values of the named series within [from, to)
+// downsampled to step. A zero step returns every sample as a point.
+func (s *Store) Range(name string, from, to time.Time, step time.Duration) ([]Point, error) {
+	if step < 0 {
+		return nil, fmt.Errorf("invalid step %s", step)
+	}
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	ser, ok := s.series[name]
+	if !ok {
+		return nil, nil
+	}
+	start, end := from.Unix(), to.Unix()
+	var records []record
+	for _, seg := range ser.segments {
+		if !seg.overlaps(start, end) {
+			continue
+		}
+		rs, err := readSegment(filepath.Join(ser.dir, seg.File))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			if r.ts >= start && r.ts < end {
+				records = append(records, r)
+			}
+		}
+	}
+	slices.SortStableFunc(records, func(a, b record) int {
+		return cmp.Compare(a.ts, b.ts)
+	})
+	return downsample(records, start, int64(step/time.Second)), nil
+}
+
+// Maintain compacts and removes the old segments as of now. It runs on Open
+// and whenever a segment is sealed.
+func (s *Store) Maintain(now time.Time) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.maintain(now)
+}
+
+func (s *Store) maintain(now time.Time) error {
+	var errs []error
+	for _, ser := range s.series {
+		if err := ser.maintain(now, s.opt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// open returns the named series, loading or creating it on first use.
+func (s *Store) open(name string) (*series, error) {
+	if ser, ok := s.series[name]; ok {
+		return ser, nil
+	}
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid series name %q", name)
+	}
+	ser := &series{dir: filepath.Join(s.dir, name)}
+	if err := os.MkdirAll(ser.dir, 0o755); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(ser.dir, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &ser.segments); err != nil {
+			return nil, fmt.Errorf("corrupt index of %s: %w", name, err)
+		}
+	}
+	// the statistics of the active segment are not in the index
+	file := segmentName(time.Now().Unix())
+	if len(ser.segments) > 0 {
+		file = ser.segments[len(ser.segments)-1].File
+		ser.segments = ser.segments[:len(ser.segments)-1]
+	}
+	f, seg, err := openActive(ser.dir, file)
+	if err != nil {
+		return nil, err
+	}
+	ser.active = f
+	ser.segments = append(ser.segments, seg)
+	if err := ser.writeIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.series[name] = ser
+	return ser, nil
+}
+
+// rotate seals the active segment and starts a new one at ts.
+func (ser *series) rotate(ts int64) error {
+	if err := ser.active.Sync(); err != nil {
+		return err
+	}
+	if err := ser.active.Close(); err != nil {
+		return err
+	}
+	f, seg, err := openActive(ser.dir, segmentName(ts))
+	if err != nil {
+		return err
+	}
+	ser.active = f
+	ser.segments = append(ser.segments, seg)
+	return ser.writeIndex()
+}
+
+func (ser *series) maintain(now time.Time, opt *Options) error {
+	sealed := ser.segments[:len(ser.segments)-1]
+	kept := make([]segment, 0, len(ser.segments))
+	changed := false
+	for _, seg := range sealed {
+		path := filepath.Join(ser.dir, seg.File)
+		if opt.Retention > 0 && seg.Max < now.Add(-opt.Retention).Unix() {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			changed = true
+			continue
+		}
+		step := int64(opt.CompactStep / time.Second)
+		if opt.CompactAfter > 0 && seg.Step < step && seg.Max < now.Add(-opt.CompactAfter).Unix() {
+			compacted, err := compact(path, step)
+			if err != nil {
+				return err
+			}
+			compacted.File = seg.File
+			seg = compacted
+			changed = true
+		}
+		kept = append(kept, seg)
+	}
+	if !changed {
+		return nil
+	}
+	ser.segments = append(kept, ser.segments[len(ser.segments)-1])
+	return ser.writeIndex()
+}
+
+// compact replaces the samples of a segment by their mean over every step.
+func compact(path string, step int64) (segment, error) {
+	records, err := readSegment(path)
+	if err != nil {
+		return segment{}, err
+	}
+	slices.SortStableFunc(records, func(a, b record) int {
+		return cmp.Compare(a.ts, b.ts)
+	})
+	var start int64
+	if len(records) > 0 {
+		start = records[0].ts - mod(records[0].ts, step)
+	}
+	points := downsample(records, start, step)
+	compacted := make([]record, len(points))
+	seg := segment{Step: step}
+	for i, p := range points {
+		compacted[i] = record{ts: p.Time.Unix(), value: p.Mean}
+		seg.add(compacted[i])
+	}
+	return seg, writeSegment(path, compacted)
+}
+
+// writeIndex atomically rewrites the index of the series.
+func (ser *series) writeIndex() error {
+	b, err := json.MarshalIndent(ser.segments, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ser.dir, indexFile)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// downsample aggregates the time ordered records into buckets of step
+// seconds aligned on start.
+func downsample(records []record, start int64, step int64) []Point {
+	points := make([]Point, 0, len(records))
+	for _, r := range records {
+		bucket := r.ts
+		if step > 0 {
+			bucket = r.ts - mod(r.ts-start, step)
+		}
+		if n := len(points); n > 0 && points[n-1].Time.Unix() == bucket {
+			p := &points[n-1]
+			p.Min = min(p.Min, r.value)
+			p.Max = max(p.Max, r.value)
+			p.Mean += (r.value - p.Mean) / float64(p.Count+1)
+			p.Last = r.value
+			p.Count++
+			continue
+		}
+		points = append(points, Point{
+			Time: time.Unix(bucket, 0), Min: r.value, Max: r.value, Mean: r.value, Last: r.value, Count: 1,
+		})
+	}
+	return points
+}
+
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
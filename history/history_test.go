@@ -0,0 +1,158 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRange(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	// 0, 1, ..., 5 every 10s, out of order within the last minute
+	for i := range 60 {
+		if err := s.Append("P", start.Add(time.Duration(i)*10*time.Second), float64(i%6)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append("P", start.Add(5*time.Second), 10); err != nil {
+		t.Fatal(err)
+	}
+	points, err := s.Range("P", start, start.Add(10*time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 10 {
+		t.Fatalf("%d points, want 10", len(points))
+	}
+	p := points[0]
+	if !p.Time.Equal(start) || p.Count != 7 || p.Min != 0 || p.Max != 10 || p.Last != 5 {
+		t.Errorf("first point %+v", p)
+	}
+	if want := 25.0 / 7; p.Mean < want-1e-9 || p.Mean > want+1e-9 {
+		t.Errorf("mean %g, want %g", p.Mean, want)
+	}
+	if p := points[9]; !p.Time.Equal(start.Add(9*time.Minute)) || p.Count != 6 || p.Mean != 2.5 {
+		t.Errorf("last point %+v", p)
+	}
+
+	// the buckets are aligned on from, which is excluded from the end
+	points, err = s.Range("P", start.Add(30*time.Second), start.Add(90*time.Second), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || !points[0].Time.Equal(start.Add(30*time.Second)) || points[0].Count != 6 {
+		t.Errorf("points %+v, want one of 6 samples from 30s", points)
+	}
+	// every sample without step
+	if points, _ := s.Range("P", start, start.Add(time.Minute), 0); len(points) != 7 {
+		t.Errorf("%d raw points, want 7", len(points))
+	}
+	if points, err := s.Range("Q", start, start.Add(time.Minute), 0); points != nil || err != nil {
+		t.Errorf("unknown series: %v, %v", points, err)
+	}
+	if _, err := s.Range("P", start, start.Add(time.Minute), -time.Second); err == nil {
+		t.Error("negative step accepted")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithSegmentDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+	// three segments of an hour
+	for i := range 3 * 60 {
+		if err := s.Append("P", start.Add(time.Duration(i)*time.Minute), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Open(dir, WithSegmentDuration(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.series["P"].segments); n != 3 {
+		t.Errorf("%d segments, want 3", n)
+	}
+	if err := s.Append("P", start.Add(3*time.Hour), 2); err != nil {
+		t.Fatal(err)
+	}
+	points, err := s.Range("P", start, start.Add(4*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 4 || points[0].Count != 60 || points[3].Count != 1 || points[3].Mean != 2 {
+		t.Errorf("points %+v", points)
+	}
+}
+
+func TestCompactionAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, WithSegmentDuration(24*time.Hour), WithCompaction(3*24*time.Hour, time.Minute),
+		WithRetention(9*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Hour)
+	base := now.Add(-10 * 24 * time.Hour)
+	for i := range 10 * 24 * 360 {
+		if err := s.Append("P", base.Add(time.Duration(i)*10*time.Second), float64(i%6)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Maintain(now); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the first day is past the retention
+	if points, _ := s.Range("P", base, base.Add(24*time.Hour), 0); len(points) != 0 {
+		t.Errorf("%d samples of the first day kept", len(points))
+	}
+	// a week old hour is compacted to the mean of every minute
+	hour := now.Add(-5 * 24 * time.Hour)
+	points, err := s.Range("P", hour, hour.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 60 || points[0].Mean != 2.5 {
+		t.Errorf("%d compacted samples of mean %g, want 60 of 2.5", len(points), points[0].Mean)
+	}
+	// the last day is kept as is
+	points, _ = s.Range("P", now.Add(-time.Hour), now, 0)
+	if len(points) != 360 {
+		t.Errorf("%d recent samples, want 360", len(points))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "P", indexFile)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := Open(t.TempDir(), WithSegmentDuration(0)); err == nil {
+		t.Error("zero segment duration accepted")
+	}
+	if _, err := Open(t.TempDir(), WithCompaction(time.Hour, time.Millisecond)); err == nil {
+		t.Error("sub-second compaction step accepted")
+	}
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, name := range []string{"", ".", "..", "../P", "a/b"} {
+		if err := s.Append(name, time.Now(), 1); err == nil {
+			t.Errorf("series %q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package history
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// recordSize is the size of a record in a segment file: the unix time of the
+// sample followed by its value, both little endian.
+const recordSize = 16
+
+type record struct {
+	ts    int64
+	value float64
+}
+
+// segment describes a segment file of a series as kept in its index.
+type segment struct {
+	File  string `json:"file"`
+	Min   int64  `json:"min"`
+	Max   int64  `json:"max"`
+	Count int    `json:"count"`
+	// Step is the resolution, in seconds, the segment was compacted to. Zero
+	// means it holds the raw samples.
+	Step int64 `json:"step,omitempty"`
+}
+
+func segmentName(start int64) string {
+	return strconv.FormatInt(start, 10) + ".seg"
+}
+
+func (s *segment) add(r record) {
+	if s.Count == 0 || r.ts < s.Min {
+		s.Min = r.ts
+	}
+	if s.Count == 0 || r.ts > s.Max {
+		s.Max = r.ts
+	}
+	s.Count++
+}
+
+func (s *segment) overlaps(from, to int64) bool {
+	return s.Count > 0 && s.Min < to && s.Max >= from
+}
+
+func encodeRecord(b []byte, r record) {
+	binary.LittleEndian.PutUint64(b[0:8], uint64(r.ts))
+	binary.LittleEndian.PutUint64(b[8:16], math.Float64bits(r.value))
+}
+
+func decodeRecord(b []byte) record {
+	return record{
+		ts:    int64(binary.LittleEndian.Uint64(b[0:8])),
+		value: math.Float64frombits(binary.LittleEndian.Uint64(b[8:16])),
+	}
+}
+
+// readSegment reads all complete records of a segment file. A trailing
+// partial record, left by an interrupted write, is ignored.
+func readSegment(path string) ([]record, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]record, 0, len(b)/recordSize)
+	for off := 0; off+recordSize <= len(b); off += recordSize {
+		records = append(records, decodeRecord(b[off:off+recordSize]))
+	}
+	return records, nil
+}
+
+// writeSegment atomically replaces the segment file with records.
+func writeSegment(path string, records []record) error {
+	b := make([]byte, len(records)*recordSize)
+	for i, r := range records {
+		encodeRecord(b[i*recordSize:], r)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openActive opens the segment file for appending, truncating a trailing
+// partial record, and returns its description.
+func openActive(dir string, file string) (*os.File, segment, error) {
+	seg := segment{File: file}
+	path := filepath.Join(dir, file)
+	records, err := readSegment(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, seg, err
+	}
+	for _, r := range records {
+		seg.add(r)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, seg, err
+	}
+	if err := f.Truncate(int64(len(records) * recordSize)); err != nil {
+		f.Close()
+		return nil, seg, fmt.Errorf("truncate %s: %w", path, err)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, seg, err
+	}
+	return f, seg, nil
+}
@@ -0,0 +1,31 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryMeters(t *testing.T) {
+	h, err := openHistory(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, m := range []Message{
+		&InstantaneousPowerDemand{MeterMacId: "0x00135003000AAAA", TimeStamp: start.Unix(), Power: 1},
+		&InstantaneousPowerDemand{MeterMacId: "0x00135003000bbbb", TimeStamp: start.Unix() + 1, Power: 5},
+		&InstantaneousPowerDemand{MeterMacId: "0x00135003000aaaa", TimeStamp: start.Unix() + 2, Power: 3},
+		&InstantaneousPowerDemand{TimeStamp: start.Unix() + 3, Power: 9},
+	} {
+		if err := h.record(m); err != nil {
+			t.Fatalf("reading %d: %v", i, err)
+		}
+	}
+	for meter, mean := range map[string]float64{"0x00135003000aaaa": 2, "0x00135003000BBBB": 5, "": 9} {
+		points, err := h.Range(InstantaneousPower, meter, start, start.Add(time.Minute), time.Minute)
+		if err != nil || len(points) != 1 || points[0].Mean != mean {
+			t.Errorf("meter %q: %+v, %v, want a mean of %v", meter, points, err, mean)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Package meter holds the helpers shared by the packages processing the
+// readings of the meters.
+package meter
+
+import "math"
+
+// Key identifies the readings of a meter, as several devices may read the
+// same meter.
+type Key struct {
+	DeviceMacId string
+	MeterMacId  string
+}
+
+// Round rounds f to decimals digits, halves away from zero, hiding the float
+// noise of the sums and differences of readings.
+func Round(f float64, decimals int) float64 {
+	scale := math.Pow10(decimals)
+	return math.Round(f*scale) / scale
+}
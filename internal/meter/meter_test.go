@@ -0,0 +1,21 @@
+package meter
+
+import "testing"
+
+func TestRound(t *testing.T) {
+	for _, c := range []struct {
+		f        float64
+		decimals int
+		want     float64
+	}{
+		{0.1 + 0.2, 6, 0.3},
+		{-(0.1 + 0.2), 6, -0.3},
+		{1.0005, 3, 1.001},
+		{-1.2345, 3, -1.235},
+		{2, 0, 2},
+	} {
+		if got := Round(c.f, c.decimals); got != c.want {
+			t.Errorf("Round(%v, %d) = %v, want %v", c.f, c.decimals, got, c.want)
+		}
+	}
+}
@@ -4,14 +4,22 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 )
 
+const logFlags = log.Ldate | log.Ltime | log.Lshortfile
+
+// The loggers are shared by the sessions of the process. Their output is
+// changed in place, so that the goroutines of the sessions may log meanwhile.
 var (
-	DebugLogger   *log.Logger
-	WarningLogger *log.Logger
-	InfoLogger    *log.Logger
-	ErrorLogger   *log.Logger
+	DebugLogger             = log.New(io.Discard, "DEBUG: ", logFlags)
+	WarningLogger           = log.New(io.Discard, "WARNING: ", logFlags)
+	InfoLogger              = log.New(io.Discard, "INFO: ", logFlags)
+	ErrorLogger             = log.New(io.Discard, "ERROR: ", logFlags)
 	logFile       io.Writer = os.Stdout
+
+	logLck   sync.Mutex
+	sessions int // sessions open, see initSessionLog
 )
 
 func init() {
@@ -41,8 +49,39 @@ func initLog(file io.Writer, l LogLevel) {
 	default:
 		debugFile, infoFile, warningFile, errorFile = io.Discard, io.Discard, io.Discard, io.Discard
 	}
-	DebugLogger = log.New(debugFile, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-	InfoLogger = log.New(infoFile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	WarningLogger = log.New(warningFile, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLogger = log.New(errorFile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	DebugLogger.SetOutput(debugFile)
+	InfoLogger.SetOutput(infoFile)
+	WarningLogger.SetOutput(warningFile)
+	ErrorLogger.SetOutput(errorFile)
+}
+
+// SetLogging sets the output and level of the loggers, for the programs
+// logging without opening a session.
+func SetLogging(w io.Writer, l LogLevel) {
+	logLck.Lock()
+	defer logLck.Unlock()
+	initLog(w, l)
+}
+
+// initSessionLog applies the logging options of a session being opened,
+// unless another session is open: its logging is not changed under it.
+func initSessionLog(opt *EmuOptions) {
+	logLck.Lock()
+	defer logLck.Unlock()
+	if sessions == 0 {
+		initLog(opt.LogWriter, opt.LogLevel)
+	}
+}
+
+// sessionOpened and sessionClosed count the sessions open.
+func sessionOpened() {
+	logLck.Lock()
+	defer logLck.Unlock()
+	sessions++
+}
+
+func sessionClosed() {
+	logLck.Lock()
+	defer logLck.Unlock()
+	sessions = max(sessions-1, 0)
 }
@@ -0,0 +1,38 @@
+package emu
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// The logging of a session is not changed by the sessions opened meanwhile.
+func TestSessionLog(t *testing.T) {
+	defer initLog(io.Discard, LOG_OFF)
+	var first, second strings.Builder
+	initSessionLog(&EmuOptions{LogWriter: &first, LogLevel: LOG_WARNING})
+	sessionOpened()
+	initSessionLog(&EmuOptions{LogWriter: &second, LogLevel: LOG_ALL})
+	WarningLogger.Print("reconnecting")
+	DebugLogger.Print("sending command")
+	if !strings.Contains(first.String(), "WARNING: ") || strings.Contains(first.String(), "DEBUG") || second.Len() != 0 {
+		t.Errorf("logged %q and %q", first.String(), second.String())
+	}
+	sessionClosed()
+	initSessionLog(&EmuOptions{LogWriter: &second, LogLevel: LOG_ALL})
+	DebugLogger.Print("sending command")
+	if !strings.Contains(second.String(), "DEBUG: ") {
+		t.Errorf("logging of the next session not applied: %q", second.String())
+	}
+}
+
+func TestSetLogging(t *testing.T) {
+	defer initLog(io.Discard, LOG_OFF)
+	var b strings.Builder
+	SetLogging(&b, LOG_WARNING)
+	WarningLogger.Print("client replaced")
+	InfoLogger.Print("client connected")
+	if !strings.Contains(b.String(), "client replaced") || strings.Contains(b.String(), "INFO") {
+		t.Errorf("logged %q", b.String())
+	}
+}
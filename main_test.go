@@ -0,0 +1,13 @@
+package emu
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the loggers are shared by the sessions of the tests
+	initLog(io.Discard, LOG_OFF)
+	os.Exit(m.Run())
+}
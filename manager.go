@@ -0,0 +1,321 @@
+package emu
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu/util"
+)
+
+// DeviceMessage is a message received from one of the devices of a Manager.
+type DeviceMessage struct {
+	Device      string // name the device was added with
+	DeviceMacId string
+	Message     Message
+}
+
+// ManagedDevice describes a device of a Manager.
+type ManagedDevice struct {
+	Name        string
+	Path        string
+	DeviceMacId string // empty until the device is identified
+	Connected   bool
+}
+
+type managedDevice struct {
+	ManagedDevice
+	opts  []EmuOption
+	emu   Emu
+	cmdMu sync.Mutex // a device answers one command at a time
+}
+
+// Manager supervises several devices in one process: it opens them, retrying
+// until each one opens, identifies them by DeviceMacId, merges their message
+// streams and routes commands to them by name or DeviceMacId. Once open, a
+// device reconnects on its own when its port goes away, as any session does.
+//
+// The loggers are shared by all the devices, so the logging options should
+// be given to NewManager rather than to Add.
+type Manager struct {
+	opts    []EmuOption
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lck     sync.Mutex
+	changed chan struct{} // closed and replaced when a device changes
+	devices []*managedDevice
+	pubsub  *util.PubSub[MessageName, DeviceMessage]
+}
+
+// NewManager returns a Manager opening its devices with opts.
+func NewManager(opts ...EmuOption) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		pubsub:  util.NewPubSub[MessageName, DeviceMessage](),
+	}
+}
+
+// Add supervises the device at path under name, with opts added to the
+// options of the Manager. The device is opened in the background, retrying
+// until it succeeds.
+func (m *Manager) Add(name string, path string, opts ...EmuOption) error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	for _, d := range m.devices {
+		if d.Name == name || d.Path == path {
+			return fmt.Errorf("device %s (%s) already added", name, path)
+		}
+	}
+	d := &managedDevice{
+		ManagedDevice: ManagedDevice{Name: name, Path: path},
+		opts:          append(slices.Clone(m.opts), opts...),
+	}
+	m.devices = append(m.devices, d)
+	m.wg.Add(1)
+	go m.supervise(d)
+	return nil
+}
+
+// Discover adds the devices whose path matches pattern, e.g. /dev/ttyACM*,
+// named after their path, and returns their names.
+func (m *Manager) Discover(pattern string) ([]string, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if err := m.Add(name, path); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Devices returns the devices in the order they were added.
+func (m *Manager) Devices() []ManagedDevice {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	devices := make([]ManagedDevice, len(m.devices))
+	for i, d := range m.devices {
+		devices[i] = d.ManagedDevice
+	}
+	return devices
+}
+
+// Device returns the connected device of the given name or DeviceMacId.
+func (m *Manager) Device(id string) (Emu, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	d, err := m.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return d.emu, nil
+}
+
+// WaitDevice waits until the device of the given name or DeviceMacId is
+// connected and identified, or ctx is done.
+func (m *Manager) WaitDevice(ctx context.Context, id string) (Emu, ManagedDevice, error) {
+	for {
+		m.lck.Lock()
+		d, err := m.find(id)
+		var (
+			device Emu
+			info   ManagedDevice
+		)
+		if err == nil {
+			device, info = d.emu, d.ManagedDevice
+		}
+		changed := m.changed
+		m.lck.Unlock()
+		if err == nil && info.DeviceMacId != "" {
+			return device, info, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ManagedDevice{}, fmt.Errorf("device %s: %w", id, ctx.Err())
+		case <-m.ctx.Done():
+			return nil, ManagedDevice{}, ErrChannelClosed.Errorf("manager closed")
+		case <-changed:
+		}
+	}
+}
+
+// find returns the connected device of the given name or DeviceMacId. It is
+// called with the lock held.
+func (m *Manager) find(id string) (*managedDevice, error) {
+	for _, d := range m.devices {
+		if d.Name == id || (d.DeviceMacId != "" && d.DeviceMacId == id) {
+			if !d.Connected {
+				return nil, fmt.Errorf("device %s is not connected", id)
+			}
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown device %s", id)
+}
+
+// Execute sends cmd to the device of the given name or DeviceMacId and
+// returns its response.
+func (m *Manager) Execute(id string, cmd Command) (Message, error) {
+	m.lck.Lock()
+	d, err := m.find(id)
+	m.lck.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return d.execute(cmd)
+}
+
+func (d *managedDevice) execute(cmd Command) (Message, error) {
+	d.cmdMu.Lock()
+	defer d.cmdMu.Unlock()
+	if err := d.emu.SendCommand(cmd); err != nil {
+		return nil, err
+	}
+	return d.emu.GetResponse()
+}
+
+// Subscribe returns a channel receiving the messages of the given name from
+// all the devices.
+func (m *Manager) Subscribe(mn MessageName) (chan DeviceMessage, error) {
+	if !slices.Contains(apiMessageNames, mn) {
+		return nil, fmt.Errorf("invalid API MessageName %s", mn)
+	}
+	return m.pubsub.Subscribe(mn), nil
+}
+
+func (m *Manager) Unsubscribe(mn MessageName, ch <-chan DeviceMessage) {
+	m.pubsub.Close(mn, ch)
+}
+
+// Close closes all the devices.
+func (m *Manager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// notify wakes up WaitDevice. It is called with the lock held.
+func (m *Manager) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// supervise opens the device, retrying with backoff, forwards its messages
+// and identifies it, then closes it with the Manager.
+func (m *Manager) supervise(d *managedDevice) {
+	defer m.wg.Done()
+	var device Emu
+	backoff := reconnectMinBackoff
+	for {
+		var err error
+		if device, err = NewEmu(d.Path, d.opts...); err == nil {
+			break
+		}
+		WarningLogger.Printf("opening %s failed, retrying in %s: %v", d.Path, backoff, err)
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+	device.Start()
+	m.lck.Lock()
+	d.emu = device
+	d.Connected = true
+	m.notify()
+	m.lck.Unlock()
+
+	var wg sync.WaitGroup
+	for _, mn := range apiMessageNames {
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer device.Unsubscribe(mn, ch)
+			for {
+				select {
+				case <-m.ctx.Done():
+					return
+				case msg := <-ch:
+					m.forward(d, msg)
+				}
+			}
+		}()
+	}
+	m.identify(d)
+
+	<-m.ctx.Done()
+	wg.Wait()
+	m.lck.Lock()
+	d.Connected = false
+	m.lck.Unlock()
+	device.Close()
+}
+
+// forward publishes msg with the identity of d, giving up on the subscribers
+// not reading once the Manager is closed.
+func (m *Manager) forward(d *managedDevice, msg Message) {
+	m.lck.Lock()
+	m.learn(d, msg)
+	dm := DeviceMessage{Device: d.Name, DeviceMacId: d.DeviceMacId, Message: msg}
+	m.lck.Unlock()
+	m.pubsub.PublishContext(m.ctx, MessageName(msg.GetName()), dm)
+}
+
+// learn sets the DeviceMacId of d from msg if still unknown. It is called
+// with the lock held.
+func (m *Manager) learn(d *managedDevice, msg Message) {
+	if d.DeviceMacId != "" {
+		return
+	}
+	if mac, ok := msg.GetAttrib("DeviceMacId"); ok {
+		if s, ok := mac.(string); ok && s != "" {
+			d.DeviceMacId = s
+			m.notify()
+		}
+	}
+}
+
+// identify asks the device its DeviceMacId until it is known.
+func (m *Manager) identify(d *managedDevice) {
+	backoff := reconnectMinBackoff
+	for {
+		m.lck.Lock()
+		known := d.DeviceMacId != ""
+		m.lck.Unlock()
+		if known {
+			return
+		}
+		cmd, _ := NewCommand(GET_DEVICE_INFO)
+		rsp, err := d.execute(cmd)
+		if err == nil {
+			m.lck.Lock()
+			m.learn(d, rsp)
+			m.lck.Unlock()
+			continue
+		}
+		WarningLogger.Printf("identifying %s failed, retrying in %s: %v", d.Path, backoff, err)
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
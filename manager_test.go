@@ -0,0 +1,121 @@
+package emu
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu/util"
+)
+
+// fakeDevice answers every command with its DeviceInfo and publishes the
+// messages given to it. The methods of Emu not used by the tests are not
+// implemented.
+type fakeDevice struct {
+	Emu
+	pubsub    *util.PubSub[subscription, Message]
+	responses chan Message
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{
+		pubsub:    util.NewPubSub[subscription, Message](),
+		responses: make(chan Message, 1),
+	}
+}
+
+func (d *fakeDevice) SendCommand(cmd Command) error {
+	d.responses <- &messageImpl{Name: emuDeviceInfo, Attribs: map[emuMessageAttribute]any{
+		emuDeviceMacId: "0xd8d5b9000000abcd",
+	}}
+	return nil
+}
+
+func (d *fakeDevice) GetResponse() (Message, error) {
+	select {
+	case m := <-d.responses:
+		return m, nil
+	case <-time.After(time.Second):
+		return nil, ErrTimeOut
+	}
+}
+
+func (d *fakeDevice) Subscribe(mn MessageName) (chan Message, error) {
+	return d.pubsub.Subscribe(subscription{name: mn}), nil
+}
+
+func (d *fakeDevice) Unsubscribe(mn MessageName, ch <-chan Message) {
+	d.pubsub.Close(subscription{name: mn}, ch)
+}
+
+func (d *fakeDevice) Meters() []Meter {
+	return nil
+}
+
+func (d *fakeDevice) publish(m Message) {
+	d.pubsub.Publish(subscription{name: MessageName(m.GetName())}, m)
+}
+
+// serveFake serves device on a socket and returns its unix:// address.
+func serveFake(t *testing.T, device Emu) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "emu.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocketServer(device)
+	go server.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		server.Close()
+	})
+	return socketScheme + path
+}
+
+func TestManagerCloseWithIdleSubscriber(t *testing.T) {
+	device := newFakeDevice()
+	addr := serveFake(t, device)
+	m := NewManager(WithLoggingLevel(LOG_OFF))
+	if err := m.Add("a", addr); err != nil {
+		t.Fatal(err)
+	}
+	// a subscriber never reading its messages
+	if _, err := m.Subscribe(InstantaneousPower); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, info, err := m.WaitDevice(ctx, "a"); err != nil {
+		t.Fatal(err)
+	} else if info.DeviceMacId != "0xd8d5b9000000abcd" {
+		t.Errorf("device identified as %q", info.DeviceMacId)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				device.publish(&InstantaneousPowerDemand{Power: 1, DeviceMacId: "0xd8d5b9000000abcd"})
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close is held up by a subscriber not reading")
+	}
+}
@@ -0,0 +1,129 @@
+package emu
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const meterListXml = "<MeterList>\n<DeviceMacId>0xd8d5b90000001111</DeviceMacId>\n<MeterMacId>0x00135003000aaaa</MeterMacId>\n" +
+	"<MeterMacId>0x00135003000bbbb</MeterMacId>\n</MeterList>\n"
+
+// parse returns the message of the lines read from the device.
+func parse(t *testing.T, lines string) Message {
+	t.Helper()
+	rp := newResponseProcessor()
+	for _, line := range strings.SplitAfter(strings.TrimSpace(lines), "\n") {
+		rp.process(line)
+	}
+	if rp.state != RspReceived {
+		t.Fatalf("%s not received: %s", lines, rp.state)
+	}
+	m, err := convertApiMessage(rp.resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestJoinedMeters(t *testing.T) {
+	m, ok := parse(t, meterListXml).(*JoinedMeters)
+	if !ok || m.DeviceMacId != "0xd8d5b90000001111" ||
+		!slices.Equal(m.MeterMacIds, []string{"0x00135003000aaaa", "0x00135003000bbbb"}) {
+		t.Errorf("MeterList parsed as %+v", m)
+	}
+	single := strings.Replace(meterListXml, "<MeterMacId>0x00135003000bbbb</MeterMacId>\n", "", 1)
+	if m, ok := parse(t, single).(*JoinedMeters); !ok || !slices.Equal(m.MeterMacIds, []string{"0x00135003000aaaa"}) {
+		t.Errorf("MeterList of a meter parsed as %+v", m)
+	}
+}
+
+func TestMeterCache(t *testing.T) {
+	e := &emuImpl{}
+	macs := func() string {
+		var s []string
+		for _, mt := range e.Meters() {
+			s = append(s, mt.MeterMacId+":"+mt.NickName)
+		}
+		return strings.Join(s, ",")
+	}
+	e.learnMeters(&InstantaneousPowerDemand{DeviceMacId: "0xd8d5b90000001111", MeterMacId: "0x00135003000aaaa"})
+	e.learnMeters(&CurrentPrice{MeterMacId: "0x00135003000AAAA"})
+	e.learnMeters(&InstantaneousPowerDemand{})
+	if got := macs(); got != "0x00135003000aaaa:" || e.meters[0].DeviceMacId != "0xd8d5b90000001111" {
+		t.Errorf("meters %q from the readings", got)
+	}
+	e.learnMeters(&Meter{MeterMacId: "0x00135003000aaaa", NickName: "house"})
+	e.learnMeters(&InstantaneousPowerDemand{MeterMacId: "0x00135003000cccc"})
+	if got := macs(); got != "0x00135003000aaaa:house,0x00135003000cccc:" {
+		t.Errorf("meters %q", got)
+	}
+	// the MeterList is authoritative, keeping what is known of its meters
+	e.learnMeters(parse(t, meterListXml))
+	if got := macs(); got != "0x00135003000aaaa:house,0x00135003000bbbb:" {
+		t.Errorf("meters %q after the MeterList", got)
+	}
+}
+
+func TestWithMeterSubscription(t *testing.T) {
+	otherXml := strings.ReplaceAll(demandXml, "0x00135003000aaaa", "0x00135003000bbbb")
+	upperXml := strings.ReplaceAll(demandXml, "0x00135003000aaaa", "0x00135003000AAAA")
+	e := newPipeSession(t, func(cmd string) []string {
+		return []string{otherXml, upperXml}
+	})
+	// the case of the MeterMacId does not matter
+	ch, err := e.SubscribeMeter(InstantaneousPower, WithMeter("0x00135003000aAaA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Unsubscribe(InstantaneousPower, ch)
+	cmd, err := NewCommand(GET_DEMAND, WithMeter("0x00135003000AAAA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SendCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	// the response is the demand of the meter of the command
+	rsp, err := e.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := rsp.(*InstantaneousPowerDemand); !ok || d.MeterMacId != "0x00135003000AAAA" {
+		t.Errorf("response %+v", rsp)
+	}
+	select {
+	case m := <-ch:
+		if d := m.(*InstantaneousPowerDemand); d.MeterMacId != "0x00135003000AAAA" {
+			t.Errorf("received the demand of %s", d.MeterMacId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("demand of the meter not received")
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("received %+v of another meter", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := e.Meters(); len(got) != 2 {
+		t.Errorf("meters %+v", got)
+	}
+}
+
+func TestCommandMeter(t *testing.T) {
+	if _, err := NewCommand(GET_DEVICE_INFO, WithMeter("0x00135003000aaaa")); err == nil {
+		t.Error("GET_DEVICE_INFO accepted a MeterMacId")
+	}
+	cmd, err := NewCommand(GET_DEMAND, WithMeter("0x00135003000aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xml := cmd.(*commandImpl).xml(); xml != "<Command><Name>get_instantaneous_demand</Name><MeterMacId>0x00135003000aaaa</MeterMacId></Command>" {
+		t.Errorf("command %s", xml)
+	}
+	// an empty meter is the default one
+	if _, err := NewCommand(GET_DEVICE_INFO, WithMeter("")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,406 @@
+// Package mqtt bridges the readings of an emu session to an MQTT broker.
+//
+// Each reading is published as a plain value on
+// <prefix>/<device>/<meter>/<reading>, or <prefix>/<device>/<reading> when it
+// carries no MeterMacId, the bridge availability on <prefix>/status
+// (online/offline, the latter as the last will), and Home Assistant MQTT
+// discovery configs are announced for every reading seen so the sensors show up
+// without any manual setup.
+//
+// The readings are queued so that a slow or unreachable broker never holds up
+// the device; they are dropped while the broker is disconnected and the oldest
+// queued reading is dropped when the broker does not keep up.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kbhuyan/emu"
+)
+
+const (
+	online  = "online"
+	offline = "offline"
+
+	publishTimeout = 10 * time.Second // to wait for the broker to acknowledge a message
+	queueLen       = 64
+)
+
+var bridgedNames = []emu.MessageName{
+	emu.InstantaneousPower, emu.CumulativeEnergy, emu.Price, emu.ConnectionStatus,
+}
+
+type BridgeOptions struct {
+	ClientId        string
+	Username        string
+	Password        string
+	TopicPrefix     string
+	DiscoveryPrefix string // empty disables Home Assistant discovery
+	QoS             byte
+	Retain          bool
+	ConnectTimeout  time.Duration
+}
+
+type BridgeOption func(*BridgeOptions)
+
+func WithClientId(id string) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.ClientId = id
+	}
+}
+
+func WithCredentials(username, password string) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.Username = username
+		o.Password = password
+	}
+}
+
+func WithTopicPrefix(prefix string) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.TopicPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithDiscoveryPrefix sets the Home Assistant discovery prefix, an empty
+// prefix disables discovery.
+func WithDiscoveryPrefix(prefix string) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.DiscoveryPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+func WithQoS(qos byte) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.QoS = qos
+	}
+}
+
+func WithRetain(retain bool) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.Retain = retain
+	}
+}
+
+func WithConnectTimeout(timeout time.Duration) BridgeOption {
+	return func(o *BridgeOptions) {
+		o.ConnectTimeout = timeout
+	}
+}
+
+// Bridge publishes the readings of an emu session to an MQTT broker.
+type Bridge struct {
+	device emu.Emu
+	client paho.Client
+	opt    *BridgeOptions
+
+	lck       sync.Mutex
+	announced map[string]bool // unique ids of the sensors announced
+}
+
+// NewBridge creates a bridge between device and the broker, given as an URL
+// such as tcp://localhost:1883. The broker is not contacted until Run.
+func NewBridge(device emu.Emu, broker string, opts ...BridgeOption) (*Bridge, error) {
+	options := &BridgeOptions{
+		ClientId:        "emu-bridge",
+		TopicPrefix:     "emu",
+		DiscoveryPrefix: "homeassistant",
+		QoS:             1,
+		Retain:          true,
+		ConnectTimeout:  30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS %d", options.QoS)
+	}
+	b := &Bridge{
+		device:    device,
+		opt:       options,
+		announced: make(map[string]bool),
+	}
+	co := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(options.ClientId).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetConnectTimeout(options.ConnectTimeout).
+		SetAutoReconnect(true).
+		SetWill(b.availabilityTopic(), offline, options.QoS, true).
+		SetOnConnectHandler(b.onConnect)
+	b.client = paho.NewClient(co)
+	return b, nil
+}
+
+// Run connects to the broker and publishes the readings of the device until
+// ctx is done, then marks the bridge offline and disconnects.
+func (b *Bridge) Run(ctx context.Context) error {
+	if err := wait(b.client.Connect(), b.opt.ConnectTimeout); err != nil {
+		return fmt.Errorf("mqtt connect failed: %w", err)
+	}
+	defer func() {
+		b.publish(b.availabilityTopic(), offline, true)
+		b.client.Disconnect(250)
+	}()
+
+	queue := make(chan emu.Message, queueLen)
+	published := make(chan struct{})
+	go b.publisher(queue, published)
+	defer func() {
+		close(queue)
+		<-published
+	}()
+
+	chs := make(map[emu.MessageName]chan emu.Message, len(bridgedNames))
+	defer func() {
+		for mn, ch := range chs {
+			b.device.Unsubscribe(mn, ch)
+		}
+	}()
+	for _, mn := range bridgedNames {
+		ch, err := b.device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		chs[mn] = ch
+	}
+	for {
+		var msg emu.Message
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg = <-chs[emu.InstantaneousPower]:
+		case msg = <-chs[emu.CumulativeEnergy]:
+		case msg = <-chs[emu.Price]:
+		case msg = <-chs[emu.ConnectionStatus]:
+		}
+		enqueue(queue, msg)
+	}
+}
+
+// enqueue queues msg for the publisher, dropping the oldest queued message
+// when the broker does not keep up.
+func enqueue(queue chan emu.Message, msg emu.Message) {
+	for {
+		select {
+		case queue <- msg:
+			return
+		default:
+		}
+		select {
+		case m := <-queue:
+			emu.WarningLogger.Printf("mqtt broker is too slow, dropping %s", m.GetName())
+		default:
+		}
+	}
+}
+
+// publisher publishes the queued messages until the queue is closed.
+func (b *Bridge) publisher(queue chan emu.Message, published chan struct{}) {
+	defer close(published)
+	for msg := range queue {
+		if !b.client.IsConnectionOpen() {
+			// the state topics are retained, the next readings refresh them
+			emu.DebugLogger.Printf("mqtt disconnected, dropping %s", msg.GetName())
+			continue
+		}
+		if err := b.Publish(msg); err != nil {
+			emu.WarningLogger.Printf("mqtt publish of %s failed: %v", msg.GetName(), err)
+		}
+	}
+}
+
+// Publish sends the values of msg to their state topics, announcing the
+// device to Home Assistant the first time it is seen.
+func (b *Bridge) Publish(msg emu.Message) error {
+	mac, ok := macId(msg, "DeviceMacId")
+	if !ok {
+		return fmt.Errorf("%s has no DeviceMacId", msg.GetName())
+	}
+	meter, _ := macId(msg, "MeterMacId")
+	values := readings(msg)
+	if err := b.announce(mac, meter, values); err != nil {
+		return err
+	}
+	for reading, value := range values {
+		if err := b.publish(b.stateTopic(mac, meter, reading), value, b.opt.Retain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) onConnect(c paho.Client) {
+	emu.InfoLogger.Println("mqtt connected.")
+	if err := b.publish(b.availabilityTopic(), online, true); err != nil {
+		emu.WarningLogger.Printf("mqtt publish of availability failed: %v", err)
+	}
+	// a broker restart may have lost the retained configs, announce again
+	b.lck.Lock()
+	clear(b.announced)
+	b.lck.Unlock()
+}
+
+func (b *Bridge) publish(topic string, payload string, retain bool) error {
+	return wait(b.client.Publish(topic, b.opt.QoS, retain, payload), publishTimeout)
+}
+
+func (b *Bridge) availabilityTopic() string {
+	return b.opt.TopicPrefix + "/status"
+}
+
+// stateTopic returns the topic of a reading of the meter, of the device when
+// meter is empty.
+func (b *Bridge) stateTopic(mac string, meter string, reading string) string {
+	if meter == "" {
+		return b.opt.TopicPrefix + "/" + mac + "/" + reading
+	}
+	return b.opt.TopicPrefix + "/" + mac + "/" + meter + "/" + reading
+}
+
+// announce publishes the Home Assistant discovery config of the sensors of
+// values once per connection, a meter being a Home Assistant device, so that
+// only the sensors whose state topic is published are announced.
+func (b *Bridge) announce(mac string, meter string, values map[string]string) error {
+	if b.opt.DiscoveryPrefix == "" {
+		return nil
+	}
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	id, name := "emu_"+mac, "EMU-2 "+mac
+	if meter != "" {
+		id, name = id+"_"+meter, name+" meter "+meter
+	}
+	for _, s := range sensors {
+		uniqueId := id + "_" + s.reading
+		if _, ok := values[s.reading]; !ok || b.announced[uniqueId] {
+			continue
+		}
+		cfg := discoveryConfig{
+			Name:              s.name,
+			UniqueId:          uniqueId,
+			StateTopic:        b.stateTopic(mac, meter, s.reading),
+			AvailabilityTopic: b.availabilityTopic(),
+			DeviceClass:       s.deviceClass,
+			StateClass:        s.stateClass,
+			Unit:              s.unit,
+			Icon:              s.icon,
+			Device: discoveryDevice{
+				Identifiers:  []string{id},
+				Name:         name,
+				Manufacturer: "Rainforest Automation",
+				Model:        "EMU-2",
+			},
+		}
+		payload, err := json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		topic := b.opt.DiscoveryPrefix + "/sensor/" + id + "/" + s.reading + "/config"
+		if err := b.publish(topic, string(payload), true); err != nil {
+			return err
+		}
+		b.announced[uniqueId] = true
+	}
+	return nil
+}
+
+type sensor struct {
+	reading     string
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+	icon        string
+}
+
+var sensors = []sensor{
+	{reading: "power", name: "Power", deviceClass: "power", stateClass: "measurement", unit: "kW"},
+	{reading: "energy", name: "Energy", deviceClass: "energy", stateClass: "total", unit: "kWh"},
+	{reading: "energy_delivered", name: "Energy delivered", deviceClass: "energy", stateClass: "total_increasing", unit: "kWh"},
+	{reading: "energy_received", name: "Energy received", deviceClass: "energy", stateClass: "total_increasing", unit: "kWh"},
+	{reading: "price", name: "Price", stateClass: "measurement", icon: "mdi:cash"},
+	{reading: "price_tier", name: "Price tier", icon: "mdi:stairs"},
+	{reading: "connection_status", name: "Connection status", icon: "mdi:zigbee"},
+	{reading: "link_strength", name: "Link strength", stateClass: "measurement", unit: "%", icon: "mdi:signal"},
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	Unit              string          `json:"unit_of_measurement,omitempty"`
+	Icon              string          `json:"icon,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// readings maps msg to the state payloads of its sensors.
+func readings(msg emu.Message) map[string]string {
+	switch m := msg.(type) {
+	case *emu.InstantaneousPowerDemand:
+		return map[string]string{"power": formatFloat(m.Power)}
+	case *emu.CumulativeEnergyConsumption:
+		return map[string]string{
+			"energy":           formatFloat(m.Energy),
+			"energy_delivered": formatFloat(m.Delivered),
+			"energy_received":  formatFloat(m.Received),
+		}
+	case *emu.CurrentPrice:
+		return map[string]string{"price": formatFloat(m.Price), "price_tier": strconv.Itoa(m.Tier)}
+	}
+	out := make(map[string]string)
+	if emu.MessageName(msg.GetName()) == emu.ConnectionStatus {
+		if status, ok := msg.GetAttrib("Status"); ok {
+			out["connection_status"] = fmt.Sprint(status)
+		}
+		if link, ok := msg.GetAttrib("LinkStrength"); ok {
+			out["link_strength"] = fmt.Sprint(link)
+		}
+	}
+	return out
+}
+
+// macId returns the DeviceMacId or MeterMacId of msg without the 0x prefix.
+func macId(msg emu.Message, at string) (string, bool) {
+	v, ok := msg.GetAttrib(at)
+	if !ok {
+		return "", false
+	}
+	mac, ok := v.(string)
+	if !ok || mac == "" {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.ToLower(mac), "0x"), true
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// wait waits for the completion of t, at most timeout when positive.
+func wait(t paho.Token, timeout time.Duration) error {
+	if timeout <= 0 {
+		t.Wait()
+	} else if !t.WaitTimeout(timeout) {
+		return fmt.Errorf("no reply of the broker within %s", timeout)
+	}
+	return t.Error()
+}
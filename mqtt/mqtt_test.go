@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// fakeDevice publishes the messages given to it, the other methods of the
+// interface are not used.
+type fakeDevice struct {
+	emu.Emu
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+}
+
+func (d *fakeDevice) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	return d.pubsub.Subscribe(mn), nil
+}
+
+func (d *fakeDevice) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	d.pubsub.Close(mn, ch)
+}
+
+// broker is an in-process broker recording the last payload of every topic.
+type broker struct {
+	*mochi.Server
+	addr string
+
+	lck      sync.Mutex
+	payloads map[string]string
+}
+
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	b := &broker{
+		Server:   mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}),
+		addr:     addr,
+		payloads: make(map[string]string),
+	}
+	b.AddHook(new(auth.AllowHook), nil)
+	if err := b.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	b.Subscribe("#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		b.lck.Lock()
+		b.payloads[pk.TopicName] = string(pk.Payload)
+		b.lck.Unlock()
+	})
+	if err := b.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// waitPayload waits for the payload of topic to be want.
+func (b *broker) waitPayload(t *testing.T, topic string, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.lck.Lock()
+		got, ok := b.payloads[topic]
+		b.lck.Unlock()
+		if ok && got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	t.Fatalf("%s = %q, want %q", topic, b.payloads[topic], want)
+}
+
+// attribs is a message of the attributes of the device, e.g. ConnectionStatus.
+type attribs struct {
+	name   emu.MessageName
+	values map[string]any
+}
+
+func (m *attribs) GetName() string { return string(m.name) }
+
+func (m *attribs) GetAttrib(at string) (any, bool) {
+	v, ok := m.values[at]
+	return v, ok
+}
+
+func TestBridge(t *testing.T) {
+	srv := newBroker(t)
+	defer srv.Close()
+	device := &fakeDevice{pubsub: util.NewPubSub[emu.MessageName, emu.Message]()}
+	bridge, err := NewBridge(device, "tcp://"+srv.addr, WithClientId("test"), WithConnectTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- bridge.Run(ctx)
+	}()
+	srv.waitPayload(t, "emu/status", online)
+
+	device.pubsub.Publish(emu.InstantaneousPower, &emu.InstantaneousPowerDemand{
+		Power: 1.5, DeviceMacId: "0xD8D5B9000000ABCD", MeterMacId: "0x00135003007c3d11"})
+	device.pubsub.Publish(emu.InstantaneousPower, &emu.InstantaneousPowerDemand{
+		Power: -0.25, DeviceMacId: "0xD8D5B9000000ABCD", MeterMacId: "0x00135003007c3d22"})
+	srv.waitPayload(t, "emu/d8d5b9000000abcd/00135003007c3d11/power", "1.5")
+	srv.waitPayload(t, "emu/d8d5b9000000abcd/00135003007c3d22/power", "-0.25")
+	srv.lck.Lock()
+	_, ok := srv.payloads["homeassistant/sensor/emu_d8d5b9000000abcd_00135003007c3d22/power/config"]
+	srv.lck.Unlock()
+	if !ok {
+		t.Error("meter not announced to Home Assistant")
+	}
+
+	// the device only publishes its connection status
+	device.pubsub.Publish(emu.ConnectionStatus, &attribs{name: emu.ConnectionStatus, values: map[string]any{
+		"DeviceMacId": "0xD8D5B9000000ABCD", "Status": "Connected", "LinkStrength": 100}})
+	srv.waitPayload(t, "emu/d8d5b9000000abcd/connection_status", "Connected")
+	srv.lck.Lock()
+	for topic, announced := range map[string]bool{
+		"homeassistant/sensor/emu_d8d5b9000000abcd/connection_status/config":                  true,
+		"homeassistant/sensor/emu_d8d5b9000000abcd/link_strength/config":                      true,
+		"homeassistant/sensor/emu_d8d5b9000000abcd/power/config":                              false,
+		"homeassistant/sensor/emu_d8d5b9000000abcd_00135003007c3d22/energy/config":            false,
+		"homeassistant/sensor/emu_d8d5b9000000abcd_00135003007c3d22/connection_status/config": false,
+	} {
+		if _, ok := srv.payloads[topic]; ok != announced {
+			t.Errorf("%s announced: %v, want %v", topic, ok, announced)
+		}
+	}
+	srv.lck.Unlock()
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("Run = %v", err)
+	}
+	srv.waitPayload(t, "emu/status", offline)
+}
+
+func TestBrokerDown(t *testing.T) {
+	srv := newBroker(t)
+	device := &fakeDevice{pubsub: util.NewPubSub[emu.MessageName, emu.Message]()}
+	bridge, err := NewBridge(device, "tcp://"+srv.addr, WithClientId("test"), WithConnectTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bridge.Run(ctx)
+	srv.waitPayload(t, "emu/status", online)
+	srv.Close()
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 1000; i++ {
+			device.pubsub.Publish(emu.InstantaneousPower, &emu.InstantaneousPowerDemand{Power: float64(i), DeviceMacId: "0x1"})
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device is held up by the broker being down")
+	}
+}
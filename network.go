@@ -0,0 +1,209 @@
+package emu
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// NetworkState is a step of the lifecycle of the join of the device to the
+// meter, from the Status of the ConnectionStatus and NetworkInfo messages.
+type NetworkState string
+
+const (
+	StateUnknown        NetworkState = "Unknown"
+	StateInitializing   NetworkState = "Initializing"
+	StateDiscovery      NetworkState = "Discovery"      // looking for the network of the meter
+	StateJoining        NetworkState = "Joining"        // joining the network
+	StateJoinFailed     NetworkState = "JoinFailed"     // no network accepted the join
+	StateJoined         NetworkState = "Joined"         // joined, not authenticated yet
+	StateAuthenticating NetworkState = "Authenticating" // exchanging the keys derived from the install code
+	StateAuthenticated  NetworkState = "Authenticated"
+	StateRejected       NetworkState = "Rejected" // the meter refused the authentication
+	StateConnected      NetworkState = "Connected"
+	StateDisconnected   NetworkState = "Disconnected"
+	StateRejoining      NetworkState = "Rejoining" // joining again after losing the network
+)
+
+var networkStates = map[string]NetworkState{
+	"initializing":            StateInitializing,
+	"network discovery":       StateDiscovery,
+	"joining":                 StateJoining,
+	"join: fail":              StateJoinFailed,
+	"join: success":           StateJoined,
+	"authenticating":          StateAuthenticating,
+	"authenticating: success": StateAuthenticated,
+	"authenticating: fail":    StateRejected,
+	"connected":               StateConnected,
+	"disconnected":            StateDisconnected,
+	"rejoining":               StateRejoining,
+}
+
+// ParseNetworkState returns the state of a Status reported by the device.
+func ParseNetworkState(status string) NetworkState {
+	if s, ok := networkStates[strings.ToLower(strings.TrimSpace(status))]; ok {
+		return s
+	}
+	return StateUnknown
+}
+
+// Network is the ConnectionStatus or NetworkInfo message, describing the
+// Zigbee network joined by the device.
+type Network struct {
+	Name         MessageName  `json:"-"` //ConnectionStatus when empty
+	DeviceMacId  string       `json:"DeviceMacId"`
+	MeterMacId   string       `json:"MeterMacId"`
+	CoordMacId   string       `json:"CoordMacId"`
+	Status       string       `json:"Status"` //as reported by the device
+	State        NetworkState `json:"State"`
+	Description  string       `json:"Description"`
+	StatusCode   int64        `json:"StatusCode"`
+	ExtPanId     string       `json:"ExtPanId"`
+	Channel      int64        `json:"Channel"`
+	ShortAddr    string       `json:"ShortAddr"`
+	LinkStrength int64        `json:"LinkStrength"` //Unit is percent
+}
+
+func (m *Network) GetName() string {
+	if m.Name == "" {
+		return string(ConnectionStatus)
+	}
+	return string(m.Name)
+}
+func (m *Network) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	case "CoordMacId":
+		return m.CoordMacId, true
+	case "Status":
+		return m.Status, true
+	case "State":
+		return string(m.State), true
+	case "Description":
+		return m.Description, true
+	case "StatusCode":
+		return m.StatusCode, true
+	case "ExtPanId":
+		return m.ExtPanId, true
+	case "Channel":
+		return m.Channel, true
+	case "ShortAddr":
+		return m.ShortAddr, true
+	case "LinkStrength":
+		return m.LinkStrength, true
+	default:
+		return nil, false
+	}
+}
+
+// StateTransition is the NetworkTransition message, published when the state
+// of the network changes.
+type StateTransition struct {
+	TimeStamp   int64        `json:"TimeStamp"` //Unix time of the host
+	From        NetworkState `json:"From"`
+	To          NetworkState `json:"To"`
+	Status      string       `json:"Status"`
+	Description string       `json:"Description"`
+	DeviceMacId string       `json:"DeviceMacId"`
+	MeterMacId  string       `json:"MeterMacId"`
+}
+
+func (m *StateTransition) GetName() string {
+	return string(NetworkTransition)
+}
+func (m *StateTransition) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "From":
+		return string(m.From), true
+	case "To":
+		return string(m.To), true
+	case "Status":
+		return m.Status, true
+	case "Description":
+		return m.Description, true
+	case "DeviceMacId":
+		return m.DeviceMacId, true
+	case "MeterMacId":
+		return m.MeterMacId, true
+	default:
+		return nil, false
+	}
+}
+
+// NetworkStatus is the state of the network as seen by a session.
+type NetworkStatus struct {
+	State   NetworkState
+	Since   time.Time         // zero until a first state is reported
+	Network *Network          // latest ConnectionStatus or NetworkInfo, nil until one is received
+	History []StateTransition // the oldest first, at most networkHistorySize
+}
+
+// trackNetwork updates the state of the network from m and returns the
+// transition to publish, if any. It is called with the lock held.
+func (e *emuImpl) trackNetwork(m *Network, now time.Time) *StateTransition {
+	if last := e.network.Network; last != nil {
+		// ConnectionStatus and NetworkInfo complement each other
+		m = mergeNetwork(last, m)
+	}
+	e.network.Network = m
+	if m.State == StateUnknown || m.State == e.network.State {
+		return nil
+	}
+	t := &StateTransition{
+		TimeStamp:   now.Unix(),
+		From:        e.network.State,
+		To:          m.State,
+		Status:      m.Status,
+		Description: m.Description,
+		DeviceMacId: m.DeviceMacId,
+		MeterMacId:  m.MeterMacId,
+	}
+	e.network.State = m.State
+	e.network.Since = now
+	e.network.History = append(e.network.History, *t)
+	if n := len(e.network.History) - networkHistorySize; n > 0 {
+		e.network.History = slices.Delete(e.network.History, 0, n)
+	}
+	return t
+}
+
+// mergeNetwork returns m with the attributes it lacks taken from last.
+func mergeNetwork(last *Network, m *Network) *Network {
+	merged := *m
+	if merged.Status == "" {
+		merged.Status, merged.State, merged.Description = last.Status, last.State, last.Description
+	}
+	if merged.CoordMacId == "" {
+		merged.CoordMacId = last.CoordMacId
+	}
+	if merged.ExtPanId == "" {
+		merged.ExtPanId = last.ExtPanId
+	}
+	if merged.Channel == 0 {
+		merged.Channel = last.Channel
+	}
+	if merged.ShortAddr == "" {
+		merged.ShortAddr = last.ShortAddr
+	}
+	if merged.MeterMacId == "" {
+		merged.MeterMacId = last.MeterMacId
+	}
+	if merged.LinkStrength == 0 && merged.State != StateDisconnected {
+		// a status without LinkStrength, the link is only lost once disconnected
+		merged.LinkStrength = last.LinkStrength
+	}
+	return &merged
+}
+
+func (e *emuImpl) NetworkStatus() NetworkStatus {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	status := e.network
+	status.History = slices.Clone(e.network.History)
+	return status
+}
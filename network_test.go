@@ -0,0 +1,74 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func networkMessage(name emuMessageName, attribs map[emuMessageAttribute]any) *Network {
+	attribs[emuDeviceMacId] = "0xd8d5b9000000abcd"
+	n, err := GetNetwork(&messageImpl{Name: name, Attribs: attribs})
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestTrackNetwork(t *testing.T) {
+	e := &emuImpl{network: NetworkStatus{State: StateUnknown}}
+	now := time.Unix(1655127645, 0)
+	steps := []struct {
+		m    *Network
+		want NetworkState
+		link int64
+	}{
+		{networkMessage(emuConnectionStatus, map[emuMessageAttribute]any{"Status": "Joining"}), StateJoining, 0},
+		{networkMessage(emuNetworkInfo, map[emuMessageAttribute]any{"Status": "Connected", "Channel": int64(20), "LinkStrength": int64(90)}),
+			StateConnected, 90},
+		// without Status nor LinkStrength
+		{networkMessage(emuConnectionStatus, map[emuMessageAttribute]any{"Description": "fast poll"}), StateConnected, 90},
+		{networkMessage(emuConnectionStatus, map[emuMessageAttribute]any{"Status": "Connected", "LinkStrength": int64(60)}), StateConnected, 60},
+		{networkMessage(emuConnectionStatus, map[emuMessageAttribute]any{"Status": "Disconnected"}), StateDisconnected, 0},
+	}
+	var transitions []*StateTransition
+	for i, s := range steps {
+		now = now.Add(time.Minute)
+		if tr := e.trackNetwork(s.m, now); tr != nil {
+			transitions = append(transitions, tr)
+		}
+		n := e.network.Network
+		if e.network.State != s.want || n.LinkStrength != s.link {
+			t.Errorf("step %d: state %s, link %d, want %s, %d", i, e.network.State, n.LinkStrength, s.want, s.link)
+		}
+		if n.Channel != 20 && i > 0 {
+			t.Errorf("step %d: channel %d not merged", i, n.Channel)
+		}
+	}
+	want := []NetworkState{StateJoining, StateConnected, StateDisconnected}
+	if len(transitions) != len(want) {
+		t.Fatalf("%d transitions, want %d", len(transitions), len(want))
+	}
+	from := StateUnknown
+	for i, tr := range transitions {
+		if tr.From != from || tr.To != want[i] {
+			t.Errorf("transition %d: %s -> %s, want %s -> %s", i, tr.From, tr.To, from, want[i])
+		}
+		from = tr.To
+	}
+	if len(e.network.History) != len(want) || !e.network.Since.Equal(time.Unix(transitions[2].TimeStamp, 0)) {
+		t.Errorf("history %+v since %s", e.network.History, e.network.Since)
+	}
+}
+
+func TestParseNetworkState(t *testing.T) {
+	for status, want := range map[string]NetworkState{
+		"Connected":               StateConnected,
+		" join: FAIL ":            StateJoinFailed,
+		"Authenticating: Success": StateAuthenticated,
+		"Rebooting":               StateUnknown,
+	} {
+		if got := ParseNetworkState(status); got != want {
+			t.Errorf("ParseNetworkState(%q) = %s, want %s", status, got, want)
+		}
+	}
+}
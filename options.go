@@ -0,0 +1,182 @@
+package emu
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is the configuration of a device, as read from an options file and
+// the environment. Zero values are left to the defaults.
+type Profile struct {
+	Port    string        `yaml:"port"`
+	Baud    int           `yaml:"baud"`
+	Timeout time.Duration `yaml:"timeout"`
+	Log     string        `yaml:"log"`     // LOG_ALL, LOG_INFO, LOG_WARNING, LOG_ERROR or LOG_OFF
+	Meter   string        `yaml:"meter"`   // MeterMacId the commands are sent for, see WithMeter
+	History string        `yaml:"history"` // directory of the history, see WithHistory
+}
+
+// OptionsFile is the content of an options file, e.g.
+//
+//	baud: 115200
+//	timeout: 15s
+//	default: garage
+//	profiles:
+//	  garage:
+//	    port: /dev/ttyACM0
+//	  solar:
+//	    port: /dev/ttyACM1
+//	    log: LOG_INFO
+//
+// The settings at the top apply to every profile, the settings of a profile
+// override them.
+type OptionsFile struct {
+	Profile  `yaml:",inline"`
+	Default  string             `yaml:"default"` // profile used when none is named
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Environment variables overriding the settings of the profiles.
+const (
+	EnvProfile = "EMU_PROFILE"
+	EnvPort    = "EMU_PORT"
+	EnvBaud    = "EMU_BAUD"
+	EnvTimeout = "EMU_TIMEOUT"
+	EnvLog     = "EMU_LOG"
+	EnvMeter   = "EMU_METER"
+	EnvHistory = "EMU_HISTORY"
+)
+
+// ReadOptionsFile reads a YAML options file.
+func ReadOptionsFile(path string) (*OptionsFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &OptionsFile{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Select returns the settings of the profile name, or of the default profile
+// when name is empty, merged over the settings at the top of the file.
+func (f *OptionsFile) Select(name string) (Profile, error) {
+	if name == "" {
+		name = f.Default
+	}
+	p := f.Profile
+	if name == "" {
+		return p, nil
+	}
+	named, ok := f.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %s", name)
+	}
+	return p.merge(named), nil
+}
+
+// merge returns p with the settings of o that are set.
+func (p Profile) merge(o Profile) Profile {
+	if o.Port != "" {
+		p.Port = o.Port
+	}
+	if o.Baud != 0 {
+		p.Baud = o.Baud
+	}
+	if o.Timeout != 0 {
+		p.Timeout = o.Timeout
+	}
+	if o.Log != "" {
+		p.Log = o.Log
+	}
+	if o.Meter != "" {
+		p.Meter = o.Meter
+	}
+	if o.History != "" {
+		p.History = o.History
+	}
+	return p
+}
+
+// ProfileFromEnv returns p with the settings given by the EMU_* environment
+// variables.
+func ProfileFromEnv(p Profile) (Profile, error) {
+	var env Profile
+	env.Port = os.Getenv(EnvPort)
+	if v := os.Getenv(EnvBaud); v != "" {
+		baud, err := strconv.Atoi(v)
+		if err != nil {
+			return Profile{}, fmt.Errorf("%s: %w", EnvBaud, err)
+		}
+		env.Baud = baud
+	}
+	if v := os.Getenv(EnvTimeout); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return Profile{}, fmt.Errorf("%s: %w", EnvTimeout, err)
+		}
+		env.Timeout = timeout
+	}
+	env.Log = os.Getenv(EnvLog)
+	env.Meter = os.Getenv(EnvMeter)
+	env.History = os.Getenv(EnvHistory)
+	return p.merge(env), nil
+}
+
+// LoadProfile returns the profile name of the options file at path, the one
+// named by EMU_PROFILE or the default one when name is empty, with the
+// environment overrides.
+func LoadProfile(path string, name string) (Profile, error) {
+	f, err := ReadOptionsFile(path)
+	if err != nil {
+		return Profile{}, err
+	}
+	if name == "" {
+		name = os.Getenv(EnvProfile)
+	}
+	p, err := f.Select(name)
+	if err != nil {
+		return Profile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return ProfileFromEnv(p)
+}
+
+// Options returns the options of NewEmu set by the profile. The Port and the
+// Meter are not options, they are given to NewEmu and WithMeter.
+func (p Profile) Options() ([]EmuOption, error) {
+	var opts []EmuOption
+	if p.Baud != 0 {
+		opts = append(opts, WithBaudRate(p.Baud))
+	}
+	if p.Timeout != 0 {
+		opts = append(opts, WithTimeOut(p.Timeout))
+	}
+	if p.Log != "" {
+		ll, err := StringToLogLevel(p.Log)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithLoggingLevel(ll))
+	}
+	if p.History != "" {
+		opts = append(opts, WithHistory(p.History))
+	}
+	return opts, nil
+}
+
+// LoadOptions returns the options of NewEmu set by the profile of the options
+// file at path named by EMU_PROFILE, or its default profile, with the
+// environment overrides. See LoadProfile for the port.
+func LoadOptions(path string) ([]EmuOption, error) {
+	p, err := LoadProfile(path, "")
+	if err != nil {
+		return nil, err
+	}
+	return p.Options()
+}
@@ -0,0 +1,107 @@
+package emu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const optionsYaml = `
+baud: 9600
+timeout: 15s
+log: LOG_WARNING
+default: garage
+profiles:
+  garage:
+    port: /dev/ttyACM0
+  solar:
+    port: /dev/ttyACM1
+    log: LOG_INFO
+    meter: "0x00135003000bbbb"
+`
+
+func writeOptions(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "emu.yaml")
+	if err := os.WriteFile(path, []byte(optionsYaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func clearEnv(t *testing.T) {
+	for _, v := range []string{EnvProfile, EnvPort, EnvBaud, EnvTimeout, EnvLog, EnvMeter, EnvHistory} {
+		t.Setenv(v, "")
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	clearEnv(t)
+	path := writeOptions(t)
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want Profile
+	}{
+		// the default profile over the top settings
+		{"", nil, Profile{Port: "/dev/ttyACM0", Baud: 9600, Timeout: 15 * time.Second, Log: "LOG_WARNING"}},
+		{"solar", nil, Profile{Port: "/dev/ttyACM1", Baud: 9600, Timeout: 15 * time.Second, Log: "LOG_INFO", Meter: "0x00135003000bbbb"}},
+		{"", map[string]string{EnvProfile: "solar"}, Profile{Port: "/dev/ttyACM1", Baud: 9600, Timeout: 15 * time.Second, Log: "LOG_INFO", Meter: "0x00135003000bbbb"}},
+		// a name given wins over EMU_PROFILE
+		{"garage", map[string]string{EnvProfile: "solar"}, Profile{Port: "/dev/ttyACM0", Baud: 9600, Timeout: 15 * time.Second, Log: "LOG_WARNING"}},
+		// the environment wins over the file
+		{"solar", map[string]string{EnvPort: "/dev/ttyUSB0", EnvBaud: "115200", EnvTimeout: "1m", EnvHistory: "/var/lib/emu"},
+			Profile{Port: "/dev/ttyUSB0", Baud: 115200, Timeout: time.Minute, Log: "LOG_INFO", Meter: "0x00135003000bbbb", History: "/var/lib/emu"}},
+	} {
+		for k, v := range tc.env {
+			t.Setenv(k, v)
+		}
+		got, err := LoadProfile(path, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("LoadProfile(%q) with %v = %+v, want %+v", tc.name, tc.env, got, tc.want)
+		}
+		clearEnv(t)
+	}
+}
+
+func TestLoadProfileErrors(t *testing.T) {
+	clearEnv(t)
+	path := writeOptions(t)
+	if _, err := LoadProfile(path, "attic"); err == nil {
+		t.Error("unknown profile loaded")
+	}
+	t.Setenv(EnvBaud, "fast")
+	if _, err := LoadProfile(path, ""); err == nil {
+		t.Errorf("%s=fast accepted", EnvBaud)
+	}
+	clearEnv(t)
+	if _, err := LoadProfile(filepath.Join(t.TempDir(), "none.yaml"), ""); !os.IsNotExist(err) {
+		t.Errorf("err = %v, want not exist", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.yaml")
+	os.WriteFile(bad, []byte("baud: [9600"), 0o644)
+	if _, err := LoadProfile(bad, ""); err == nil {
+		t.Error("invalid YAML loaded")
+	}
+}
+
+func TestSelectWithoutDefault(t *testing.T) {
+	f := &OptionsFile{Profile: Profile{Baud: 9600}, Profiles: map[string]Profile{"solar": {Port: "/dev/ttyACM1"}}}
+	if p, err := f.Select(""); err != nil || p != (Profile{Baud: 9600}) {
+		t.Errorf("Select(\"\") = %+v, %v, want the top settings", p, err)
+	}
+}
+
+func TestProfileOptions(t *testing.T) {
+	opts, err := Profile{Baud: 9600, Timeout: time.Second, Log: "LOG_INFO", Port: "/dev/ttyACM0"}.Options()
+	if err != nil || len(opts) != 3 {
+		t.Errorf("Options() = %d options, %v", len(opts), err)
+	}
+	if _, err := (Profile{Log: "LOUD"}).Options(); err == nil {
+		t.Error("log level LOUD accepted")
+	}
+}
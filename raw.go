@@ -0,0 +1,180 @@
+package emu
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fragment is the RawFragments message, an XML fragment read from the device
+// as is, whether its element is modelled or not.
+type Fragment struct {
+	TimeStamp int64             `json:"TimeStamp"` //Unix time of the host
+	Element   string            `json:"Element"`   //name of the top level element, e.g. LocalAttributes
+	Xml       string            `json:"Xml"`
+	Attribs   map[string]string `json:"Attribs"` //text of the child elements, the values of a repeated one comma separated
+}
+
+func (m *Fragment) GetName() string {
+	return string(RawFragments)
+}
+func (m *Fragment) GetAttrib(at string) (any, bool) {
+	switch at {
+	case "TimeStamp":
+		return m.TimeStamp, true
+	case "Element":
+		return m.Element, true
+	case "Xml":
+		return m.Xml, true
+	default:
+		value, ok := m.Attribs[at]
+		return value, ok
+	}
+}
+
+// newFragment returns the fragment of element read at t, with the attributes
+// of its child elements when it parses.
+func newFragment(element string, fragment string, t time.Time) *Fragment {
+	m := &Fragment{TimeStamp: t.Unix(), Element: element, Xml: fragment}
+	var doc struct {
+		Children []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := xml.Unmarshal([]byte(fragment), &doc); err != nil {
+		DebugLogger.Printf("fragment %s has no attributes: %v", element, err)
+		return m
+	}
+	m.Attribs = make(map[string]string, len(doc.Children))
+	for _, c := range doc.Children {
+		key, value := c.XMLName.Local, strings.TrimSpace(c.Value)
+		if prev, ok := m.Attribs[key]; ok {
+			value = prev + "," + value
+		}
+		m.Attribs[key] = value
+	}
+	return m
+}
+
+var startTagRe = regexp.MustCompile(`^<([A-Za-z_][\w.-]*)>`)
+
+// fragmentCollector assembles the lines read from the device into top level
+// fragments, the device writing every element on its own line.
+type fragmentCollector struct {
+	element string
+	sb      strings.Builder
+}
+
+// add adds a line, returning the fragment it completes if any. The lines
+// outside of a fragment are ignored.
+func (fc *fragmentCollector) add(line string) (string, string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if fc.element == "" {
+		m := startTagRe.FindStringSubmatch(trimmed)
+		if m == nil {
+			return "", "", false
+		}
+		if strings.HasSuffix(trimmed, "</"+m[1]+">") {
+			return m[1], trimmed, true
+		}
+		fc.element = m[1]
+		fc.sb.Reset()
+	}
+	fc.sb.WriteString(trimmed)
+	fc.sb.WriteByte('\n')
+	if trimmed != "</"+fc.element+">" {
+		return "", "", false
+	}
+	element := fc.element
+	fc.element = ""
+	return element, strings.TrimSuffix(fc.sb.String(), "\n"), true
+}
+
+// rawCommand renders the <Command> of name with its parameters.
+func rawCommand(name string, params map[string]string) (string, error) {
+	if !startTagRe.MatchString("<" + name + ">") {
+		return "", fmt.Errorf("invalid command name %q", name)
+	}
+	cmd := &commandImpl{Name: emuCommandName(name), Attribs: make(map[string]any, len(params))}
+	for key, value := range params {
+		if !startTagRe.MatchString("<" + key + ">") {
+			return "", fmt.Errorf("invalid parameter name %q", key)
+		}
+		cmd.Attribs[key] = value
+	}
+	return cmd.xml(), nil
+}
+
+// periodicElements are the elements the device writes on its own, which do not
+// answer a raw command.
+var periodicElements = []string{
+	string(emuInstantaneousDemand), string(emuCurrentSummationDelivered),
+	string(emuPriceCluster), string(emuTimeCluster),
+}
+
+// rawDevice is a session publishing the RawFragments.
+type rawDevice interface {
+	Emu
+	RawSender
+}
+
+// sendRaw implements SendRaw for a device publishing the RawFragments, waiting
+// at most timeout when ctx has no earlier deadline.
+func sendRaw(ctx context.Context, e rawDevice, timeout time.Duration, name string, params map[string]string, expect []string) ([]*Fragment, error) {
+	fragment, err := rawCommand(name, params)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := e.Subscribe(RawFragments)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Unsubscribe(RawFragments, ch)
+	if err := e.WriteRaw(fragment); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var (
+		fragments []*Fragment
+		missing   = slices.Clone(expect)
+	)
+	for {
+		select {
+		case m := <-ch:
+			f, ok := m.(*Fragment)
+			if !ok {
+				continue
+			}
+			if len(expect) == 0 {
+				// the first fragment the device did not write on its own
+				if slices.Contains(periodicElements, f.Element) {
+					continue
+				}
+				return []*Fragment{f}, nil
+			}
+			if !slices.Contains(expect, f.Element) {
+				continue
+			}
+			fragments = append(fragments, f)
+			missing = slices.DeleteFunc(missing, func(s string) bool { return s == f.Element })
+			if len(missing) == 0 {
+				return fragments, nil
+			}
+		case <-ctx.Done():
+			if len(expect) > 0 {
+				DebugLogger.Printf("raw command %s: missing %v", name, missing)
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fragments, ErrTimeOut
+			}
+			return fragments, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package emu
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu/util"
+)
+
+const (
+	demandXml = "<InstantaneousDemand>\n<DeviceMacId>0xd8d5b90000001111</DeviceMacId>\n<MeterMacId>0x00135003000aaaa</MeterMacId>\n" +
+		"<TimeStamp>0x1</TimeStamp>\n<Demand>0x10</Demand>\n<Multiplier>0x1</Multiplier>\n<Divisor>0x3e8</Divisor>\n" +
+		"<DigitsRight>0x3</DigitsRight>\n</InstantaneousDemand>\n"
+	networkXml = "<NetworkInfo>\n<DeviceMacId>0xd8d5b90000001111</DeviceMacId>\n<Status>Connected</Status>\n" +
+		"<LinkStrength>0x64</LinkStrength>\n</NetworkInfo>\n"
+	scheduleXml = "<ScheduleInfo>\n<DeviceMacId>0xd8d5b90000001111</DeviceMacId>\n<Event>demand</Event>\n</ScheduleInfo>\n"
+)
+
+// pipeDevice is the device end of a session, answering each command read
+// with answer. The commands are read as soon as they are written, while the
+// answers are written one after the other. It writes an empty line every few
+// milliseconds as the session only sends its commands between two lines read.
+type pipeDevice struct {
+	conn    net.Conn
+	answer  func(cmd string) []string
+	answers chan []string
+	lck     sync.Mutex
+}
+
+func newPipeSession(t *testing.T, answer func(cmd string) []string) *emuImpl {
+	t.Helper()
+	a, b := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &emuImpl{
+		conn:      a,
+		open:      func() (io.ReadWriteCloser, error) { return nil, io.EOF },
+		responses: make(chan Message, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		opt:       &EmuOptions{TimeOut: 2 * time.Second, Metrics: noopMetrics{}},
+		pubsub:    util.NewPubSub[subscription, Message](),
+		meterSub:  make(map[<-chan Message]string),
+		network:   NetworkStatus{State: StateUnknown},
+	}
+	d := &pipeDevice{conn: b, answer: answer, answers: make(chan []string, 16)}
+	go d.serve(ctx)
+	go d.writer(ctx)
+	e.Start()
+	t.Cleanup(func() {
+		// waits for the reader to stop
+		e.Close()
+		b.Close()
+	})
+	return e
+}
+
+func (d *pipeDevice) write(s string) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.conn.Write([]byte(s))
+}
+
+// writer writes the answers, a "sleep <duration>" pausing it.
+func (d *pipeDevice) writer(ctx context.Context) {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			d.write("\n")
+		case answer := <-d.answers:
+			for _, s := range answer {
+				if dur, ok := strings.CutPrefix(s, "sleep "); ok {
+					dur, _ := time.ParseDuration(dur)
+					time.Sleep(dur)
+					continue
+				}
+				d.write(s)
+			}
+		}
+	}
+}
+
+func (d *pipeDevice) serve(ctx context.Context) {
+	r := bufio.NewReader(d.conn)
+	var cmd string
+	for {
+		s, err := r.ReadString('>')
+		if err != nil {
+			return
+		}
+		if cmd += s; strings.HasSuffix(cmd, "</Command>") {
+			select {
+			case d.answers <- d.answer(cmd):
+			case <-ctx.Done():
+				return
+			}
+			cmd = ""
+		}
+	}
+}
+
+func TestSendRawWithoutExpect(t *testing.T) {
+	e := newPipeSession(t, func(cmd string) []string {
+		return []string{demandXml, scheduleXml, demandXml}
+	})
+	start := time.Now()
+	fragments, err := e.SendRaw(context.Background(), "get_schedule", map[string]string{"Event": "demand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 1 || fragments[0].Element != "ScheduleInfo" {
+		t.Fatalf("fragments = %+v, want the ScheduleInfo", fragments)
+	}
+	if fragments[0].Attribs["Event"] != "demand" {
+		t.Errorf("attribs = %v", fragments[0].Attribs)
+	}
+	if d := time.Since(start); d >= e.opt.TimeOut {
+		t.Errorf("waited %v, the time out of the session", d)
+	}
+}
+
+func TestSendRawExpect(t *testing.T) {
+	e := newPipeSession(t, func(cmd string) []string {
+		return []string{networkXml, demandXml, scheduleXml}
+	})
+	fragments, err := e.SendRaw(context.Background(), "get_schedule", nil, "ScheduleInfo", "InstantaneousDemand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fragments {
+		got = append(got, f.Element)
+	}
+	if strings.Join(got, ",") != "InstantaneousDemand,ScheduleInfo" {
+		t.Errorf("fragments of %v, want InstantaneousDemand and ScheduleInfo", got)
+	}
+	if _, err := e.SendRaw(context.Background(), "get_schedule", nil, "PriceCluster"); err != ErrTimeOut {
+		t.Errorf("err = %v, want ErrTimeOut", err)
+	}
+}
+
+// A raw command waits for the response of the command sent before it, so that
+// it is not written while the device answers.
+func TestSendRawAfterCommand(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	var (
+		lck  sync.Mutex
+		sent time.Time
+		wait time.Duration
+	)
+	e := newPipeSession(t, func(cmd string) []string {
+		lck.Lock()
+		defer lck.Unlock()
+		if strings.Contains(cmd, "get_network_info") {
+			sent = time.Now()
+			return []string{"sleep " + delay.String(), networkXml}
+		}
+		wait = time.Since(sent)
+		return []string{scheduleXml}
+	})
+	if err := e.SendCommand(mustCommand(t, GET_NETWORK)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := e.SendRaw(context.Background(), "get_schedule", nil, "ScheduleInfo")
+		done <- err
+	}()
+	if _, err := e.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	lck.Lock()
+	defer lck.Unlock()
+	if wait < delay {
+		t.Errorf("raw command written %v after the pending command, before its response", wait)
+	}
+}
+
+func TestRawSubscribed(t *testing.T) {
+	e := newPipeSession(t, func(string) []string { return nil })
+	if e.rawSubscribed() {
+		t.Fatal("fragments subscribed without subscriber")
+	}
+	ch, _ := e.SubscribeMeter(RawFragments, WithMeter("0x00135003000aaaa"))
+	if !e.rawSubscribed() {
+		t.Error("fragments of a meter not subscribed")
+	}
+	e.Unsubscribe(RawFragments, ch)
+	if e.rawSubscribed() {
+		t.Error("fragments subscribed after Unsubscribe")
+	}
+}
+
+func mustCommand(t *testing.T, id CommandId) Command {
+	t.Helper()
+	cmd, err := NewCommand(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
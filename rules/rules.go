@@ -0,0 +1,418 @@
+// Package rules raises alerts from conditions declared over the emu message
+// streams, e.g. "InstantaneousPower > 7 kW for 2 minutes", "no
+// CumulativeEnergy for 10 minutes" or "price tier changed", and sends them to
+// notification sinks (webhook, exec, log).
+//
+// A rule fires once its condition has held for its For duration and resolves
+// when the condition clears; for > and < the value must come back past the
+// threshold by Hysteresis. Notifications of a rule are at most one per
+// Cooldown. A "changed" rule fires on every change of the value and never
+// resolves. An "absent" rule fires when no message was received for For.
+package rules
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kbhuyan/emu"
+)
+
+// Operators of a rule condition.
+const (
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+	OpChanged      = "changed"
+	OpAbsent       = "absent"
+)
+
+// States of a Notification.
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+type Rule struct {
+	Name       string          `yaml:"name"`
+	Message    emu.MessageName `yaml:"message"`
+	Attribute  string          `yaml:"attribute"` // not used by absent
+	Op         string          `yaml:"op"`
+	Value      any             `yaml:"value"` // number, or string for == and !=
+	For        time.Duration   `yaml:"for"`
+	Hysteresis float64         `yaml:"hysteresis"`
+	Cooldown   time.Duration   `yaml:"cooldown"`
+	Sinks      []string        `yaml:"sinks"` // all the sinks when empty
+}
+
+// Config is the content of a rules file.
+type Config struct {
+	Sinks []SinkConfig `yaml:"sinks"`
+	Rules []Rule       `yaml:"rules"`
+}
+
+// LoadFile reads a YAML rules file.
+func LoadFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Notification is sent to the sinks of a rule when it fires or resolves.
+type Notification struct {
+	Rule      string          `json:"rule"`
+	State     string          `json:"state"`
+	Message   emu.MessageName `json:"message"`
+	Attribute string          `json:"attribute,omitempty"`
+	Value     any             `json:"value,omitempty"`
+	Text      string          `json:"text"`
+	Time      time.Time       `json:"time"`
+}
+
+type ruleState struct {
+	rule      *Rule
+	threshold float64 // Value of numeric operators
+	sinks     []Sink
+
+	value    any // last value
+	seen     bool
+	lastSeen time.Time
+	since    time.Time // the condition holds since, zero when it does not
+	firing   bool
+	notified time.Time
+	sent     bool // the firing was notified, so is its resolution
+}
+
+// Engine evaluates rules against the messages of a device.
+type Engine struct {
+	rules []*ruleState
+	lck   sync.Mutex
+	wg    sync.WaitGroup
+}
+
+func NewEngine(cfg *Config) (*Engine, error) {
+	sinks := make(map[string]Sink)
+	var all []Sink
+	for _, sc := range cfg.Sinks {
+		if _, ok := sinks[sc.Name]; ok || sc.Name == "" {
+			return nil, fmt.Errorf("invalid or duplicate sink name %q", sc.Name)
+		}
+		s, err := NewSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+		sinks[sc.Name] = s
+		all = append(all, s)
+	}
+	if len(all) == 0 {
+		all = []Sink{LogSink{}}
+	}
+	e := &Engine{}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		rs := &ruleState{rule: r}
+		if err := rs.validate(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		for _, name := range r.Sinks {
+			s, ok := sinks[name]
+			if !ok {
+				return nil, fmt.Errorf("rule %q: unknown sink %s", r.Name, name)
+			}
+			rs.sinks = append(rs.sinks, s)
+		}
+		if len(rs.sinks) == 0 {
+			rs.sinks = all
+		}
+		e.rules = append(e.rules, rs)
+	}
+	return e, nil
+}
+
+func (rs *ruleState) validate() error {
+	r := rs.rule
+	if r.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if r.Message == "" {
+		return fmt.Errorf("missing message")
+	}
+	if r.Op != OpAbsent && r.Attribute == "" {
+		return fmt.Errorf("missing attribute")
+	}
+	if r.For < 0 || r.Cooldown < 0 || r.Hysteresis < 0 {
+		return fmt.Errorf("for, cooldown and hysteresis must not be negative")
+	}
+	switch r.Op {
+	case OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		f, ok := toFloat(r.Value)
+		if !ok {
+			return fmt.Errorf("%s needs a numeric value, got %v", r.Op, r.Value)
+		}
+		rs.threshold = f
+	case OpEqual, OpNotEqual:
+		if r.Value == nil {
+			return fmt.Errorf("%s needs a value", r.Op)
+		}
+	case OpChanged:
+	case OpAbsent:
+		if r.For <= 0 {
+			return fmt.Errorf("absent needs a for duration")
+		}
+	default:
+		return fmt.Errorf("invalid op %q", r.Op)
+	}
+	return nil
+}
+
+// Run evaluates the rules on the messages published by device until ctx is
+// done.
+func (e *Engine) Run(ctx context.Context, device emu.Emu) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer e.wg.Wait()
+	msgs := make(chan emu.Message)
+	subscribed := make(map[emu.MessageName]bool)
+	now := time.Now()
+	for _, rs := range e.rules {
+		rs.lastSeen = now
+		mn := rs.rule.Message
+		if subscribed[mn] {
+			continue
+		}
+		subscribed[mn] = true
+		ch, err := device.Subscribe(mn)
+		if err != nil {
+			return err
+		}
+		defer device.Unsubscribe(mn, ch)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-ch:
+					select {
+					case msgs <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-msgs:
+			e.Evaluate(ctx, m, time.Now())
+		case t := <-ticker.C:
+			e.Tick(ctx, t)
+		}
+	}
+}
+
+// Evaluate updates the rules on msg, received at now.
+func (e *Engine) Evaluate(ctx context.Context, msg emu.Message, now time.Time) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	for _, rs := range e.rules {
+		r := rs.rule
+		if string(r.Message) != msg.GetName() {
+			continue
+		}
+		rs.lastSeen = now
+		if r.Op == OpAbsent {
+			rs.since = time.Time{}
+			if rs.firing {
+				rs.firing = false
+				e.notify(ctx, rs, Resolved, nil, now)
+			}
+			continue
+		}
+		v, ok := msg.GetAttrib(r.Attribute)
+		if !ok {
+			continue
+		}
+		prev, seen := rs.value, rs.seen
+		rs.value, rs.seen = v, true
+		if r.Op == OpChanged {
+			if seen && fmt.Sprint(prev) != fmt.Sprint(v) {
+				e.notify(ctx, rs, Firing, v, now)
+			}
+			continue
+		}
+		switch {
+		case rs.holds(v):
+			if rs.since.IsZero() {
+				rs.since = now
+			}
+		case rs.firing && !rs.cleared(v):
+			// within the hysteresis band, keep firing
+		default:
+			rs.since = time.Time{}
+			if rs.firing {
+				rs.firing = false
+				e.notify(ctx, rs, Resolved, v, now)
+			}
+		}
+		e.check(ctx, rs, now)
+	}
+}
+
+// Tick fires the rules whose condition has held long enough, or whose message
+// is absent, at now.
+func (e *Engine) Tick(ctx context.Context, now time.Time) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	for _, rs := range e.rules {
+		if rs.rule.Op == OpAbsent && rs.since.IsZero() && now.Sub(rs.lastSeen) >= rs.rule.For {
+			rs.since = rs.lastSeen
+		}
+		e.check(ctx, rs, now)
+	}
+}
+
+// check fires rs once its condition has held for its For duration.
+func (e *Engine) check(ctx context.Context, rs *ruleState, now time.Time) {
+	if rs.firing || rs.since.IsZero() {
+		return
+	}
+	if rs.rule.Op != OpAbsent && now.Sub(rs.since) < rs.rule.For {
+		return
+	}
+	rs.firing = true
+	e.notify(ctx, rs, Firing, rs.value, now)
+}
+
+func (rs *ruleState) holds(v any) bool {
+	r := rs.rule
+	switch r.Op {
+	case OpEqual:
+		return equal(v, r.Value)
+	case OpNotEqual:
+		return !equal(v, r.Value)
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	switch r.Op {
+	case OpGreater:
+		return f > rs.threshold
+	case OpGreaterEqual:
+		return f >= rs.threshold
+	case OpLess:
+		return f < rs.threshold
+	case OpLessEqual:
+		return f <= rs.threshold
+	}
+	return false
+}
+
+// cleared reports whether v is past the threshold by the hysteresis.
+func (rs *ruleState) cleared(v any) bool {
+	f, ok := toFloat(v)
+	if !ok {
+		return true
+	}
+	switch rs.rule.Op {
+	case OpGreater, OpGreaterEqual:
+		return f <= rs.threshold-rs.rule.Hysteresis
+	case OpLess, OpLessEqual:
+		return f >= rs.threshold+rs.rule.Hysteresis
+	}
+	return true
+}
+
+func (e *Engine) notify(ctx context.Context, rs *ruleState, state string, v any, now time.Time) {
+	r := rs.rule
+	if state == Firing {
+		rs.sent = rs.notified.IsZero() || now.Sub(rs.notified) >= r.Cooldown
+		if !rs.sent {
+			return
+		}
+		rs.notified = now
+	} else if !rs.sent {
+		return
+	}
+	n := Notification{
+		Rule:      r.Name,
+		State:     state,
+		Message:   r.Message,
+		Attribute: r.Attribute,
+		Value:     v,
+		Text:      describe(r, state, v),
+		Time:      now,
+	}
+	for _, s := range rs.sinks {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			if err := s.Notify(ctx, n); err != nil {
+				emu.WarningLogger.Printf("rule %s: notification failed: %v", r.Name, err)
+			}
+		}()
+	}
+}
+
+func describe(r *Rule, state string, v any) string {
+	var cond string
+	switch r.Op {
+	case OpAbsent:
+		cond = fmt.Sprintf("no %s for %s", r.Message, r.For)
+	case OpChanged:
+		cond = fmt.Sprintf("%s %s changed to %v", r.Message, r.Attribute, v)
+	default:
+		cond = fmt.Sprintf("%s %s %s %v", r.Message, r.Attribute, r.Op, r.Value)
+		if r.For > 0 {
+			cond += " for " + r.For.String()
+		}
+		if v != nil {
+			cond += fmt.Sprintf(" (%v)", v)
+		}
+	}
+	return fmt.Sprintf("%s %s: %s", r.Name, state, cond)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func equal(a any, b any) bool {
+	fa, oka := toFloat(a)
+	fb, okb := toFloat(b)
+	if oka && okb {
+		return fa == fb
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
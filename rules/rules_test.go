@@ -0,0 +1,229 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// recorder is a Sink keeping the notifications.
+type recorder struct {
+	lck   sync.Mutex
+	notes []Notification
+}
+
+func (r *recorder) Notify(ctx context.Context, n Notification) error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.notes = append(r.notes, n)
+	return nil
+}
+
+// states returns the states notified so far as "rule:state" and forgets them.
+func (r *recorder) states(e *Engine) []string {
+	e.wg.Wait()
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	var out []string
+	for _, n := range r.notes {
+		out = append(out, n.Rule+":"+n.State)
+	}
+	r.notes = nil
+	return out
+}
+
+func newEngine(t *testing.T, rules ...Rule) (*Engine, *recorder) {
+	t.Helper()
+	e, err := NewEngine(&Config{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{}
+	for _, rs := range e.rules {
+		rs.sinks = []Sink{rec}
+	}
+	return e, rec
+}
+
+var t0 = time.Unix(1700000000, 0)
+
+func TestHysteresis(t *testing.T) {
+	e, rec := newEngine(t, Rule{Name: "high", Message: emu.InstantaneousPower, Attribute: "Power", Op: OpGreater,
+		Value: 7, For: 2 * time.Minute, Hysteresis: 0.5})
+	ctx := context.Background()
+	for i, step := range []struct {
+		kw   float64
+		want string
+	}{
+		{5, ""},
+		{8, ""},
+		{8, ""},
+		{8, "high:firing"}, // held for 2 minutes
+		{8, ""},
+		{6.8, ""}, // within the hysteresis band
+		{8, ""},
+		{6.4, "high:resolved"},
+		{8, ""},
+		{6, ""}, // cleared before For
+		{8, ""},
+	} {
+		now := t0.Add(time.Duration(i) * time.Minute)
+		e.Evaluate(ctx, &emu.InstantaneousPowerDemand{Power: step.kw}, now)
+		e.Tick(ctx, now)
+		if got := strings.Join(rec.states(e), ","); got != step.want {
+			t.Errorf("minute %d, %g kW: notified %q, want %q", i, step.kw, got, step.want)
+		}
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	e, rec := newEngine(t, Rule{Name: "link", Message: emu.NetworkInfo, Attribute: "LinkStrength", Op: OpLess,
+		Value: 20, Cooldown: 10 * time.Minute})
+	ctx := context.Background()
+	// flap drops the link strength then restores it, returning the states
+	// notified by each.
+	flap := func(at time.Duration) string {
+		e.Evaluate(ctx, &emu.Network{Name: emu.NetworkInfo, LinkStrength: 10}, t0.Add(at))
+		low := rec.states(e)
+		e.Evaluate(ctx, &emu.Network{Name: emu.NetworkInfo, LinkStrength: 50}, t0.Add(at+time.Minute))
+		return strings.Join(append(low, rec.states(e)...), ",")
+	}
+	if got := flap(0); got != "link:firing,link:resolved" {
+		t.Errorf("notified %q", got)
+	}
+	// the firing within the cooldown is not notified, nor its resolution
+	if got := flap(5 * time.Minute); got != "" {
+		t.Errorf("notified %q within the cooldown", got)
+	}
+	if got := flap(10 * time.Minute); got != "link:firing,link:resolved" {
+		t.Errorf("notified %q after the cooldown", got)
+	}
+}
+
+func TestChangedAndAbsent(t *testing.T) {
+	e, rec := newEngine(t,
+		Rule{Name: "tier", Message: emu.Price, Attribute: "Tier", Op: OpChanged},
+		Rule{Name: "stale", Message: emu.CumulativeEnergy, Op: OpAbsent, For: 10 * time.Minute})
+	for _, rs := range e.rules {
+		rs.lastSeen = t0
+	}
+	ctx := context.Background()
+	e.Evaluate(ctx, &emu.CurrentPrice{Tier: 1}, t0)
+	e.Evaluate(ctx, &emu.CurrentPrice{Tier: 1}, t0)
+	e.Evaluate(ctx, &emu.CurrentPrice{Tier: 2}, t0)
+	e.Tick(ctx, t0.Add(9*time.Minute))
+	if got := strings.Join(rec.states(e), ","); got != "tier:firing" {
+		t.Errorf("notified %q, want the change of tier only", got)
+	}
+	e.Tick(ctx, t0.Add(10*time.Minute))
+	e.Tick(ctx, t0.Add(11*time.Minute))
+	if got := strings.Join(rec.states(e), ","); got != "stale:firing" {
+		t.Errorf("notified %q, want stale firing once", got)
+	}
+	e.Evaluate(ctx, &emu.CumulativeEnergyConsumption{}, t0.Add(12*time.Minute))
+	if got := strings.Join(rec.states(e), ","); got != "stale:resolved" {
+		t.Errorf("notified %q, want stale resolved", got)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, r := range []Rule{
+		{Message: emu.InstantaneousPower, Attribute: "Power", Op: OpGreater, Value: 7},
+		{Name: "r", Attribute: "Power", Op: OpGreater, Value: 7},
+		{Name: "r", Message: emu.InstantaneousPower, Op: OpGreater, Value: 7},
+		{Name: "r", Message: emu.InstantaneousPower, Attribute: "Power", Op: OpGreater, Value: "high"},
+		{Name: "r", Message: emu.InstantaneousPower, Attribute: "Power", Op: OpEqual},
+		{Name: "r", Message: emu.InstantaneousPower, Op: OpAbsent},
+		{Name: "r", Message: emu.InstantaneousPower, Attribute: "Power", Op: "~"},
+		{Name: "r", Message: emu.InstantaneousPower, Attribute: "Power", Op: OpGreater, Value: 7, For: -time.Second},
+		{Name: "r", Message: emu.InstantaneousPower, Attribute: "Power", Op: OpGreater, Value: 7, Sinks: []string{"nope"}},
+	} {
+		if _, err := NewEngine(&Config{Rules: []Rule{r}}); err == nil {
+			t.Errorf("rule %+v accepted", r)
+		}
+	}
+	if _, err := NewEngine(&Config{Sinks: []SinkConfig{{Name: "a", Type: SinkLog}, {Name: "a", Type: SinkLog}}}); err == nil {
+		t.Error("duplicate sink accepted")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte(`
+sinks:
+  - name: log
+    type: log
+rules:
+  - name: high
+    message: InstantaneousPower
+    attribute: Power
+    op: ">"
+    value: 7
+    for: 2m
+    hysteresis: 0.5
+    sinks: [log]
+`), 0o644)
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.Rules[0]
+	if r.Name != "high" || r.For != 2*time.Minute || r.Hysteresis != 0.5 || r.Value != 7 || cfg.Sinks[0].Type != SinkLog {
+		t.Errorf("loaded %+v", cfg)
+	}
+	if _, err := NewEngine(cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	got := make(chan Notification, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if r.Header.Get("Authorization") != "Bearer token" || json.NewDecoder(r.Body).Decode(&n) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got <- n
+	}))
+	defer ts.Close()
+	s, err := NewSink(SinkConfig{Name: "hook", Type: SinkWebhook, URL: ts.URL, Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Notify(context.Background(), Notification{Rule: "high", State: Firing, Text: "high firing"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-got; n.Rule != "high" || n.State != Firing {
+		t.Errorf("received %+v", n)
+	}
+	s, _ = NewSink(SinkConfig{Name: "hook", Type: SinkWebhook, URL: ts.URL})
+	if err := s.Notify(context.Background(), Notification{Rule: "high"}); err == nil {
+		t.Error("rejected notification succeeded")
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s, err := NewSink(SinkConfig{Name: "exec", Type: SinkExec, Command: "sh",
+		Args: []string{"-c", `printf '%s %s ' "$EMU_RULE" "$EMU_STATE" > "$0"; cat >> "$0"`, out}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Notify(context.Background(), Notification{Rule: "high", State: Resolved}); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(out)
+	if !strings.HasPrefix(string(b), `high resolved {"rule":"high","state":"resolved"`) {
+		t.Errorf("command got %q", b)
+	}
+}
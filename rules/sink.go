@@ -0,0 +1,133 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+// Types of sinks.
+const (
+	SinkWebhook = "webhook"
+	SinkExec    = "exec"
+	SinkLog     = "log"
+)
+
+// SinkConfig declares a sink of a rules file.
+type SinkConfig struct {
+	Name    string            `yaml:"name"`
+	Type    string            `yaml:"type"`
+	URL     string            `yaml:"url"`     // webhook
+	Headers map[string]string `yaml:"headers"` // webhook
+	Command string            `yaml:"command"` // exec
+	Args    []string          `yaml:"args"`    // exec
+	Timeout time.Duration     `yaml:"timeout"` // webhook and exec, 10s by default
+}
+
+// Sink delivers notifications.
+type Sink interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+func NewSink(sc SinkConfig) (Sink, error) {
+	timeout := sc.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	switch sc.Type {
+	case SinkWebhook:
+		if sc.URL == "" {
+			return nil, fmt.Errorf("missing url")
+		}
+		return &WebhookSink{URL: sc.URL, Headers: sc.Headers, Timeout: timeout}, nil
+	case SinkExec:
+		if sc.Command == "" {
+			return nil, fmt.Errorf("missing command")
+		}
+		return &ExecSink{Command: sc.Command, Args: sc.Args, Timeout: timeout}, nil
+	case SinkLog:
+		return LogSink{}, nil
+	default:
+		return nil, fmt.Errorf("invalid sink type %q", sc.Type)
+	}
+}
+
+// WebhookSink POSTs the notification as JSON.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+	Timeout time.Duration
+}
+
+func (s *WebhookSink) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// ExecSink runs a command with the notification as JSON on its standard
+// input and in EMU_RULE, EMU_STATE, EMU_VALUE and EMU_TEXT.
+type ExecSink struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (s *ExecSink) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command, s.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"EMU_RULE="+n.Rule,
+		"EMU_STATE="+n.State,
+		"EMU_VALUE="+fmt.Sprint(n.Value),
+		"EMU_TEXT="+n.Text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", s.Command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// LogSink writes the notification to the emu loggers.
+type LogSink struct{}
+
+func (LogSink) Notify(ctx context.Context, n Notification) error {
+	if n.State == Firing {
+		emu.WarningLogger.Println(n.Text)
+	} else {
+		emu.InfoLogger.Println(n.Text)
+	}
+	return nil
+}
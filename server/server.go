@@ -0,0 +1,270 @@
+// Package server exposes an emu session over HTTP so that several
+// applications can share the single serial connection to the device.
+//
+//	GET  /v1/device    device information (GET_DEVICE_INFO)
+//	GET  /v1/time      device time (GET_TIME)
+//	GET  /v1/network   connection status with the meter (GET_CONN_STATUS)
+//	GET  /v1/power     instantaneous demand (GET_DEMAND)
+//	GET  /v1/energy    cumulative energy (GET_SUMMATION)
+//	POST /v1/commands  any command, e.g. {"command": "RESTART", "params": {}}
+//	GET  /v1/stream    Server-Sent Events of the subscribed messages,
+//	                   ?topics=InstantaneousPower,CumulativeEnergy selects
+//	                   the topics, all of them by default
+//	GET  /v1/ws        WebSocket feed, clients select the topics with
+//	                   {"action": "subscribe", "topics": ["InstantaneousPower"]}
+//	                   and {"action": "unsubscribe", "topics": [...]} frames
+//
+// Messages are encoded as the JSON envelopes of emu.MarshalMessage.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbhuyan/emu"
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	sseWriteWait      = 10 * time.Second
+	sseQueueLen       = 64
+)
+
+type ServerOptions struct {
+	AllowedOrigins []string
+}
+
+type ServerOption func(*ServerOptions)
+
+// WithAllowedOrigins sets the cross origins allowed to open a WebSocket,
+// "*" allows any origin. Same-origin requests are always allowed.
+func WithAllowedOrigins(origins ...string) ServerOption {
+	return func(o *ServerOptions) {
+		o.AllowedOrigins = origins
+	}
+}
+
+// Server serves the HTTP API of an emu session. Commands are executed one at
+// a time as the device can only answer one command at a time.
+type Server struct {
+	device emu.Emu
+	mux    *http.ServeMux
+	lck    sync.Mutex
+	opt    *ServerOptions
+}
+
+// NewServer returns the HTTP API of a started device.
+func NewServer(device emu.Emu, opts ...ServerOption) *Server {
+	options := &ServerOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	s := &Server{device: device, mux: http.NewServeMux(), opt: options}
+	s.mux.HandleFunc("GET /v1/device", s.commandHandler(emu.GET_DEVICE_INFO))
+	s.mux.HandleFunc("GET /v1/time", s.commandHandler(emu.GET_TIME))
+	s.mux.HandleFunc("GET /v1/network", s.commandHandler(emu.GET_CONN_STATUS))
+	s.mux.HandleFunc("GET /v1/power", s.commandHandler(emu.GET_DEMAND))
+	s.mux.HandleFunc("GET /v1/energy", s.commandHandler(emu.GET_SUMMATION))
+	s.mux.HandleFunc("POST /v1/commands", s.handleCommand)
+	s.mux.HandleFunc("GET /v1/stream", s.handleStream)
+	s.mux.HandleFunc("GET /v1/ws", s.handleWebSocket)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Execute sends the command to the device and waits for its response.
+func (s *Server) Execute(cmd emu.Command) (emu.Message, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if err := s.device.SendCommand(cmd); err != nil {
+		return nil, err
+	}
+	return s.device.GetResponse()
+}
+
+// commandRequest is the body of POST /v1/commands.
+type commandRequest struct {
+	Command string            `json:"command"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) commandHandler(id emu.CommandId) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cmd, err := emu.NewCommand(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.respond(w, cmd)
+	}
+}
+
+func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
+	var req commandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	id, err := emu.StrToCommandId(req.Command)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var meterOpts []emu.MeterOption
+	if meter, ok := req.Params["MeterMacId"]; ok {
+		// rejected by the commands not targeting a meter
+		meterOpts = append(meterOpts, emu.WithMeter(meter))
+	}
+	cmd, err := emu.NewCommand(id, meterOpts...)
+	if _, ok := req.Params["UTCTime"]; err == nil && id == emu.SET_TIME && !ok {
+		// set the device clock to the host clock
+		cmd, err = emu.NewSetTimeCommand(time.Now())
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for key, value := range req.Params {
+		if key == "MeterMacId" {
+			continue
+		}
+		if !isXmlName(key) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid parameter name %q", key))
+			return
+		}
+		cmd.SetAttrib(key, value)
+	}
+	s.respond(w, cmd)
+}
+
+func (s *Server) respond(w http.ResponseWriter, cmd emu.Command) {
+	rsp, err := s.Execute(cmd)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, emu.ErrTimeOut) {
+			status = http.StatusGatewayTimeout
+		}
+		writeError(w, status, err)
+		return
+	}
+	env, err := emu.NewEnvelope(rsp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, env)
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	topics := emu.MessageNames()
+	if q := r.URL.Query().Get("topics"); q != "" {
+		topics = topics[:0]
+		for _, t := range strings.Split(q, ",") {
+			topics = append(topics, emu.MessageName(strings.TrimSpace(t)))
+		}
+	}
+
+	// fan the subscriptions into a single queue, dropping the oldest frame
+	// when the client does not keep up so that it never holds up the device
+	// reader
+	frames := make(chan []byte, sseQueueLen)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	for _, topic := range topics {
+		ch, err := s.device.Subscribe(topic)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.device.Unsubscribe(topic, ch)
+			for {
+				select {
+				case <-done:
+					return
+				case m := <-ch:
+					data, err := emu.MarshalMessage(m)
+					if err != nil {
+						emu.WarningLogger.Printf("unable to encode %s: %v", m.GetName(), err)
+						continue
+					}
+					enqueue(frames, fmt.Appendf(nil, "event: %s\ndata: %s\n\n", m.GetName(), data), "stream client "+r.RemoteAddr)
+				}
+			}
+		}()
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc.SetWriteDeadline(time.Now().Add(sseWriteWait))
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var frame []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			frame = []byte(": heartbeat\n\n")
+		case frame = <-frames:
+		}
+		rc.SetWriteDeadline(time.Now().Add(sseWriteWait))
+		if _, err := w.Write(frame); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		emu.WarningLogger.Printf("unable to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// isXmlName reports whether s can be used as an element name of a command.
+func isXmlName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != "Name"
+}
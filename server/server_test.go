@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kbhuyan/emu"
+	"github.com/kbhuyan/emu/util"
+)
+
+// fakeDevice publishes the messages given to it, the other methods of the
+// interface are not used.
+type fakeDevice struct {
+	emu.Emu
+	pubsub *util.PubSub[emu.MessageName, emu.Message]
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{pubsub: util.NewPubSub[emu.MessageName, emu.Message]()}
+}
+
+func (d *fakeDevice) Subscribe(mn emu.MessageName) (chan emu.Message, error) {
+	return d.pubsub.Subscribe(mn), nil
+}
+
+func (d *fakeDevice) Unsubscribe(mn emu.MessageName, ch <-chan emu.Message) {
+	d.pubsub.Close(mn, ch)
+}
+
+func TestSlowStreamClient(t *testing.T) {
+	device := newFakeDevice()
+	ts := httptest.NewServer(NewServer(device))
+	defer ts.Close()
+
+	// a client reading the headers only
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /v1/stream?topics=InstantaneousPower HTTP/1.1\r\nHost: emu\r\n\r\n"))
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		t.Fatalf("stream = %v, %v", rsp, err)
+	}
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		m := &emu.InstantaneousPowerDemand{DeviceMacId: strings.Repeat("0", 1024)}
+		for i := 0; i < 50000; i++ {
+			device.pubsub.Publish(emu.InstantaneousPower, m)
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the device is held up by a client not reading its stream")
+	}
+}
+
+func TestCommandMeter(t *testing.T) {
+	ts := httptest.NewServer(NewServer(newFakeDevice()))
+	defer ts.Close()
+	body := `{"command": "GET_DEVICE_INFO", "params": {"MeterMacId": "0x00135003007c3d11"}}`
+	rsp, err := http.Post(ts.URL+"/v1/commands", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET_DEVICE_INFO with a MeterMacId = %s, want %d", rsp.Status, http.StatusBadRequest)
+	}
+}
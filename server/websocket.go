@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kbhuyan/emu"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingPeriod   = wsPongWait * 9 / 10
+	wsMaxFrameSize = 4096
+	wsSendQueueLen = 64
+)
+
+// wsRequest is a frame sent by a WebSocket client, e.g.
+// {"action": "subscribe", "topics": ["InstantaneousPower"]}.
+type wsRequest struct {
+	Action string            `json:"action"`
+	Topics []emu.MessageName `json:"topics"`
+}
+
+// wsReply acknowledges a wsRequest with the topics the client is now
+// subscribed to, or reports why it failed.
+type wsReply struct {
+	Action string            `json:"action"`
+	Topics []emu.MessageName `json:"topics"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// wsClient is a WebSocket connection and its subscriptions. Messages are
+// queued per client so that a slow client never holds up the device reader;
+// when the queue is full the oldest message is dropped.
+type wsClient struct {
+	device emu.Emu
+	conn   *websocket.Conn
+	send   chan []byte
+	done   chan struct{}
+
+	lck  sync.Mutex
+	subs map[emu.MessageName]chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (s *Server) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     s.checkOrigin,
+	}
+}
+
+// checkOrigin accepts same-origin requests, requests without an Origin
+// header and the origins configured with WithAllowedOrigins.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(s.opt.AllowedOrigins, "*") {
+		return true
+	}
+	if slices.Contains(s.opt.AllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied with an HTTP error
+		emu.WarningLogger.Printf("websocket upgrade failed: %v", err)
+		return
+	}
+	c := &wsClient{
+		device: s.device,
+		conn:   conn,
+		send:   make(chan []byte, wsSendQueueLen),
+		done:   make(chan struct{}),
+		subs:   make(map[emu.MessageName]chan struct{}),
+	}
+	go c.writer()
+	c.reader()
+}
+
+// reader handles the subscribe/unsubscribe frames of the client until the
+// connection is closed, then releases its subscriptions.
+func (c *wsClient) reader() {
+	defer func() {
+		close(c.done)
+		c.lck.Lock()
+		for _, stop := range c.subs {
+			close(stop)
+		}
+		c.lck.Unlock()
+		c.wg.Wait()
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(wsMaxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				emu.WarningLogger.Printf("websocket read failed: %v", err)
+			}
+			return
+		}
+		var req wsRequest
+		if err := json.Unmarshal(frame, &req); err != nil {
+			c.reply(wsReply{Error: "invalid frame: " + err.Error()})
+			continue
+		}
+		switch req.Action {
+		case "subscribe":
+			err = c.subscribe(req.Topics)
+		case "unsubscribe":
+			c.unsubscribe(req.Topics)
+		default:
+			err = fmt.Errorf("invalid action %q", req.Action)
+		}
+		rep := wsReply{Action: req.Action, Topics: c.topics()}
+		if err != nil {
+			rep.Error = err.Error()
+		}
+		c.reply(rep)
+	}
+}
+
+// writer sends the queued frames and the heartbeat pings.
+func (c *wsClient) writer() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+			return
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) subscribe(topics []emu.MessageName) error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, topic := range topics {
+		if _, ok := c.subs[topic]; ok {
+			continue
+		}
+		ch, err := c.device.Subscribe(topic)
+		if err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		c.subs[topic] = stop
+		c.wg.Add(1)
+		go c.forward(topic, ch, stop)
+	}
+	return nil
+}
+
+func (c *wsClient) unsubscribe(topics []emu.MessageName) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, topic := range topics {
+		if stop, ok := c.subs[topic]; ok {
+			close(stop)
+			delete(c.subs, topic)
+		}
+	}
+}
+
+func (c *wsClient) topics() []emu.MessageName {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	topics := make([]emu.MessageName, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// forward encodes the messages of a subscription into the send queue.
+func (c *wsClient) forward(topic emu.MessageName, ch chan emu.Message, stop chan struct{}) {
+	defer c.wg.Done()
+	defer c.device.Unsubscribe(topic, ch)
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-ch:
+			frame, err := emu.MarshalMessage(m)
+			if err != nil {
+				emu.WarningLogger.Printf("unable to encode %s: %v", m.GetName(), err)
+				continue
+			}
+			c.enqueue(frame)
+		}
+	}
+}
+
+func (c *wsClient) reply(rep wsReply) {
+	frame, err := json.Marshal(rep)
+	if err != nil {
+		return
+	}
+	c.enqueue(frame)
+}
+
+func (c *wsClient) enqueue(frame []byte) {
+	enqueue(c.send, frame, "websocket client "+c.conn.RemoteAddr().String())
+}
+
+// enqueue queues frame for the writer of a client, dropping the oldest queued
+// frame when the client does not keep up.
+func enqueue(send chan []byte, frame []byte, client string) {
+	for {
+		select {
+		case send <- frame:
+			return
+		default:
+		}
+		select {
+		case <-send:
+			emu.WarningLogger.Printf("%s is too slow, dropping a message", client)
+		default:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kbhuyan/emu"
+)
+
+func dialWebSocket(t *testing.T, ts *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, rsp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/v1/ws", header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+	return conn, rsp, err
+}
+
+func request(t *testing.T, conn *websocket.Conn, req wsRequest) wsReply {
+	t.Helper()
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	var rep wsReply
+	if err := conn.ReadJSON(&rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestWebSocket(t *testing.T) {
+	device := newFakeDevice()
+	ts := httptest.NewServer(NewServer(device))
+	defer ts.Close()
+	conn, _, err := dialWebSocket(t, ts, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := request(t, conn, wsRequest{Action: "subscribe", Topics: []emu.MessageName{emu.InstantaneousPower, emu.Price}})
+	if rep.Error != "" || len(rep.Topics) != 2 || rep.Topics[0] != emu.InstantaneousPower || rep.Topics[1] != emu.Price {
+		t.Fatalf("subscribe reply %+v", rep)
+	}
+	device.pubsub.Publish(emu.InstantaneousPower, &emu.InstantaneousPowerDemand{TimeStamp: 1, Power: 1.5})
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := emu.UnmarshalMessage(frame)
+	if d, ok := m.(*emu.InstantaneousPowerDemand); err != nil || !ok || d.Power != 1.5 {
+		t.Errorf("frame %s: %+v, %v", frame, m, err)
+	}
+
+	rep = request(t, conn, wsRequest{Action: "unsubscribe", Topics: []emu.MessageName{emu.InstantaneousPower}})
+	if rep.Error != "" || len(rep.Topics) != 1 || rep.Topics[0] != emu.Price {
+		t.Errorf("unsubscribe reply %+v", rep)
+	}
+	if rep = request(t, conn, wsRequest{Action: "publish"}); rep.Error == "" {
+		t.Errorf("reply %+v to an invalid action", rep)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("{"))
+	if err := conn.ReadJSON(&rep); err != nil || !strings.HasPrefix(rep.Error, "invalid frame") {
+		t.Errorf("reply %+v, %v to an invalid frame", rep, err)
+	}
+
+	// the subscriptions are released with the connection
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for device.pubsub.Subscribed(func(emu.MessageName) bool { return true }) {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriptions left after the client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	ts := httptest.NewServer(NewServer(newFakeDevice()))
+	defer ts.Close()
+	if _, _, err := dialWebSocket(t, ts, ts.URL); err != nil {
+		t.Errorf("same origin: %v", err)
+	}
+	if _, rsp, err := dialWebSocket(t, ts, "http://evil.example"); err == nil || rsp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross origin accepted")
+	}
+
+	ts = httptest.NewServer(NewServer(newFakeDevice(), WithAllowedOrigins("http://dashboard.example")))
+	defer ts.Close()
+	if _, _, err := dialWebSocket(t, ts, "http://dashboard.example"); err != nil {
+		t.Errorf("allowed origin: %v", err)
+	}
+	if _, _, err := dialWebSocket(t, ts, "http://evil.example"); err == nil {
+		t.Errorf("cross origin accepted")
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	send := make(chan []byte, 2)
+	for _, frame := range []string{"a", "b", "c"} {
+		enqueue(send, []byte(frame), "test")
+	}
+	if a, b := <-send, <-send; string(a) != "b" || string(b) != "c" {
+		t.Errorf("queued %s, %s, want the oldest frame dropped", a, b)
+	}
+}
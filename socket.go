@@ -0,0 +1,460 @@
+package emu
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The socket protocol lets the processes of a host share the device opened by
+// one of them, see NewSocketServer and Dial. Requests and responses are JSON
+// lines; a response carries the id of its request, the messages of the
+// subscriptions carry the id of the subscription chosen by the client:
+//
+//	{"id":1,"op":"command","command":"GET_TIME","params":{"MeterMacId":"0x..."}}
+//	{"id":1,"message":{"type":"TimeCluster","data":{...}}}
+//	{"id":2,"op":"subscribe","sub":1,"topic":"InstantaneousPower"}
+//	{"id":2}
+//	{"sub":1,"message":{"type":"InstantaneousPower","ts":1655127645,"data":{...}}}
+//	{"id":3,"op":"unsubscribe","sub":1}
+//	{"id":4,"op":"raw","fragment":"<Command><Name>get_schedule</Name></Command>"}
+//	{"id":5,"op":"meters"}
+//	{"id":6,"op":"network"}
+//
+// Failed requests are answered with an error, and "timeout":true when the
+// device did not answer in time.
+
+const (
+	socketScheme     = "unix://"
+	socketWriteWait  = 10 * time.Second
+	socketQueueLen   = 64
+	socketMaxRequest = 1 << 20
+)
+
+var errNoDevice = errors.New("no device is open")
+
+// unsupported is the error of an op the device of the server does not
+// implement, see the capabilities of Emu.
+func unsupported(op string) error {
+	return fmt.Errorf("op %q is not supported by the device", op)
+}
+
+// socketRequest is a line sent by a client.
+type socketRequest struct {
+	Id       uint64            `json:"id"`
+	Op       string            `json:"op"`                 // command, subscribe, unsubscribe, raw, meters, network or an op of WithSocketHandler
+	Command  string            `json:"command,omitempty"`  // CommandId of the command op
+	Params   map[string]string `json:"params,omitempty"`   // attributes of the command, or parameters of a WithSocketHandler op
+	Sub      uint64            `json:"sub,omitempty"`      // subscription of the subscribe and unsubscribe ops
+	Topic    MessageName       `json:"topic,omitempty"`    // subscribe
+	Meter    string            `json:"meter,omitempty"`    // subscribe: MeterMacId of the messages, any when empty
+	Fragment string            `json:"fragment,omitempty"` // raw
+}
+
+// socketResponse is a line sent by the server.
+type socketResponse struct {
+	Id      uint64               `json:"id,omitempty"`  // 0 for the messages of a subscription
+	Sub     uint64               `json:"sub,omitempty"` // subscription of the message
+	Error   string               `json:"error,omitempty"`
+	Timeout bool                 `json:"timeout,omitempty"`
+	Message *Envelope            `json:"message,omitempty"`
+	Meters  []Meter              `json:"meters,omitempty"`
+	Network *socketNetworkStatus `json:"network,omitempty"`
+	Data    json.RawMessage      `json:"data,omitempty"` // result of a WithSocketHandler op
+}
+
+// err returns the error of the response, ErrTimeOut when the device did not
+// answer in time.
+func (r *socketResponse) err() error {
+	switch {
+	case r.Timeout:
+		return ErrTimeOut
+	case r.Error != "":
+		return errors.New(r.Error)
+	default:
+		return nil
+	}
+}
+
+// socketNetworkStatus is a NetworkStatus on the wire, its Network is an
+// envelope to keep its message name.
+type socketNetworkStatus struct {
+	State   NetworkState      `json:"State"`
+	Since   time.Time         `json:"Since"`
+	Network *Envelope         `json:"Network,omitempty"`
+	History []StateTransition `json:"History,omitempty"`
+}
+
+func newSocketNetworkStatus(s NetworkStatus) (*socketNetworkStatus, error) {
+	ns := &socketNetworkStatus{State: s.State, Since: s.Since, History: s.History}
+	if s.Network != nil {
+		env, err := NewEnvelope(s.Network)
+		if err != nil {
+			return nil, err
+		}
+		ns.Network = env
+	}
+	return ns, nil
+}
+
+func (ns *socketNetworkStatus) status() NetworkStatus {
+	s := NetworkStatus{State: ns.State, Since: ns.Since, History: ns.History}
+	if ns.Network != nil {
+		if m, err := ns.Network.Message(); err == nil {
+			s.Network, _ = m.(*Network)
+		}
+	}
+	return s
+}
+
+// SocketHandler answers an op added to the socket protocol with the value
+// encoded as the data of the response.
+type SocketHandler func(params map[string]string) (any, error)
+
+type SocketServerOptions struct {
+	Handlers map[string]SocketHandler
+}
+
+type SocketServerOption func(*SocketServerOptions)
+
+// WithSocketHandler adds the op to the socket protocol, e.g. the status of the
+// process owning the device. The ops of the protocol cannot be replaced.
+func WithSocketHandler(op string, h SocketHandler) SocketServerOption {
+	return func(o *SocketServerOptions) {
+		o.Handlers[op] = h
+	}
+}
+
+// SocketServer serves a started device to the clients of Dial. Commands are
+// executed one at a time as the device can only answer one command at a time.
+type SocketServer struct {
+	device Emu // nil when no device is open, only the ops of WithSocketHandler succeed
+	opt    *SocketServerOptions
+	cmdLck sync.Mutex
+
+	lck   sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewSocketServer returns the socket server of a started device, or of no
+// device when it is nil.
+func NewSocketServer(device Emu, opts ...SocketServerOption) *SocketServer {
+	options := &SocketServerOptions{Handlers: make(map[string]SocketHandler)}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return &SocketServer{device: device, opt: options, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve serves the connections of l until it is closed.
+func (s *SocketServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a client until it disconnects or the server is closed.
+func (s *SocketServer) ServeConn(conn net.Conn) {
+	s.lck.Lock()
+	s.conns[conn] = struct{}{}
+	s.lck.Unlock()
+	c := &socketConn{
+		server:   s,
+		conn:     conn,
+		replies:  make(chan []byte),
+		messages: make(chan []byte, socketQueueLen),
+		done:     make(chan struct{}),
+		subs:     make(map[uint64]chan struct{}),
+	}
+	go c.writer()
+	c.reader()
+	s.lck.Lock()
+	delete(s.conns, conn)
+	s.lck.Unlock()
+}
+
+// Close disconnects the clients, which reconnect to the server now serving
+// the socket. The server can still serve new connections.
+func (s *SocketServer) Close() {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// execute sends the command to the device and waits for its response.
+func (s *SocketServer) execute(req *socketRequest) (Message, error) {
+	id, err := StrToCommandId(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	var meterOpts []MeterOption
+	if meter, ok := req.Params[string(emuMeterMacId)]; ok {
+		// rejected by the commands not targeting a meter
+		meterOpts = append(meterOpts, WithMeter(meter))
+	}
+	cmd, err := NewCommand(id, meterOpts...)
+	if _, ok := req.Params[string(emuUTCTime)]; err == nil && id == SET_TIME && !ok {
+		// set the device clock to the host clock
+		cmd, err = NewSetTimeCommand(time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range req.Params {
+		if key == string(emuMeterMacId) {
+			continue
+		}
+		cmd.SetAttrib(key, value)
+	}
+	s.cmdLck.Lock()
+	defer s.cmdLck.Unlock()
+	if err := s.device.SendCommand(cmd); err != nil {
+		return nil, err
+	}
+	return s.device.GetResponse()
+}
+
+// socketConn is a client connection and its subscriptions. The messages are
+// queued so that a slow client never holds up the device reader; when the
+// queue is full the oldest message is dropped. Responses are never dropped.
+type socketConn struct {
+	server   *SocketServer
+	conn     net.Conn
+	replies  chan []byte
+	messages chan []byte
+	done     chan struct{}
+
+	lck  sync.Mutex
+	subs map[uint64]chan struct{}
+	wg   sync.WaitGroup
+}
+
+// reader handles the requests of the client until the connection is closed,
+// then releases its subscriptions.
+func (c *socketConn) reader() {
+	defer func() {
+		c.lck.Lock()
+		for _, stop := range c.subs {
+			close(stop)
+		}
+		c.lck.Unlock()
+		c.wg.Wait()
+		close(c.done)
+		c.conn.Close()
+	}()
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(nil, socketMaxRequest)
+	for scanner.Scan() {
+		var req socketRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			c.reply(&socketResponse{Error: "invalid request: " + err.Error()})
+			continue
+		}
+		if req.Op == "command" {
+			// the other requests are not held up by the device
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.reply(c.handle(&req))
+			}()
+			continue
+		}
+		c.reply(c.handle(&req))
+	}
+}
+
+func (c *socketConn) handle(req *socketRequest) *socketResponse {
+	rsp := &socketResponse{Id: req.Id}
+	fail := func(err error) *socketResponse {
+		rsp.Error = err.Error()
+		rsp.Timeout = errors.Is(err, ErrTimeOut)
+		return rsp
+	}
+	if h, ok := c.server.opt.Handlers[req.Op]; ok {
+		v, err := h(req.Params)
+		if err != nil {
+			return fail(err)
+		}
+		if rsp.Data, err = json.Marshal(v); err != nil {
+			return fail(err)
+		}
+		return rsp
+	}
+	device := c.server.device
+	if device == nil {
+		return fail(errNoDevice)
+	}
+	switch req.Op {
+	case "command":
+		m, err := c.server.execute(req)
+		if err != nil {
+			return fail(err)
+		}
+		if rsp.Message, err = NewEnvelope(m); err != nil {
+			return fail(err)
+		}
+	case "subscribe":
+		if err := c.subscribe(req.Sub, req.Topic, req.Meter); err != nil {
+			return fail(err)
+		}
+	case "unsubscribe":
+		c.unsubscribe(req.Sub)
+	case "raw":
+		raw, ok := device.(RawSender)
+		if !ok {
+			return fail(unsupported(req.Op))
+		}
+		// not in the middle of a command
+		c.server.cmdLck.Lock()
+		err := raw.WriteRaw(req.Fragment)
+		c.server.cmdLck.Unlock()
+		if err != nil {
+			return fail(err)
+		}
+	case "meters":
+		lister, ok := device.(MeterLister)
+		if !ok {
+			return fail(unsupported(req.Op))
+		}
+		rsp.Meters = lister.Meters()
+	case "network":
+		reporter, ok := device.(NetworkReporter)
+		if !ok {
+			return fail(unsupported(req.Op))
+		}
+		ns, err := newSocketNetworkStatus(reporter.NetworkStatus())
+		if err != nil {
+			return fail(err)
+		}
+		rsp.Network = ns
+	default:
+		return fail(fmt.Errorf("invalid op %q", req.Op))
+	}
+	return rsp
+}
+
+func (c *socketConn) subscribe(sub uint64, topic MessageName, meter string) error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if _, ok := c.subs[sub]; ok {
+		return fmt.Errorf("subscription %d already exists", sub)
+	}
+	var (
+		ch  chan Message
+		err error
+	)
+	if meter == "" {
+		ch, err = c.server.device.Subscribe(topic)
+	} else if ms, ok := c.server.device.(MeterSubscriber); ok {
+		ch, err = ms.SubscribeMeter(topic, WithMeter(meter))
+	} else {
+		err = unsupported("subscribe")
+	}
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	c.subs[sub] = stop
+	c.wg.Add(1)
+	go c.forward(sub, topic, ch, stop)
+	return nil
+}
+
+func (c *socketConn) unsubscribe(sub uint64) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if stop, ok := c.subs[sub]; ok {
+		close(stop)
+		delete(c.subs, sub)
+	}
+}
+
+// forward encodes the messages of a subscription into the message queue.
+func (c *socketConn) forward(sub uint64, topic MessageName, ch chan Message, stop chan struct{}) {
+	defer c.wg.Done()
+	defer c.server.device.Unsubscribe(topic, ch)
+	for {
+		select {
+		case <-stop:
+			return
+		case m := <-ch:
+			env, err := NewEnvelope(m)
+			if err != nil {
+				WarningLogger.Printf("unable to encode %s: %v", m.GetName(), err)
+				continue
+			}
+			line, err := json.Marshal(&socketResponse{Sub: sub, Message: env})
+			if err != nil {
+				continue
+			}
+			c.enqueue(line)
+		}
+	}
+}
+
+func (c *socketConn) reply(rsp *socketResponse) {
+	line, err := json.Marshal(rsp)
+	if err != nil {
+		line, _ = json.Marshal(&socketResponse{Id: rsp.Id, Error: err.Error()})
+	}
+	select {
+	case c.replies <- line:
+	case <-c.done:
+	}
+}
+
+// enqueue queues a message for the writer, dropping the oldest queued
+// message when the client does not keep up.
+func (c *socketConn) enqueue(line []byte) {
+	for {
+		select {
+		case c.messages <- line:
+			return
+		default:
+		}
+		select {
+		case <-c.messages:
+			WarningLogger.Printf("socket client %s is too slow, dropping a message", c.conn.RemoteAddr())
+		default:
+		}
+	}
+}
+
+// writer writes the responses and the queued messages.
+func (c *socketConn) writer() {
+	for {
+		var line []byte
+		select {
+		case <-c.done:
+			return
+		case line = <-c.replies:
+		case line = <-c.messages:
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+		if _, err := c.conn.Write(append(line, '\n')); err != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// socketPath returns the path of a unix:// address.
+func socketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, socketScheme); ok && path != "" {
+		return path, true
+	}
+	return "", false
+}
@@ -0,0 +1,266 @@
+package emu
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// socketDevice is a fakeDevice recording what it is sent, subscribing to the
+// messages of a meter as the session does.
+type socketDevice struct {
+	*fakeDevice
+	lck    sync.Mutex
+	sent   []*commandImpl
+	raw    []string
+	meters map[<-chan Message]string
+}
+
+func newSocketDevice() *socketDevice {
+	return &socketDevice{fakeDevice: newFakeDevice(), meters: make(map[<-chan Message]string)}
+}
+
+func (d *socketDevice) SendCommand(cmd Command) error {
+	d.lck.Lock()
+	d.sent = append(d.sent, cmd.(*commandImpl))
+	d.lck.Unlock()
+	return d.fakeDevice.SendCommand(cmd)
+}
+
+func (d *socketDevice) WriteRaw(fragment string) error {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.raw = append(d.raw, fragment)
+	return nil
+}
+
+func (d *socketDevice) SendRaw(ctx context.Context, name string, params map[string]string, expect ...string) ([]*Fragment, error) {
+	return sendRaw(ctx, d, time.Second, name, params, expect)
+}
+
+func (d *socketDevice) Subscribe(mn MessageName) (chan Message, error) {
+	return d.SubscribeMeter(mn)
+}
+
+func (d *socketDevice) SubscribeMeter(mn MessageName, opts ...MeterOption) (chan Message, error) {
+	meter := strings.ToLower(newMeterOptions(opts).MeterMacId)
+	ch := d.pubsub.Subscribe(subscription{name: mn, meter: meter})
+	d.lck.Lock()
+	d.meters[ch] = meter
+	d.lck.Unlock()
+	return ch, nil
+}
+
+func (d *socketDevice) Unsubscribe(mn MessageName, ch <-chan Message) {
+	d.lck.Lock()
+	meter := d.meters[ch]
+	delete(d.meters, ch)
+	d.lck.Unlock()
+	d.pubsub.Close(subscription{name: mn, meter: meter}, ch)
+}
+
+func (d *socketDevice) Meters() []Meter {
+	return []Meter{{MeterMacId: "0x00135003000aaaa", Enabled: true}}
+}
+
+func (d *socketDevice) NetworkStatus() NetworkStatus {
+	return NetworkStatus{State: StateConnected, Since: time.Unix(1655127645, 0).UTC(),
+		Network: &Network{Name: NetworkInfo, Status: "Connected", LinkStrength: 100}}
+}
+
+// subscribed reports whether the device has a subscription of the meter,
+// waiting for it to be made or released.
+func (d *socketDevice) subscribed(t *testing.T, meter string, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.pubsub.Subscribed(func(s subscription) bool { return s.meter == meter }) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscription of %q = %v, want %v", meter, !want, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dialFake(t *testing.T, device Emu) (*socketEmu, *SocketServer) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "emu.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocketServer(device, WithSocketHandler("status", func(params map[string]string) (any, error) {
+		return params, nil
+	}))
+	go server.Serve(l)
+	e, err := Dial(socketScheme+path, WithLoggingLevel(LOG_OFF), WithTimeOut(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		l.Close()
+		server.Close()
+	})
+	return e.(*socketEmu), server
+}
+
+func TestSocketCommand(t *testing.T) {
+	device := newSocketDevice()
+	e, _ := dialFake(t, device)
+	cmd, err := NewCommand(GET_DEMAND, WithMeter("0x00135003000aaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SendCommand(cmd); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := e.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac, _ := rsp.GetAttrib("DeviceMacId"); rsp.GetName() != string(emuDeviceInfo) || mac != "0xd8d5b9000000abcd" {
+		t.Errorf("response %+v", rsp)
+	}
+	device.lck.Lock()
+	if len(device.sent) != 1 || device.sent[0].Id != GET_DEMAND || device.sent[0].Attribs["MeterMacId"] != "0x00135003000aaaa" {
+		t.Errorf("device sent %+v", device.sent)
+	}
+	device.lck.Unlock()
+
+	// a command not targeting a meter is refused by the server
+	cmd, _ = NewCommand(GET_DEVICE_INFO)
+	cmd.SetAttrib("MeterMacId", "0x00135003000aaaa")
+	e.SendCommand(cmd)
+	if _, err := e.GetResponse(); err == nil || !strings.Contains(err.Error(), "does not accept a MeterMacId") {
+		t.Errorf("err = %v, want the MeterMacId refused", err)
+	}
+	if _, err := e.GetResponse(); err != ErrTimeOut {
+		t.Errorf("err = %v without command, want ErrTimeOut", err)
+	}
+}
+
+func TestSocketSubscribe(t *testing.T) {
+	device := newSocketDevice()
+	e, _ := dialFake(t, device)
+	ch, err := e.SubscribeMeter(InstantaneousPower, WithMeter("0x00135003000AAAA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.subscribed(t, "0x00135003000aaaa", true)
+	want := &InstantaneousPowerDemand{TimeStamp: 1655127645, Power: 1.25, MeterMacId: "0x00135003000aaaa"}
+	device.pubsub.Publish(subscription{name: InstantaneousPower, meter: "0x00135003000aaaa"}, want)
+	select {
+	case m := <-ch:
+		if d, ok := m.(*InstantaneousPowerDemand); !ok || *d != *want {
+			t.Errorf("received %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	e.Unsubscribe(InstantaneousPower, ch)
+	device.subscribed(t, "0x00135003000aaaa", false)
+}
+
+func TestSocketOps(t *testing.T) {
+	device := newSocketDevice()
+	e, _ := dialFake(t, device)
+	if err := e.WriteRaw("<Command><Name>get_schedule</Name></Command>"); err != nil {
+		t.Fatal(err)
+	}
+	device.lck.Lock()
+	if len(device.raw) != 1 || device.raw[0] != "<Command><Name>get_schedule</Name></Command>" {
+		t.Errorf("device written %q", device.raw)
+	}
+	device.lck.Unlock()
+	if meters := e.Meters(); len(meters) != 1 || meters[0] != device.Meters()[0] {
+		t.Errorf("meters %+v", meters)
+	}
+	ns, want := e.NetworkStatus(), device.NetworkStatus()
+	if ns.State != want.State || !ns.Since.Equal(want.Since) || ns.Network == nil || *ns.Network != *want.Network {
+		t.Errorf("network status %+v", ns)
+	}
+	rsp, err := e.call(&socketRequest{Op: "status", Params: map[string]string{"a": "b"}})
+	if err != nil || string(rsp.Data) != `{"a":"b"}` {
+		t.Errorf("status op = %+v, %v", rsp, err)
+	}
+	if _, err := e.call(&socketRequest{Op: "format"}); err == nil {
+		t.Error("invalid op answered")
+	}
+}
+
+// The sessions implement every capability.
+func TestCapabilities(t *testing.T) {
+	for _, e := range []Emu{&emuImpl{}, &socketEmu{}} {
+		_, subscriber := e.(MeterSubscriber)
+		_, lister := e.(MeterLister)
+		_, reporter := e.(NetworkReporter)
+		_, raw := e.(RawSender)
+		_, keeper := e.(HistoryKeeper)
+		if !subscriber || !lister || !reporter || !raw || !keeper {
+			t.Errorf("%T lacks a capability", e)
+		}
+	}
+}
+
+// The ops of the capabilities a device does not implement fail.
+func TestSocketUnsupported(t *testing.T) {
+	e, _ := dialFake(t, newFakeDevice())
+	for _, req := range []*socketRequest{
+		{Op: "network"},
+		{Op: "raw", Fragment: "<Command><Name>get_time</Name></Command>"},
+		{Op: "subscribe", Sub: 1, Topic: InstantaneousPower, Meter: "0x00135003000aaaa"},
+	} {
+		if _, err := e.call(req); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("op %q = %v", req.Op, err)
+		}
+	}
+	if _, err := e.call(&socketRequest{Op: "subscribe", Sub: 2, Topic: InstantaneousPower}); err != nil {
+		t.Errorf("subscribe = %v", err)
+	}
+}
+
+// The client reconnects when the server closes the connections, e.g. on a
+// reload, and subscribes again.
+func TestSocketReconnect(t *testing.T) {
+	device := newSocketDevice()
+	e, server := dialFake(t, device)
+	ch, err := e.Subscribe(Price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.subscribed(t, "", true)
+	server.Close()
+	device.subscribed(t, "", false)
+	device.subscribed(t, "", true)
+	device.publish(&CurrentPrice{Price: 0.125, Tier: 2})
+	select {
+	case m := <-ch:
+		if p, ok := m.(*CurrentPrice); !ok || p.Tier != 2 {
+			t.Errorf("received %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received after the reconnection")
+	}
+	if _, err := e.call(&socketRequest{Op: "meters"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocketWithoutDevice(t *testing.T) {
+	e, _ := dialFake(t, nil)
+	if err := e.WriteRaw("<Command/>"); err == nil || err.Error() != errNoDevice.Error() {
+		t.Errorf("err = %v, want %v", err, errNoDevice)
+	}
+	if _, err := e.call(&socketRequest{Op: "status"}); err != nil {
+		t.Errorf("status op without device: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := e.SendRaw(ctx, "get_schedule", nil); err == nil {
+		t.Error("raw command sent without device")
+	}
+}
@@ -3,7 +3,7 @@ package emu
 import (
 	"fmt"
 	"math"
-	"reflect"
+	"strconv"
 	"time"
 )
 
@@ -75,6 +75,8 @@ func GetCumulativeEnergyConsumption(in Message) (*CumulativeEnergyConsumption, e
 		}
 		energy := roundToDecimal(float64((delivered-received)*multiplier)/float64(divisor), int(digitsRight))
 		cec.Energy = energy
+		cec.Delivered = roundToDecimal(float64(delivered*multiplier)/float64(divisor), int(digitsRight))
+		cec.Received = roundToDecimal(float64(received*multiplier)/float64(divisor), int(digitsRight))
 
 		if cec.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
 			return nil, fmt.Errorf("DeviceMacId not found in message")
@@ -88,26 +90,162 @@ func GetCumulativeEnergyConsumption(in Message) (*CumulativeEnergyConsumption, e
 	return nil, fmt.Errorf("failed to cast message to messageImpl")
 }
 
+func GetCurrentPrice(in Message) (*CurrentPrice, error) {
+	DebugLogger.Printf("%+v", in)
+	if msg, ok := in.(*messageImpl); ok {
+		cp := &CurrentPrice{}
+		if cp.TimeStamp, ok = msg.Attribs["TimeStamp"].(int64); !ok {
+			return nil, fmt.Errorf("TimeStamp not found in message")
+		}
+		var price, trailingDigits, currency, tier int64
+		if price, ok = msg.Attribs["Price"].(int64); !ok {
+			return nil, fmt.Errorf("price not found in message")
+		}
+		if price == priceNotAvailable {
+			return nil, fmt.Errorf("price not set on the meter")
+		}
+		if trailingDigits, ok = msg.Attribs["TrailingDigits"].(int64); !ok {
+			return nil, fmt.Errorf("TrailingDigits not found in message")
+		}
+		cp.Price = roundToDecimal(float64(price)/math.Pow(10, float64(trailingDigits)), int(trailingDigits))
+		if currency, ok = msg.Attribs["Currency"].(int64); ok {
+			cp.Currency = int(currency)
+		}
+		if tier, ok = msg.Attribs["Tier"].(int64); ok {
+			cp.Tier = int(tier)
+		}
+		cp.RateLabel, _ = msg.Attribs["RateLabel"].(string)
+		if cp.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
+			return nil, fmt.Errorf("DeviceMacId not found in message")
+		}
+
+		if cp.MeterMacId, ok = msg.Attribs["MeterMacId"].(string); !ok {
+			return nil, fmt.Errorf("MeterMacId not found in message")
+		}
+		return cp, nil
+	}
+	return nil, fmt.Errorf("failed to cast message to messageImpl")
+}
+
+func GetMeter(in Message) (*Meter, error) {
+	DebugLogger.Printf("%+v", in)
+	if msg, ok := in.(*messageImpl); ok {
+		m := &Meter{}
+		if m.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
+			return nil, fmt.Errorf("DeviceMacId not found in message")
+		}
+		if m.MeterMacId, ok = msg.Attribs["MeterMacId"].(string); !ok {
+			return nil, fmt.Errorf("MeterMacId not found in message")
+		}
+		if meterType, ok := msg.Attribs["MeterType"].(int64); ok {
+			m.MeterType = int(meterType)
+		}
+		m.NickName, _ = msg.Attribs["NickName"].(string)
+		m.Account, _ = msg.Attribs["Account"].(string)
+		m.Auth, _ = msg.Attribs["Auth"].(string)
+		m.Host, _ = msg.Attribs["Host"].(string)
+		m.Enabled, _ = msg.Attribs["Enabled"].(bool)
+		return m, nil
+	}
+	return nil, fmt.Errorf("failed to cast message to messageImpl")
+}
+
+func GetNotice(in Message) (*Notice, error) {
+	DebugLogger.Printf("%+v", in)
+	if msg, ok := in.(*messageImpl); ok {
+		n := &Notice{}
+		if n.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
+			return nil, fmt.Errorf("DeviceMacId not found in message")
+		}
+		if n.MeterMacId, ok = msg.Attribs["MeterMacId"].(string); !ok {
+			return nil, fmt.Errorf("MeterMacId not found in message")
+		}
+		n.TimeStamp, _ = msg.Attribs["TimeStamp"].(int64)
+		n.Id, _ = msg.Attribs["Id"].(string)
+		n.Text, _ = msg.Attribs["Text"].(string)
+		n.Priority, _ = msg.Attribs["Priority"].(string)
+		n.ConfirmationRequired, _ = msg.Attribs["ConfirmationRequired"].(bool)
+		n.Confirmed, _ = msg.Attribs["Confirmed"].(bool)
+		n.Queue, _ = msg.Attribs["Queue"].(string)
+		n.StartTime, _ = msg.Attribs["StartTime"].(int64)
+		if duration, ok := msg.Attribs["Duration"].(string); ok {
+			// minutes in hex, 0xffff until changed
+			n.Duration, _ = strconv.ParseInt(duration, 0, 64)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("failed to cast message to messageImpl")
+}
+
+func GetJoinedMeters(in Message) (*JoinedMeters, error) {
+	DebugLogger.Printf("%+v", in)
+	if msg, ok := in.(*messageImpl); ok {
+		jm := &JoinedMeters{MeterMacIds: []string{}}
+		if jm.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
+			return nil, fmt.Errorf("DeviceMacId not found in message")
+		}
+		// MeterMacId is repeated for each of the meters, if any
+		switch v := msg.Attribs["MeterMacId"].(type) {
+		case string:
+			jm.MeterMacIds = append(jm.MeterMacIds, v)
+		case []any:
+			for _, mac := range v {
+				if s, ok := mac.(string); ok {
+					jm.MeterMacIds = append(jm.MeterMacIds, s)
+				}
+			}
+		}
+		return jm, nil
+	}
+	return nil, fmt.Errorf("failed to cast message to messageImpl")
+}
+
+func GetNetwork(in Message) (*Network, error) {
+	DebugLogger.Printf("%+v", in)
+	if msg, ok := in.(*messageImpl); ok {
+		n := &Network{Name: MessageName(msg.Name)}
+		if n.DeviceMacId, ok = msg.Attribs["DeviceMacId"].(string); !ok {
+			return nil, fmt.Errorf("DeviceMacId not found in message")
+		}
+		n.MeterMacId, _ = msg.Attribs["MeterMacId"].(string)
+		n.CoordMacId, _ = msg.Attribs["CoordMacId"].(string)
+		n.Status, _ = msg.Attribs["Status"].(string)
+		n.State = ParseNetworkState(n.Status)
+		n.Description, _ = msg.Attribs["Description"].(string)
+		n.StatusCode, _ = msg.Attribs["StatusCode"].(int64)
+		n.ExtPanId, _ = msg.Attribs["ExtPanId"].(string)
+		n.Channel, _ = msg.Attribs["Channel"].(int64)
+		n.ShortAddr, _ = msg.Attribs["ShortAddr"].(string)
+		n.LinkStrength, _ = msg.Attribs["LinkStrength"].(int64)
+		return n, nil
+	}
+	return nil, fmt.Errorf("failed to cast message to messageImpl")
+}
+
+func parseUint(s string, bitSize int) (int64, error) {
+	v, err := strconv.ParseUint(s, 0, bitSize)
+	return int64(v), err
+}
+
 func roundToDecimal(num float64, decimals int) float64 {
 	pow10 := math.Pow(10, float64(decimals))
 	return math.Round(num*pow10) / pow10
 }
 
-func getCorrectTimeStamp(ts int64) int64 {
-	return time.Unix(ts, 0).AddDate(30, 0, -1).Unix()
+// ZigbeeEpoch is the origin of the timestamps of the device, which counts the
+// seconds since 2000-01-01 00:00:00 UTC.
+var ZigbeeEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ZigbeeTime returns the time of a device timestamp.
+func ZigbeeTime(seconds int64) time.Time {
+	return time.Unix(ZigbeeEpoch.Unix()+seconds, 0)
 }
 
-func structToMap(obj interface{}) map[string]interface{} {
-	out := make(map[string]interface{})
-	val := reflect.ValueOf(obj)
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
-	}
+// ZigbeeSeconds returns the device timestamp of t.
+func ZigbeeSeconds(t time.Time) int64 {
+	return t.Unix() - ZigbeeEpoch.Unix()
+}
 
-	for i := 0; i < val.NumField(); i++ {
-		field := val.Type().Field(i)
-		fieldValue := val.Field(i).Interface()
-		out[field.Name] = fieldValue
-	}
-	return out
+func getCorrectTimeStamp(ts int64) int64 {
+	return ZigbeeTime(ts).Unix()
 }
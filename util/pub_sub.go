@@ -1,10 +1,13 @@
 package util
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type PubSub[S comparable, T any] struct {
 	mu          sync.Mutex
-	subscribers map[S]map[chan T]bool
+	subscribers map[S]map[chan T]chan struct{}
 }
 
 // NewPubSub initializes a new PubSub instance with a map to hold subscribers for each topic.
@@ -12,7 +15,7 @@ type PubSub[S comparable, T any] struct {
 // Each channel represents a subscriber for that topic.
 func NewPubSub[S comparable, T any]() *PubSub[S, T] {
 	return &PubSub[S, T]{
-		subscribers: make(map[S]map[chan T]bool),
+		subscribers: make(map[S]map[chan T]chan struct{}),
 	}
 }
 
@@ -21,22 +24,23 @@ func (ps *PubSub[S, T]) Subscribe(topic S) chan T {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	if _, ok := ps.subscribers[topic]; !ok {
-		ps.subscribers[topic] = make(map[chan T]bool)
+		ps.subscribers[topic] = make(map[chan T]chan struct{})
 	}
 	ch := make(chan T, 1)
-	ps.subscribers[topic][ch] = true
+	ps.subscribers[topic][ch] = make(chan struct{})
 	return ch
 }
 
 // Close unsubscribes the channel from the topic and cleans up if no more subscribers exist for that topic.
-
+// A Publish blocked on the channel is released, so Close is safe to call after the subscriber stopped reading.
 func (ps *PubSub[S, T]) Close(topic S, ch <-chan T) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	// Remove the channel from the subscribers map
 	if subs, ok := ps.subscribers[topic]; ok {
-		for s := range subs {
+		for s, done := range subs {
 			if s == ch {
+				close(done)
 				delete(subs, s)
 				break
 			}
@@ -47,12 +51,39 @@ func (ps *PubSub[S, T]) Close(topic S, ch <-chan T) {
 	}
 }
 
-func (ps *PubSub[S, T]) Publish(topic S, val T) {
+// Subscribed reports whether a topic matching match has subscribers.
+func (ps *PubSub[S, T]) Subscribed(match func(topic S) bool) bool {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
-	if subs, ok := ps.subscribers[topic]; ok {
-		for s := range subs {
-			s <- val
+	for topic := range ps.subscribers {
+		if match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish delivers val to every subscriber of the topic, waiting for each one
+// to receive it or to be closed.
+func (ps *PubSub[S, T]) Publish(topic S, val T) {
+	ps.PublishContext(context.Background(), topic, val)
+}
+
+// PublishContext is Publish giving up on the subscribers not receiving val
+// once ctx is done.
+func (ps *PubSub[S, T]) PublishContext(ctx context.Context, topic S, val T) {
+	ps.mu.Lock()
+	subs := make(map[chan T]chan struct{}, len(ps.subscribers[topic]))
+	for s, done := range ps.subscribers[topic] {
+		subs[s] = done
+	}
+	ps.mu.Unlock()
+	for s, done := range subs {
+		select {
+		case s <- val:
+		case <-done:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,214 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// telnet commands and the COM-PORT-OPTION of RFC 2217
+const (
+	telnetSE   byte = 240
+	telnetSB   byte = 250
+	telnetWILL byte = 251
+	telnetWONT byte = 252
+	telnetDO   byte = 253
+	telnetDONT byte = 254
+	telnetIAC  byte = 255
+
+	comPortOption   byte = 44
+	comSetBaudRate  byte = 1
+	comServerOffset byte = 100 // the server answers a command with its code plus 100
+)
+
+// Rfc2217Conn carries the data of a serial port over a telnet connection,
+// controlling the port with the COM-PORT-OPTION of RFC 2217. Only the baud
+// rate is negotiated, the other commands and options are refused.
+type Rfc2217Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	err     error // of the reader, returned once the data read is consumed
+	wlck    sync.Mutex
+	setBaud func(int) int // server: sets the baud rate of the port and returns the one in effect
+
+	lck  sync.Mutex
+	baud int // rate in effect, as confirmed by the server
+}
+
+// NewRfc2217Client returns the client end of conn, asking the server to set
+// its port to the baud rate. The rate is confirmed asynchronously, see
+// BaudRate.
+func NewRfc2217Client(conn net.Conn, baud int) (*Rfc2217Conn, error) {
+	c := &Rfc2217Conn{Conn: conn, r: bufio.NewReader(conn)}
+	req := []byte{telnetIAC, telnetWILL, comPortOption, telnetIAC, telnetSB, comPortOption, comSetBaudRate}
+	req = appendEscaped(req, binary.BigEndian.AppendUint32(nil, uint32(baud)))
+	req = append(req, telnetIAC, telnetSE)
+	if err := c.writeCommand(req); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewRfc2217Server returns the server end of conn, setting the baud rate of
+// the port with setBaud when the client asks for it; a rate of 0 asks for the
+// rate in effect.
+func NewRfc2217Server(conn net.Conn, setBaud func(int) int) *Rfc2217Conn {
+	return &Rfc2217Conn{Conn: conn, r: bufio.NewReader(conn), setBaud: setBaud}
+}
+
+// BaudRate returns the baud rate confirmed by the server, 0 until then.
+func (c *Rfc2217Conn) BaudRate() int {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.baud
+}
+
+// Read reads the data of the port, handling the telnet commands in between.
+func (c *Rfc2217Conn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && c.err == nil {
+		if n > 0 && c.r.Buffered() == 0 {
+			break
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.err = err
+			break
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+		if b, ok, err := c.command(); err != nil {
+			c.err = err
+		} else if ok {
+			p[n] = b
+			n++
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, c.err
+}
+
+// Write writes the data of the port, escaping the IAC bytes.
+func (c *Rfc2217Conn) Write(p []byte) (int, error) {
+	if err := c.writeCommand(appendEscaped(nil, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Rfc2217Conn) writeCommand(b []byte) error {
+	c.wlck.Lock()
+	defer c.wlck.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// command handles the telnet command following an IAC, returning the data
+// byte of an escaped IAC.
+func (c *Rfc2217Conn) command() (byte, bool, error) {
+	cmd, err := c.r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch cmd {
+	case telnetIAC:
+		return telnetIAC, true, nil
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		option, err := c.r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, false, c.negotiate(cmd, option)
+	case telnetSB:
+		sub, err := c.subnegotiation()
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, false, c.handle(sub)
+	default:
+		// NOP, BRK and the like carry nothing for the port
+		return 0, false, nil
+	}
+}
+
+// negotiate accepts the COM-PORT-OPTION and refuses the other options.
+func (c *Rfc2217Conn) negotiate(cmd byte, option byte) error {
+	switch {
+	case cmd == telnetWILL && option == comPortOption && c.setBaud != nil:
+		return c.writeCommand([]byte{telnetIAC, telnetDO, option})
+	case cmd == telnetDO && option == comPortOption && c.setBaud == nil:
+		return nil // offered by NewRfc2217Client
+	case cmd == telnetWILL:
+		return c.writeCommand([]byte{telnetIAC, telnetDONT, option})
+	case cmd == telnetDO:
+		return c.writeCommand([]byte{telnetIAC, telnetWONT, option})
+	default:
+		return nil
+	}
+}
+
+// subnegotiation reads the bytes up to IAC SE.
+func (c *Rfc2217Conn) subnegotiation() ([]byte, error) {
+	var sub []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == telnetIAC {
+			if b, err = c.r.ReadByte(); err != nil {
+				return nil, err
+			}
+			if b == telnetSE {
+				return sub, nil
+			}
+		}
+		sub = append(sub, b)
+	}
+}
+
+var errBadSubnegotiation = errors.New("rfc2217: bad subnegotiation")
+
+// handle handles a COM-PORT-OPTION subnegotiation, ignoring the others.
+func (c *Rfc2217Conn) handle(sub []byte) error {
+	if len(sub) < 2 || sub[0] != comPortOption {
+		return nil
+	}
+	switch {
+	case sub[1] == comSetBaudRate && c.setBaud != nil:
+		if len(sub) != 6 {
+			return errBadSubnegotiation
+		}
+		// the rate in effect is confirmed, the requested one when it was set
+		baud := c.setBaud(int(binary.BigEndian.Uint32(sub[2:])))
+		rsp := []byte{telnetIAC, telnetSB, comPortOption, comSetBaudRate + comServerOffset}
+		rsp = appendEscaped(rsp, binary.BigEndian.AppendUint32(nil, uint32(baud)))
+		return c.writeCommand(append(rsp, telnetIAC, telnetSE))
+	case sub[1] == comSetBaudRate+comServerOffset && c.setBaud == nil:
+		if len(sub) != 6 {
+			return errBadSubnegotiation
+		}
+		c.lck.Lock()
+		c.baud = int(binary.BigEndian.Uint32(sub[2:]))
+		c.lck.Unlock()
+	}
+	return nil
+}
+
+// appendEscaped appends p to b, doubling the IAC bytes.
+func appendEscaped(b []byte, p []byte) []byte {
+	for _, x := range p {
+		if x == telnetIAC {
+			b = append(b, telnetIAC)
+		}
+		b = append(b, x)
+	}
+	return b
+}
@@ -0,0 +1,64 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States sent to systemd by SdNotify, see sd_notify(3).
+const (
+	SdReady     = "READY=1"
+	SdReloading = "RELOADING=1"
+	SdStopping  = "STOPPING=1"
+	SdWatchdog  = "WATCHDOG=1"
+)
+
+// SdReloadingNow returns SdReloading with the MONOTONIC_USEC of now, which
+// Type=notify-reload services must send for systemd to tell the end of the
+// reload from an earlier READY=1.
+func SdReloadingNow() string {
+	usec, ok := monotonicUsec()
+	if !ok {
+		return SdReloading
+	}
+	return SdReloading + "\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+}
+
+// SdNotify sends state to the service manager through $NOTIFY_SOCKET. It
+// reports false, without error, when the program was not started by systemd
+// with notification enabled.
+func SdNotify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	if path[0] == '@' {
+		// abstract socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdogInterval returns the interval within which systemd expects a
+// SdWatchdog notification, 0 when the watchdog is not enabled for this
+// process.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package util
+
+// monotonicUsec is only needed by systemd.
+func monotonicUsec() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	before, _ := monotonicUsec()
+	if ok, err := SdNotify(SdReloadingNow()); !ok || err != nil {
+		t.Fatalf("SdNotify = %v, %v", ok, err)
+	}
+	after, _ := monotonicUsec()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	if lines[0] != SdReloading {
+		t.Errorf("state %q, want %s first", buf[:n], SdReloading)
+	}
+	if after == 0 {
+		return // no monotonic clock on this platform
+	}
+	usec, ok := strings.CutPrefix(lines[len(lines)-1], "MONOTONIC_USEC=")
+	if v, err := strconv.ParseInt(usec, 10, 64); !ok || err != nil || v < before || v > after {
+		t.Errorf("state %q, want MONOTONIC_USEC between %d and %d", buf[:n], before, after)
+	}
+}
+
+func TestSdNotifyDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := SdNotify(SdReady); ok || err != nil {
+		t.Errorf("SdNotify without socket = %v, %v", ok, err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := SdWatchdogInterval(); got != 30*time.Second {
+		t.Errorf("interval %s, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if got := SdWatchdogInterval(); got != 0 {
+		t.Errorf("interval %s for another process", got)
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -18,6 +19,10 @@ type Fini func()
 // It logs the received signal and the exit message using the provided logger (ilog).
 // The function blocks until a signal is received, ensuring that the program can
 // gracefully handle termination requests and perform any necessary cleanup before exiting.
+//
+// Deprecated: WaitingToBeTerminate exits the program from inside the helper,
+// skipping the deferred calls of the caller. Use TerminationContext and return
+// once its context is done.
 func WaitingToBeTerminate(fini Fini, ilog *log.Logger) {
 	// Create a channel to receive signals.
 	sigChan := make(chan os.Signal, 1)
@@ -44,3 +49,19 @@ func WaitingToBeTerminate(fini Fini, ilog *log.Logger) {
 		ilog.Println("Unexpected signal received.")
 	}
 }
+
+// TerminationContext returns a copy of parent cancelled on SIGINT or SIGTERM,
+// and the function releasing the signals.
+func TerminationContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+}
+
+// Hangups returns a channel receiving SIGHUP, which asks daemons to reload
+// their configuration, and the function releasing the signal.
+func Hangups() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch, func() {
+		signal.Stop(ch)
+	}
+}
@@ -0,0 +1,45 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestZigbeeTime(t *testing.T) {
+	if got := ZigbeeTime(0); !got.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ZigbeeTime(0) = %s", got)
+	}
+	leap := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	if got := ZigbeeSeconds(leap); got != 0x2d732e40 {
+		t.Errorf("ZigbeeSeconds(%s) = %#x, want 0x2d732e40", leap, got)
+	}
+	if got := ZigbeeTime(ZigbeeSeconds(leap)); !got.Equal(leap) {
+		t.Errorf("ZigbeeTime(ZigbeeSeconds(%s)) = %s", leap, got)
+	}
+	// the time zone of t does not change its timestamp
+	if got := ZigbeeSeconds(leap.In(time.FixedZone("PDT", -7*3600))); got != 0x2d732e40 {
+		t.Errorf("ZigbeeSeconds of a local time = %#x", got)
+	}
+}
+
+func TestEpochAttrib(t *testing.T) {
+	key, value, err := newResponseProcessor().getAttrib("<UTCTime>0x2d732e40</UTCTime>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != emuUTCTime || value != int64(1709208000) {
+		t.Errorf("attrib %s = %v, want the Unix time 1709208000", key, value)
+	}
+}
+
+func TestSetTimeCommand(t *testing.T) {
+	at := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC).In(time.FixedZone("PDT", -7*3600))
+	cmd, err := NewSetTimeCommand(at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attribs := cmd.(*commandImpl).Attribs
+	if attribs["UTCTime"] != "0x2d732e40" || attribs["LocalTime"] != "0x2d72cbd0" {
+		t.Errorf("SET_TIME of %s: %v", at, attribs)
+	}
+}